@@ -36,6 +36,11 @@ type options struct {
 	Concurrent   int           `short:"c" long:"concurrent" description:"concurrent tasks" default:"1"`
 	SSHTimeout   time.Duration `long:"timeout" env:"SPOT_TIMEOUT" description:"ssh timeout" default:"30s"`
 	SSHAgent     bool          `long:"ssh-agent" env:"SPOT_SSH_AGENT" description:"use ssh-agent"`
+	SSHAuth      []string      `long:"ssh-auth" env:"SPOT_SSH_AUTH" env-delim:"," description:"ssh auth methods in order of use: agent, key, password, keyboard-interactive"`
+	SSHPassword  string        `long:"ssh-password-secret" env:"SPOT_SSH_PASSWORD_SECRET" description:"name of the secret with ssh password"`
+	SSHKeyPass   string        `long:"ssh-key-passphrase-secret" env:"SPOT_SSH_KEY_PASSPHRASE_SECRET" description:"name of the secret with passphrase of ssh key"`
+	TmpDir       string        `long:"tmp-dir" env:"SPOT_TMP_DIR" description:"base directory for temporary files on hosts" default:"/tmp"`
+	MaxOutput    int           `long:"max-output" env:"SPOT_MAX_OUTPUT" description:"max bytes of command output kept in memory, 0 for unlimited" default:"0"`
 
 	// overrides
 	Inventory string            `short:"i" long:"inventory" description:"inventory file or url [$SPOT_INVENTORY]"`
@@ -57,9 +62,10 @@ type options struct {
 
 	Version bool `long:"version" description:"show version"`
 
-	Dry     bool `long:"dry" description:"dry run"`
-	Verbose bool `short:"v" long:"verbose" description:"verbose mode"`
-	Dbg     bool `long:"dbg" description:"debug mode"`
+	Dry     bool   `long:"dry" description:"dry run"`
+	Plan    string `long:"plan" description:"show execution plan, nothing executed" optional:"yes" optional-value:"text" choice:"text" choice:"json"`
+	Verbose bool   `short:"v" long:"verbose" description:"verbose mode"`
+	Dbg     bool   `long:"dbg" description:"debug mode"`
 }
 
 // SecretsProvider defines secrets provider options, for all supported providers
@@ -102,8 +108,9 @@ func main() {
 	}
 	setupLog(opts.Dbg)
 
-	if !opts.GenEnable || opts.GenOutput != "stdout" {
-		fmt.Printf("spot %s\n", revision) // print version only if not generating inventory to stdout
+	if (!opts.GenEnable || opts.GenOutput != "stdout") && opts.Plan != "json" {
+		// print version only if not generating inventory to stdout and not printing json plan
+		fmt.Printf("spot %s\n", revision)
 	}
 
 	if err := run(opts); err != nil {
@@ -133,17 +140,20 @@ func run(opts options) error {
 	if err != nil {
 		return fmt.Errorf("can't get playbook %q: %w", opts.PlaybookFile, err)
 	}
-	lgr.Setup(lgr.Secret(pbook.AllSecretValues()...)) // mask secrets in logs
 
 	r, err := makeRunner(opts, pbook)
 	if err != nil {
 		return fmt.Errorf("can't make runner: %w", err)
 	}
+	lgr.Setup(lgr.Secret(pbook.AllSecretValues()...)) // mask secrets in logs, including ssh secrets loaded by runner
 
 	if opts.PositionalArgs.AdHocCmd != "" { // run ad-hoc command
 		if r.Playbook, err = setAdHocSSH(opts, pbook); err != nil {
 			return fmt.Errorf("can't setup ad-hoc ssh params: %w", err)
 		}
+		if opts.Plan != "" {
+			return runPlan(os.Stdout, "ad-hoc", opts.Targets, opts.Plan == "json", r)
+		}
 		return runAdHoc(ctx, opts.Targets, r)
 	}
 
@@ -152,6 +162,11 @@ func run(opts options) error {
 		return runGen(opts, r)
 	}
 
+	if opts.Plan != "" {
+		// show execution plan for all tasks or a single task, nothing executed
+		return runPlan(os.Stdout, opts.TaskName, opts.Targets, opts.Plan == "json", r)
+	}
+
 	if err := runTasks(ctx, opts.TaskName, opts.Targets, r); err != nil {
 		return err
 	}
@@ -183,6 +198,29 @@ func runTasks(ctx context.Context, taskName string, targets []string, r *runner.
 	return nil
 }
 
+// runPlan writes execution plan for all tasks in playbook or for a single task if specified. Nothing is executed.
+func runPlan(wr io.Writer, taskName string, targets []string, asJSON bool, r *runner.Process) error {
+	taskNames := []string{taskName}
+	if taskName == "" {
+		taskNames = []string{}
+		for _, task := range r.Playbook.AllTasks() {
+			taskNames = append(taskNames, task.Name)
+		}
+	}
+
+	plans := []runner.TaskPlan{}
+	for _, name := range taskNames {
+		for _, targetName := range targetsForTask(targets, name, r.Playbook) {
+			plan, err := r.Plan(name, targetName)
+			if err != nil {
+				return fmt.Errorf("can't make plan for task %q and target %q: %w", name, targetName, err)
+			}
+			plans = append(plans, plan)
+		}
+	}
+	return runner.WritePlan(wr, plans, asJSON)
+}
+
 func runAdHoc(ctx context.Context, targets []string, r *runner.Process) error {
 	errs := new(multierror.Error)
 	r.Verbose = true // always verbose for ad-hoc
@@ -305,6 +343,9 @@ func makeRunner(opts options, pbook *config.PlayBook) (*runner.Process, error) {
 	if opts.SSHAgent {
 		connector = connector.WithAgent()
 	}
+	if connector, err = sshAuth(opts, pbook, connector); err != nil {
+		return nil, fmt.Errorf("can't setup ssh auth: %w", err)
+	}
 
 	r := runner.Process{
 		Concurrency: opts.Concurrent,
@@ -315,6 +356,8 @@ func makeRunner(opts options, pbook *config.PlayBook) (*runner.Process, error) {
 		ColorWriter: executor.NewColorizedWriter(os.Stdout, "", "", "", nil),
 		Verbose:     opts.Verbose,
 		Dry:         opts.Dry,
+		TmpDir:      opts.TmpDir,
+		MaxOutput:   opts.MaxOutput,
 	}
 	return &r, nil
 }
@@ -375,6 +418,65 @@ func sshKey(sshKey string, pbook *config.PlayBook) (key string, err error) {
 	return sshKey, nil
 }
 
+// sshAuth sets ssh password, key passphrase and order of auth methods. Passwords are loaded from secrets,
+// if not set, they are asked on the terminal.
+func sshAuth(opts options, pbook *config.PlayBook, connector *executor.Connector) (*executor.Connector, error) {
+	if opts.SSHPassword != "" {
+		pwd, err := pbook.Secret(opts.SSHPassword)
+		if err != nil {
+			return nil, fmt.Errorf("can't get ssh password: %w", err)
+		}
+		connector = connector.WithPassword(pwd)
+	}
+	if opts.SSHKeyPass != "" {
+		passphrase, err := pbook.Secret(opts.SSHKeyPass)
+		if err != nil {
+			return nil, fmt.Errorf("can't get ssh key passphrase: %w", err)
+		}
+		connector = connector.WithPassphrase(passphrase)
+	}
+	if isTerminal(int(os.Stdin.Fd())) {
+		connector = connector.WithPrompt(terminalPrompt)
+	}
+	if len(opts.SSHAuth) > 0 {
+		return connector.WithAuthOrder(opts.SSHAuth)
+	}
+	return connector, nil
+}
+
+// terminalPrompt asks the user on the terminal, the input of secret values is not echoed
+func terminalPrompt(question string, echo bool) (string, error) {
+	fmt.Fprint(os.Stderr, question) // nolint
+	if echo {
+		return readLine(os.Stdin)
+	}
+	res, err := readPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr) // nolint
+	return res, err
+}
+
+// readLine reads a single line byte by byte, so nothing after the line is consumed from the reader
+func readLine(r io.Reader) (string, error) {
+	var res []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				return strings.TrimSuffix(string(res), "\r"), nil
+			}
+			res = append(res, buf[0])
+			continue
+		}
+		if err == io.EOF && len(res) > 0 {
+			return string(res), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
 // get ssh user from cli or playbook. if no user is provided, use current user from os
 func sshUser(sshUser string, pbook *config.PlayBook) (string, error) {
 	if sshUser == "" && (pbook == nil || pbook.User != "") { // no user provided in cli
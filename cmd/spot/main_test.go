@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -20,6 +22,7 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 
 	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/runner"
 )
 
 func Test_main(t *testing.T) {
@@ -274,6 +277,107 @@ func Test_runGen_goTmplFile(t *testing.T) {
 	assert.Equal(t, exp, string(res), "expected output")
 }
 
+func Test_runPlan(t *testing.T) {
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		PlaybookFile: "testdata/conf.yml",
+		Targets:      []string{"dev"},
+		Inventory:    "testdata/inventory.yml",
+		Only:         []string{"copy configuration", "no auto cmd"},
+		SecretsProvider: SecretsProvider{
+			Provider: "spot",
+			Conn:     "testdata/test-secrets.db",
+			Key:      "1234567890",
+		},
+	}
+	setupLog(false)
+	pbook, err := makePlaybook(opts, opts.Inventory)
+	require.NoError(t, err)
+	r, err := makeRunner(opts, pbook)
+	require.NoError(t, err)
+
+	t.Run("single task, json", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		err = runPlan(&buf, "task1", opts.Targets, true, r)
+		require.NoError(t, err)
+		var plans []runner.TaskPlan
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &plans))
+		require.Len(t, plans, 1)
+		assert.Equal(t, "task1", plans[0].Task)
+		require.Len(t, plans[0].Hosts, 2)
+		assert.Equal(t, "dev1.umputun.dev", plans[0].Hosts[0].Host)
+		cmds := plans[0].Hosts[0].Commands
+		require.Len(t, cmds, 8)
+		assert.Equal(t, "not in only list", cmds[0].Skip)
+		assert.Equal(t, "", cmds[1].Skip)
+		assert.Equal(t, "testdata/conf.yml -> /tmp/conf.yml", cmds[1].Details)
+		assert.Equal(t, "", cmds[7].Skip, "no_auto command allowed by only")
+	})
+
+	t.Run("all tasks, text", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		err = runPlan(&buf, "", opts.Targets, false, r)
+		require.NoError(t, err)
+		assert.Contains(t, buf.String(), `task "task1", target "dev", hosts: 2`)
+		assert.Contains(t, buf.String(), `task "failed_task", target "dev", hosts: 2`)
+		assert.Contains(t, buf.String(), " host dev2.umputun.dev:22 (dev2), user: test\n")
+	})
+}
+
+func Test_sshAuth(t *testing.T) {
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		PlaybookFile: "testdata/conf.yml",
+		SecretsProvider: SecretsProvider{
+			Provider: "spot",
+			Conn:     "testdata/test-secrets.db",
+			Key:      "1234567890",
+		},
+	}
+	setupLog(false)
+
+	t.Run("password and passphrase from secrets", func(t *testing.T) {
+		o := opts
+		o.SSHPassword, o.SSHKeyPass, o.SSHAuth = "sec1", "sec2", []string{"password", "key"}
+		pbook, err := makePlaybook(o, "testdata/inventory.yml")
+		require.NoError(t, err)
+		_, err = makeRunner(o, pbook)
+		require.NoError(t, err)
+		assert.Len(t, pbook.AllSecretValues(), 2, "ssh secrets masked in logs")
+	})
+
+	t.Run("unknown secret", func(t *testing.T) {
+		o := opts
+		o.SSHPassword = "no-such-secret"
+		pbook, err := makePlaybook(o, "testdata/inventory.yml")
+		require.NoError(t, err)
+		_, err = makeRunner(o, pbook)
+		require.ErrorContains(t, err, "can't setup ssh auth: can't get ssh password: can't get secret \"no-such-secret\"")
+	})
+
+	t.Run("bad auth method", func(t *testing.T) {
+		o := opts
+		o.SSHAuth = []string{"key", "token"}
+		pbook, err := makePlaybook(o, "testdata/inventory.yml")
+		require.NoError(t, err)
+		_, err = makeRunner(o, pbook)
+		require.ErrorContains(t, err, `unknown ssh auth method "token"`)
+	})
+}
+
+func Test_readLine(t *testing.T) {
+	r := strings.NewReader("line1\r\nline2\nlast")
+	for _, exp := range []string{"line1", "line2", "last"} {
+		res, err := readLine(r)
+		require.NoError(t, err)
+		assert.Equal(t, exp, res)
+	}
+	_, err := readLine(r)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
 func Test_connectFailed(t *testing.T) {
 	hostAndPort, teardown := startTestContainer(t)
 	defer teardown()
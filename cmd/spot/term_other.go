@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package main
+
+import "fmt"
+
+// isTerminal always returns false, prompts are not supported on this platform
+func isTerminal(int) bool {
+	return false
+}
+
+// readPassword is not supported on this platform
+func readPassword(int) (string, error) {
+	return "", fmt.Errorf("password prompt is not supported")
+}
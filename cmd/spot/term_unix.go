@@ -0,0 +1,48 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// isTerminal returns true if fd is a terminal
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	return err == nil
+}
+
+// readPassword reads a line from the terminal with echo disabled, the terminal state is restored after the input
+func readPassword(fd int) (string, error) {
+	st, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return "", fmt.Errorf("can't get terminal state: %w", err)
+	}
+	noEcho := *st
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	noEcho.Iflag |= unix.ICRNL
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &noEcho); err != nil {
+		return "", fmt.Errorf("can't disable terminal echo: %w", err)
+	}
+	defer unix.IoctlSetTermios(fd, ioctlSetTermios, st) // nolint
+
+	return readLine(fdReader(fd))
+}
+
+// fdReader reads from file descriptor directly, without making os.File closing it on finalization
+type fdReader int
+
+func (r fdReader) Read(p []byte) (int, error) {
+	n, err := unix.Read(int(r), p)
+	if n < 0 {
+		n = 0
+	}
+	if n == 0 && err == nil {
+		return 0, io.EOF
+	}
+	return n, err
+}
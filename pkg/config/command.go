@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,12 +24,20 @@ type Cmd struct {
 	MSync       []SyncInternal    `yaml:"msync" toml:"msync"` // multiple sync commands, implemented internally
 	Delete      DeleteInternal    `yaml:"delete" toml:"delete"`
 	MDelete     []DeleteInternal  `yaml:"mdelete" toml:"mdelete"` // multiple delete commands, implemented internally
+	Restore     RestoreInternal   `yaml:"restore" toml:"restore"`
+	Release     ReleaseInternal   `yaml:"release" toml:"release"`
+	Transfer    TransferInternal  `yaml:"transfer" toml:"transfer"`
 	Wait        WaitInternal      `yaml:"wait" toml:"wait"`
 	Script      string            `yaml:"script" toml:"script,multiline"`
 	Echo        string            `yaml:"echo" toml:"echo"`
+	Parallel    ParallelInternal  `yaml:"parallel" toml:"parallel"` // commands running concurrently, implemented internally
+	Block       []Cmd             `yaml:"block" toml:"block"`       // commands running sequentially as a single block
+	Rescue      []Cmd             `yaml:"rescue" toml:"rescue"`     // commands to run if block failed, allowed with block only
+	Always      []Cmd             `yaml:"always" toml:"always"`     // commands to run after block regardless of result
 	Environment map[string]string `yaml:"env" toml:"env"`
 	Options     CmdOptions        `yaml:"options" toml:"options,omitempty"`
 	Condition   string            `yaml:"cond" toml:"cond,omitempty"`
+	OkExitCodes []int             `yaml:"ok_exit_codes" toml:"ok_exit_codes,omitempty"` // exit codes of script treated as success
 
 	Secrets map[string]string `yaml:"-" toml:"-"` // loaded secrets, filled by playbook
 }
@@ -40,24 +50,60 @@ type CmdOptions struct {
 	Sudo         bool     `yaml:"sudo" toml:"sudo"`                   // run command with sudo
 	Secrets      []string `yaml:"secrets" toml:"secrets"`             // list of secrets (keys) to load
 	OnlyOn       []string `yaml:"only_on" toml:"only_on"`             // only run on these hosts
+	TTY          bool     `yaml:"tty" toml:"tty"`                     // request pty for script, wait and cond commands
+	Become       string   `yaml:"become" toml:"become"`               // privilege escalation method: sudo, doas or su
+	BecomeUser   string   `yaml:"become_user" toml:"become_user"`     // user to run command as with become, root by default
+	BecomeSecret string   `yaml:"become_secret" toml:"become_secret"` // secret with password for become
+	ForwardAgent bool     `yaml:"forward_agent" toml:"forward_agent"` // forward ssh agent to script, wait and cond commands
+}
+
+// Privileged returns true if the command is executed with privilege escalation, set by sudo or become.
+func (o CmdOptions) Privileged() bool {
+	return o.Sudo || o.Become != ""
 }
 
 // CopyInternal defines copy command, implemented internally
 type CopyInternal struct {
-	Source  string   `yaml:"src" toml:"src"`         // source must be a file or a glob pattern
-	Dest    string   `yaml:"dst" toml:"dst"`         // destination must be a file or a directory
-	Mkdir   bool     `yaml:"mkdir" toml:"mkdir"`     // create destination directory if it does not exist
-	Force   bool     `yaml:"force" toml:"force"`     // force copy even if source and destination are the same
-	Exclude []string `yaml:"exclude" toml:"exclude"` // exclude files matching these patterns
+	Source   string   `yaml:"src" toml:"src"`           // source must be a file or a glob pattern
+	Dest     string   `yaml:"dst" toml:"dst"`           // destination must be a file or a directory
+	Mkdir    bool     `yaml:"mkdir" toml:"mkdir"`       // create destination directory if it does not exist
+	Force    bool     `yaml:"force" toml:"force"`       // force copy even if source and destination are the same
+	Exclude  []string `yaml:"exclude" toml:"exclude"`   // exclude files matching these patterns
+	Checksum bool     `yaml:"checksum" toml:"checksum"` // compare content checksums instead of modification time
+	Mode     string   `yaml:"mode" toml:"mode"`         // permissions of destination files, octal, e.g. 0644
+	Owner    string   `yaml:"owner" toml:"owner"`       // owner of destination files, name or uid
+	Group    string   `yaml:"group" toml:"group"`       // group of destination files, name or gid
+	Preserve []string `yaml:"preserve" toml:"preserve"` // source attributes to keep: mode, owner, links, times
+	Atomic   bool     `yaml:"atomic" toml:"atomic"`     // upload to a temporary file and rename it to destination
+	Backup   int      `yaml:"backup" toml:"backup"`     // number of backups of replaced files to keep
 }
 
 // SyncInternal defines sync command (recursive copy), implemented internally
 type SyncInternal struct {
-	Source  string   `yaml:"src" toml:"src"`         // source must be a directory
-	Dest    string   `yaml:"dst" toml:"dst"`         // destination must be a directory
-	Delete  bool     `yaml:"delete" toml:"delete"`   // delete files in destination that are not in source
-	Exclude []string `yaml:"exclude" toml:"exclude"` // exclude files matching these patterns
-	Force   bool     `yaml:"force" toml:"force"`     // force sync even if source and destination are the same
+	Source      string   `yaml:"src" toml:"src"`                 // source must be a directory
+	Dest        string   `yaml:"dst" toml:"dst"`                 // destination must be a directory
+	Delete      bool     `yaml:"delete" toml:"delete"`           // delete files in destination that are not in source
+	Exclude     []string `yaml:"exclude" toml:"exclude"`         // exclude files matching these patterns
+	Force       bool     `yaml:"force" toml:"force"`             // force sync even if source and destination are the same
+	Checksum    bool     `yaml:"checksum" toml:"checksum"`       // compare content checksums instead of modification time
+	Mode        string   `yaml:"mode" toml:"mode"`               // transfer mode, sftp (default) or tar, or permissions, see Perm
+	Compress    string   `yaml:"compress" toml:"compress"`       // compression of tar stream, gzip (default) or zstd
+	Concurrency int      `yaml:"concurrency" toml:"concurrency"` // number of files uploaded in parallel
+	Owner       string   `yaml:"owner" toml:"owner"`             // owner of destination files, name or uid
+	Group       string   `yaml:"group" toml:"group"`             // group of destination files, name or gid
+	Preserve    []string `yaml:"preserve" toml:"preserve"`       // source attributes to keep: mode, owner, links, times
+	Atomic      bool     `yaml:"atomic" toml:"atomic"`           // upload to a temporary file and rename it to destination
+	Backup      int      `yaml:"backup" toml:"backup"`           // number of backups of replaced files to keep
+	Direction   string   `yaml:"direction" toml:"direction"`     // push (default) local src to remote dst, or pull remote src to local dst
+}
+
+// Perm returns permissions of destination files set by mode, empty if mode is a transfer mode, sftp or tar.
+// Sync mode is shared by both, so octal mode sets permissions of files uploaded with the default sftp transfer.
+func (s SyncInternal) Perm() string {
+	if s.Mode == "" || s.Mode == "sftp" || s.Mode == "tar" {
+		return ""
+	}
+	return s.Mode
 }
 
 // DeleteInternal defines delete command, implemented internally
@@ -67,6 +113,36 @@ type DeleteInternal struct {
 	Exclude   []string `yaml:"exclude" toml:"exclude"`
 }
 
+// RestoreInternal defines restore command, implemented internally.
+// It restores a file from the backup made by copy or sync with backup option.
+type RestoreInternal struct {
+	Location string `yaml:"path" toml:"path"`
+	Version  string `yaml:"version" toml:"version"` // timestamp of the backup, the latest backup if not set
+}
+
+// ReleaseInternal defines release command, implemented internally. It syncs src to a new timestamped directory
+// under base_dir/releases, switches base_dir/current link to it and removes old releases, keeping the last keep ones.
+// With rollback, current link is switched back to the previous release.
+type ReleaseInternal struct {
+	Source   string   `yaml:"src" toml:"src"`           // source must be a directory
+	BaseDir  string   `yaml:"base_dir" toml:"base_dir"` // base directory of releases and current link
+	Keep     int      `yaml:"keep" toml:"keep"`         // number of releases to keep, 5 by default
+	Exclude  []string `yaml:"exclude" toml:"exclude"`   // exclude files matching these patterns
+	Rollback bool     `yaml:"rollback" toml:"rollback"` // switch current link back to the previous release
+}
+
+// TransferInternal defines transfer command, implemented internally. It copies a file from the source host
+// to the target host, streamed through spot or copied by the source host directly with direct option.
+// With fanout, only the first fanout hosts get the file from the source, the rest get it from the hosts already done.
+type TransferInternal struct {
+	SrcHost string `yaml:"src_host" toml:"src_host"` // source host, name, address or target, the first host is used
+	Source  string `yaml:"src" toml:"src"`           // file on the source host
+	Dest    string `yaml:"dst" toml:"dst"`           // file on the target host
+	Direct  bool   `yaml:"direct" toml:"direct"`     // source host copies the file to the target host with scp
+	Fanout  int    `yaml:"fanout" toml:"fanout"`     // number of hosts getting the file from the source host
+	Force   bool   `yaml:"force" toml:"force"`       // transfer even if the target file has the same size and mod time
+}
+
 // WaitInternal defines wait command, implemented internally
 type WaitInternal struct {
 	Timeout       time.Duration `yaml:"timeout" toml:"timeout"`
@@ -74,6 +150,12 @@ type WaitInternal struct {
 	Command       string        `yaml:"cmd" toml:"cmd,multiline"`
 }
 
+// ParallelInternal defines a group of commands executed concurrently on the same host, implemented internally
+type ParallelInternal struct {
+	Commands    []Cmd `yaml:"commands" toml:"commands"`       // commands to run concurrently
+	Concurrency int   `yaml:"concurrency" toml:"concurrency"` // max number of commands running at once, all if not set
+}
+
 // GetScript returns a script string and an io.Reader based on the command being single line or multiline.
 func (cmd *Cmd) GetScript() (command string, rdr io.Reader) {
 	if cmd.Script == "" {
@@ -134,17 +216,20 @@ func (cmd *Cmd) scriptCommand(inp string) string {
 		return ""
 	}
 
-	// add environment variables
+	// add environment variables, single quotes in values (e.g. SPOT_ERROR passed to rollback) are escaped
+	// as the whole command is wrapped in single quotes
 	envs := cmd.genEnv()
+	for i := range envs {
+		envs[i] = strings.ReplaceAll(envs[i], "'", `'\''`)
+	}
 	res := "sh -c '"
 	if len(envs) > 0 {
 		res += strings.Join(envs, "; ") + "; "
 	}
 
-	// add secrets as environment variables
-	secrets := cmd.getSecrets()
-	if len(secrets) > 0 {
-		res += strings.Join(secrets, "; ") + "; "
+	// secrets are read from stdin, see SecretsInput
+	if len(cmd.getSecrets()) > 0 {
+		res += secretsLoader + "; "
 	}
 
 	elems := strings.Split(inp, "\n")
@@ -174,16 +259,20 @@ func (cmd *Cmd) scriptFile(inp string) (r io.Reader) {
 	}
 
 	envs := cmd.genEnv()
-	envs = append(envs, cmd.getSecrets()...)
 	// set environment variables for the script
 	if len(envs) > 0 {
 		for _, env := range envs {
 			buf.WriteString(fmt.Sprintf("export %s\n", env))
 		}
 	}
+	// secrets are read from stdin, see SecretsInput
+	if len(cmd.getSecrets()) > 0 {
+		buf.WriteString(secretsLoader + "\n")
+	}
 
 	// process all the exported variables in the script
 	exports := []string{} // we collect them all here to pass as setenv to the next command
+	var body bytes.Buffer // script lines, written between the exit trap and the final print of exports
 	elems := strings.Split(inp, "\n")
 	for _, c := range elems {
 		if len(c) < 2 {
@@ -206,8 +295,8 @@ func (cmd *Cmd) scriptFile(inp string) (r io.Reader) {
 			// remove comments from the line
 			c = strings.TrimSpace(c[:i])
 		}
-		buf.WriteString(c)
-		buf.WriteString("\n")
+		body.WriteString(c)
+		body.WriteString("\n")
 
 		// if the line in the script is an export, add it to the list of exports
 		// this is done to be able to print the variables set by the script to the console after the script is executed
@@ -226,11 +315,22 @@ func (cmd *Cmd) scriptFile(inp string) (r io.Reader) {
 		}
 	}
 
-	// each exported variable is printed as a setvar command to be captured by the caller
+	// each exported variable is printed as a setvar command to be captured by the caller. This is done after the script
+	// body, keeping its exit code, and by the exit trap, so the variables are printed even if the script exited with
+	// an error, e.g. with exit code allowed by ok_exit_codes. The script may replace the trap with its own, in this case
+	// the variables are printed only if the script runs to the end.
 	if len(exports) > 0 {
+		setvars := make([]string, 0, len(exports))
 		for i := range exports {
-			buf.WriteString(fmt.Sprintf("echo setvar %s=${%s}\n", exports[i], exports[i]))
+			setvars = append(setvars, fmt.Sprintf("echo setvar %s=${%s}", exports[i], exports[i]))
 		}
+		buf.WriteString(fmt.Sprintf("_spot_setvars() { [ -z \"${_spot_vars_done:-}\" ] || return 0; _spot_vars_done=1; %s; }\n",
+			strings.Join(setvars, "; ")))
+		buf.WriteString("trap _spot_setvars EXIT\n")
+	}
+	buf.Write(body.Bytes())
+	if len(exports) > 0 {
+		buf.WriteString("rc=$?; _spot_setvars; exit $rc\n")
 	}
 
 	return &buf
@@ -250,30 +350,63 @@ func (cmd *Cmd) hasShebang(inp string) bool {
 	return false
 }
 
-// genEnv returns a sorted list of environment variables from the Environment map (part of the command)
+// genEnv returns a sorted list of environment variables from the Environment map (part of the command).
+// Values are single-quoted, so the shell doesn't expand them, e.g. command substitutions in SPOT_ERROR.
 func (cmd *Cmd) genEnv() []string {
 	envs := make([]string, 0, len(cmd.Environment))
 	for k, v := range cmd.Environment {
-		envs = append(envs, fmt.Sprintf("%s=%q", k, v))
+		envs = append(envs, fmt.Sprintf("%s=%s", k, shellQuote(v)))
 	}
 	sort.Slice(envs, func(i, j int) bool { return envs[i] < envs[j] })
 	return envs
 }
 
-// getSecrets returns a sorted list of secrets keys from the secrets slice (part of the command)
+// secretsLoader is the shell command reading secrets exports from stdin. It has no quotes and no $,
+// so it can be embedded in the command as is, even if the command is wrapped in double quotes for sudo.
+const secretsLoader = ". /dev/stdin"
+
+// getSecrets returns a sorted list of secrets exports from the secrets slice (part of the command).
+// Values are single-quoted, so the shell doesn't expand them.
 func (cmd *Cmd) getSecrets() []string {
 	secrets := []string{}
 	for _, k := range cmd.Options.Secrets {
 		if v := cmd.Secrets[k]; v != "" {
-			secrets = append(secrets, fmt.Sprintf("%s=%q", k, v))
+			secrets = append(secrets, fmt.Sprintf("export %s=%s", k, shellQuote(v)))
 		}
 	}
 	sort.Slice(secrets, func(i, j int) bool { return secrets[i] < secrets[j] })
 	return secrets
 }
 
+// shellQuote quotes a string for safe use as a single shell argument
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// BecomePassword returns the password for privilege escalation, loaded from the secret set by become_secret.
+// Returns empty string if the secret is not set.
+func (cmd *Cmd) BecomePassword() string {
+	if cmd.Options.BecomeSecret == "" {
+		return ""
+	}
+	return cmd.Secrets[cmd.Options.BecomeSecret]
+}
+
+// SecretsInput returns a reader with secrets of the command as shell exports, to be passed to the stdin of the command
+// made by GetScript, GetWait or GetCondition. Such a command reads them with ". /dev/stdin", so secrets never touch
+// the remote disk and are not visible in the command line. Returns nil if the command has no secrets.
+// Note: stdin of the command is consumed by reading secrets.
+func (cmd *Cmd) SecretsInput() io.Reader {
+	secrets := cmd.getSecrets()
+	if len(secrets) == 0 {
+		return nil
+	}
+	return strings.NewReader(strings.Join(secrets, "\n") + "\n")
+}
+
 // UnmarshalYAML implements yaml.Unmarshaler interface
-// It allows to unmarshal a "copy", "sync" and "delete" from a single field or a slice
+// It allows to unmarshal a "copy", "sync" and "delete" from a single field or a slice.
+// The "parallel" field can be either a struct with commands and concurrency or just a list of commands.
 // All other fields are unmarshalled as usual.
 func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var asMap map[string]interface{}
@@ -290,6 +423,7 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		{"copy", &cmd.Copy, &cmd.MCopy},
 		{"sync", &cmd.Sync, &cmd.MSync},
 		{"delete", &cmd.Delete, &cmd.MDelete},
+		{"parallel", &cmd.Parallel, &cmd.Parallel.Commands},
 	}
 
 	// helper function to check if a field is special, matching by filed name (yaml tag)
@@ -343,7 +477,7 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 	}
 
-	// copy, sync and delete are special cases, as they can be either a struct or a list of structs
+	// copy, sync, delete and parallel are special cases, as they can be either a struct or a list of structs
 	for _, sf := range specialFlds {
 		if err := unmarshalField(sf.fld, sf.destSingle); err != nil {
 			if err := unmarshalField(sf.fld, sf.destSlice); err != nil {
@@ -355,8 +489,9 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-// validate checks if a Cmd has the exactly one command type set (script, copy, mcopy, delete, sync, wait or echo)
-// and returns an error if there are either multiple command types set or none set.
+// validate checks if a Cmd has the exactly one command type set (script, copy, mcopy, delete, sync, wait, echo,
+// parallel or block) and returns an error if there are either multiple command types set or none set.
+// Nested commands of parallel and block (including rescue and always) are validated recursively.
 func (cmd *Cmd) validate() error {
 	cmdTypes := []struct {
 		name  string
@@ -367,10 +502,15 @@ func (cmd *Cmd) validate() error {
 		{"mcopy", func() bool { return len(cmd.MCopy) > 0 }},
 		{"delete", func() bool { return cmd.Delete.Location != "" }},
 		{"mdelete", func() bool { return len(cmd.MDelete) > 0 }},
+		{"restore", func() bool { return cmd.Restore.Location != "" }},
+		{"release", func() bool { return cmd.Release.BaseDir != "" }},
+		{"transfer", func() bool { return cmd.Transfer.SrcHost != "" }},
 		{"sync", func() bool { return cmd.Sync.Source != "" && cmd.Sync.Dest != "" }},
 		{"msync", func() bool { return len(cmd.MSync) > 0 }},
 		{"wait", func() bool { return cmd.Wait.Command != "" }},
 		{"echo", func() bool { return cmd.Echo != "" }},
+		{"parallel", func() bool { return len(cmd.Parallel.Commands) > 0 }},
+		{"block", func() bool { return len(cmd.Block) > 0 }},
 	}
 
 	setCmds, names := []string{}, []string{}
@@ -388,5 +528,184 @@ func (cmd *Cmd) validate() error {
 	if len(setCmds) == 0 {
 		return fmt.Errorf("one of [%s] must be set", strings.Join(names, ", "))
 	}
+
+	if len(cmd.Block) == 0 && (len(cmd.Rescue) > 0 || len(cmd.Always) > 0) {
+		return fmt.Errorf("rescue and always are allowed with block only")
+	}
+
+	if len(cmd.OkExitCodes) > 0 {
+		if cmd.Script == "" {
+			return fmt.Errorf("ok_exit_codes is allowed with script only")
+		}
+		for _, code := range cmd.OkExitCodes {
+			if code < 0 || code > 255 {
+				return fmt.Errorf("invalid ok exit code %d, allowed 0-255", code)
+			}
+		}
+	}
+
+	if cmd.Options.Become != "" && cmd.Options.Become != "sudo" && cmd.Options.Become != "doas" && cmd.Options.Become != "su" {
+		return fmt.Errorf("unknown become method %q, allowed: sudo, doas, su", cmd.Options.Become)
+	}
+	if !cmd.Options.Privileged() && (cmd.Options.BecomeUser != "" || cmd.Options.BecomeSecret != "") {
+		return fmt.Errorf("become_user and become_secret require sudo or become")
+	}
+	if cmd.Options.Local && cmd.Options.BecomeSecret != "" && (cmd.Options.Become == "doas" || cmd.Options.Become == "su") {
+		return fmt.Errorf("become %s with password is not supported with local", cmd.Options.Become)
+	}
+
+	if cmd.Options.TTY {
+		if cmd.Options.Local {
+			return fmt.Errorf("tty is not supported with local")
+		}
+		if cmd.Script == "" && cmd.Wait.Command == "" {
+			return fmt.Errorf("tty is allowed with script and wait only")
+		}
+		if len(cmd.Options.Secrets) > 0 {
+			// secrets are passed over stdin, and the terminal would truncate long lines and interpret control characters
+			return fmt.Errorf("tty is not supported with secrets")
+		}
+	}
+	if len(cmd.Options.Secrets) > 0 && cmd.Options.BecomeSecret != "" && (cmd.Options.Become == "doas" || cmd.Options.Become == "su") {
+		return fmt.Errorf("become %s with password is not supported with secrets, as it requires tty", cmd.Options.Become)
+	}
+
+	if cmd.Options.ForwardAgent {
+		if cmd.Options.Local {
+			return fmt.Errorf("forward_agent is not supported with local")
+		}
+		if cmd.Script == "" && cmd.Wait.Command == "" {
+			return fmt.Errorf("forward_agent is allowed with script and wait only")
+		}
+	}
+
+	if cmd.Release.BaseDir != "" {
+		if cmd.Release.Rollback && cmd.Release.Source != "" {
+			return fmt.Errorf("release src is not allowed with rollback")
+		}
+		if !cmd.Release.Rollback && cmd.Release.Source == "" {
+			return fmt.Errorf("release src is required")
+		}
+		if cmd.Release.Keep < 0 {
+			return fmt.Errorf("release keep can't be negative")
+		}
+	}
+
+	if cmd.Transfer.SrcHost != "" {
+		if cmd.Transfer.Source == "" || cmd.Transfer.Dest == "" {
+			return fmt.Errorf("transfer src and dst are required")
+		}
+		if cmd.Transfer.Fanout < 0 {
+			return fmt.Errorf("transfer fanout can't be negative")
+		}
+		if cmd.Options.Local || cmd.Options.Privileged() {
+			return fmt.Errorf("transfer is not supported with local and sudo")
+		}
+	}
+
+	syncCmds := append([]SyncInternal{cmd.Sync}, cmd.MSync...)
+	for _, s := range syncCmds {
+		if s.Mode != "" && s.Mode != "sftp" && s.Mode != "tar" {
+			if _, err := ParseFileMode(s.Mode); err != nil {
+				return fmt.Errorf("unknown sync mode %q, allowed: sftp, tar or octal permissions, e.g. 0644", s.Mode)
+			}
+		}
+		if s.Compress != "" && s.Compress != "gzip" && s.Compress != "zstd" {
+			return fmt.Errorf("unknown sync compression %q, allowed: gzip, zstd", s.Compress)
+		}
+		if s.Compress != "" && s.Mode != "tar" {
+			return fmt.Errorf("sync compression is allowed with tar mode only")
+		}
+		if s.Concurrency < 0 {
+			return fmt.Errorf("sync concurrency can't be negative")
+		}
+		if err := validateAttrs(s.Perm(), s.Preserve); err != nil {
+			return fmt.Errorf("invalid sync %s: %w", s.Source, err)
+		}
+		if s.Backup < 0 {
+			return fmt.Errorf("sync backup can't be negative")
+		}
+		if s.Mode == "tar" && (s.Atomic || s.Backup > 0) {
+			return fmt.Errorf("sync atomic and backup are not supported with tar mode")
+		}
+		if s.Direction != "" && s.Direction != "push" && s.Direction != "pull" {
+			return fmt.Errorf("unknown sync direction %q, allowed: push, pull", s.Direction)
+		}
+		if s.Direction == "pull" {
+			if s.Mode == "tar" || s.Concurrency > 0 || s.Atomic || s.Backup > 0 ||
+				s.Perm() != "" || s.Owner != "" || s.Group != "" || len(s.Preserve) > 0 {
+				return fmt.Errorf("sync pull is supported with sftp mode only, without concurrency, atomic, backup and attributes")
+			}
+			if cmd.Options.Privileged() {
+				return fmt.Errorf("sync pull is not supported with sudo")
+			}
+		}
+	}
+
+	copyCmds := append([]CopyInternal{cmd.Copy}, cmd.MCopy...)
+	for _, c := range copyCmds {
+		if err := validateAttrs(c.Mode, c.Preserve); err != nil {
+			return fmt.Errorf("invalid copy %s: %w", c.Source, err)
+		}
+		if c.Backup < 0 {
+			return fmt.Errorf("copy backup can't be negative")
+		}
+	}
+
+	for _, c := range cmd.subCommands() {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("invalid nested command %q: %w", c.Name, err)
+		}
+	}
 	return nil
 }
+
+// validateAttrs checks file attributes options of copy and sync commands
+func validateAttrs(mode string, preserve []string) error {
+	if mode != "" {
+		if _, err := ParseFileMode(mode); err != nil {
+			return err
+		}
+	}
+	for _, p := range preserve {
+		switch p {
+		case "mode", "owner", "links", "times":
+		default:
+			return fmt.Errorf("unknown preserve attribute %q, allowed: mode, owner, links, times", p)
+		}
+		if p == "mode" && mode != "" {
+			return fmt.Errorf("mode and preserve mode can't be set together")
+		}
+	}
+	return nil
+}
+
+// ParseFileMode parses octal file permissions, like 0644 or 755
+func ParseFileMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o7777 {
+		return 0, fmt.Errorf("invalid file mode %q, should be octal, e.g. 0644", mode)
+	}
+	res := os.FileMode(m) & os.ModePerm
+	if m&0o4000 != 0 {
+		res |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		res |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		res |= os.ModeSticky
+	}
+	return res, nil
+}
+
+// subCommands returns all nested commands of parallel group and block, including rescue and always
+func (cmd *Cmd) subCommands() []*Cmd {
+	res := []*Cmd{}
+	for _, cc := range [][]Cmd{cmd.Parallel.Commands, cmd.Block, cmd.Rescue, cmd.Always} {
+		for i := range cc {
+			res = append(res, &cc[i])
+		}
+	}
+	return res
+}
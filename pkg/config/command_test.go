@@ -1,7 +1,10 @@
 package config
 
 import (
+	"errors"
 	"io"
+	"os"
+	"os/exec"
 	"strings"
 	"testing"
 	"time"
@@ -54,13 +57,14 @@ export BAR='foo'
 			expectedContents: []string{
 				"#!/bin/sh",
 				"set -e",
+				`_spot_setvars() { [ -z "${_spot_vars_done:-}" ] || return 0; _spot_vars_done=1; echo setvar FOO=${FOO}; echo setvar BAR=${BAR}; }`,
+				"trap _spot_setvars EXIT",
 				"echo 'Hello, World!'",
 				"export FOO='bar'",
 				"echo 'Goodbye, World!'",
 				" echo \"with space\"",
 				"export BAR='foo'",
-				"echo setvar FOO=${FOO}",
-				"echo setvar BAR=${BAR}",
+				"rc=$?; _spot_setvars; exit $rc",
 			},
 		},
 		{
@@ -77,12 +81,14 @@ export FOO='bar'
 			expectedContents: []string{
 				"#!/bin/sh",
 				"set -e",
+				`_spot_setvars() { [ -z "${_spot_vars_done:-}" ] || return 0; _spot_vars_done=1; echo setvar FOO=${FOO}; }`,
+				"trap _spot_setvars EXIT",
 				"echo 'Hello, World!'",
 				"export",
 				"echo 'Goodbye, World!'",
 				"export BAR",
 				"export FOO='bar'",
-				"echo setvar FOO=${FOO}",
+				"rc=$?; _spot_setvars; exit $rc",
 			},
 		},
 		{
@@ -93,7 +99,7 @@ export FOO='bar'
 					"GREETING": "Hello, World!",
 				},
 			},
-			expectedScript:   `sh -c 'GREETING="Hello, World!"; echo $GREETING'`,
+			expectedScript:   `sh -c 'GREETING='\''Hello, World!'\''; echo $GREETING'`,
 			expectedContents: nil,
 		},
 		{
@@ -110,8 +116,8 @@ echo $FAREWELL`,
 			expectedContents: []string{
 				"#!/bin/sh",
 				"set -e",
-				`export FAREWELL="Goodbye, World!"`,
-				`export GREETING="Hello, World!"`,
+				`export FAREWELL='Goodbye, World!'`,
+				`export GREETING='Hello, World!'`,
 				"echo $GREETING",
 				"echo $FAREWELL",
 			},
@@ -149,8 +155,10 @@ echo 'Goodbye, World!'`,
 			expectedContents: []string{
 				"#!/bin/sh",
 				"set -e",
+				`_spot_setvars() { [ -z "${_spot_vars_done:-}" ] || return 0; _spot_vars_done=1; echo setvar GREETING=${GREETING}; }`,
+				"trap _spot_setvars EXIT",
 				"export GREETING='Hello, World!'",
-				"echo setvar GREETING=${GREETING}",
+				"rc=$?; _spot_setvars; exit $rc",
 			},
 		},
 	}
@@ -195,7 +203,35 @@ func TestCmd_getScriptCommand(t *testing.T) {
 		cmd := c.Tasks[0].Commands[4]
 		assert.Equal(t, "docker", cmd.Name)
 		res := cmd.scriptCommand(cmd.Script)
-		assert.Equal(t, `sh -c 'BAR="qux"; FOO="bar"; docker pull umputun/remark42:latest; docker stop remark42 || true; docker rm remark42 || true; docker run -d --name remark42 -p 8080:8080 umputun/remark42:latest'`, res)
+		assert.Equal(t, `sh -c 'BAR='\''qux'\''; FOO='\''bar'\''; docker pull umputun/remark42:latest; docker stop remark42 || true; docker rm remark42 || true; docker run -d --name remark42 -p 8080:8080 umputun/remark42:latest'`, res)
+	})
+
+	t.Run("script with secrets", func(t *testing.T) {
+		cmd := Cmd{Script: "echo $SEC1", Secrets: map[string]string{"SEC1": "secret1"}, Options: CmdOptions{Secrets: []string{"SEC1"}}}
+		res := cmd.scriptCommand(cmd.Script)
+		assert.Equal(t, `sh -c '. /dev/stdin; echo $SEC1'`, res)
+		assert.NotContains(t, res, "secret1")
+	})
+
+	t.Run("script with single quote in env", func(t *testing.T) {
+		cmd := Cmd{Script: "echo $SPOT_ERROR", Environment: map[string]string{"SPOT_ERROR": "can't run"}}
+		res := cmd.scriptCommand(cmd.Script)
+		assert.Equal(t, `sh -c 'SPOT_ERROR='\''can'\''\'\'''\''t run'\''; echo $SPOT_ERROR'`, res)
+	})
+
+	t.Run("script with shell metacharacters in env", func(t *testing.T) {
+		spotErr := "can't run `id -un` $(id -un) ${HOME} \"quoted\""
+		cmd := Cmd{Script: `printf "%s" "$SPOT_ERROR"`, Environment: map[string]string{"SPOT_ERROR": spotErr}}
+		out, err := exec.Command("sh", "-c", cmd.scriptCommand(cmd.Script)).Output()
+		require.NoError(t, err)
+		assert.Equal(t, spotErr, string(out), "env value not expanded")
+
+		rdr := cmd.scriptFile("echo start\nprintf \"%s\" \"$SPOT_ERROR\"")
+		script, err := io.ReadAll(rdr)
+		require.NoError(t, err)
+		out, err = exec.Command("sh", "-c", string(script)).Output()
+		require.NoError(t, err)
+		assert.Equal(t, "start\n"+spotErr, string(out), "env value not expanded in script file")
 	})
 }
 
@@ -227,7 +263,7 @@ func TestCmd_getScriptFile(t *testing.T) {
 					"VAR1": "value1",
 				},
 			},
-			expected: "#!/bin/sh\nset -e\nexport VAR1=\"value1\"\necho 'Hello, World!'\n",
+			expected: "#!/bin/sh\nset -e\nexport VAR1='value1'\necho 'Hello, World!'\n",
 		},
 		{
 			name: "with multiple environment variables",
@@ -238,7 +274,7 @@ func TestCmd_getScriptFile(t *testing.T) {
 					"VAR2": "value2",
 				},
 			},
-			expected: "#!/bin/sh\nset -e\nexport VAR1=\"value1\"\nexport VAR2=\"value2\"\necho 'Hello, World!'\n",
+			expected: "#!/bin/sh\nset -e\nexport VAR1='value1'\nexport VAR2='value2'\necho 'Hello, World!'\n",
 		},
 		{
 			name: "with multiple environment variables and secrets",
@@ -255,7 +291,7 @@ func TestCmd_getScriptFile(t *testing.T) {
 					Secrets: []string{"SEC1"},
 				},
 			},
-			expected: "#!/bin/sh\nset -e\nexport VAR1=\"value1\"\nexport VAR2=\"value2\"\nexport SEC1=\"secret1\"\necho 'Hello, World!'\n",
+			expected: "#!/bin/sh\nset -e\nexport VAR1='value1'\nexport VAR2='value2'\n. /dev/stdin\necho 'Hello, World!'\n",
 		},
 		{
 			name: "with multiple secrets",
@@ -270,7 +306,7 @@ func TestCmd_getScriptFile(t *testing.T) {
 					Secrets: []string{"SEC1", "SEC2"},
 				},
 			},
-			expected: "#!/bin/sh\nset -e\nexport SEC1=\"secret1\"\nexport SEC2=\"secret2\"\necho 'Hello, World!'\n",
+			expected: "#!/bin/sh\nset -e\n. /dev/stdin\necho 'Hello, World!'\n",
 		},
 	}
 
@@ -285,6 +321,58 @@ func TestCmd_getScriptFile(t *testing.T) {
 	}
 }
 
+func TestCmd_scriptFileExports(t *testing.T) {
+	run := func(script string) (string, int) {
+		cmd := Cmd{Script: script}
+		data, err := io.ReadAll(cmd.scriptFile(cmd.Script))
+		require.NoError(t, err)
+		out, err := exec.Command("sh", "-c", string(data)).Output()
+		exitErr := &exec.ExitError{}
+		if errors.As(err, &exitErr) {
+			return string(out), exitErr.ExitCode()
+		}
+		require.NoError(t, err)
+		return string(out), 0
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		out, code := run("export FOO=foo\necho done")
+		assert.Equal(t, "done\nsetvar FOO=foo\n", out)
+		assert.Equal(t, 0, code)
+	})
+
+	t.Run("failed with set -e", func(t *testing.T) {
+		out, code := run("export FOO=foo\nfalse\necho never")
+		assert.Equal(t, "setvar FOO=foo\n", out)
+		assert.Equal(t, 1, code)
+	})
+
+	t.Run("exit code kept", func(t *testing.T) {
+		out, code := run("export FOO=foo\ntest -z foo || echo last")
+		assert.Equal(t, "last\nsetvar FOO=foo\n", out)
+		assert.Equal(t, 0, code)
+		out, code = run("export FOO=foo\nexit 3")
+		assert.Equal(t, "setvar FOO=foo\n", out)
+		assert.Equal(t, 3, code)
+	})
+
+	t.Run("script with own exit trap", func(t *testing.T) {
+		out, code := run("trap 'echo cleanup' EXIT\nexport FOO=foo\nexport BAR=bar\necho done")
+		assert.Equal(t, "done\nsetvar FOO=foo\nsetvar BAR=bar\ncleanup\n", out)
+		assert.Equal(t, 0, code)
+	})
+}
+
+func TestCmd_SecretsInput(t *testing.T) {
+	cmd := Cmd{Script: "echo $SEC1", Secrets: map[string]string{"SEC1": "secret1", "SEC2": "it's $HOME", "SEC3": "s3"},
+		Options: CmdOptions{Secrets: []string{"SEC2", "SEC1"}}}
+	data, err := io.ReadAll(cmd.SecretsInput())
+	require.NoError(t, err)
+	assert.Equal(t, "export SEC1='secret1'\nexport SEC2='it'\\''s $HOME'\n", string(data))
+
+	assert.Nil(t, (&Cmd{Script: "echo 1"}).SecretsInput())
+}
+
 func TestCmd_UnmarshalYAML(t *testing.T) {
 	type testCase struct {
 		name        string
@@ -369,6 +457,61 @@ sync:
 			},
 		},
 
+		{
+			name: "parallel with concurrency",
+			yamlInput: `
+name: test
+parallel:
+  concurrency: 2
+  commands:
+    - {name: pull1, script: docker pull image1}
+    - {name: pull2, script: docker pull image2}
+    - name: sync
+      sync: {src: source, dst: destination}
+`,
+			expectedCmd: Cmd{
+				Name: "test",
+				Parallel: ParallelInternal{Concurrency: 2, Commands: []Cmd{
+					{Name: "pull1", Script: "docker pull image1"},
+					{Name: "pull2", Script: "docker pull image2"},
+					{Name: "sync", Sync: SyncInternal{Source: "source", Dest: "destination"}},
+				}},
+			},
+		},
+		{
+			name: "parallel as a list",
+			yamlInput: `
+name: test
+parallel:
+  - {name: pull1, script: docker pull image1}
+  - {name: pull2, script: docker pull image2}
+`,
+			expectedCmd: Cmd{
+				Name: "test",
+				Parallel: ParallelInternal{Commands: []Cmd{
+					{Name: "pull1", Script: "docker pull image1"},
+					{Name: "pull2", Script: "docker pull image2"},
+				}},
+			},
+		},
+		{
+			name: "block with rescue and always",
+			yamlInput: `
+name: test
+block:
+  - {name: deploy, script: ./deploy.sh}
+rescue:
+  - {name: restore, copy: {src: backup, dst: destination}}
+always:
+  - {name: cleanup, delete: {path: /tmp/deploy, recur: true}}
+`,
+			expectedCmd: Cmd{
+				Name:   "test",
+				Block:  []Cmd{{Name: "deploy", Script: "./deploy.sh"}},
+				Rescue: []Cmd{{Name: "restore", Copy: CopyInternal{Source: "backup", Dest: "destination"}}},
+				Always: []Cmd{{Name: "cleanup", Delete: DeleteInternal{Location: "/tmp/deploy", Recursive: true}}},
+			},
+		},
 		{
 			name: "All fields",
 			yamlInput: `
@@ -471,7 +614,86 @@ func TestCmd_validate(t *testing.T) {
 		{"only wait", Cmd{Wait: WaitInternal{Command: "command"}}, ""},
 		{"multiple fields set", Cmd{Script: "example_script", Copy: CopyInternal{Source: "source", Dest: "dest"}},
 			"only one of [script, copy] is allowed"},
-		{"nothing set", Cmd{}, "one of [script, copy, mcopy, delete, mdelete, sync, msync, wait, echo] must be set"},
+		{"only parallel", Cmd{Parallel: ParallelInternal{Commands: []Cmd{{Script: "s1"}, {Copy: CopyInternal{Source: "s", Dest: "d"}}}}}, ""},
+		{"parallel with invalid command", Cmd{Parallel: ParallelInternal{Commands: []Cmd{{Name: "c1", Script: "s1"}, {Name: "c2"}}}},
+			"invalid nested command \"c2\": one of [script, copy, mcopy, delete, mdelete, restore, release, transfer, sync, msync, wait, echo, parallel, block] must be set"},
+		{"block with rescue and always", Cmd{Block: []Cmd{{Script: "s1"}}, Rescue: []Cmd{{Script: "r1"}}, Always: []Cmd{{Script: "a1"}}}, ""},
+		{"rescue without block", Cmd{Script: "s1", Rescue: []Cmd{{Script: "r1"}}}, "rescue and always are allowed with block only"},
+		{"script with ok exit codes", Cmd{Script: "s1", OkExitCodes: []int{0, 3}}, ""},
+		{"script with tty", Cmd{Script: "s1", Options: CmdOptions{TTY: true}}, ""},
+		{"wait with tty", Cmd{Wait: WaitInternal{Command: "c1"}, Options: CmdOptions{TTY: true}}, ""},
+		{"local with tty", Cmd{Script: "s1", Options: CmdOptions{TTY: true, Local: true}}, "tty is not supported with local"},
+		{"copy with tty", Cmd{Copy: CopyInternal{Source: "s", Dest: "d"}, Options: CmdOptions{TTY: true}},
+			"tty is allowed with script and wait only"},
+		{"tty with secrets", Cmd{Script: "s1", Options: CmdOptions{TTY: true, Secrets: []string{"s1"}}},
+			"tty is not supported with secrets"},
+		{"su with password and secrets", Cmd{Script: "s1", Options: CmdOptions{Become: "su", BecomeSecret: "pw", Secrets: []string{"s1"}}},
+			"become su with password is not supported with secrets, as it requires tty"},
+		{"sudo with password and secrets", Cmd{Script: "s1", Options: CmdOptions{Sudo: true, BecomeSecret: "pw", Secrets: []string{"s1"}}}, ""},
+		{"script with forward agent", Cmd{Script: "s1", Options: CmdOptions{ForwardAgent: true}}, ""},
+		{"local with forward agent", Cmd{Script: "s1", Options: CmdOptions{ForwardAgent: true, Local: true}},
+			"forward_agent is not supported with local"},
+		{"sync with forward agent", Cmd{Sync: SyncInternal{Source: "s", Dest: "d"}, Options: CmdOptions{ForwardAgent: true}},
+			"forward_agent is allowed with script and wait only"},
+		{"become doas as user", Cmd{Script: "s1", Options: CmdOptions{Become: "doas", BecomeUser: "app"}}, ""},
+		{"sudo with become secret", Cmd{Script: "s1", Options: CmdOptions{Sudo: true, BecomeSecret: "pw"}}, ""},
+		{"unknown become", Cmd{Script: "s1", Options: CmdOptions{Become: "pbrun"}},
+			`unknown become method "pbrun", allowed: sudo, doas, su`},
+		{"become user without become", Cmd{Script: "s1", Options: CmdOptions{BecomeUser: "app"}},
+			"become_user and become_secret require sudo or become"},
+		{"local su with password", Cmd{Script: "s1", Options: CmdOptions{Local: true, Become: "su", BecomeSecret: "pw"}},
+			"become su with password is not supported with local"},
+		{"ok exit codes without script", Cmd{Echo: "e1", OkExitCodes: []int{0, 3}}, "ok_exit_codes is allowed with script only"},
+		{"invalid ok exit code", Cmd{Script: "s1", OkExitCodes: []int{0, 256}}, "invalid ok exit code 256, allowed 0-255"},
+		{"always without block", Cmd{Script: "s1", Always: []Cmd{{Script: "a1"}}}, "rescue and always are allowed with block only"},
+		{"block with invalid rescue", Cmd{Block: []Cmd{{Script: "s1"}}, Rescue: []Cmd{{Name: "r1", Script: "r1", Echo: "e1"}}},
+			"invalid nested command \"r1\": only one of [script, echo] is allowed"},
+		{"sync with tar mode", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "tar", Compress: "zstd"}}, ""},
+		{"sync with unknown mode", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "rsync"}},
+			"unknown sync mode \"rsync\", allowed: sftp, tar or octal permissions, e.g. 0644"},
+		{"msync with unknown compression", Cmd{MSync: []SyncInternal{{Source: "s", Dest: "d", Mode: "tar", Compress: "xz"}}},
+			"unknown sync compression \"xz\", allowed: gzip, zstd"},
+		{"sync compression without tar", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Compress: "gzip"}},
+			"sync compression is allowed with tar mode only"},
+		{"sync with permissions as mode", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "0644"}}, ""},
+		{"sync with permissions and preserve mode", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "4755",
+			Preserve: []string{"mode"}}}, "invalid sync s: mode and preserve mode can't be set together"},
+		{"pull sync with permissions", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "0644", Direction: "pull"}},
+			"sync pull is supported with sftp mode only, without concurrency, atomic, backup and attributes"},
+		{"sync with negative concurrency", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Concurrency: -1}},
+			"sync concurrency can't be negative"},
+		{"sync with attributes", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "0644", Owner: "app", Group: "app",
+			Preserve: []string{"owner", "links", "times"}}}, ""},
+		{"sync with invalid mode", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "0x644"}},
+			"unknown sync mode \"0x644\", allowed: sftp, tar or octal permissions, e.g. 0644"},
+		{"copy with invalid mode", Cmd{Copy: CopyInternal{Source: "s", Dest: "d", Mode: "0x644"}},
+			"invalid copy s: invalid file mode \"0x644\", should be octal, e.g. 0644"},
+		{"mcopy with unknown preserve", Cmd{MCopy: []CopyInternal{{Source: "s", Dest: "d", Preserve: []string{"acl"}}}},
+			"invalid copy s: unknown preserve attribute \"acl\", allowed: mode, owner, links, times"},
+		{"copy with mode and preserve mode", Cmd{Copy: CopyInternal{Source: "s", Dest: "d", Mode: "600", Preserve: []string{"mode"}}},
+			"invalid copy s: mode and preserve mode can't be set together"},
+		{"restore", Cmd{Restore: RestoreInternal{Location: "/etc/app.conf"}}, ""},
+		{"copy with negative backup", Cmd{Copy: CopyInternal{Source: "s", Dest: "d", Backup: -1}}, "copy backup can't be negative"},
+		{"sync with atomic and tar", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Mode: "tar", Atomic: true}},
+			"sync atomic and backup are not supported with tar mode"},
+		{"sync pull", Cmd{Sync: SyncInternal{Source: "/var/log/app", Dest: "logs", Direction: "pull", Delete: true}}, ""},
+		{"sync unknown direction", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Direction: "both"}},
+			`unknown sync direction "both", allowed: push, pull`},
+		{"sync pull with tar", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Direction: "pull", Mode: "tar"}},
+			"sync pull is supported with sftp mode only, without concurrency, atomic, backup and attributes"},
+		{"sync pull with sudo", Cmd{Sync: SyncInternal{Source: "s", Dest: "d", Direction: "pull"},
+			Options: CmdOptions{Sudo: true}}, "sync pull is not supported with sudo"},
+		{"transfer", Cmd{Transfer: TransferInternal{SrcHost: "build", Source: "/tmp/app.tgz", Dest: "/opt/app.tgz", Fanout: 3}}, ""},
+		{"transfer without dst", Cmd{Transfer: TransferInternal{SrcHost: "build", Source: "/tmp/app.tgz"}},
+			"transfer src and dst are required"},
+		{"transfer with sudo", Cmd{Transfer: TransferInternal{SrcHost: "build", Source: "s", Dest: "d"}, Options: CmdOptions{Sudo: true}},
+			"transfer is not supported with local and sudo"},
+		{"release", Cmd{Release: ReleaseInternal{Source: "dist", BaseDir: "/srv/app", Keep: 3}}, ""},
+		{"release rollback", Cmd{Release: ReleaseInternal{BaseDir: "/srv/app", Rollback: true}}, ""},
+		{"release without src", Cmd{Release: ReleaseInternal{BaseDir: "/srv/app"}}, "release src is required"},
+		{"release rollback with src", Cmd{Release: ReleaseInternal{Source: "dist", BaseDir: "/srv/app", Rollback: true}},
+			"release src is not allowed with rollback"},
+		{"nothing set", Cmd{}, "one of [script, copy, mcopy, delete, mdelete, restore, release, transfer, sync, msync, wait, echo, parallel, block] must be set"},
 	}
 
 	for _, tt := range tbl {
@@ -486,6 +708,33 @@ func TestCmd_validate(t *testing.T) {
 	}
 }
 
+func TestParseFileMode(t *testing.T) {
+	tbl := []struct {
+		mode string
+		res  os.FileMode
+		err  bool
+	}{
+		{"0644", 0o644, false},
+		{"755", 0o755, false},
+		{"4755", 0o755 | os.ModeSetuid, false},
+		{"1777", 0o777 | os.ModeSticky, false},
+		{"0800", 0, true},
+		{"17777", 0, true},
+		{"rw-r--r--", 0, true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.mode, func(t *testing.T) {
+			res, err := ParseFileMode(tt.mode)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
 func TestCmd_GetWait(t *testing.T) {
 	testCases := []struct {
 		name           string
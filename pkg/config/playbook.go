@@ -30,6 +30,8 @@ type PlayBook struct {
 	Targets   map[string]Target `yaml:"targets" toml:"targets"`     // list of targets/environments
 	Tasks     []Task            `yaml:"tasks" toml:"tasks"`         // list of tasks
 
+	ForwardAgent bool `yaml:"forward_agent" toml:"forward_agent"` // forward ssh agent to script and wait commands of all hosts
+
 	inventory       *InventoryData    // loaded inventory
 	overrides       *Overrides        // overrides passed from cli
 	secrets         map[string]string // list of all discovered secrets
@@ -50,6 +52,8 @@ type SimplePlayBook struct {
 	Targets   []string `yaml:"targets" toml:"targets"`     // list of names
 	Target    string   `yaml:"target" toml:"target"`       // a single target to run task on
 	Task      []Cmd    `yaml:"task" toml:"task"`           // single task is a list of commands
+
+	ForwardAgent bool `yaml:"forward_agent" toml:"forward_agent"` // forward ssh agent to script and wait commands
 }
 
 // Task defines multiple commands runs together
@@ -59,24 +63,49 @@ type Task struct {
 	Commands []Cmd    `yaml:"commands" toml:"commands"`
 	OnError  string   `yaml:"on_error" toml:"on_error"`
 	Targets  []string `yaml:"targets" toml:"targets"` // optional list of targets to run task on, names or groups
+
+	Rollback    string `yaml:"rollback" toml:"rollback"`         // optional task to run on failed hosts if task failed
+	RollbackAll bool   `yaml:"rollback_all" toml:"rollback_all"` // run rollback task on completed hosts too
+
+	Canary      int         `yaml:"canary" toml:"canary"`             // number of hosts to run task on first, before the rest
+	CanaryCheck CanaryCheck `yaml:"canary_check" toml:"canary_check"` // optional check of canary hosts
+}
+
+// CanaryCheck defines a check of canary hosts, executed after the task completed on them.
+// The rest of the hosts processed only if all checks passed.
+type CanaryCheck struct {
+	Script  string        `yaml:"script" toml:"script,multiline"` // script to run on each canary host
+	Local   bool          `yaml:"local" toml:"local"`             // run script on localhost, once per canary host
+	URL     string        `yaml:"url" toml:"url"`                 // http url to probe for each canary host, 2xx is success
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`         // timeout of http probe, 10s by default
+	Pause   time.Duration `yaml:"pause" toml:"pause"`             // soak duration to wait after the check
+	Confirm bool          `yaml:"confirm" toml:"confirm"`         // wait for manual confirmation on the terminal
 }
 
 // Target defines hosts to run commands on
 type Target struct {
-	Name   string        `yaml:"-" toml:"-"`           // name of target, set from the map key
-	Hosts  []Destination `yaml:"hosts" toml:"hosts"`   // direct list of hosts to run commands on, no need to use inventory
-	Groups []string      `yaml:"groups" toml:"groups"` // list of groups to run commands on, matches to inventory
-	Names  []string      `yaml:"names" toml:"names"`   // list of host names to run commands on, matches to inventory
-	Tags   []string      `yaml:"tags" toml:"tags"`     // list of tags to run commands on, matches to inventory
+	Name    string        `yaml:"-" toml:"-"`               // name of target, set from the map key
+	Hosts   []Destination `yaml:"hosts" toml:"hosts"`       // direct list of hosts to run commands on, no need to use inventory
+	Groups  []string      `yaml:"groups" toml:"groups"`     // list of groups to run commands on, matches to inventory
+	Names   []string      `yaml:"names" toml:"names"`       // list of host names to run commands on, matches to inventory
+	Tags    []string      `yaml:"tags" toml:"tags"`         // list of tags to run commands on, matches to inventory
+	SSHKey  string        `yaml:"ssh_key" toml:"ssh_key"`   // ssh key for hosts of the target without own key
+	SSHCert string        `yaml:"ssh_cert" toml:"ssh_cert"` // ssh certificate for hosts of the target without own key
+
+	ForwardAgent bool `yaml:"forward_agent" toml:"forward_agent"` // forward ssh agent to all hosts of the target
 }
 
 // Destination defines destination info
 type Destination struct {
-	Name string   `yaml:"name" toml:"name"`
-	Host string   `yaml:"host" toml:"host"`
-	Port int      `yaml:"port" toml:"port"`
-	User string   `yaml:"user" toml:"user"`
-	Tags []string `yaml:"tags" toml:"tags"`
+	Name    string   `yaml:"name" toml:"name"`
+	Host    string   `yaml:"host" toml:"host"`
+	Port    int      `yaml:"port" toml:"port"`
+	User    string   `yaml:"user" toml:"user"`
+	Tags    []string `yaml:"tags" toml:"tags"`
+	SSHKey  string   `yaml:"ssh_key" toml:"ssh_key"`   // ssh key of the host, overrides the key of playbook and cli
+	SSHCert string   `yaml:"ssh_cert" toml:"ssh_cert"` // ssh certificate of the key, <key>-cert.pub by default
+
+	ForwardAgent bool `yaml:"forward_agent" toml:"forward_agent"` // forward ssh agent to the host, set by host, target or playbook
 }
 
 // Overrides defines override for task passed from cli
@@ -237,6 +266,7 @@ func unmarshalPlaybookFile(fname string, data []byte, overrides *Overrides, res
 	if err := unmarshal(data, simple, false); err == nil && len(simple.Task) > 0 {
 		// success, this is SimplePlayBook config, convert it to full PlayBook config
 		res.Inventory = simple.Inventory
+		res.ForwardAgent = simple.ForwardAgent
 		res.Tasks = []Task{{Commands: simple.Task}} // simple playbook has just a list of commands as the task
 		res.Tasks[0].Name = "default"               // we have only one task, set it as default
 
@@ -369,6 +399,7 @@ func (p *PlayBook) TargetHosts(name string) ([]Destination, error) {
 			h.Port = 22 // the default port is 22 if not set
 		}
 		h.User = userOverride(h.User)
+		h.ForwardAgent = h.ForwardAgent || p.ForwardAgent
 		res[i] = h
 	}
 
@@ -386,6 +417,23 @@ func (p *PlayBook) AllSecretValues() []string {
 	return res
 }
 
+// Secret returns the value of the secret from secrets provider, like ssh password. The value is stored
+// in secrets of the playbook, so it is masked in logs the same way as secrets of commands.
+func (p *PlayBook) Secret(key string) (string, error) {
+	if p.secretsProvider == nil {
+		return "", fmt.Errorf("secret %q is requested, but provider is not set", key)
+	}
+	val, err := p.secretsProvider.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("can't get secret %q: %w", key, err)
+	}
+	if p.secrets == nil {
+		p.secrets = make(map[string]string)
+	}
+	p.secrets[key] = val
+	return val, nil
+}
+
 // UpdateTasksTargets updates the targets of all tasks in the playbook with the values from the specified map of variables.
 // The method is used to replace variables in the targets of tasks with their actual values and this way provide dynamic targets.
 func (p *PlayBook) UpdateTasksTargets(vars map[string]string) {
@@ -503,6 +551,8 @@ func (p *PlayBook) loadInventory(loc string) (*InventoryData, error) {
 
 // checkConfig validates the PlayBook configuration by ensuring that:
 // - all tasks have unique names and no empty names
+// - rollback tasks exist
+// - canary settings are valid
 // - all commands have a single type set
 // - the target set is not called "all"
 // Returns an error if any of these conditions are not met.
@@ -520,6 +570,29 @@ func (p *PlayBook) checkConfig() error {
 		names[t.Name] = true
 	}
 
+	// check what rollback tasks exist and not the same as the task itself
+	for _, t := range p.Tasks {
+		if t.Rollback == "" {
+			continue
+		}
+		if t.Rollback == t.Name {
+			return fmt.Errorf("task %q can't be rollback of itself", t.Name)
+		}
+		if !names[t.Rollback] {
+			return fmt.Errorf("rollback task %q of task %q not found", t.Rollback, t.Name)
+		}
+	}
+
+	// check what canary settings are valid
+	for _, t := range p.Tasks {
+		if t.Canary < 0 {
+			return fmt.Errorf("task %q has negative canary %d", t.Name, t.Canary)
+		}
+		if t.Canary == 0 && t.CanaryCheck != (CanaryCheck{}) {
+			return fmt.Errorf("task %q has canary_check without canary", t.Name)
+		}
+	}
+
 	// check what all commands have a single type set
 	for _, t := range p.Tasks {
 		if len(t.Commands) == 0 {
@@ -544,14 +617,27 @@ func (p *PlayBook) checkConfig() error {
 
 // loadSecrets loads secrets from secrets provider and stores them in secrets map
 func (p *PlayBook) loadSecrets() error {
+	// countSecrets returns the number of secrets defined in the command, including all nested commands
+	var countSecrets func(c *Cmd) int
+	countSecrets = func(c *Cmd) int {
+		if c.Options.NoAuto {
+			return 0 // skip commands with noauto flag
+		}
+		res := len(c.Options.Secrets)
+		if c.Options.BecomeSecret != "" {
+			res++
+		}
+		for _, sc := range c.subCommands() {
+			res += countSecrets(sc)
+		}
+		return res
+	}
+
 	// check if secrets are defined in playbook
 	secretsCount := 0
 	for _, t := range p.Tasks {
-		for _, c := range t.Commands {
-			if c.Options.NoAuto {
-				continue // skip commands with noauto flag
-			}
-			secretsCount += len(c.Options.Secrets)
+		for i := range t.Commands {
+			secretsCount += countSecrets(&t.Commands[i])
 		}
 	}
 
@@ -566,21 +652,40 @@ func (p *PlayBook) loadSecrets() error {
 		p.secrets = make(map[string]string)
 	}
 
+	// loadCmdSecrets retrieves secrets of the command from provider and stores them in the secrets map of the playbook
+	// and in the command itself. Nested commands are processed recursively.
+	var loadCmdSecrets func(taskName string, c *Cmd) error
+	loadCmdSecrets = func(taskName string, c *Cmd) error {
+		keys := c.Options.Secrets
+		if c.Options.BecomeSecret != "" {
+			// become password is loaded to the secrets of command, but not exported to the script
+			keys = append(append([]string{}, keys...), c.Options.BecomeSecret)
+		}
+		for _, key := range keys {
+			val, err := p.secretsProvider.Get(key)
+			if err != nil {
+				return fmt.Errorf("can't get secret %q defined in task %q, command %q: %w", key, taskName, c.Name, err)
+			}
+			p.secrets[key] = val // store secret in the secrets map of playbook
+			if c.Secrets == nil {
+				c.Secrets = make(map[string]string)
+			}
+			c.Secrets[key] = val // store secret in the secrets map of command
+		}
+		for _, sc := range c.subCommands() {
+			if err := loadCmdSecrets(taskName, sc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	// collect Secrets from all command's, retrieve them from provider and store in the secrets map
 	for _, t := range p.Tasks {
-		for i, c := range t.Commands {
-			for _, key := range c.Options.Secrets {
-				val, err := p.secretsProvider.Get(key)
-				if err != nil {
-					return fmt.Errorf("can't get secret %q defined in task %q, command %q: %w", key, t.Name, c.Name, err)
-				}
-				p.secrets[key] = val // store secret in the secrets map of playbook
-				if c.Secrets == nil {
-					c.Secrets = make(map[string]string)
-				}
-				c.Secrets[key] = val // store secret in the secrets map of command
+		for i := range t.Commands {
+			if err := loadCmdSecrets(t.Name, &t.Commands[i]); err != nil {
+				return err
 			}
-			t.Commands[i] = c
 		}
 	}
 	return nil
@@ -376,6 +376,15 @@ func TestTargetHosts(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("forward agent of playbook", func(t *testing.T) {
+		p.overrides = nil
+		p.ForwardAgent = true
+		defer func() { p.ForwardAgent = false }()
+		res, err := p.TargetHosts("target1")
+		require.NoError(t, err)
+		require.Equal(t, []Destination{{Host: "host1.example.com", Port: 22, User: "defaultuser", ForwardAgent: true}}, res)
+	})
 }
 
 func TestPlayBook_UpdateTasksTargets(t *testing.T) {
@@ -625,6 +634,52 @@ func TestPlayBook_checkConfig(t *testing.T) {
 			},
 			expectedErr: `task "task1" rejected, invalid command "c1": only one of [script, delete] is allowed`,
 		},
+		{
+			name: "rollback task",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "task1", Rollback: "undo", Commands: []Cmd{{Script: "example_script"}}},
+					{Name: "undo", Commands: []Cmd{{Script: "undo_script"}}},
+				},
+			},
+			expectedErr: "",
+		},
+		{
+			name: "rollback task not found",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "task1", Rollback: "undo", Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `rollback task "undo" of task "task1" not found`,
+		},
+		{
+			name: "rollback to itself",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "task1", Rollback: "task1", Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "task1" can't be rollback of itself`,
+		},
+		{
+			name: "canary with check",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "task1", Canary: 1, CanaryCheck: CanaryCheck{URL: "http://localhost/health"},
+					Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: "",
+		},
+		{
+			name: "canary check without canary",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "task1", CanaryCheck: CanaryCheck{Script: "check"}, Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "task1" has canary_check without canary`,
+		},
+		{
+			name: "negative canary",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "task1", Canary: -1, Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "task1" has negative canary -1`,
+		},
 		{
 			name: "no commands",
 			playbook: PlayBook{
@@ -674,6 +729,32 @@ func TestPlayBook_loadSecrets(t *testing.T) {
 		assert.Equal(t, map[string]string{"secret1": "value1", "secret2": "value2"}, p.secrets)
 	})
 
+	t.Run("secrets of parallel commands", func(t *testing.T) {
+		p := PlayBook{secretsProvider: &secProvider, Tasks: []Task{
+			{Commands: []Cmd{{Parallel: ParallelInternal{Commands: []Cmd{
+				{Name: "p1", Options: CmdOptions{Secrets: []string{"secret1"}}},
+				{Name: "p2", Options: CmdOptions{Secrets: []string{"secret2"}}},
+			}}}}},
+		}}
+		err := p.loadSecrets()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"secret1": "value1", "secret2": "value2"}, p.secrets)
+		assert.Equal(t, map[string]string{"secret1": "value1"}, p.Tasks[0].Commands[0].Parallel.Commands[0].Secrets)
+		assert.Equal(t, map[string]string{"secret2": "value2"}, p.Tasks[0].Commands[0].Parallel.Commands[1].Secrets)
+	})
+
+	t.Run("become secret", func(t *testing.T) {
+		p := PlayBook{secretsProvider: &secProvider, Tasks: []Task{
+			{Commands: []Cmd{{Script: "echo 1", Options: CmdOptions{Sudo: true, Secrets: []string{"secret1"}, BecomeSecret: "secret2"}}}},
+		}}
+		err := p.loadSecrets()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"secret1": "value1", "secret2": "value2"}, p.secrets)
+		cmd := p.Tasks[0].Commands[0]
+		assert.Equal(t, "value2", cmd.BecomePassword())
+		assert.Equal(t, []string{"secret1"}, cmd.Options.Secrets, "become secret not added to exported secrets")
+	})
+
 	t.Run("provider not set", func(t *testing.T) {
 		p := PlayBook{Tasks: []Task{{Commands: []Cmd{{Options: CmdOptions{Secrets: []string{"secret1"}}}}}}}
 		err := p.loadSecrets()
@@ -689,6 +770,29 @@ func TestPlayBook_loadSecrets(t *testing.T) {
 	})
 }
 
+func TestPlayBook_Secret(t *testing.T) {
+	secProvider := mocks.SecretProvider{
+		GetFunc: func(key string) (string, error) {
+			if key == "ssh_pass" {
+				return "pass1", nil
+			}
+			return "", fmt.Errorf("unknown secret key %q", key)
+		},
+	}
+
+	p := PlayBook{secretsProvider: &secProvider}
+	val, err := p.Secret("ssh_pass")
+	require.NoError(t, err)
+	assert.Equal(t, "pass1", val)
+	assert.Equal(t, []string{"pass1"}, p.AllSecretValues(), "secret masked in logs")
+
+	_, err = p.Secret("unknown")
+	assert.EqualError(t, err, `can't get secret "unknown": unknown secret key "unknown"`)
+
+	_, err = (&PlayBook{}).Secret("ssh_pass")
+	assert.EqualError(t, err, `secret "ssh_pass" is requested, but provider is not set`)
+}
+
 func TestPlayBook_AllTasks(t *testing.T) {
 	p := PlayBook{Tasks: []Task{
 		{Name: "task1", Targets: []string{"target1"}},
@@ -67,6 +67,20 @@ func (tg *targetExtractor) destinationsFromPlaybook(name string, t Target) ([]De
 	if len(res) == 0 {
 		return nil, fmt.Errorf("hosts for target %q not found", t.Name)
 	}
+	for i := range res {
+		res[i].ForwardAgent = res[i].ForwardAgent || t.ForwardAgent
+	}
+	// ssh key of the target is inherited by hosts without own key. The certificate of the target is signed
+	// for its key, so it is inherited only together with the key, hosts with own key use own certificate.
+	for i := range res {
+		if res[i].SSHKey != "" {
+			continue
+		}
+		res[i].SSHKey = t.SSHKey
+		if res[i].SSHCert == "" {
+			res[i].SSHCert = t.SSHCert
+		}
+	}
 	log.Printf("[DEBUG] target %q has %d total hosts: %+v", t.Name, len(res), res)
 	return res, nil
 }
@@ -196,6 +196,46 @@ func TestDestinations(t *testing.T) {
 			},
 			err: false,
 		},
+
+		{
+			name: "ssh key and certificate of target for hosts without own key",
+			targets: map[string]Target{
+				"test": {Hosts: []Destination{{Host: "h1", Port: 22}, {Host: "h2", Port: 22, SSHKey: "keys/h2"},
+					{Host: "h3", Port: 22, SSHCert: "keys/h3-cert.pub"}},
+					Groups: []string{"web"}, SSHKey: "keys/web", SSHCert: "keys/web-ca.pub"},
+			},
+			user: "user",
+			inventory: &InventoryData{
+				Groups: map[string][]Destination{
+					"web": {{Name: "server1", Host: "192.168.1.1", Port: 22}},
+				},
+			},
+			expected: []Destination{
+				{Host: "h1", Port: 22, SSHKey: "keys/web", SSHCert: "keys/web-ca.pub"},
+				{Host: "h2", Port: 22, SSHKey: "keys/h2"}, // own key, target's certificate is not for it
+				{Host: "h3", Port: 22, SSHKey: "keys/web", SSHCert: "keys/h3-cert.pub"},
+				{Name: "server1", Host: "192.168.1.1", Port: 22, SSHKey: "keys/web", SSHCert: "keys/web-ca.pub"},
+			},
+			err: false,
+		},
+
+		{
+			name: "forward agent of target",
+			targets: map[string]Target{
+				"test": {Hosts: []Destination{{Host: "h1", Port: 22}}, Groups: []string{"web"}, ForwardAgent: true},
+			},
+			user: "user",
+			inventory: &InventoryData{
+				Groups: map[string][]Destination{
+					"web": {{Name: "server1", Host: "192.168.1.1", Port: 22}},
+				},
+			},
+			expected: []Destination{
+				{Host: "h1", Port: 22, ForwardAgent: true},
+				{Name: "server1", Host: "192.168.1.1", Port: 22, ForwardAgent: true},
+			},
+			err: false,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -0,0 +1,242 @@
+package executor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Become defines privilege escalation of commands. Wrap makes the escalated command, and Run with RunOpts.Become
+// feeds the password to the escalation method over stdin, so the password never appears in the command line or logs.
+type Become struct {
+	Method   string // sudo, doas or su, sudo if empty
+	User     string // user to run the command as, root if empty
+	Password string // password sent on the prompt of the method, no password if empty
+	token    string // random token of markers printed by the wrapped command
+}
+
+// becomePromptRe matches the password prompt of sudo (set by Wrap), su and doas
+var becomePromptRe = regexp.MustCompile(`(?i)password[^\n]*:\s*$`)
+
+// NewBecome makes Become for the method, user and password.
+func NewBecome(method, user, password string) *Become {
+	res := &Become{Method: method, User: user, Password: password}
+	if res.Method == "" {
+		res.Method = "sudo"
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		res.token = "0000000000000000"
+		return res
+	}
+	res.token = hex.EncodeToString(buf)
+	return res
+}
+
+// Wrap makes the command to be executed with privilege escalation. The command is a simple command, like
+// "rm -rf /srv/app" or `sh -c '...'`, same as would be prefixed with "sudo". With password, the wrapped command
+// prints the marker to stderr before running the command, the marker separates the password exchange
+// from the command itself. Prompts of su and doas can't be set, so with password they run with LC_ALL=C
+// to get the prompt not localized, and LC_ALL is unset for the command itself.
+func (b *Become) Wrap(cmd string) string {
+	user := b.User
+	if b.Method == "su" {
+		// su runs the command as a shell string, the marker is printed by the same shell
+		if user == "" {
+			user = "root"
+		}
+		if b.Password == "" {
+			return fmt.Sprintf("su %s -c %s", user, ShellQuote(cmd))
+		}
+		cmd = fmt.Sprintf("echo %s >&2; unset LC_ALL; %s", b.marker(), cmd)
+		return fmt.Sprintf("LC_ALL=C su %s -c %s", user, ShellQuote(cmd))
+	}
+
+	if b.Password != "" {
+		unset := ""
+		if b.Method == "doas" {
+			unset = "unset LC_ALL; " // sudo prompt is set with -p, no LC_ALL override for it
+		}
+		cmd = fmt.Sprintf(`sh -c 'echo %s >&2; %sexec "$@"' sh %s`, b.marker(), unset, cmd)
+	}
+	opts := ""
+	if b.Method != "doas" && b.Password != "" {
+		opts += fmt.Sprintf(" -S -p '[spot-%s] password: '", b.token)
+	}
+	if user != "" {
+		opts += " -u " + user
+	}
+	if b.Method == "doas" {
+		if b.Password != "" {
+			return "LC_ALL=C doas" + opts + " " + cmd
+		}
+		return "doas" + opts + " " + cmd
+	}
+	return "sudo" + opts + " " + cmd
+}
+
+// NeedsTTY returns true if the password can be read by the method from the terminal only
+func (b *Become) NeedsTTY() bool {
+	return b.Password != "" && b.Method != "sudo"
+}
+
+func (b *Become) marker() string {
+	return "spot-become-" + b.token
+}
+
+// becomeSession handles the password exchange of a single run of the wrapped command. It watches stdout and stderr
+// of the command for the password prompt and the marker, strips them from the output, and provides stdin of
+// the command. Stdin sends the password on the prompt and passes the original input after the marker.
+// If the prompt repeats, i.e. the password is rejected, stdin is closed, so the original input is never sent
+// as a password.
+type becomeSession struct {
+	become *Become
+	input  io.Reader
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	prompted bool   // prompt seen, password to be sent
+	sent     bool   // password sent
+	passed   bool   // marker seen, the command is running
+	failed   bool   // password rejected or the command finished, no input anymore
+	pending  []byte // part of the password not read yet
+}
+
+func newBecomeSession(b *Become, input io.Reader) *becomeSession {
+	res := &becomeSession{become: b, input: input}
+	res.cond = sync.NewCond(&res.mu)
+	return res
+}
+
+// Read implements io.Reader, blocks until the password is requested or the command started
+func (s *becomeSession) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for {
+		if len(s.pending) > 0 {
+			n := copy(p, s.pending)
+			s.pending = s.pending[n:]
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.failed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		if s.passed {
+			break
+		}
+		if s.prompted && !s.sent {
+			s.sent, s.pending = true, []byte(s.become.Password+"\n")
+			continue
+		}
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+
+	if s.input == nil {
+		return 0, io.EOF
+	}
+	return s.input.Read(p)
+}
+
+// Close stops the input, unblocking Read
+func (s *becomeSession) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.cond.Broadcast()
+}
+
+// Writer wraps the output stream of the command, stripping the prompt and the marker
+func (s *becomeSession) Writer(wr io.Writer) io.Writer {
+	return &becomeWriter{session: s, wr: wr}
+}
+
+func (s *becomeSession) onPrompt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sent {
+		s.failed = true // prompt repeated, password rejected
+	}
+	s.prompted = true
+	s.cond.Broadcast()
+}
+
+func (s *becomeSession) onMarker() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passed = true
+	s.cond.Broadcast()
+}
+
+func (s *becomeSession) started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.passed
+}
+
+// becomeWriter passes the output of the command through, except the password prompts and the marker line.
+// Until the marker, the output is processed line by line, the incomplete line is checked for the prompt.
+type becomeWriter struct {
+	session *becomeSession
+	wr      io.Writer
+	buf     []byte
+	done    bool // marker seen on this stream, the rest passed as is
+}
+
+// Write implements io.Writer
+func (w *becomeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if !w.done && w.session.started() {
+		// the marker is seen on the other stream, no prompts expected anymore
+		data := append(w.buf, p...)
+		w.done, w.buf = true, nil
+		if _, err := w.wr.Write(data); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	if w.done {
+		return w.wr.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	marker := w.session.become.marker()
+	for len(w.buf) > 0 {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			if becomePromptRe.Match(w.buf) {
+				w.buf = w.buf[:0]
+				w.session.onPrompt()
+			}
+			return n, nil
+		}
+		line := w.buf[:idx+1]
+		w.buf = w.buf[idx+1:]
+		switch {
+		case strings.TrimSpace(string(line)) == marker:
+			w.session.onMarker()
+			w.done = true
+			rest := w.buf
+			w.buf = nil
+			if len(rest) > 0 {
+				if _, err := w.wr.Write(rest); err != nil {
+					return 0, err
+				}
+			}
+			return n, nil
+		case len(bytes.TrimSpace(line)) == 0:
+			// empty line printed after the password, skip
+		default:
+			if _, err := w.wr.Write(line); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
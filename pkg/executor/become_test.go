@@ -0,0 +1,123 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBecome_Wrap(t *testing.T) {
+	tbl := []struct {
+		name   string
+		become Become
+		res    string
+	}{
+		{"sudo", Become{Method: "sudo"}, "sudo rm -rf /srv/app"},
+		{"sudo as user", Become{Method: "sudo", User: "app"}, "sudo -u app rm -rf /srv/app"},
+		{"sudo with password", Become{Method: "sudo", Password: "pass", token: "t1"},
+			`sudo -S -p '[spot-t1] password: ' sh -c 'echo spot-become-t1 >&2; exec "$@"' sh rm -rf /srv/app`},
+		{"sudo as user with password", Become{Method: "sudo", User: "app", Password: "pass", token: "t1"},
+			`sudo -S -p '[spot-t1] password: ' -u app sh -c 'echo spot-become-t1 >&2; exec "$@"' sh rm -rf /srv/app`},
+		{"doas", Become{Method: "doas"}, "doas rm -rf /srv/app"},
+		{"doas as user with password", Become{Method: "doas", User: "app", Password: "pass", token: "t1"},
+			`LC_ALL=C doas -u app sh -c 'echo spot-become-t1 >&2; unset LC_ALL; exec "$@"' sh rm -rf /srv/app`},
+		{"su", Become{Method: "su"}, `su root -c 'rm -rf /srv/app'`},
+		{"su as user with password", Become{Method: "su", User: "app", Password: "pass", token: "t1"},
+			`LC_ALL=C su app -c 'echo spot-become-t1 >&2; unset LC_ALL; rm -rf /srv/app'`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.res, tt.become.Wrap("rm -rf /srv/app"))
+		})
+	}
+
+	t.Run("su command passed as is", func(t *testing.T) {
+		b := Become{Method: "su"}
+		wrapped := b.Wrap(`printf '%s|' "it's" "a	b" "привет" "$HOME"`)
+		require.True(t, strings.HasPrefix(wrapped, "su root -c "), wrapped)
+		// run the command the way su does, with the shell getting the argument of -c
+		out, err := exec.Command("sh", "-c", "sh -c "+strings.TrimPrefix(wrapped, "su root -c ")).Output() //nolint
+		require.NoError(t, err)
+		assert.Equal(t, "it's|a\tb|привет|"+os.Getenv("HOME")+"|", string(out))
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		b := NewBecome("", "", "pass")
+		assert.Equal(t, "sudo", b.Method)
+		assert.Len(t, b.token, 16)
+		assert.False(t, b.NeedsTTY())
+		assert.True(t, NewBecome("su", "", "pass").NeedsTTY())
+		assert.False(t, NewBecome("doas", "", "").NeedsTTY())
+		assert.NotEqual(t, b.token, NewBecome("", "", "pass").token)
+	})
+}
+
+func TestLocal_RunWithBecome(t *testing.T) {
+	ctx := context.Background()
+	svc := &Local{}
+	b := &Become{Method: "sudo", Password: "pass1", token: "test"}
+
+	t.Run("password on prompt", func(t *testing.T) {
+		cmd := `printf '[spot-test] password: ' >&2; read -r pw; [ "$pw" = "pass1" ] || exit 1; ` +
+			`echo spot-become-test >&2; read -r in; echo "ok $in"; echo "err $in" >&2`
+		res, err := svc.Run(ctx, cmd, &RunOpts{Become: b, Stdin: strings.NewReader("input1\n")})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ok input1"}, res.Stdout)
+		assert.Equal(t, []string{"err input1"}, res.Stderr)
+	})
+
+	t.Run("no prompt, password not consumed", func(t *testing.T) {
+		cmd := `echo spot-become-test >&2; read -r in; echo "in: $in"`
+		res, err := svc.Run(ctx, cmd, &RunOpts{Become: b, Stdin: strings.NewReader("input1\n")})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"in: input1"}, res.Stdout)
+	})
+
+	t.Run("password rejected", func(t *testing.T) {
+		cmd := `printf 'Password: ' >&2; read -r pw; printf 'Password: ' >&2; read -r pw2 || echo "no input" >&2; exit 1`
+		res, err := svc.Run(ctx, cmd, &RunOpts{Become: b, Stdin: strings.NewReader("secret-input\n")})
+		require.Error(t, err)
+		assert.Equal(t, 1, res.ExitCode)
+		assert.Equal(t, []string{"no input"}, res.Stderr)
+		assert.NotContains(t, err.Error(), "pass1")
+		assert.NotContains(t, err.Error(), "secret-input")
+	})
+
+	t.Run("password requires terminal", func(t *testing.T) {
+		_, err := svc.Run(ctx, "true", &RunOpts{Become: &Become{Method: "su", Password: "pass1", token: "test"}})
+		require.EqualError(t, err, "become su with password requires terminal, not supported locally")
+	})
+}
+
+func TestBecomeWriter(t *testing.T) {
+	s := newBecomeSession(&Become{Password: "pass1", token: "test"}, nil)
+	buf := bytes.Buffer{}
+	wr := s.Writer(&buf)
+
+	write := func(parts ...string) {
+		for _, p := range parts {
+			n, err := wr.Write([]byte(p))
+			require.NoError(t, err)
+			assert.Equal(t, len(p), n)
+		}
+	}
+
+	write("[spot-test] pass", "word: ")
+	out := make([]byte, 16)
+	n, err := s.Read(out)
+	require.NoError(t, err)
+	assert.Equal(t, "pass1\n", string(out[:n]), "password sent on prompt")
+
+	write("\n", "spot-become-", "test\nline1\n", "line2\n")
+	assert.Equal(t, "line1\nline2\n", buf.String())
+	assert.True(t, s.started())
+	_, err = s.Read(out)
+	assert.ErrorIs(t, err, io.EOF, "no input after the marker")
+}
@@ -1,23 +1,63 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+// ssh auth methods supported by Connector, DefaultAuthOrder lists them in the default order
+const (
+	AuthAgent               = "agent"
+	AuthKey                 = "key"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// DefaultAuthOrder is the order of ssh auth methods used if not set with WithAuthOrder.
+var DefaultAuthOrder = []string{AuthAgent, AuthKey, AuthPassword, AuthKeyboardInteractive}
+
+// PromptFunc asks the user for a value, like ssh password or passphrase of the private key.
+// Echo is false for secret values, which should not be shown on input.
+type PromptFunc func(question string, echo bool) (string, error)
+
 // Connector provides factory methods to create Remote executor. Each executor is connected to a single SSH hostAddr.
 type Connector struct {
 	privateKey  string
 	timeout     time.Duration
 	enableAgent bool
+	password    string     // password for password and keyboard-interactive auth
+	passphrase  string     // passphrase of encrypted private key
+	authOrder   []string   // auth methods in order of use, set explicitly with WithAuthOrder
+	prompt      PromptFunc // asks for the password and passphrase if not set, nothing asked if nil
+
+	mu             sync.Mutex           // serializes prompts and protects values loaded on the first connection
+	keys           map[string]loadedKey // private keys by path, parsed once, as they may ask for the passphrase
+	promptPassword string               // password entered on prompt, asked once for all hosts until rejected
+}
+
+// ConnectOpts defines options of a single connection, nil for the defaults of the Connector.
+type ConnectOpts struct {
+	SSHKey  string // private key of the host, replaces the key of the Connector
+	SSHCert string // user certificate of the key, <key>-cert.pub is used if exists
+}
+
+type loadedKey struct {
+	signer ssh.Signer
+	err    error
 }
 
 // NewConnector creates a new Connector for a given user and private key.
@@ -29,9 +69,6 @@ func NewConnector(privateKey string, timeout time.Duration) (res *Connector, err
 		return res, nil
 	}
 	log.Printf("[DEBUG] use private key %q", privateKey)
-	if _, err := os.Stat(privateKey); os.IsNotExist(err) {
-		return nil, fmt.Errorf("private key file %q does not exist", privateKey)
-	}
 	return res, nil
 }
 
@@ -42,10 +79,54 @@ func (c *Connector) WithAgent() *Connector {
 	return c
 }
 
+// WithPassword sets password for password and keyboard-interactive authentication.
+func (c *Connector) WithPassword(password string) *Connector {
+	log.Printf("[DEBUG] use ssh password")
+	c.password = password
+	return c
+}
+
+// WithPassphrase sets passphrase of the encrypted private key.
+func (c *Connector) WithPassphrase(passphrase string) *Connector {
+	c.passphrase = passphrase
+	return c
+}
+
+// WithPrompt sets the function asking the user for the password, the passphrase of the private key
+// and keyboard-interactive answers, if they are not set.
+func (c *Connector) WithPrompt(prompt PromptFunc) *Connector {
+	c.prompt = prompt
+	return c
+}
+
+// WithAuthOrder sets ssh auth methods and the order they are tried in. Only the listed methods are used,
+// i.e. listed agent is used without WithAgent, and listed password is asked with prompt if not set.
+// Without explicit order, DefaultAuthOrder is used with methods having credentials only.
+func (c *Connector) WithAuthOrder(methods []string) (*Connector, error) {
+	known := map[string]bool{}
+	for _, m := range DefaultAuthOrder {
+		known[m] = true
+	}
+	seen := map[string]bool{}
+	for _, m := range methods {
+		if !known[m] {
+			return nil, fmt.Errorf("unknown ssh auth method %q, allowed: %s", m, strings.Join(DefaultAuthOrder, ", "))
+		}
+		if seen[m] {
+			return nil, fmt.Errorf("duplicate ssh auth method %q", m)
+		}
+		seen[m] = true
+	}
+	log.Printf("[DEBUG] ssh auth order: %s", strings.Join(methods, ", "))
+	c.authOrder = methods
+	return c, nil
+}
+
 // Connect connects to a remote hostAddr and returns a remote executer, caller must close.
-func (c *Connector) Connect(ctx context.Context, hostAddr, hostName, user string) (*Remote, error) {
+// opts can set the key and certificate of the host, nil for the key of the Connector.
+func (c *Connector) Connect(ctx context.Context, hostAddr, hostName, user string, opts *ConnectOpts) (*Remote, error) {
 	log.Printf("[DEBUG] connect to %q (%s), user %q", hostAddr, hostName, user)
-	client, err := c.sshClient(ctx, hostAddr, user)
+	client, err := c.sshClient(ctx, hostAddr, user, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -53,61 +134,157 @@ func (c *Connector) Connect(ctx context.Context, hostAddr, hostName, user string
 }
 
 // sshClient creates ssh client connected to remote server. Caller must close session.
-func (c *Connector) sshClient(ctx context.Context, host, user string) (session *ssh.Client, err error) {
+func (c *Connector) sshClient(ctx context.Context, host, user string, opts *ConnectOpts) (session *ssh.Client, err error) {
 	log.Printf("[DEBUG] create ssh session to %s, user %s", host, user)
 	if !strings.Contains(host, ":") {
 		host += ":22"
 	}
 
+	// auth methods are made before dialing, so expired certificate or bad key fail without connection attempt
+	conf, trace, err := c.sshConfig(user, host, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ssh config: %w", err)
+	}
+	defer trace.close()
+
 	dialer := net.Dialer{Timeout: c.timeout}
 	conn, err := dialer.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial: %w", err)
 	}
 
-	conf, err := c.sshConfig(user, c.privateKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create ssh config: %w", err)
-	}
 	ncc, chans, reqs, err := ssh.NewClientConn(conn, host, conf)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client connection to %s: %v", host, err)
+		if trace.rejected(AuthPassword) || trace.rejected(AuthKeyboardInteractive) {
+			c.forgetPassword() // don't send the rejected password to other hosts, ask it again
+		}
+		return nil, fmt.Errorf("failed to create client connection to %s: %v, auth methods: %s", host, err, trace)
 	}
 	client := ssh.NewClient(ncc, chans, reqs)
 	log.Printf("[DEBUG] ssh session created to %s", host)
 	return client, nil
 }
 
-func (c *Connector) sshConfig(user, privateKeyPath string) (*ssh.ClientConfig, error) {
+// sshConfig makes ssh client config with auth methods in the configured order. Methods which can't be used,
+// like the agent without socket or the key with wrong passphrase, are skipped with the reason recorded to the trace.
+// Returns error if no auth methods left.
+func (c *Connector) sshConfig(user, host string, opts *ConnectOpts) (*ssh.ClientConfig, *authTrace, error) {
+	order, explicit := c.authOrder, len(c.authOrder) > 0
+	if !explicit {
+		order = DefaultAuthOrder
+	}
+	keyPath, certPath := c.privateKey, ""
+	if opts != nil && opts.SSHKey != "" {
+		keyPath = expandHome(opts.SSHKey)
+	}
+	if opts != nil && opts.SSHCert != "" {
+		certPath = expandHome(opts.SSHCert)
+	}
+	trace := &authTrace{}
 
-	// getAuth returns a list of ssh.AuthMethod to be used for authentication.
-	// if ssh agent is enabled, it will be used, otherwise private key will be used.
-	getAuth := func() (auth []ssh.AuthMethod, err error) {
-		if privateKeyPath == "" || c.enableAgent {
-			if aconn, e := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); e == nil {
-				auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(aconn).Signers))
-				log.Printf("[DEBUG] ssh agent found at %s", os.Getenv("SSH_AUTH_SOCK"))
-			} else {
-				return nil, fmt.Errorf("unable to connect to ssh agent: %w", e)
-			}
-			return auth, nil
+	// agent and key are both "publickey" method, ssh client tries each method once, so their signers are combined
+	var signers []func() ([]ssh.Signer, error)
+	var auth []ssh.AuthMethod
+	pubKeyPos := -1
+	addPubKey := func(method string, fn func() ([]ssh.Signer, error)) {
+		signers = append(signers, func() ([]ssh.Signer, error) {
+			trace.set(method, "rejected by server")
+			return fn()
+		})
+		if pubKeyPos < 0 {
+			pubKeyPos = len(auth)
+			auth = append(auth, nil) // placeholder for combined public keys method
 		}
+	}
 
-		key, err := os.ReadFile(privateKeyPath) // nolint
-		if err != nil {
-			return nil, fmt.Errorf("unable to read private key: %vw", err)
-		}
-		signer, err := ssh.ParsePrivateKey(key)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse private key: %w", err)
+	for _, method := range order {
+		switch method {
+		case AuthAgent:
+			if !explicit && !c.enableAgent {
+				continue
+			}
+			trace.add(method)
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			aconn, err := net.Dial("unix", sock)
+			if err != nil {
+				trace.set(method, fmt.Sprintf("unable to connect to ssh agent: %v", err))
+				continue
+			}
+			log.Printf("[DEBUG] ssh agent found at %s", sock)
+			trace.closers = append(trace.closers, aconn)
+			addPubKey(method, agent.NewClient(aconn).Signers)
+		case AuthKey:
+			if keyPath == "" {
+				if explicit {
+					trace.add(method)
+					trace.set(method, "private key is not set")
+				}
+				continue
+			}
+			trace.add(method)
+			// missing key is checked here and not on NewConnector, as it is not needed for other auth methods
+			if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+				trace.set(method, fmt.Sprintf("private key file %q does not exist", keyPath))
+				continue
+			}
+			keySigners, certErr, err := c.keySigners(keyPath, certPath, time.Now())
+			if err != nil {
+				trace.set(method, err.Error())
+				continue
+			}
+			if certErr == nil {
+				addPubKey(method, func() ([]ssh.Signer, error) { return keySigners, nil })
+				continue
+			}
+			// bad certificate is not offered, but the plain key still is, the certificate error is kept for the report
+			log.Printf("[WARN] %v, use key %s without certificate", certErr, keyPath)
+			trace.set(method, certErr.Error())
+			addPubKey(method, func() ([]ssh.Signer, error) {
+				trace.set(AuthKey, certErr.Error()+", plain key rejected by server")
+				return keySigners, nil
+			})
+		case AuthPassword, AuthKeyboardInteractive:
+			if !explicit && c.password == "" {
+				continue
+			}
+			trace.add(method)
+			if c.password == "" && c.prompt == nil {
+				trace.set(method, "password is not set and can't be asked")
+				continue
+			}
+			if method == AuthPassword {
+				auth = append(auth, ssh.PasswordCallback(func() (string, error) {
+					pwd, err := c.getPassword(user, host)
+					if err != nil {
+						trace.set(AuthPassword, err.Error())
+						return "", err
+					}
+					trace.set(AuthPassword, "rejected by server")
+					return pwd, nil
+				}))
+				continue
+			}
+			auth = append(auth, ssh.KeyboardInteractive(c.keyboardInteractive(user, host, trace)))
 		}
-		auth = append(auth, ssh.PublicKeys(signer))
-		return auth, nil
 	}
 
-	auth, err := getAuth()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get ssh auth: %w", err)
+	if pubKeyPos >= 0 {
+		auth[pubKeyPos] = ssh.PublicKeysCallback(func() (res []ssh.Signer, err error) {
+			for _, fn := range signers {
+				ss, e := fn()
+				if e != nil {
+					log.Printf("[WARN] can't get ssh keys: %v", e)
+					continue
+				}
+				res = append(res, ss...)
+			}
+			return res, nil
+		})
+	}
+
+	if len(auth) == 0 {
+		trace.close()
+		return nil, nil, fmt.Errorf("no ssh auth methods available, auth methods: %s", trace)
 	}
 
 	sshConfig := &ssh.ClientConfig{
@@ -115,6 +292,254 @@ func (c *Connector) sshConfig(user, privateKeyPath string) (*ssh.ClientConfig, e
 		Auth:            auth,
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // nolint
 	}
+	return sshConfig, trace, nil
+}
 
-	return sshConfig, nil
+// keySigners returns signers of the private key, with the certificate signer first if the key has a certificate.
+// The certificate is certPath or <key>-cert.pub if exists. It is read on each call, as short-lived certificates
+// can be renewed during the run, and checked to be valid at the given time. Invalid certificate is returned
+// as certErr, with the signer of the plain key only.
+func (c *Connector) keySigners(keyPath, certPath string, now time.Time) (signers []ssh.Signer, certErr, err error) {
+	signer, err := c.keySigner(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if certPath == "" {
+		certPath = keyPath + "-cert.pub"
+		if _, err := os.Stat(certPath); err != nil {
+			return []ssh.Signer{signer}, nil, nil // no certificate for the key
+		}
+	}
+	certSigner, err := newCertSigner(certPath, signer, now)
+	if err != nil {
+		return []ssh.Signer{signer}, err, nil
+	}
+	return []ssh.Signer{certSigner, signer}, nil, nil
+}
+
+// keySigner returns signer of the private key. Each key is loaded on the first call, if the key is encrypted,
+// the passphrase is taken from WithPassphrase or asked with prompt.
+func (c *Connector) keySigner(keyPath string) (ssh.Signer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.keys[keyPath]; ok {
+		return k.signer, k.err
+	}
+	signer, err := c.loadKey(keyPath)
+	if c.keys == nil {
+		c.keys = map[string]loadedKey{}
+	}
+	c.keys[keyPath] = loadedKey{signer: signer, err: err}
+	return signer, err
+}
+
+func (c *Connector) loadKey(keyPath string) (ssh.Signer, error) {
+	key, err := os.ReadFile(keyPath) // nolint
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer, nil
+	}
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+
+	passphrase := c.passphrase
+	if passphrase == "" {
+		if c.prompt == nil {
+			return nil, fmt.Errorf("private key is encrypted, passphrase is not set")
+		}
+		if passphrase, err = c.prompt(fmt.Sprintf("Enter passphrase for key %s: ", keyPath), false); err != nil {
+			return nil, fmt.Errorf("can't get passphrase for private key: %w", err)
+		}
+	}
+	if signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase)); err != nil {
+		return nil, fmt.Errorf("unable to parse private key with passphrase: %w", err)
+	}
+	return signer, nil
+}
+
+// newCertSigner makes signer of the user certificate for the key. The certificate should match the key
+// and be valid at the given time.
+func newCertSigner(certPath string, signer ssh.Signer, now time.Time) (ssh.Signer, error) {
+	data, err := os.ReadFile(certPath) // nolint
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate %s: %w", certPath, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", certPath)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate %s is not a user certificate", certPath)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("certificate %s doesn't match private key", certPath)
+	}
+	if cert.ValidAfter > 0 && cert.ValidAfter <= math.MaxInt64 && now.Before(time.Unix(int64(cert.ValidAfter), 0)) {
+		return nil, fmt.Errorf("certificate %s is not valid before %s", certPath,
+			time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339))
+	}
+	if cert.ValidBefore <= math.MaxInt64 && !now.Before(time.Unix(int64(cert.ValidBefore), 0)) {
+		return nil, fmt.Errorf("certificate %s expired at %s", certPath, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+	res, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("can't make signer of certificate %s: %w", certPath, err)
+	}
+	log.Printf("[DEBUG] use certificate %s, key id %q", certPath, cert.KeyId)
+	return res, nil
+}
+
+// expandHome replaces leading ~ of the path with home directory of the current user
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// getPassword returns the password set with WithPassword, or asks it with prompt once for all hosts.
+// The prompted password is kept until rejected by any host, see forgetPassword.
+func (c *Connector) getPassword(user, host string) (string, error) {
+	if c.password != "" {
+		return c.password, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.promptPassword != "" {
+		return c.promptPassword, nil
+	}
+	if c.prompt == nil {
+		return "", fmt.Errorf("password is not set")
+	}
+	pwd, err := c.prompt(fmt.Sprintf("%s@%s's password: ", user, host), false)
+	if err != nil {
+		return "", fmt.Errorf("can't get password: %w", err)
+	}
+	c.promptPassword = pwd
+	return pwd, nil
+}
+
+// forgetPassword drops the prompted password, so it is asked again on the next connection instead of sending
+// the rejected password to all hosts, which can lock the user out.
+func (c *Connector) forgetPassword() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.promptPassword = ""
+}
+
+// keyboardInteractive makes challenge handler of keyboard-interactive auth. Password questions are answered
+// with the password, other questions, like one-time codes, are asked with prompt.
+func (c *Connector) keyboardInteractive(user, host string, trace *authTrace) ssh.KeyboardInteractiveChallenge {
+	return func(_, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers, err := c.answerQuestions(user, host, instruction, questions, echos)
+		if err != nil {
+			trace.set(AuthKeyboardInteractive, err.Error())
+			return nil, err
+		}
+		if len(questions) > 0 {
+			trace.set(AuthKeyboardInteractive, "rejected by server")
+		}
+		return answers, nil
+	}
+}
+
+// answerQuestions answers keyboard-interactive questions, with the password or asked with prompt
+func (c *Connector) answerQuestions(user, host, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) == 0 {
+		return nil, nil // informational message, no answers expected
+	}
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		if !echos[i] && strings.Contains(strings.ToLower(q), "password") {
+			pwd, err := c.getPassword(user, host)
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = pwd
+			continue
+		}
+		if c.prompt == nil {
+			return nil, fmt.Errorf("can't answer %q, prompt is not available", strings.TrimSpace(q))
+		}
+		c.mu.Lock()
+		if instruction != "" && i == 0 {
+			q = instruction + "\n" + q
+		}
+		ans, err := c.prompt(q, echos[i])
+		c.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("can't get answer for %q: %w", strings.TrimSpace(q), err)
+		}
+		answers[i] = ans
+	}
+	return answers, nil
+}
+
+// authTrace collects the state of auth methods of a single connection, to report why the authentication failed.
+// Methods not marked as failed are reported as not tried, i.e. not accepted by the server or not reached.
+type authTrace struct {
+	mu      sync.Mutex
+	methods []string
+	status  map[string]string
+	closers []io.Closer // resources used by auth methods, like ssh agent connection
+}
+
+func (t *authTrace) add(method string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.methods = append(t.methods, method)
+}
+
+func (t *authTrace) set(method, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status == nil {
+		t.status = map[string]string{}
+	}
+	t.status[method] = status
+}
+
+// rejected returns true if the method was tried and rejected by server
+func (t *authTrace) rejected(method string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status[method] == "rejected by server"
+}
+
+// String returns the status of all methods, like "agent: rejected by server; password: not tried"
+func (t *authTrace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.methods) == 0 {
+		return "none"
+	}
+	res := make([]string, 0, len(t.methods))
+	for _, m := range t.methods {
+		status, ok := t.status[m]
+		if !ok {
+			status = "not tried"
+		}
+		res = append(res, m+": "+status)
+	}
+	return strings.Join(res, "; ")
+}
+
+func (t *authTrace) close() {
+	for _, c := range t.closers {
+		_ = c.Close()
+	}
+	t.closers = nil
 }
@@ -1,11 +1,21 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestConnector_Connect(t *testing.T) {
@@ -16,7 +26,7 @@ func TestConnector_Connect(t *testing.T) {
 	t.Run("good connection", func(t *testing.T) {
 		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 		require.NoError(t, err)
-		sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+		sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 		require.NoError(t, err)
 		defer sess.Close()
 	})
@@ -24,19 +34,347 @@ func TestConnector_Connect(t *testing.T) {
 	t.Run("bad user", func(t *testing.T) {
 		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 		require.NoError(t, err)
-		_, err = c.Connect(ctx, hostAndPort, "h1", "test33")
+		_, err = c.Connect(ctx, hostAndPort, "h1", "test33", nil)
 		require.ErrorContains(t, err, "ssh: unable to authenticate")
 	})
 
 	t.Run("bad key", func(t *testing.T) {
-		_, err := NewConnector("testdata/test_ssh_key33", time.Second*10)
-		require.ErrorContains(t, err, "private key file \"testdata/test_ssh_key33\" does not exist", "test")
+		c, err := NewConnector("testdata/test_ssh_key33", time.Second*10)
+		require.NoError(t, err)
+		_, err = c.Connect(ctx, hostAndPort, "h1", "test", nil)
+		require.ErrorContains(t, err, "key: private key file \"testdata/test_ssh_key33\" does not exist", "test")
 	})
 
 	t.Run("wrong port", func(t *testing.T) {
 		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 		require.NoError(t, err)
-		_, err = c.Connect(ctx, "127.0.0.1:12345", "h1", "test")
+		_, err = c.Connect(ctx, "127.0.0.1:12345", "h1", "test", nil)
 		require.ErrorContains(t, err, "failed to dial: dial tcp 127.0.0.1:12345")
 	})
 }
+
+func TestConnector_Auth(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/no-such-agent.sock")
+	encPub := authorizedKey(t, "testdata/test_ssh_key_enc.pub")
+
+	srvConf := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, pwd []byte) (*ssh.Permissions, error) {
+			if string(pwd) == "pass1" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("bad password")
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), encPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+		KeyboardInteractiveCallback: func(_ ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			ans, err := client("", "", []string{"Password: ", "Code: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+			if ans[0] == "pass1" && ans[1] == "123456" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("bad answers")
+		},
+	}
+	addr := startTestSSHServer(t, srvConf, nil)
+
+	connect := func(t *testing.T, c *Connector) error {
+		sess, err := c.Connect(ctx, addr, "h1", "test", nil)
+		if err != nil {
+			return err
+		}
+		return sess.Close()
+	}
+
+	t.Run("password with rejected key", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+		require.NoError(t, err)
+		require.NoError(t, connect(t, c.WithPassword("pass1")))
+	})
+
+	t.Run("key used with unavailable agent", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key_enc", time.Second*10)
+		require.NoError(t, err)
+		require.NoError(t, connect(t, c.WithAgent().WithPassphrase("passphrase1")))
+	})
+
+	t.Run("encrypted key with passphrase prompt", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key_enc", time.Second*10)
+		require.NoError(t, err)
+		var prompts int32
+		c = c.WithPrompt(func(question string, echo bool) (string, error) {
+			atomic.AddInt32(&prompts, 1)
+			assert.Equal(t, "Enter passphrase for key testdata/test_ssh_key_enc: ", question)
+			assert.False(t, echo)
+			return "passphrase1", nil
+		})
+		require.NoError(t, connect(t, c))
+		require.NoError(t, connect(t, c))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&prompts), "passphrase asked once")
+	})
+
+	t.Run("encrypted key without passphrase", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key_enc", time.Second*10)
+		require.NoError(t, err)
+		err = connect(t, c)
+		require.EqualError(t, err, "failed to create ssh config: no ssh auth methods available, "+
+			"auth methods: key: private key is encrypted, passphrase is not set")
+	})
+
+	t.Run("password prompt with explicit order", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+		require.NoError(t, err)
+		var prompts int32
+		c, err = c.WithPrompt(func(question string, echo bool) (string, error) {
+			atomic.AddInt32(&prompts, 1)
+			assert.Equal(t, "test@"+addr+"'s password: ", question)
+			return "pass1", nil
+		}).WithAuthOrder([]string{AuthPassword})
+		require.NoError(t, err)
+		require.NoError(t, connect(t, c))
+		require.NoError(t, connect(t, c))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&prompts), "password asked once")
+	})
+
+	t.Run("password only without key file", func(t *testing.T) {
+		c, err := NewConnector("testdata/no-such-key", time.Second*10)
+		require.NoError(t, err)
+		c, err = c.WithPassword("pass1").WithAuthOrder([]string{AuthPassword})
+		require.NoError(t, err)
+		require.NoError(t, connect(t, c))
+
+		c, err = NewConnector("testdata/no-such-key", time.Second*10)
+		require.NoError(t, err)
+		err = connect(t, c.WithPassword("bad"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `key: private key file "testdata/no-such-key" does not exist; password: rejected by server`)
+	})
+
+	t.Run("rejected password prompt asked again", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+		require.NoError(t, err)
+		answers := []string{"typo", "pass1"}
+		var prompts int32
+		c, err = c.WithPrompt(func(question string, echo bool) (string, error) {
+			n := atomic.AddInt32(&prompts, 1)
+			return answers[n-1], nil
+		}).WithAuthOrder([]string{AuthPassword})
+		require.NoError(t, err)
+		require.Error(t, connect(t, c), "typo rejected")
+		require.NoError(t, connect(t, c), "asked again, not reused")
+		require.NoError(t, connect(t, c))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&prompts), "accepted password kept")
+	})
+
+	t.Run("keyboard interactive", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+		require.NoError(t, err)
+		c, err = c.WithPassword("pass1").WithPrompt(func(question string, echo bool) (string, error) {
+			assert.Equal(t, "Code: ", question)
+			assert.True(t, echo)
+			return "123456", nil
+		}).WithAuthOrder([]string{AuthKeyboardInteractive})
+		require.NoError(t, err)
+		require.NoError(t, connect(t, c))
+	})
+
+	t.Run("all methods failed", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+		require.NoError(t, err)
+		c, err = c.WithPassword("bad").WithAuthOrder([]string{AuthAgent, AuthKey, AuthPassword, AuthKeyboardInteractive})
+		require.NoError(t, err)
+		err = connect(t, c)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "auth methods: agent: unable to connect to ssh agent: dial unix /tmp/no-such-agent.sock: "+
+			"connect: no such file or directory; key: rejected by server; password: rejected by server; "+
+			"keyboard-interactive: can't answer \"Code:\", prompt is not available")
+	})
+
+	t.Run("password rejected", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+		require.NoError(t, err)
+		c, err = c.WithPassword("bad").WithAuthOrder([]string{AuthKey, AuthPassword})
+		require.NoError(t, err)
+		err = connect(t, c)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ssh: unable to authenticate")
+		assert.True(t, strings.HasSuffix(err.Error(), "auth methods: key: rejected by server; password: rejected by server"), err.Error())
+	})
+
+	t.Run("bad auth order", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+		require.NoError(t, err)
+		_, err = c.WithAuthOrder([]string{"key", "token"})
+		require.EqualError(t, err, `unknown ssh auth method "token", allowed: agent, key, password, keyboard-interactive`)
+		_, err = c.WithAuthOrder([]string{"key", "key"})
+		require.EqualError(t, err, `duplicate ssh auth method "key"`)
+	})
+}
+
+// startTestSSHServer starts ssh server accepting connections with given config. New channels are passed to handle,
+// rejected if it is nil.
+func startTestSSHServer(t *testing.T, conf *ssh.ServerConfig, handle func(*ssh.ServerConn, ssh.NewChannel)) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	conf.AddHostKey(hostKey)
+
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lst.Close() })
+	go func() {
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sconn, chans, reqs, err := ssh.NewServerConn(conn, conf)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					if handle == nil {
+						_ = ch.Reject(ssh.Prohibited, "no sessions")
+						continue
+					}
+					go handle(sconn, ch)
+				}
+				_ = sconn.Close()
+			}()
+		}
+	}()
+	return lst.Addr().String()
+}
+
+func authorizedKey(t *testing.T, file string) ssh.PublicKey {
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	require.NoError(t, err)
+	return key
+}
+
+func TestConnector_Cert(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	require.NoError(t, err)
+	checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+		return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+	}}
+	addr := startTestSSHServer(t, &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}, nil)
+
+	// copy of the test key, so certificates can be placed next to it
+	dir := t.TempDir()
+	keyData, err := os.ReadFile("testdata/test_ssh_key")
+	require.NoError(t, err)
+	keyFile := dir + "/id_test"
+	require.NoError(t, os.WriteFile(keyFile, keyData, 0o600))
+	keySigner, err := ssh.ParsePrivateKey(keyData)
+	require.NoError(t, err)
+
+	writeCert := func(t *testing.T, file string, key ssh.PublicKey, validAfter, validBefore time.Time) {
+		cert := &ssh.Certificate{Key: key, CertType: ssh.UserCert, KeyId: "test", ValidPrincipals: []string{"test"},
+			ValidAfter: uint64(validAfter.Unix()), ValidBefore: uint64(validBefore.Unix())}
+		require.NoError(t, cert.SignCert(rand.Reader, ca))
+		require.NoError(t, os.WriteFile(file, ssh.MarshalAuthorizedKey(cert), 0o600))
+	}
+	connect := func(c *Connector, opts *ConnectOpts) error {
+		sess, err := c.Connect(ctx, addr, "h1", "test", opts)
+		if err != nil {
+			return err
+		}
+		return sess.Close()
+	}
+
+	t.Run("key without certificate rejected", func(t *testing.T) {
+		c, err := NewConnector(keyFile, time.Second*10)
+		require.NoError(t, err)
+		err = connect(c, nil)
+		require.ErrorContains(t, err, "auth methods: key: rejected by server")
+	})
+
+	t.Run("certificate next to key", func(t *testing.T) {
+		writeCert(t, keyFile+"-cert.pub", keySigner.PublicKey(), time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+		defer os.Remove(keyFile + "-cert.pub")
+		c, err := NewConnector(keyFile, time.Second*10)
+		require.NoError(t, err)
+		require.NoError(t, connect(c, nil))
+	})
+
+	t.Run("per-host key and certificate", func(t *testing.T) {
+		certFile := dir + "/host-cert.pub"
+		writeCert(t, certFile, keySigner.PublicKey(), time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+		c, err := NewConnector("testdata/test_ssh_key_enc", time.Second*10)
+		require.NoError(t, err)
+		require.NoError(t, connect(c, &ConnectOpts{SSHKey: keyFile, SSHCert: certFile}))
+		err = connect(c, nil)
+		require.ErrorContains(t, err, "key: private key is encrypted, passphrase is not set", "connector key used without opts")
+	})
+
+	t.Run("expired certificate", func(t *testing.T) {
+		certFile := dir + "/expired-cert.pub"
+		expired := time.Now().Add(-time.Minute).Truncate(time.Second)
+		writeCert(t, certFile, keySigner.PublicKey(), time.Now().Add(-time.Hour), expired)
+		c, err := NewConnector(keyFile, time.Second*10)
+		require.NoError(t, err)
+		err = connect(c, &ConnectOpts{SSHCert: certFile})
+		require.ErrorContains(t, err, fmt.Sprintf("auth methods: key: certificate %s expired at %s, "+
+			"plain key rejected by server", certFile, expired.Format(time.RFC3339)))
+	})
+
+	t.Run("invalid certificate, plain key accepted", func(t *testing.T) {
+		certFile := dir + "/expired2-cert.pub"
+		writeCert(t, certFile, keySigner.PublicKey(), time.Now().Add(-time.Hour), time.Now().Add(-time.Minute))
+		srvAddr := startTestSSHServer(t, &ssh.ServerConfig{
+			PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if bytes.Equal(key.Marshal(), keySigner.PublicKey().Marshal()) {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("unknown key")
+			}}, nil)
+		c, err := NewConnector(keyFile, time.Second*10)
+		require.NoError(t, err)
+		sess, err := c.Connect(ctx, srvAddr, "h1", "test", &ConnectOpts{SSHCert: certFile})
+		require.NoError(t, err)
+		require.NoError(t, sess.Close())
+	})
+
+	t.Run("certificate not valid yet", func(t *testing.T) {
+		certFile := dir + "/future-cert.pub"
+		writeCert(t, certFile, keySigner.PublicKey(), time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+		c, err := NewConnector(keyFile, time.Second*10)
+		require.NoError(t, err)
+		err = connect(c, &ConnectOpts{SSHCert: certFile})
+		require.ErrorContains(t, err, "auth methods: key: certificate "+certFile+" is not valid before")
+	})
+
+	t.Run("certificate of another key", func(t *testing.T) {
+		certFile := dir + "/other-cert.pub"
+		writeCert(t, certFile, authorizedKey(t, "testdata/test_ssh_key_enc.pub"), time.Now(), time.Now().Add(time.Hour))
+		c, err := NewConnector(keyFile, time.Second*10)
+		require.NoError(t, err)
+		err = connect(c, &ConnectOpts{SSHCert: certFile})
+		require.ErrorContains(t, err, "auth methods: key: certificate "+certFile+" doesn't match private key")
+	})
+
+	t.Run("not a certificate", func(t *testing.T) {
+		c, err := NewConnector(keyFile, time.Second*10)
+		require.NoError(t, err)
+		err = connect(c, &ConnectOpts{SSHCert: "testdata/test_ssh_key.pub"})
+		require.ErrorContains(t, err, "auth methods: key: testdata/test_ssh_key.pub is not a certificate")
+	})
+}
@@ -4,18 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/sftp"
+	"github.com/pmezard/go-difflib/difflib"
 )
 
+// maxDiffSize is the max size of a file to show content diff for
+const maxDiffSize = 64 * 1024
+
 // Dry is an executor for dry run, just prints commands and files to be copied, synced, deleted.
 // Useful for debugging and testing, doesn't actually execute anything.
+// If connected remote executor is set, it is used in read-only mode to show what upload and sync would change.
 type Dry struct {
 	hostAddr string
 	hostName string
 	secrets  []string
+	remote   *Remote
 }
 
 // NewDry creates new executor for dry run
@@ -23,13 +34,20 @@ func NewDry(hostAddr, hostName string) *Dry {
 	return &Dry{hostAddr: hostAddr, hostName: hostName}
 }
 
+// WithRemote sets connected remote executor to inspect remote files. It is used for reading only,
+// to list files upload and sync would change and to show content diffs. Nothing is written to the remote host.
+func (ex *Dry) WithRemote(remote *Remote) *Dry {
+	ex.remote = remote
+	return ex
+}
+
 // SetSecrets sets secrets for the executor
 func (ex *Dry) SetSecrets(secrets []string) {
 	ex.secrets = secrets
 }
 
 // Run shows the command content, doesn't execute it
-func (ex *Dry) Run(_ context.Context, cmd string, opts *RunOpts) (out []string, err error) {
+func (ex *Dry) Run(_ context.Context, cmd string, opts *RunOpts) (res RunResult, err error) {
 	log.Printf("[DEBUG] run %s", cmd)
 	outLog, _ := MakeOutAndErrWriters(ex.hostAddr, ex.hostName, opts != nil && opts.Verbose, ex.secrets)
 	var stdoutBuf bytes.Buffer
@@ -37,14 +55,14 @@ func (ex *Dry) Run(_ context.Context, cmd string, opts *RunOpts) (out []string,
 	mwr.Write([]byte(cmd)) //nolint
 	for _, line := range strings.Split(stdoutBuf.String(), "\n") {
 		if line != "" {
-			out = append(out, line)
+			res.Stdout = append(res.Stdout, line)
 		}
 	}
-	return out, nil
+	return res, nil
 }
 
 // Upload doesn't actually upload, just prints the command
-func (ex *Dry) Upload(_ context.Context, local, remote string, opts *UpDownOpts) (err error) {
+func (ex *Dry) Upload(ctx context.Context, local, remote string, opts *UpDownOpts) (err error) {
 	var mkdir bool
 	var exclude []string
 
@@ -54,6 +72,9 @@ func (ex *Dry) Upload(_ context.Context, local, remote string, opts *UpDownOpts)
 	}
 
 	log.Printf("[DEBUG] upload %s to %s, mkdir: %v, exclude: %v", local, remote, mkdir, exclude)
+	if !strings.Contains(remote, "spot-script") && ex.remote != nil && ex.remote.client != nil {
+		return ex.uploadDiff(ctx, local, remote, opts)
+	}
 	if strings.Contains(remote, "spot-script") {
 		// this is a temp script created by spot to perform script execution on remote host
 		outLog, outErr := MakeOutAndErrWriters(ex.hostAddr, ex.hostName, true, ex.secrets)
@@ -91,14 +112,92 @@ func (ex *Dry) Download(_ context.Context, remote, local string, opts *UpDownOpt
 }
 
 // Sync doesn't sync anything, just prints the command
-func (ex *Dry) Sync(_ context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
+func (ex *Dry) Sync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
 	del := opts != nil && opts.Delete
 	exclude := []string{}
 	if opts != nil {
 		exclude = opts.Exclude
 	}
+	if opts != nil && opts.Pull {
+		log.Printf("[DEBUG] sync pull %s to %s, delete: %v, exclude: %v", remoteDir, localDir, del, exclude)
+		if ex.remote == nil || ex.remote.client == nil {
+			return nil, nil
+		}
+		return ex.syncPullDiff(ctx, localDir, remoteDir, opts)
+	}
 	log.Printf("[DEBUG] sync %s to %s, delete: %v, exlcude: %v", localDir, remoteDir, del, exclude) //nolint
-	return nil, nil
+	if ex.remote == nil || ex.remote.client == nil {
+		return nil, nil
+	}
+
+	localFiles, err := ex.remote.getLocalFilesProperties(localDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
+	}
+	remoteFiles, err := ex.remote.getRemoteFilesProperties(ctx, remoteDir, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote files properties for %s: %w", remoteDir, err)
+	}
+
+	outLog, _ := MakeOutAndErrWriters(ex.hostAddr, ex.hostName, true, ex.secrets)
+	unmatchedFiles, deletedFiles := ex.remote.findUnmatchedFiles(localFiles, remoteFiles, exclude)
+	if opts != nil && opts.Checksum {
+		unmatchedFiles, err = ex.remote.findUnmatchedFilesByChecksum(ctx, localDir, remoteDir, localFiles, remoteFiles, exclude)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare checksums for %s: %w", localDir, err)
+		}
+	}
+	if opts != nil {
+		unmatchedFiles = withModeChanged(unmatchedFiles, localFiles, remoteFiles, exclude, opts.Attrs)
+	}
+	for _, file := range unmatchedFiles {
+		action := "upload"
+		if _, ok := remoteFiles[file]; ok {
+			action = "update"
+		}
+		fmt.Fprintf(outLog, "sync %s: %s -> %s", action, filepath.Join(localDir, file), filepath.Join(remoteDir, file)) //nolint
+	}
+	if del {
+		for _, file := range deletedFiles {
+			fmt.Fprintf(outLog, "sync delete: %s", filepath.Join(remoteDir, file)) //nolint
+		}
+	}
+	return unmatchedFiles, nil
+}
+
+// syncPullDiff prints remote files to be downloaded and local files to be deleted by sync with pull option
+func (ex *Dry) syncPullDiff(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
+	remoteFiles, err := ex.remote.getRemoteFilesProperties(ctx, remoteDir, opts.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote files properties for %s: %w", remoteDir, err)
+	}
+	localFiles := map[string]fileProperties{}
+	if _, err = os.Stat(localDir); err == nil {
+		if localFiles, err = ex.remote.getLocalFilesProperties(localDir); err != nil {
+			return nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
+		}
+	}
+
+	outLog, _ := MakeOutAndErrWriters(ex.hostAddr, ex.hostName, true, ex.secrets)
+	updatedFiles, deletedFiles := ex.remote.findUnmatchedFiles(remoteFiles, localFiles, opts.Exclude)
+	if opts.Checksum {
+		updatedFiles, err = ex.remote.findUnmatchedFilesByChecksum(ctx, localDir, remoteDir, remoteFiles, localFiles, opts.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare checksums for %s: %w", remoteDir, err)
+		}
+	}
+	for _, file := range updatedFiles {
+		fmt.Fprintf(outLog, "sync download: %s -> %s", filepath.Join(remoteDir, file), filepath.Join(localDir, file)) //nolint
+	}
+	if opts.Delete {
+		for _, file := range deletedFiles {
+			if localFiles[file].IsDir || isExcluded(file, opts.Exclude) {
+				continue
+			}
+			fmt.Fprintf(outLog, "sync delete local: %s", filepath.Join(localDir, file)) //nolint
+		}
+	}
+	return updatedFiles, nil
 }
 
 // Delete doesn't delete anything, just prints the command
@@ -118,3 +217,129 @@ func (ex *Dry) Delete(_ context.Context, remoteFile string, opts *DeleteOpts) (e
 func (ex *Dry) Close() error {
 	return nil
 }
+
+// uploadDiff shows what upload would change on the remote host, with content diffs for small text files.
+// It uses sftp for reading remote files only.
+func (ex *Dry) uploadDiff(ctx context.Context, local, remote string, opts *UpDownOpts) error {
+	matches, err := filepath.Glob(local)
+	if err != nil {
+		return fmt.Errorf("failed to expand glob pattern %s: %w", local, err)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("source file %q not found", local)
+	}
+
+	var exclude []string
+	var attrs FileAttrs
+	if opts != nil {
+		exclude, attrs = opts.Exclude, opts.Attrs
+	}
+
+	sftpClient, err := ex.remote.sftpClient()
+	if err != nil {
+		return err
+	}
+
+	outLog, _ := MakeOutAndErrWriters(ex.hostAddr, ex.hostName, true, ex.secrets)
+	for _, match := range matches {
+		relPath, e := filepath.Rel(filepath.Dir(local), match)
+		if e != nil {
+			return fmt.Errorf("failed to build relative path for %s: %w", match, e)
+		}
+		if isExcluded(relPath, exclude) {
+			continue
+		}
+		remoteFile := remote
+		if len(matches) > 1 { // if there are multiple files, treat remote as a directory
+			remoteFile = filepath.Join(remote, filepath.Base(match))
+		}
+
+		inpFi, e := os.Stat(match)
+		if e != nil {
+			return fmt.Errorf("failed to stat local file %s: %v", match, e)
+		}
+		remoteFi, e := sftpClient.Stat(remoteFile)
+		if e != nil {
+			if !os.IsNotExist(e) {
+				return fmt.Errorf("failed to stat remote file %s: %w", remoteFile, e)
+			}
+			fmt.Fprintf(outLog, "upload: %s -> %s (new file)", match, remoteFile) //nolint
+			continue
+		}
+
+		// the mode is compared with the one set by upload, same as sftpUpload does
+		isSame := (opts == nil || !opts.Force) && remoteFi.Size() == inpFi.Size() && remoteFi.Mode() == attrs.fileMode(inpFi.Mode())
+		if isSame && (opts == nil || !opts.Checksum) {
+			isSame = isWithinOneSecond(remoteFi.ModTime(), inpFi.ModTime())
+		}
+		if isSame && opts != nil && opts.Checksum {
+			if isSame, e = ex.remote.sameChecksum(ctx, match, remoteFile); e != nil {
+				return fmt.Errorf("failed to compare checksums of %s and %s: %w", match, remoteFile, e)
+			}
+		}
+		if isSame {
+			fmt.Fprintf(outLog, "upload: %s -> %s (unchanged)", match, remoteFile) //nolint
+			continue
+		}
+		fmt.Fprintf(outLog, "upload: %s -> %s (update)", match, remoteFile) //nolint
+
+		if inpFi.Size() > maxDiffSize || remoteFi.Size() > maxDiffSize {
+			continue // too large to diff
+		}
+		localData, e := os.ReadFile(match) //nolint
+		if e != nil {
+			return fmt.Errorf("failed to read local file %s: %w", match, e)
+		}
+		remoteData, e := readSftpFile(sftpClient, remoteFile)
+		if e != nil {
+			return fmt.Errorf("failed to read remote file %s: %w", remoteFile, e)
+		}
+		diff, e := textDiff(remoteFile, remoteData, match, localData)
+		if e != nil {
+			return fmt.Errorf("failed to make diff for %s: %w", remoteFile, e)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+			if line != "" {
+				outLog.Write([]byte(line)) //nolint
+			}
+		}
+	}
+	return nil
+}
+
+// readSftpFile reads remote file with sftp client, up to maxDiffSize bytes
+func readSftpFile(client *sftp.Client, remoteFile string) ([]byte, error) {
+	fh, err := client.Open(remoteFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close() //nolint ro file
+	return io.ReadAll(io.LimitReader(fh, maxDiffSize))
+}
+
+// textDiff makes unified diff from the remote (old) content to the local (new) one.
+// Returns empty string if any of them is not a text.
+func textDiff(remoteName string, remoteData []byte, localName string, localData []byte) (string, error) {
+	isText := func(data []byte) bool { return utf8.Valid(data) && !bytes.Contains(data, []byte{0}) }
+	splitLines := func(data []byte) []string {
+		if len(data) == 0 {
+			return nil
+		}
+		res := strings.SplitAfter(string(data), "\n")
+		if res[len(res)-1] == "" {
+			res = res[:len(res)-1] // drop empty element after the trailing new line
+		}
+		return res
+	}
+	if !isText(remoteData) || !isText(localData) {
+		return "", nil
+	}
+	ud := difflib.UnifiedDiff{
+		A:        splitLines(remoteData),
+		B:        splitLines(localData),
+		FromFile: "remote:" + remoteName,
+		ToFile:   localName,
+		Context:  3,
+	}
+	return difflib.GetUnifiedDiffString(ud)
+}
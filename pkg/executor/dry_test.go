@@ -6,7 +6,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,8 +19,8 @@ func TestDry_Run(t *testing.T) {
 	dry := NewDry("hostAddr", "hostName")
 	res, err := dry.Run(ctx, "ls -la /srv", &RunOpts{Verbose: true})
 	require.NoError(t, err)
-	require.Len(t, res, 1)
-	require.Equal(t, "ls -la /srv", res[0])
+	require.Len(t, res.Stdout, 1)
+	require.Equal(t, "ls -la /srv", res.Stdout[0])
 }
 
 func TestDryUpload(t *testing.T) {
@@ -111,6 +113,86 @@ func TestDryOperations(t *testing.T) {
 	}
 }
 
+func TestDry_WithRemote(t *testing.T) {
+	ctx := context.Background()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	dry := NewDry(hostAndPort, "h1").WithRemote(sess)
+
+	t.Run("sync", func(t *testing.T) {
+		_, err = sess.Sync(ctx, "testdata/sync", "/tmp/sync.dry", nil)
+		require.NoError(t, err)
+		_, err = sess.Run(ctx, "echo blah > /tmp/sync.dry/file1.txt && touch /tmp/sync.dry/extra.txt && rm /tmp/sync.dry/file2.txt", nil)
+		require.NoError(t, err)
+
+		var res []string
+		stdout := captureOutput(func() {
+			res, err = dry.Sync(ctx, "testdata/sync", "/tmp/sync.dry", &SyncOpts{Delete: true})
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"file1.txt", "file2.txt"}, res)
+		assert.Contains(t, stdout, "sync update: testdata/sync/file1.txt -> /tmp/sync.dry/file1.txt")
+		assert.Contains(t, stdout, "sync upload: testdata/sync/file2.txt -> /tmp/sync.dry/file2.txt")
+		assert.Contains(t, stdout, "sync delete: /tmp/sync.dry/extra.txt")
+
+		runRes, err := sess.Run(ctx, "cat /tmp/sync.dry/file1.txt; ls /tmp/sync.dry", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"blah", "d1", "extra.txt", "file1.txt"}, runRes.Stdout, "remote not changed")
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		_, err = sess.Run(ctx, "mkdir -p /tmp/upload.dry && printf 'line1\\nold line\\n' > /tmp/upload.dry/f.txt", nil)
+		require.NoError(t, err)
+		local := filepath.Join(t.TempDir(), "f.txt")
+		require.NoError(t, os.WriteFile(local, []byte("line1\nnew line\n"), 0o600))
+
+		stdout := captureOutput(func() {
+			err = dry.Upload(ctx, local, "/tmp/upload.dry/f.txt", nil)
+		})
+		require.NoError(t, err)
+		assert.Contains(t, stdout, "(update)")
+		assert.Contains(t, stdout, "-old line")
+		assert.Contains(t, stdout, "+new line")
+
+		stdout = captureOutput(func() {
+			err = dry.Upload(ctx, local, "/tmp/upload.dry/new.txt", nil)
+		})
+		require.NoError(t, err)
+		assert.Contains(t, stdout, "(new file)")
+
+		runRes, err := sess.Run(ctx, "cat /tmp/upload.dry/f.txt; ls /tmp/upload.dry", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"line1", "old line", "f.txt"}, runRes.Stdout, "remote not changed")
+	})
+}
+
+func Test_textDiff(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		res, err := textDiff("/srv/f.txt", []byte("l1\nl2\nl3\n"), "f.txt", []byte("l1\nl2 changed\nl3\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "--- remote:/srv/f.txt\n+++ f.txt\n@@ -1,3 +1,3 @@\n l1\n-l2\n+l2 changed\n l3\n", res)
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		res, err := textDiff("/srv/f.bin", []byte{0, 1, 2}, "f.bin", []byte{0, 1, 3})
+		require.NoError(t, err)
+		assert.Empty(t, res)
+	})
+
+	t.Run("same", func(t *testing.T) {
+		res, err := textDiff("/srv/f.txt", []byte("l1\n"), "f.txt", []byte("l1\n"))
+		require.NoError(t, err)
+		assert.Empty(t, res)
+	})
+}
+
 func captureOutput(f func()) (stdout string) {
 	// redirect stdout
 	oldStdout := os.Stdout
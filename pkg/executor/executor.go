@@ -6,13 +6,19 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
@@ -22,7 +28,7 @@ import (
 // Implemented by Remote and Local structs.
 type Interface interface {
 	SetSecrets(secrets []string)
-	Run(ctx context.Context, c string, opts *RunOpts) (out []string, err error)
+	Run(ctx context.Context, c string, opts *RunOpts) (res RunResult, err error)
 	Upload(ctx context.Context, local, remote string, opts *UpDownOpts) (err error)
 	Download(ctx context.Context, remote, local string, opts *UpDownOpts) (err error)
 	Sync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error)
@@ -32,7 +38,89 @@ type Interface interface {
 
 // RunOpts is a struct for run options.
 type RunOpts struct {
-	Verbose bool // print more info to primary stdout
+	Verbose bool      // print more info to primary stdout
+	Stdin   io.Reader // input of the command, i.e. secrets, no input if not set
+	// MaxOutput is a max size of stdout retained and returned as lines, in bytes, unlimited if 0.
+	// The output is streamed to logs in full, lines over the limit are dropped from the result.
+	MaxOutput int
+	// OkExitCodes are exit codes treated as success, only 0 if empty. The list replaces the default,
+	// i.e. [0, 3] accepts 0 and 3, while [3] accepts 3 only.
+	OkExitCodes []int
+	// TTY requests a pseudo-terminal for the remote command. Stderr is merged into stdout by the terminal
+	// and CR characters are stripped from the output. Ignored by local executor.
+	TTY bool
+	// Become is privilege escalation the command is wrapped with by Become.Wrap. Used to send the password,
+	// if set, on the prompt of the escalation method. Terminal requested for methods reading password from it.
+	Become *Become
+	// ForwardAgent forwards local ssh agent, found by SSH_AUTH_SOCK, to the remote command, so the command
+	// can use local keys, i.e. for git clone of private repositories. Ignored by local executor.
+	ForwardAgent bool
+}
+
+// stderrTailLines is a number of last stderr lines kept in RunResult and reported by ExitError
+const stderrTailLines = 10
+
+// RunResult is a result of the command run.
+type RunResult struct {
+	Stdout   []string // stdout lines, bounded by RunOpts.MaxOutput
+	Stderr   []string // last lines of stderr, with secrets masked
+	ExitCode int      // exit code of the command, -1 if it didn't exit normally, i.e. killed by a signal
+	Signal   string   // name of the signal terminated the command, if any
+}
+
+// ExitError is returned by Run if the command exited with a code not in RunOpts.OkExitCodes or was killed by a signal.
+// The message includes the last lines of stderr.
+type ExitError struct {
+	ExitCode int
+	Signal   string
+	Stderr   []string
+	Err      error // original error of the command
+}
+
+// Error implements error interface
+func (e *ExitError) Error() string {
+	msg := e.Err.Error()
+	if len(e.Stderr) == 0 {
+		return msg
+	}
+	return msg + ", stderr:\n  " + strings.Join(e.Stderr, "\n  ")
+}
+
+// Unwrap returns the original error of the command
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// exitResult checks the exit code of the finished command against ok codes. It returns nil for accepted code
+// and *ExitError otherwise. Errors not related to the exit, like connection failures, are returned as is.
+func exitResult(res *RunResult, opts *RunOpts, runErr error) error {
+	var okCodes []int
+	if opts != nil {
+		okCodes = opts.OkExitCodes
+	}
+	if res.Signal == "" && res.ExitCode >= 0 && isOkExitCode(res.ExitCode, okCodes) {
+		if res.ExitCode != 0 {
+			log.Printf("[DEBUG] exit code %d accepted", res.ExitCode)
+		}
+		return nil
+	}
+	if res.Signal == "" && res.ExitCode < 0 {
+		return runErr // not exited, i.e. failed to start
+	}
+	if runErr == nil {
+		runErr = fmt.Errorf("exit code %d is not allowed", res.ExitCode)
+	}
+	return &ExitError{ExitCode: res.ExitCode, Signal: res.Signal, Stderr: res.Stderr, Err: runErr}
+}
+
+func isOkExitCode(code int, okCodes []int) bool {
+	if len(okCodes) == 0 {
+		return code == 0
+	}
+	for _, c := range okCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
 }
 
 // UpDownOpts is a struct for upload and download options.
@@ -41,14 +129,112 @@ type UpDownOpts struct {
 	Checksum bool     // compare checksums of local and remote files, default is size and modtime
 	Force    bool     // overwrite existing files on remote
 	Exclude  []string // exclude files matching the given patterns
+	Atomic   bool     // upload to a temporary file next to the destination and rename it to the destination
+	Backup   int      // number of backups of replaced destination files to keep, as file.spot-<timestamp>
+	Attrs    FileAttrs
 }
 
 // SyncOpts is a struct for sync options.
 type SyncOpts struct {
-	Delete   bool     // delete extra files on remote
-	Exclude  []string // exclude files matching the given patterns
-	Checksum bool     // compare checksums of local and remote files, default is size and modtime
-	Force    bool     // overwrite existing files on remote
+	Delete      bool     // delete extra files on remote
+	Exclude     []string // exclude files matching the given patterns
+	Checksum    bool     // compare checksums of local and remote files, default is size and modtime
+	Force       bool     // overwrite existing files on remote
+	Tar         bool     // upload changed files as a single compressed tar stream, remote only
+	Compress    string   // compression of tar stream, gzip (default) or zstd
+	Concurrency int      // number of files uploaded in parallel, remote only
+	Atomic      bool     // replace each file atomically, not supported with tar
+	Backup      int      // number of backups of replaced files to keep, not supported with tar
+	Pull        bool     // mirror remote directory to local one, sftp only, no attributes, atomic and backup
+	Files       []string // sync only these files, relative to local dir, without comparing and deleting, not for pull
+	Attrs       FileAttrs
+}
+
+// FileAttrs defines attributes of destination files for upload and sync.
+// By default, permissions of source files are kept and ownership is left to the destination user.
+type FileAttrs struct {
+	Mode          os.FileMode // permissions of destination files, source permissions if not set
+	Owner         string      // owner of destination files, name or uid
+	Group         string      // group of destination files, name or gid
+	PreserveOwner bool        // keep numeric uid and gid of source files
+	PreserveLinks bool        // recreate symlinks instead of copying files they point to
+	PreserveTimes bool        // keep modification time of source files, remote always keeps it
+}
+
+// fileMode returns the mode of destination file for the source mode
+func (a FileAttrs) fileMode(src os.FileMode) os.FileMode {
+	if a.Mode == 0 {
+		return src
+	}
+	return src&^(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | a.Mode
+}
+
+// unixMode returns unix permission bits of the mode, including setuid, setgid and sticky bits
+func unixMode(m os.FileMode) uint32 {
+	res := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		res |= 0o4000
+	}
+	if m&os.ModeSetgid != 0 {
+		res |= 0o2000
+	}
+	if m&os.ModeSticky != 0 {
+		res |= 0o1000
+	}
+	return res
+}
+
+// fromUnixMode returns the mode for unix mode bits, including file type ones. Types other than regular files,
+// directories and symlinks are irregular.
+func fromUnixMode(m uint32) os.FileMode {
+	res := os.FileMode(m & 0o777)
+	if m&0o4000 != 0 {
+		res |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		res |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		res |= os.ModeSticky
+	}
+	switch m & 0o170000 {
+	case 0o100000:
+	case 0o040000:
+		res |= os.ModeDir
+	case 0o120000:
+		res |= os.ModeSymlink
+	default:
+		res |= os.ModeIrregular
+	}
+	return res
+}
+
+// withModeChanged adds to updated the source files existing in dst with permissions different from the ones set by
+// mode attribute. Without mode attribute updated is returned as is, as sync compares size and time only by default.
+func withModeChanged(updated []string, src, dst map[string]fileProperties, excl []string, attrs FileAttrs) []string {
+	if attrs.Mode == 0 {
+		return updated
+	}
+	res := updated
+	inUpdated := make(map[string]bool, len(updated))
+	for _, f := range updated {
+		inUpdated[f] = true
+	}
+	for path, srcProps := range src {
+		if !srcProps.Mode.IsRegular() || inUpdated[path] || isExcluded(path, excl) {
+			continue
+		}
+		if dstProps, ok := dst[path]; ok && dstProps.Mode != attrs.fileMode(srcProps.Mode) {
+			res = append(res, path)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// hasOwner returns true if ownership of destination files should be changed
+func (a FileAttrs) hasOwner() bool {
+	return a.Owner != "" || a.Group != "" || a.PreserveOwner
 }
 
 // DeleteOpts is a struct for delete options.
@@ -155,6 +341,194 @@ func MakeOutAndErrWriters(hostAddr, hostName string, verbose bool, secrets []str
 	return outLog, errLog
 }
 
+// setvarPrefix is a prefix of output lines setting variables for the next commands, see config.Cmd.scriptFile
+const setvarPrefix = "setvar "
+
+// maxSetvarLine is a max size of setvar line retained regardless of the output limit
+const maxSetvarLine = 64 * 1024
+
+// outputCollector is a writer collecting stdout of a command as lines, with bounded memory.
+// Lines are retained up to max bytes, the rest is counted and replaced by a single truncation mark.
+// Lines with setvar prefix are retained regardless of the limit, as they carry variables for the next commands.
+type outputCollector struct {
+	max       int  // max size of retained lines, unlimited if 0
+	keepEmpty bool // retain empty lines
+
+	partial  []byte // incomplete last line
+	overflow bool   // partial line exceeded the limit and is being dropped
+	size     int
+	lines    []string
+	dropped  int // number of dropped lines
+	dropSize int // size of dropped lines
+	markAt   int // index of truncation mark in lines, -1 if nothing dropped
+}
+
+func newOutputCollector(opts *RunOpts, keepEmpty bool) *outputCollector {
+	res := &outputCollector{keepEmpty: keepEmpty, markAt: -1}
+	if opts != nil && opts.MaxOutput > 0 {
+		res.max = opts.MaxOutput
+	}
+	return res
+}
+
+// Write implements io.Writer, splits the input into lines and retains them
+func (c *outputCollector) Write(p []byte) (int, error) {
+	data := p
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			c.addPartial(data)
+			break
+		}
+		c.addPartial(data[:idx])
+		c.flush()
+		data = data[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Lines returns collected lines, including the incomplete last one and the truncation mark, if any
+func (c *outputCollector) Lines() []string {
+	if len(c.partial) > 0 || c.overflow {
+		c.flush()
+	}
+	if c.markAt < 0 {
+		return c.lines
+	}
+	mark := fmt.Sprintf("... output truncated, %d lines (%d bytes) dropped", c.dropped, c.dropSize)
+	res := make([]string, 0, len(c.lines)+1)
+	res = append(res, c.lines[:c.markAt]...)
+	res = append(res, mark)
+	return append(res, c.lines[c.markAt:]...)
+}
+
+func (c *outputCollector) addPartial(data []byte) {
+	if c.overflow {
+		c.dropSize += len(data)
+		return
+	}
+	c.partial = append(c.partial, data...)
+	if c.max == 0 {
+		return
+	}
+	// a single line can't grow over the limit, setvar lines have a separate limit
+	limit := c.max
+	if (bytes.HasPrefix(c.partial, []byte(setvarPrefix)) || bytes.HasPrefix([]byte(setvarPrefix), c.partial)) && limit < maxSetvarLine {
+		limit = maxSetvarLine
+	}
+	if len(c.partial) > limit {
+		c.dropSize += len(c.partial)
+		c.partial, c.overflow = nil, true
+	}
+}
+
+func (c *outputCollector) flush() {
+	line := strings.TrimSuffix(string(c.partial), "\r")
+	overflow := c.overflow
+	c.partial, c.overflow = c.partial[:0], false
+	if overflow {
+		c.drop(0)
+		return
+	}
+	if line == "" && !c.keepEmpty {
+		return
+	}
+	if c.max > 0 && c.size+len(line) > c.max && !strings.HasPrefix(line, setvarPrefix) {
+		c.drop(len(line))
+		return
+	}
+	c.size += len(line)
+	c.lines = append(c.lines, line)
+}
+
+func (c *outputCollector) drop(size int) {
+	if c.markAt < 0 {
+		c.markAt = len(c.lines)
+	}
+	c.dropped++
+	c.dropSize += size
+}
+
+// crStripper is a writer removing CR characters, added by terminal to the output
+type crStripper struct {
+	wr io.Writer
+}
+
+// Write implements io.Writer
+func (w *crStripper) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, '\r') < 0 {
+		return w.wr.Write(p)
+	}
+	if _, err := w.wr.Write(bytes.ReplaceAll(p, []byte("\r"), nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// tailWriter keeps the last n lines written, each line limited to maxLen bytes
+type tailWriter struct {
+	n, maxLen int
+	lines     []string
+	partial   []byte
+	mu        sync.Mutex
+}
+
+// Write implements io.Writer
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data := p
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		chunk := data
+		if idx >= 0 {
+			chunk = data[:idx]
+		}
+		if room := w.maxLen - len(w.partial); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			w.partial = append(w.partial, chunk...)
+		}
+		if idx < 0 {
+			break
+		}
+		w.add()
+		data = data[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Lines returns the last lines, with secrets masked
+func (w *tailWriter) Lines(secrets []string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.add()
+	}
+	res := make([]string, 0, len(w.lines))
+	for _, line := range w.lines {
+		res = append(res, maskSecrets(line, secrets))
+	}
+	return res
+}
+
+func (w *tailWriter) add() {
+	line := strings.TrimSuffix(string(w.partial), "\r")
+	w.partial = w.partial[:0]
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	w.lines = append(w.lines, line)
+	if len(w.lines) > w.n {
+		w.lines = w.lines[len(w.lines)-w.n:]
+	}
+}
+
+func newStderrTail() *tailWriter {
+	return &tailWriter{n: stderrTailLines, maxLen: 1024}
+}
+
 func maskSecrets(s string, secrets []string) string {
 	for _, secret := range secrets {
 		if secret == " " || secret == "" {
@@ -200,6 +574,44 @@ func isExcludedSubPath(path string, excl []string) bool {
 	return false
 }
 
+// backupTimeFormat is the format of timestamp in names of backup files. It sorts in chronological order.
+const backupTimeFormat = "20060102T150405.000"
+
+var reBackupName = regexp.MustCompile(`\.spot-\d{8}T\d{6}\.\d{3}$`)
+
+// BackupName returns name of the backup of the file made at the given time, e.g. app.conf.spot-20230615T143000.123
+func BackupName(file string, t time.Time) string {
+	return file + ".spot-" + t.UTC().Format(backupTimeFormat)
+}
+
+// isBackupFile checks if the file is a backup made on replacing the file
+func isBackupFile(file string) bool {
+	return reBackupName.MatchString(file)
+}
+
+// expiredBackups returns backups of the file to remove from the list of file names in its directory,
+// all but the newest keep ones. Returned names are base names.
+func expiredBackups(file string, names []string, keep int) []string {
+	prefix := filepath.Base(file) + ".spot-"
+	backups := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) && isBackupFile(name) && len(name) == len(prefix)+len(backupTimeFormat) {
+			backups = append(backups, name)
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+	sort.Strings(backups)
+	return backups[:len(backups)-keep]
+}
+
+// atomicTmpName returns hidden temporary name in the directory of the file for the atomic replacement of the file.
+// Rename within the same directory never crosses file systems, so it is atomic.
+func atomicTmpName(file string) string {
+	return filepath.Join(filepath.Dir(file), fmt.Sprintf(".%s.spot-tmp-%d", filepath.Base(file), time.Now().UnixNano()))
+}
+
 func isWithinOneSecond(t1, t2 time.Time) bool {
 	diff := t1.Sub(t2)
 	if diff < 0 {
@@ -207,3 +619,199 @@ func isWithinOneSecond(t1, t2 time.Time) bool {
 	}
 	return diff <= time.Second
 }
+
+// fileChecksum returns hex encoded sha256 checksum of a local file
+func fileChecksum(path string) (string, error) {
+	fh, err := os.Open(path) //nolint
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close() //nolint ro file
+	return readerChecksum(fh)
+}
+
+// readerChecksum returns hex encoded sha256 checksum of the reader's content
+func readerChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ShellQuote quotes a string for safe use as a single shell argument
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runChecksums returns sha256 checksums of files, by file path, calculated by sha256sum command run with run.
+// Files are passed to the command in batches, missing files are not in the result.
+func runChecksums(run func(cmd string) (RunResult, error), files []string) (map[string]string, error) {
+	const batchSize = 100
+	res := make(map[string]string, len(files))
+	for i := 0; i < len(files); i += batchSize {
+		end := i + batchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		args := make([]string, 0, end-i)
+		for _, f := range files[i:end] {
+			args = append(args, ShellQuote(f))
+		}
+		out, err := run("sha256sum -- " + strings.Join(args, " "))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range out.Stdout {
+			// each line is "<checksum>  <file>", lines starting with "\" have escaped file names and ignored
+			parts := strings.SplitN(line, "  ", 2)
+			if len(parts) != 2 || strings.HasPrefix(line, "\\") {
+				continue
+			}
+			res[parts[1]] = parts[0]
+		}
+	}
+	return res, nil
+}
+
+// unmatchedByChecksum returns local files to be uploaded, comparing the content checksums of local and remote files
+// of the same size. Files missing on remote or with a different size are unmatched without checksum calculation.
+// Checksums of remote files are returned by sums, by full remote path.
+func unmatchedByChecksum(localDir, remoteDir string, local, remote map[string]fileProperties, excl []string,
+	sums func(files []string) (map[string]string, error)) ([]string, error) {
+	updatedFiles := []string{}
+	sameSize := []string{}
+	for localPath, localProps := range local {
+		if localProps.IsDir || isExcluded(localPath, excl) {
+			continue
+		}
+		remoteProps, exists := remote[localPath]
+		if !exists || localProps.Size != remoteProps.Size {
+			updatedFiles = append(updatedFiles, localPath)
+			continue
+		}
+		sameSize = append(sameSize, localPath)
+	}
+
+	if len(sameSize) > 0 {
+		sort.Strings(sameSize)
+		remotePaths := make([]string, 0, len(sameSize))
+		for _, f := range sameSize {
+			remotePaths = append(remotePaths, filepath.Join(remoteDir, f))
+		}
+		remoteSums, err := sums(remotePaths)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range sameSize {
+			localSum, err := fileChecksum(filepath.Join(localDir, f))
+			if err != nil {
+				return nil, fmt.Errorf("failed to calculate checksum of %s: %w", f, err)
+			}
+			if remoteSums[filepath.Join(remoteDir, f)] != localSum {
+				updatedFiles = append(updatedFiles, f)
+			}
+		}
+	}
+
+	sort.Strings(updatedFiles)
+	return updatedFiles, nil
+}
+
+// listFilesCmd is a shell script listing the directory recursively, directories as "dir <path>" lines and other
+// files as "<hex raw mode> <size> <mtime> <path>" lines. Stat options of GNU and busybox are used if supported,
+// BSD ones otherwise.
+const listFilesCmd = `d=%[1]s; test -d "$d" || exit 0; find "$d" -type d -exec printf 'dir %%s\n' {} + || exit 1; ` +
+	`if stat -c %%s / >/dev/null 2>&1; then find "$d" ! -type d -exec stat -c '%%f %%s %%Y %%n' {} +; ` +
+	`else find "$d" ! -type d -exec stat -f '%%Xp %%z %%m %%N' {} +; fi`
+
+// SyncDiff compares localDir with remoteDir the same way as Sync does, without changing anything. Returns local files
+// to upload, remote files missing locally and remote directories missing locally, deepest first. Excluded files are
+// skipped and backups are kept with backup option. With mode attribute, files with other permissions are uploaded too.
+// RemoteDir is listed by find and stat commands run by the executor, privileged with become if set, so directories
+// not readable by the user can be compared. Missing remoteDir is the same as an empty one. Checksums are calculated
+// with sha256sum the same way, remote executor falls back to reading files with sftp if sha256sum fails.
+func SyncDiff(ctx context.Context, ex Interface, localDir, remoteDir string, opts *SyncOpts,
+	become *Become) (updated, deleted, deletedDirs []string, err error) {
+	if opts == nil {
+		opts = &SyncOpts{}
+	}
+	run := func(c string) (RunResult, error) {
+		if become != nil {
+			c = become.Wrap(c)
+		}
+		return ex.Run(ctx, c, &RunOpts{Become: become})
+	}
+	r := &Remote{}
+	localFiles, err := r.getLocalFilesProperties(localDir)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
+	}
+
+	out, err := run("sh -c " + ShellQuote(fmt.Sprintf(listFilesCmd, ShellQuote(remoteDir))))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to list files of %s: %w", remoteDir, err)
+	}
+	remoteFiles := make(map[string]fileProperties, len(out.Stdout))
+	for _, line := range out.Stdout {
+		props, ok := parseListedFile(line)
+		if !ok {
+			log.Printf("[WARN] can't parse file properties %q of %s", line, remoteDir)
+			continue
+		}
+		relPath, e := filepath.Rel(remoteDir, props.FileName)
+		if e != nil || relPath == "." || isExcluded(relPath, opts.Exclude) {
+			continue
+		}
+		remoteFiles[relPath] = props
+	}
+
+	updated, deleted = r.findUnmatchedFiles(localFiles, remoteFiles, opts.Exclude)
+	if opts.Checksum {
+		sums := func(files []string) (map[string]string, error) {
+			res, e := runChecksums(run, files)
+			if rex, ok := ex.(*Remote); ok && e != nil {
+				log.Printf("[DEBUG] can't run sha256sum on %s, fallback to sftp: %v", rex.hostAddr, e)
+				return rex.sftpChecksums(ctx, files)
+			}
+			return res, e
+		}
+		if updated, err = unmatchedByChecksum(localDir, remoteDir, localFiles, remoteFiles, opts.Exclude, sums); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to compare checksums for %s: %w", localDir, err)
+		}
+	}
+	updated = withModeChanged(updated, localFiles, remoteFiles, opts.Exclude, opts.Attrs)
+
+	files := make([]string, 0, len(deleted))
+	for _, f := range deleted {
+		switch {
+		case remoteFiles[f].IsDir:
+			deletedDirs = append(deletedDirs, f)
+		case opts.Backup > 0 && isBackupFile(f):
+			// keep backups of synced files
+		default:
+			files = append(files, f)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(deletedDirs)))
+	return updated, files, deletedDirs, nil
+}
+
+// parseListedFile parses a line of listFilesCmd output
+func parseListedFile(line string) (fileProperties, bool) {
+	if strings.HasPrefix(line, "dir ") {
+		return fileProperties{FileName: strings.TrimPrefix(line, "dir "), IsDir: true}, true
+	}
+	// path can contain spaces, so it is the rest of the line
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) != 4 {
+		return fileProperties{}, false
+	}
+	mode, e1 := strconv.ParseUint(parts[0], 16, 32)
+	size, e2 := strconv.ParseInt(parts[1], 10, 64)
+	mtime, e3 := strconv.ParseInt(parts[2], 10, 64)
+	if e1 != nil || e2 != nil || e3 != nil {
+		return fileProperties{}, false
+	}
+	return fileProperties{Size: size, Time: time.Unix(mtime, 0), FileName: parts[3], Mode: fromUnixMode(uint32(mode))}, true
+}
@@ -3,13 +3,19 @@ package executor
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStdOutLogWriter(t *testing.T) {
@@ -280,6 +286,69 @@ func TestMakeOutAndErrWriters(t *testing.T) {
 	})
 }
 
+func TestOutputCollector(t *testing.T) {
+	tbl := []struct {
+		name      string
+		max       int
+		keepEmpty bool
+		writes    []string
+		want      []string
+	}{
+		{name: "unlimited", writes: []string{"line1\nli", "ne2\n\nline3"}, want: []string{"line1", "line2", "line3"}},
+		{name: "keep empty", keepEmpty: true, writes: []string{"line1\n\nline3\n"}, want: []string{"line1", "", "line3"}},
+		{name: "crlf", writes: []string{"line1\r\nline2\r\n"}, want: []string{"line1", "line2"}},
+		{name: "truncated", max: 10, writes: []string{"line1\nline2\nline3\nline4\n"},
+			want: []string{"line1", "line2", "... output truncated, 2 lines (10 bytes) dropped"}},
+		{name: "setvar retained", max: 10, writes: []string{"line1\nline2\nline3\nsetvar foo=bar\nline4\nsetvar k=v\n"},
+			want: []string{"line1", "line2", "... output truncated, 2 lines (10 bytes) dropped", "setvar foo=bar", "setvar k=v"}},
+		{name: "long line", max: 10, writes: []string{"line1\n0123456789", "0123456789", "01234\nline2"},
+			want: []string{"line1", "... output truncated, 1 lines (25 bytes) dropped", "line2"}},
+		{name: "long last line", max: 10, writes: []string{"0123456789", "0123456789"},
+			want: []string{"... output truncated, 1 lines (20 bytes) dropped"}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newOutputCollector(&RunOpts{MaxOutput: tt.max}, tt.keepEmpty)
+			for _, w := range tt.writes {
+				n, err := c.Write([]byte(w))
+				require.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			assert.Equal(t, tt.want, c.Lines())
+		})
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	w := &tailWriter{n: 3, maxLen: 6}
+	for _, s := range []string{"line1\nli", "ne2\n\n", "line3\r\nlong line\nsecret"} {
+		n, err := w.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+	assert.Equal(t, []string{"line3", "long l", "****"}, w.Lines([]string{"secret"}))
+}
+
+func TestCrStripper(t *testing.T) {
+	var buf bytes.Buffer
+	w := &crStripper{wr: &buf}
+	for _, s := range []string{"line1\r\n", "line2\r", "\nline3\n"} {
+		n, err := w.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+	assert.Equal(t, "line1\nline2\nline3\n", buf.String())
+}
+
+func TestExitError(t *testing.T) {
+	e := &ExitError{ExitCode: 2, Err: errors.New("exit status 2")}
+	assert.Equal(t, "exit status 2", e.Error())
+	e.Stderr = []string{"err1", "err2"}
+	assert.Equal(t, "exit status 2, stderr:\n  err1\n  err2", e.Error())
+	assert.Equal(t, "exit status 2", errors.Unwrap(e).Error())
+}
+
 func Test_isExcluded(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -311,3 +380,108 @@ func Test_isExcluded(t *testing.T) {
 		})
 	}
 }
+
+func Test_backups(t *testing.T) {
+	ts := time.Date(2023, 6, 15, 14, 30, 0, 123000000, time.UTC)
+	name := BackupName("/etc/app.conf", ts)
+	assert.Equal(t, "/etc/app.conf.spot-20230615T143000.123", name)
+	assert.True(t, isBackupFile(name))
+	assert.False(t, isBackupFile("/etc/app.conf"))
+	assert.False(t, isBackupFile("/etc/app.conf.spot-latest"))
+
+	names := []string{"app.conf", "app.conf.spot-20230615T143000.123", "app.conf.spot-20230614T143000.123",
+		"app.conf.spot-20230616T143000.123", "other.conf.spot-20230601T143000.123", ".app.conf.spot-tmp-123",
+		"app.conf.old.spot-20230601T143000.123"}
+	assert.Equal(t, []string{"app.conf.spot-20230614T143000.123"}, expiredBackups("/etc/app.conf", names, 2))
+	assert.Empty(t, expiredBackups("/etc/app.conf", names, 3))
+
+	tmp := atomicTmpName("/etc/app.conf")
+	assert.Equal(t, "/etc", filepath.Dir(tmp))
+	assert.True(t, strings.HasPrefix(filepath.Base(tmp), ".app.conf.spot-tmp-"))
+}
+
+func TestSyncDiff(t *testing.T) {
+	ctx := context.Background()
+	src, dst := t.TempDir(), t.TempDir()
+	ts := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(dir, name, content string, mtime time.Time) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o750))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	write(src, "same.txt", "same", ts)
+	write(src, "changed.txt", "new content", ts)
+	write(src, "touched.txt", "touched", ts)
+	write(src, "sub dir/new.txt", "new", ts)
+	write(dst, "same.txt", "same", ts)
+	write(dst, "changed.txt", "old", ts)
+	write(dst, "touched.txt", "touched", ts.Add(-time.Hour))
+	write(dst, "gone.txt", "gone", ts)
+	write(dst, "gone.txt.spot-20230615T143000.123", "backup", ts)
+	write(dst, "logs/app.log", "log", ts)
+	write(dst, "old dir/sub/old.txt", "old", ts)
+
+	// fake sudo records the commands it runs
+	binDir := t.TempDir()
+	sudoLog := filepath.Join(binDir, "sudo.log")
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "sudo"),
+		[]byte("#!/bin/sh\necho \"$1\" >> "+sudoLog+"\nexec \"$@\"\n"), 0o700)) //nolint:gosec // test script
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	ex := &Local{}
+	t.Run("size and time", func(t *testing.T) {
+		updated, deleted, dirs, err := SyncDiff(ctx, ex, src, dst, &SyncOpts{Exclude: []string{"logs"}}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"changed.txt", "sub dir/new.txt", "touched.txt"}, updated)
+		assert.Equal(t, []string{"gone.txt", "gone.txt.spot-20230615T143000.123", "old dir/sub/old.txt"}, deleted)
+		assert.Equal(t, []string{"old dir/sub", "old dir"}, dirs, "deepest first, excluded skipped")
+	})
+
+	t.Run("mode", func(t *testing.T) {
+		updated, _, _, err := SyncDiff(ctx, ex, src, dst, &SyncOpts{Exclude: []string{"logs"}, Attrs: FileAttrs{Mode: 0o600}}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"changed.txt", "sub dir/new.txt", "touched.txt"}, updated, "destination has the same mode")
+
+		updated, _, _, err = SyncDiff(ctx, ex, src, dst, &SyncOpts{Exclude: []string{"logs"}, Attrs: FileAttrs{Mode: 0o640}}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"changed.txt", "same.txt", "sub dir/new.txt", "touched.txt"}, updated, "same.txt has other mode")
+	})
+
+	t.Run("checksum with become, backups kept", func(t *testing.T) {
+		opts := &SyncOpts{Exclude: []string{"logs"}, Checksum: true, Backup: 2}
+		updated, deleted, dirs, err := SyncDiff(ctx, ex, src, dst, opts, NewBecome("sudo", "", ""))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"changed.txt", "sub dir/new.txt"}, updated)
+		assert.Equal(t, []string{"gone.txt", "old dir/sub/old.txt"}, deleted)
+		assert.Equal(t, []string{"old dir/sub", "old dir"}, dirs)
+		data, err := os.ReadFile(sudoLog) //nolint:gosec // test file
+		require.NoError(t, err)
+		assert.Equal(t, "sh\nsha256sum\n", string(data), "listing and checksums made with become")
+	})
+
+	t.Run("missing destination", func(t *testing.T) {
+		updated, deleted, dirs, err := SyncDiff(ctx, ex, src, filepath.Join(dst, "missing"), nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"changed.txt", "same.txt", "sub dir/new.txt", "touched.txt"}, updated)
+		assert.Empty(t, deleted)
+		assert.Empty(t, dirs)
+	})
+
+	t.Run("bsd stat", func(t *testing.T) {
+		// fake stat supports only bsd options, translated to gnu ones of the real stat
+		statPath, err := exec.LookPath("stat")
+		require.NoError(t, err)
+		bsdDir := t.TempDir()
+		script := "#!/bin/sh\n[ \"$1\" = -f ] || exit 1\nshift 2\nexec " + statPath + " -c '%f %s %Y %n' \"$@\"\n"
+		require.NoError(t, os.WriteFile(filepath.Join(bsdDir, "stat"), []byte(script), 0o700)) //nolint:gosec // test script
+		t.Setenv("PATH", bsdDir+":"+os.Getenv("PATH"))
+
+		opts := &SyncOpts{Exclude: []string{"logs"}, Attrs: FileAttrs{Mode: 0o600}}
+		updated, deleted, dirs, err := SyncDiff(ctx, ex, src, dst, opts, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"changed.txt", "sub dir/new.txt", "touched.txt"}, updated, "mode is listed")
+		assert.Equal(t, []string{"gone.txt", "gone.txt.spot-20230615T143000.123", "old dir/sub/old.txt"}, deleted)
+		assert.Equal(t, []string{"old dir/sub", "old dir"}, dirs)
+	})
+}
@@ -1,8 +1,6 @@
 package executor
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -10,9 +8,11 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
-
-	"github.com/go-pkgz/fileutils"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // Local is a runner for local execution. Similar to remote, but without ssh, just exec on localhost and local copy/delete/sync
@@ -26,25 +26,48 @@ func (l *Local) SetSecrets(secrets []string) {
 }
 
 // Run executes command on local hostAddr, inside the shell
-func (l *Local) Run(ctx context.Context, cmd string, opts *RunOpts) (out []string, err error) {
+func (l *Local) Run(ctx context.Context, cmd string, opts *RunOpts) (res RunResult, err error) {
 	command := exec.CommandContext(ctx, "sh", "-c", cmd)
 
 	outLog, errLog := MakeOutAndErrWriters("localhost", "", opts != nil && opts.Verbose, l.secrets)
 	outLog.Write([]byte(cmd)) //nolint
 
-	var stdoutBuf bytes.Buffer
-	mwr := io.MultiWriter(outLog, &stdoutBuf)
-	command.Stdout, command.Stderr = mwr, errLog
-	err = command.Run()
-	if err != nil {
-		return nil, err
+	collector, stderrTail := newOutputCollector(opts, true), newStderrTail()
+	command.Stdout, command.Stderr = io.MultiWriter(outLog, collector), io.MultiWriter(errLog, stderrTail)
+	if opts != nil && opts.Stdin != nil {
+		command.Stdin = opts.Stdin
 	}
 
-	scanner := bufio.NewScanner(&stdoutBuf)
-	for scanner.Scan() {
-		out = append(out, scanner.Text())
+	if opts != nil && opts.Become != nil && opts.Become.Password != "" {
+		if opts.Become.NeedsTTY() {
+			return RunResult{ExitCode: -1}, fmt.Errorf("become %s with password requires terminal, not supported locally", opts.Become.Method)
+		}
+		// the password is sent over stdin on the prompt, the input is read by own goroutine, as it may block
+		// till the end of the command, and command.Run waits for its stdin reader otherwise
+		bs := newBecomeSession(opts.Become, command.Stdin)
+		defer bs.Close()
+		command.Stdout, command.Stderr, command.Stdin = bs.Writer(command.Stdout), bs.Writer(command.Stderr), nil
+		stdinPipe, e := command.StdinPipe()
+		if e != nil {
+			return RunResult{ExitCode: -1}, fmt.Errorf("failed to make stdin pipe: %w", e)
+		}
+		go func() {
+			if _, e := io.Copy(stdinPipe, bs); e != nil {
+				log.Printf("[DEBUG] can't pass input to local command: %v", e)
+			}
+			_ = stdinPipe.Close()
+		}()
 	}
-	return out, scanner.Err()
+	err = command.Run()
+
+	res = RunResult{Stdout: collector.Lines(), Stderr: stderrTail.Lines(l.secrets), ExitCode: -1}
+	if command.ProcessState != nil {
+		res.ExitCode = command.ProcessState.ExitCode()
+		if ws, ok := command.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			res.Signal = ws.Signal().String()
+		}
+	}
+	return res, exitResult(&res, opts, err)
 }
 
 // Upload just copy file from one place to another
@@ -62,10 +85,12 @@ func (l *Local) Upload(_ context.Context, src, dst string, opts *UpDownOpts) (er
 
 	var mkdir bool
 	var exclude []string
+	var attrs FileAttrs
 
 	if opts != nil {
 		mkdir = opts.Mkdir
 		exclude = opts.Exclude
+		attrs = opts.Attrs
 	}
 
 	if mkdir {
@@ -90,28 +115,56 @@ func (l *Local) Upload(_ context.Context, src, dst string, opts *UpDownOpts) (er
 
 		// check source file info
 		srcInfo, err := os.Stat(match)
+		if attrs.PreserveLinks {
+			srcInfo, err = os.Lstat(match)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to stat source file %s: %w", match, err)
 		}
 
+		if srcInfo.Mode()&os.ModeSymlink != 0 {
+			if _, err = l.copyLink(match, destination, srcInfo, attrs); err != nil {
+				return fmt.Errorf("can't copy local link from %s to %s: %w", match, destination, err)
+			}
+			continue
+		}
+
 		// check destination file info
 		dstInfo, err := os.Stat(destination)
 		if err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("failed to stat destination file %s: %w", destination, err)
 		}
+		dstExists := err == nil
 
-		// if destination file exists, and source and destination have the same size and modification time, skip copying
+		// if destination file exists, and source and destination have the same size and modification time, skip copying.
+		// with checksum option, the content checksum is compared instead of modification time.
 		forced := opts != nil && opts.Force
-		isSame := func() bool {
-			return srcInfo.Size() == dstInfo.Size() && srcInfo.ModTime().Equal(dstInfo.ModTime()) &&
-				srcInfo.Mode() == dstInfo.Mode()
+		checksum := opts != nil && opts.Checksum
+		isSame := func() (bool, error) {
+			if srcInfo.Size() != dstInfo.Size() || attrs.fileMode(srcInfo.Mode()) != dstInfo.Mode() {
+				return false, nil
+			}
+			if !checksum {
+				return srcInfo.ModTime().Equal(dstInfo.ModTime()), nil
+			}
+			return l.sameChecksum(match, destination)
 		}
-		if err == nil && !forced && isSame() {
-			log.Printf("[DEBUG] skip copying %s to %s, same size and modification time", match, destination)
-			continue
+		if err == nil && !forced {
+			same, e := isSame()
+			if e != nil {
+				return fmt.Errorf("failed to compare %s and %s: %w", match, destination, e)
+			}
+			if same {
+				log.Printf("[DEBUG] skip copying %s to %s, same file", match, destination)
+				continue
+			}
 		}
 
-		if err = l.copyFile(match, destination); err != nil {
+		wr := writeReq{src: match, dst: destination, srcInfo: srcInfo, dstExists: dstExists, attrs: attrs}
+		if opts != nil {
+			wr.atomic, wr.backup = opts.Atomic, opts.Backup
+		}
+		if err = l.writeFile(wr); err != nil {
 			return fmt.Errorf("can't copy local file from %s to %s: %w", match, dst, err)
 		}
 	}
@@ -123,19 +176,22 @@ func (l *Local) Download(_ context.Context, src, dst string, opts *UpDownOpts) (
 	return l.Upload(context.Background(), src, dst, opts) // same as upload for local
 }
 
-// Sync directories from src to dst
+// Sync directories from src to dst. With pull option, dst is synced to src, the same way as remote pulls
+// the remote directory to the local one. With files option, only the given files are copied and nothing is deleted.
 func (l *Local) Sync(ctx context.Context, src, dst string, opts *SyncOpts) ([]string, error) {
-	excl := []string{}
-	if opts != nil {
-		excl = opts.Exclude
+	if opts != nil && opts.Pull {
+		src, dst = dst, src
+		if err := os.MkdirAll(dst, 0o750); err != nil {
+			return nil, fmt.Errorf("can't create directory %s: %w", dst, err)
+		}
 	}
-	copiedFiles, err := l.syncSrcToDst(ctx, src, dst, excl)
+	copiedFiles, err := l.syncSrcToDst(ctx, src, dst, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if opts != nil && opts.Delete {
-		if err := l.removeExtraDstFiles(ctx, src, dst); err != nil {
+	if opts != nil && opts.Delete && opts.Files == nil {
+		if err := l.removeExtraDstFiles(ctx, src, dst, opts.Backup > 0); err != nil {
 			return nil, err
 		}
 	}
@@ -161,8 +217,24 @@ func (l *Local) Delete(ctx context.Context, remoteFile string, opts *DeleteOpts)
 // Close does nothing for local
 func (l *Local) Close() error { return nil }
 
-func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string) ([]string, error) {
+// syncSrcToDst copies files from src to dst recursively. With checksum option, files with the same size, content
+// checksum and mode are not copied.
+func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, opts *SyncOpts) ([]string, error) {
 	var copiedFiles []string
+	excl := []string{}
+	checksum, atomic, backup := false, false, 0
+	var attrs FileAttrs
+	var only map[string]bool // files to copy without comparing, all files if nil
+	if opts != nil {
+		excl, checksum, attrs = opts.Exclude, opts.Checksum, opts.Attrs
+		atomic, backup = opts.Atomic, opts.Backup
+		if opts.Files != nil {
+			only, checksum = make(map[string]bool, len(opts.Files)), false
+			for _, f := range opts.Files {
+				only[f] = true
+			}
+		}
+	}
 
 	err := filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -180,6 +252,9 @@ func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string
 		if isExcluded(relPath, excl) {
 			return nil
 		}
+		if only != nil && !info.IsDir() && !only[relPath] {
+			return nil
+		}
 
 		dstPath := filepath.Join(dst, relPath)
 		if info.IsDir() {
@@ -192,10 +267,34 @@ func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string
 			return nil
 		}
 
-		if err := fileutils.CopyFile(srcPath, dstPath); err != nil {
-			return err
+		if info.Mode()&os.ModeSymlink != 0 && attrs.PreserveLinks {
+			changed, err := l.copyLink(srcPath, dstPath, info, attrs)
+			if err != nil {
+				return err
+			}
+			if changed {
+				copiedFiles = append(copiedFiles, relPath)
+			}
+			return nil
 		}
-		if err := os.Chmod(dstPath, info.Mode()); err != nil {
+
+		if checksum {
+			dstInfo, e := os.Stat(dstPath)
+			if e == nil && dstInfo.Size() == info.Size() && dstInfo.Mode() == attrs.fileMode(info.Mode()) {
+				same, e := l.sameChecksum(srcPath, dstPath)
+				if e != nil {
+					return e
+				}
+				if same {
+					return nil
+				}
+			}
+		}
+
+		_, dstErr := os.Lstat(dstPath)
+		wr := writeReq{src: srcPath, dst: dstPath, srcInfo: info, dstExists: dstErr == nil, attrs: attrs,
+			atomic: atomic, backup: backup}
+		if err := l.writeFile(wr); err != nil {
 			return err
 		}
 		copiedFiles = append(copiedFiles, relPath)
@@ -209,7 +308,175 @@ func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string
 	return copiedFiles, nil
 }
 
-func (l *Local) removeExtraDstFiles(ctx context.Context, src, dst string) error {
+// sameChecksum checks if two local files have the same content checksum
+func (l *Local) sameChecksum(src, dst string) (bool, error) {
+	srcSum, err := fileChecksum(src)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := fileChecksum(dst)
+	if err != nil {
+		return false, err
+	}
+	return srcSum == dstSum, nil
+}
+
+// copyLink recreates symlink src as dst, replacing existing dst. Returns false if dst is already the same link.
+func (l *Local) copyLink(src, dst string, srcInfo os.FileInfo, attrs FileAttrs) (bool, error) {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return false, err
+	}
+	if cur, e := os.Readlink(dst); e == nil && cur == target {
+		log.Printf("[DEBUG] skip link %s to %s, same target %s", src, dst, target)
+		return false, nil
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return false, err
+	}
+	return true, l.setAttrs(dst, srcInfo, attrs)
+}
+
+// setAttrs applies requested attributes to the copied dst. Ownership is changed first, as chown may reset setuid bits.
+func (l *Local) setAttrs(dst string, srcInfo os.FileInfo, attrs FileAttrs) error {
+	if attrs.hasOwner() {
+		uid, gid, err := localOwner(srcInfo, attrs)
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			return err
+		}
+	}
+	if srcInfo.Mode()&os.ModeSymlink != 0 {
+		return nil // mode and times of links are not used
+	}
+	if attrs.Mode != 0 || attrs.hasOwner() {
+		if err := os.Chmod(dst, attrs.fileMode(srcInfo.Mode())); err != nil {
+			return err
+		}
+	}
+	if attrs.PreserveTimes {
+		return os.Chtimes(dst, srcInfo.ModTime(), srcInfo.ModTime())
+	}
+	return nil
+}
+
+// localOwner returns uid and gid to set for local file, -1 means unchanged.
+// Explicit owner and group take precedence over the preserved source ownership.
+func localOwner(srcInfo os.FileInfo, attrs FileAttrs) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if attrs.PreserveOwner {
+		if u, g, ok := FileOwner(srcInfo); ok {
+			uid, gid = u, g
+		}
+	}
+	if attrs.Owner != "" {
+		if uid, err = strconv.Atoi(attrs.Owner); err != nil {
+			u, e := user.Lookup(attrs.Owner)
+			if e != nil {
+				return 0, 0, fmt.Errorf("can't find user %q: %w", attrs.Owner, e)
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, fmt.Errorf("can't use uid %q of user %q: %w", u.Uid, attrs.Owner, err)
+			}
+		}
+	}
+	if attrs.Group != "" {
+		if gid, err = strconv.Atoi(attrs.Group); err != nil {
+			g, e := user.LookupGroup(attrs.Group)
+			if e != nil {
+				return 0, 0, fmt.Errorf("can't find group %q: %w", attrs.Group, e)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("can't use gid %q of group %q: %w", g.Gid, attrs.Group, err)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// writeReq is a request to write a local file, see writeFile
+type writeReq struct {
+	src, dst  string
+	srcInfo   os.FileInfo
+	dstExists bool
+	attrs     FileAttrs
+	atomic    bool
+	backup    int
+}
+
+// writeFile copies src to dst and sets attributes. With atomic option, the file is copied to a temporary file
+// next to dst and renamed to dst. With backup option, replaced dst is kept as dst.spot-<timestamp>,
+// and only the newest backups are kept.
+func (l *Local) writeFile(req writeReq) error {
+	backup := ""
+	if req.backup > 0 && req.dstExists {
+		backup = BackupName(req.dst, time.Now())
+		if !req.atomic {
+			if err := os.Rename(req.dst, backup); err != nil {
+				return fmt.Errorf("can't backup %s: %w", req.dst, err)
+			}
+		}
+	}
+
+	target := req.dst
+	if req.atomic {
+		target = atomicTmpName(req.dst)
+	}
+	err := l.copyFile(req.src, target)
+	if err == nil {
+		err = l.setAttrs(target, req.srcInfo, req.attrs)
+	}
+	if err != nil {
+		if req.atomic {
+			_ = os.Remove(target)
+		}
+		if backup != "" && !req.atomic {
+			// the original file is moved back in place of the partially written one
+			if e := os.Rename(backup, req.dst); e != nil {
+				log.Printf("[WARN] can't restore %s from backup %s: %v", req.dst, backup, e)
+			}
+		}
+		return err
+	}
+
+	if req.atomic {
+		if backup != "" {
+			// hard link keeps the original file in place until it is replaced
+			if err = os.Link(req.dst, backup); err != nil {
+				return fmt.Errorf("can't backup %s: %w", req.dst, err)
+			}
+		}
+		if err = os.Rename(target, req.dst); err != nil {
+			return fmt.Errorf("can't rename %s to %s: %w", target, req.dst, err)
+		}
+	}
+
+	if backup == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(req.dst))
+	if err != nil {
+		return fmt.Errorf("can't read directory of %s: %w", req.dst, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	for _, name := range expiredBackups(req.dst, names, req.backup) {
+		if err = os.Remove(filepath.Join(filepath.Dir(req.dst), name)); err != nil {
+			return fmt.Errorf("can't remove old backup %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// removeExtraDstFiles removes files and directories in dst which are not in src. Backups of files are kept if keepBackups set.
+func (l *Local) removeExtraDstFiles(ctx context.Context, src, dst string, keepBackups bool) error {
 	var pathsToDelete []string
 
 	err := filepath.Walk(dst, func(dstPath string, info os.FileInfo, err error) error {
@@ -226,6 +493,9 @@ func (l *Local) removeExtraDstFiles(ctx context.Context, src, dst string) error
 			return err
 		}
 
+		if keepBackups && isBackupFile(relPath) {
+			return nil
+		}
 		srcPath := filepath.Join(src, relPath)
 		if _, err := os.Stat(srcPath); errors.Is(err, os.ErrNotExist) {
 			pathsToDelete = append(pathsToDelete, dstPath)
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,9 +22,9 @@ func TestRun(t *testing.T) {
 	l := &Local{}
 
 	t.Run("single line out success", func(t *testing.T) {
-		out, e := l.Run(ctx, "echo 'hello world'", &RunOpts{Verbose: true})
+		runRes, e := l.Run(ctx, "echo 'hello world'", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.Equal(t, []string{"hello world"}, out)
+		assert.Equal(t, []string{"hello world"}, runRes.Stdout)
 	})
 
 	t.Run("single line out fail", func(t *testing.T) {
@@ -31,6 +32,45 @@ func TestRun(t *testing.T) {
 		require.Error(t, e)
 	})
 
+	t.Run("exit code and stderr", func(t *testing.T) {
+		l.SetSecrets([]string{"secret1"})
+		defer l.SetSecrets(nil)
+		res, e := l.Run(ctx, "echo out1; echo err1 secret1 >&2; echo err2 >&2; exit 3", nil)
+		require.Error(t, e)
+		var exitErr *ExitError
+		require.ErrorAs(t, e, &exitErr)
+		assert.Equal(t, 3, exitErr.ExitCode)
+		assert.Equal(t, []string{"err1 ****", "err2"}, exitErr.Stderr)
+		assert.Equal(t, "exit status 3, stderr:\n  err1 ****\n  err2", e.Error())
+		assert.Equal(t, RunResult{Stdout: []string{"out1"}, Stderr: []string{"err1 ****", "err2"}, ExitCode: 3}, res)
+	})
+
+	t.Run("ok exit codes", func(t *testing.T) {
+		res, e := l.Run(ctx, "echo out1; exit 3", &RunOpts{OkExitCodes: []int{0, 3}})
+		require.NoError(t, e)
+		assert.Equal(t, RunResult{Stdout: []string{"out1"}, Stderr: []string{}, ExitCode: 3}, res)
+
+		_, e = l.Run(ctx, "exit 0", &RunOpts{OkExitCodes: []int{3}})
+		assert.EqualError(t, e, "exit code 0 is not allowed")
+
+		_, e = l.Run(ctx, "exit 4", &RunOpts{OkExitCodes: []int{0, 3}})
+		assert.EqualError(t, e, "exit status 4")
+	})
+
+	t.Run("killed by signal", func(t *testing.T) {
+		res, e := l.Run(ctx, "kill -TERM $$", nil)
+		var exitErr *ExitError
+		require.ErrorAs(t, e, &exitErr)
+		assert.Equal(t, "terminated", exitErr.Signal)
+		assert.Equal(t, -1, res.ExitCode)
+	})
+
+	t.Run("with stdin", func(t *testing.T) {
+		runRes, e := l.Run(ctx, ". /dev/stdin; echo $SEC", &RunOpts{Stdin: strings.NewReader("export SEC='secret value'\n")})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"secret value"}, runRes.Stdout)
+	})
+
 	t.Run("multi line out success", func(t *testing.T) {
 		// Prepare the test environment
 		_, err := l.Run(ctx, "mkdir -p /tmp/st", &RunOpts{Verbose: true})
@@ -40,11 +80,11 @@ func TestRun(t *testing.T) {
 		_, err = l.Run(ctx, "cp testdata/data2.txt /tmp/st/data2.txt", &RunOpts{Verbose: true})
 		require.NoError(t, err)
 
-		out, err := l.Run(ctx, "ls -1 /tmp/st", nil)
+		runRes, err := l.Run(ctx, "ls -1 /tmp/st", nil)
 		require.NoError(t, err)
-		assert.Equal(t, 2, len(out))
-		assert.Equal(t, "data1.txt", out[0])
-		assert.Equal(t, "data2.txt", out[1])
+		assert.Equal(t, 2, len(runRes.Stdout))
+		assert.Equal(t, "data1.txt", runRes.Stdout[0])
+		assert.Equal(t, "data2.txt", runRes.Stdout[1])
 	})
 
 	t.Run("multi line out fail", func(t *testing.T) {
@@ -53,11 +93,11 @@ func TestRun(t *testing.T) {
 	})
 
 	t.Run("find out", func(t *testing.T) {
-		out, e := l.Run(ctx, "find /tmp/st -type f", &RunOpts{Verbose: true})
+		runRes, e := l.Run(ctx, "find /tmp/st -type f", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
-		assert.Contains(t, out, "/tmp/st/data1.txt")
-		assert.Contains(t, out, "/tmp/st/data2.txt")
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
+		assert.Contains(t, runRes.Stdout, "/tmp/st/data1.txt")
+		assert.Contains(t, runRes.Stdout, "/tmp/st/data2.txt")
 	})
 
 	t.Run("with secrets", func(t *testing.T) {
@@ -68,7 +108,7 @@ func TestRun(t *testing.T) {
 		// Set up the test environment
 		l.SetSecrets([]string{"data2"})
 		defer l.SetSecrets(nil)
-		out, e := l.Run(ctx, "find /tmp/st -type f", &RunOpts{Verbose: true})
+		runRes, e := l.Run(ctx, "find /tmp/st -type f", &RunOpts{Verbose: true})
 		writer.Close()
 		os.Stdout = originalStdout
 
@@ -76,12 +116,19 @@ func TestRun(t *testing.T) {
 		require.NoError(t, err)
 
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
-		assert.Equal(t, []string{"/tmp/st/data1.txt", "/tmp/st/data2.txt"}, out)
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
+		assert.Equal(t, []string{"/tmp/st/data1.txt", "/tmp/st/data2.txt"}, runRes.Stdout)
 		t.Logf("capturedStdout: %s", capturedStdout)
 		assert.NotContains(t, string(capturedStdout), "data2", "captured stdout should not contain secrets")
 		assert.Contains(t, string(capturedStdout), "****", "captured stdout should contain masked secrets")
 	})
+
+	t.Run("with max output", func(t *testing.T) {
+		runRes, e := l.Run(ctx, "seq 1 10000; echo setvar foo=bar", &RunOpts{MaxOutput: 10})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9",
+			"... output truncated, 9991 lines (38885 bytes) dropped", "setvar foo=bar"}, runRes.Stdout)
+	})
 }
 
 func TestUploadAndDownload(t *testing.T) {
@@ -645,6 +692,214 @@ func TestLocal_Sync(t *testing.T) {
 	}
 }
 
+func TestLocal_SyncPull(t *testing.T) {
+	svc := &Local{}
+	remoteDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "d1"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "d1", "f1.txt"), []byte("f1"), 0o600))
+	localDir := filepath.Join(t.TempDir(), "pulled", "h1")
+	require.NoError(t, os.MkdirAll(localDir, 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "extra.txt"), []byte("extra"), 0o600))
+
+	res, err := svc.Sync(context.Background(), localDir, remoteDir, &SyncOpts{Pull: true, Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d1/f1.txt"}, res)
+	data, err := os.ReadFile(filepath.Join(localDir, "d1", "f1.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "f1", string(data))
+	assert.NoFileExists(t, filepath.Join(localDir, "extra.txt"))
+	assert.FileExists(t, filepath.Join(remoteDir, "d1", "f1.txt"), "remote directory not changed")
+}
+
+func TestLocal_Checksum(t *testing.T) {
+	ctx := context.Background()
+	l := &Local{}
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "f1.txt"), []byte("content1"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "f2.txt"), []byte("content2"), 0o600))
+
+	res, err := l.Sync(ctx, srcDir, dstDir, &SyncOpts{Checksum: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"f1.txt", "f2.txt"}, res)
+
+	// same size edit, should be copied, unchanged file should be skipped even with a different mod time
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, "f2.txt"), []byte("content3"), 0o600))
+	oldTime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dstDir, "f1.txt"), oldTime, oldTime))
+	res, err = l.Sync(ctx, srcDir, dstDir, &SyncOpts{Checksum: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"f2.txt"}, res)
+	data, err := os.ReadFile(filepath.Join(dstDir, "f2.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content2", string(data))
+
+	// same content with mode set, copied once to apply the mode
+	res, err = l.Sync(ctx, srcDir, dstDir, &SyncOpts{Checksum: true, Attrs: FileAttrs{Mode: 0o640}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"f1.txt", "f2.txt"}, res)
+	res, err = l.Sync(ctx, srcDir, dstDir, &SyncOpts{Checksum: true, Attrs: FileAttrs{Mode: 0o640}})
+	require.NoError(t, err)
+	assert.Empty(t, res)
+	require.NoError(t, os.Chmod(filepath.Join(dstDir, "f1.txt"), 0o600))
+	require.NoError(t, os.Chmod(filepath.Join(dstDir, "f2.txt"), 0o600))
+
+	t.Run("upload", func(t *testing.T) {
+		dst := filepath.Join(dstDir, "f1.txt")
+		require.NoError(t, os.WriteFile(dst, []byte("content9"), 0o600))
+		st, err := os.Stat(filepath.Join(srcDir, "f1.txt"))
+		require.NoError(t, err)
+		require.NoError(t, os.Chtimes(dst, st.ModTime(), st.ModTime()))
+
+		// same size, mode and mod time, without checksum the file is considered unchanged
+		require.NoError(t, l.Upload(ctx, filepath.Join(srcDir, "f1.txt"), dst, &UpDownOpts{}))
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "content9", string(data))
+
+		require.NoError(t, l.Upload(ctx, filepath.Join(srcDir, "f1.txt"), dst, &UpDownOpts{Checksum: true}))
+		data, err = os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "content1", string(data))
+	})
+}
+
+func TestLocal_Attrs(t *testing.T) {
+	ctx := context.Background()
+	l := &Local{}
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "f1.txt"), []byte("content1"), 0o644))
+	require.NoError(t, os.Symlink("f1.txt", filepath.Join(srcDir, "link.txt")))
+	oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(filepath.Join(srcDir, "f1.txt"), oldTime, oldTime))
+
+	t.Run("sync with mode, times and links", func(t *testing.T) {
+		attrs := FileAttrs{Mode: 0o600, PreserveLinks: true, PreserveTimes: true}
+		res, err := l.Sync(ctx, srcDir, dstDir, &SyncOpts{Attrs: attrs})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"f1.txt", "link.txt"}, res)
+
+		st, err := os.Stat(filepath.Join(dstDir, "f1.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), st.Mode())
+		assert.True(t, st.ModTime().Equal(oldTime))
+
+		target, err := os.Readlink(filepath.Join(dstDir, "link.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "f1.txt", target)
+
+		// the same link is not copied again
+		res, err = l.Sync(ctx, srcDir, dstDir, &SyncOpts{Attrs: attrs})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"f1.txt"}, res)
+	})
+
+	t.Run("upload with links and times", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "link.txt")
+		require.NoError(t, os.WriteFile(dst, []byte("old"), 0o644))
+		err := l.Upload(ctx, filepath.Join(srcDir, "link.txt"), dst, &UpDownOpts{Attrs: FileAttrs{PreserveLinks: true}})
+		require.NoError(t, err)
+		target, err := os.Readlink(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "f1.txt", target)
+
+		// without links the file is copied, with preserved times unchanged file is skipped on the next upload
+		dst = filepath.Join(t.TempDir(), "f1.txt")
+		opts := &UpDownOpts{Attrs: FileAttrs{PreserveTimes: true}}
+		require.NoError(t, l.Upload(ctx, filepath.Join(srcDir, "link.txt"), dst, opts))
+		require.NoError(t, os.WriteFile(dst, []byte("content2"), 0o644))
+		require.NoError(t, os.Chtimes(dst, oldTime, oldTime))
+		require.NoError(t, l.Upload(ctx, filepath.Join(srcDir, "link.txt"), dst, opts))
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "content2", string(data))
+	})
+
+	t.Run("upload with owner", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("requires root to change owner")
+		}
+		dst := filepath.Join(t.TempDir(), "f1.txt")
+		opts := &UpDownOpts{Attrs: FileAttrs{Owner: "1234", Group: "2345", Mode: 0o750 | os.ModeSetuid}}
+		require.NoError(t, l.Upload(ctx, filepath.Join(srcDir, "f1.txt"), dst, opts))
+		st, err := os.Stat(dst)
+		require.NoError(t, err)
+		uid, gid, ok := FileOwner(st)
+		require.True(t, ok)
+		assert.Equal(t, 1234, uid)
+		assert.Equal(t, 2345, gid)
+		assert.Equal(t, 0o750|os.ModeSetuid, st.Mode())
+
+		err = l.Upload(ctx, filepath.Join(srcDir, "f1.txt"), dst, &UpDownOpts{Force: true,
+			Attrs: FileAttrs{Owner: "no-such-user-spot"}})
+		require.ErrorContains(t, err, `can't find user "no-such-user-spot"`)
+	})
+}
+
+func TestLocal_AtomicAndBackup(t *testing.T) {
+	ctx := context.Background()
+	l := &Local{}
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	src, dst := filepath.Join(srcDir, "app.conf"), filepath.Join(dstDir, "app.conf")
+
+	backups := func() (res []string) {
+		entries, err := os.ReadDir(dstDir)
+		require.NoError(t, err)
+		for _, e := range entries {
+			if isBackupFile(e.Name()) {
+				data, err := os.ReadFile(filepath.Join(dstDir, e.Name()))
+				require.NoError(t, err)
+				res = append(res, string(data))
+			}
+		}
+		return res
+	}
+
+	for _, atomic := range []bool{true, false} {
+		t.Run(fmt.Sprintf("atomic %v", atomic), func(t *testing.T) {
+			for i, content := range []string{"v1", "v22", "v333", "v4444"} {
+				require.NoError(t, os.WriteFile(src, []byte(content), 0o644))
+				err := l.Upload(ctx, src, dst, &UpDownOpts{Atomic: atomic, Backup: 2})
+				require.NoError(t, err, "upload %d", i)
+				time.Sleep(5 * time.Millisecond) // backups named with millisecond timestamps
+			}
+			data, err := os.ReadFile(dst)
+			require.NoError(t, err)
+			assert.Equal(t, "v4444", string(data))
+			assert.Equal(t, []string{"v22", "v333"}, backups())
+
+			entries, err := os.ReadDir(dstDir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 3, "no temporary files left")
+			require.NoError(t, os.RemoveAll(dstDir))
+			require.NoError(t, os.MkdirAll(dstDir, 0o750))
+		})
+	}
+
+	t.Run("failed write restores original", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(dst, []byte("original"), 0o644))
+		require.NoError(t, os.WriteFile(src, []byte("new"), 0o644))
+		err := l.Upload(ctx, src, dst, &UpDownOpts{Backup: 2, Attrs: FileAttrs{Owner: "no-such-user-spot"}})
+		require.Error(t, err, "owner can't be set after the file is written")
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "original", string(data))
+		assert.Empty(t, backups(), "backup moved back")
+		require.NoError(t, os.Remove(dst))
+	})
+
+	t.Run("sync with delete keeps backups", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(src, []byte("s1"), 0o644))
+		_, err := l.Sync(ctx, srcDir, dstDir, &SyncOpts{Delete: true, Atomic: true, Backup: 1})
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+		require.NoError(t, os.WriteFile(src, []byte("s22"), 0o644))
+		res, err := l.Sync(ctx, srcDir, dstDir, &SyncOpts{Delete: true, Atomic: true, Backup: 1})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app.conf"}, res)
+		assert.Equal(t, []string{"s1"}, backups())
+	})
+}
+
 func TestDelete(t *testing.T) {
 	testCases := []struct {
 		name        string
@@ -856,7 +1111,7 @@ func TestLocal_removeExtraDstFiles_InvalidDstPath(t *testing.T) {
 
 	dst := "non_existent_path"
 
-	err = l.removeExtraDstFiles(context.Background(), src, dst)
+	err = l.removeExtraDstFiles(context.Background(), src, dst, false)
 	assert.Error(t, err, "expected an error")
 }
 
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package executor
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileOwner returns uid and gid of the file, ok is false if ownership is not available
+func FileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package executor
+
+import "os"
+
+// FileOwner returns uid and gid of the file, ok is always false on windows as there is no posix ownership
+func FileOwner(os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -1,7 +1,9 @@
 package executor
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -11,42 +13,107 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-pkgz/syncs"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-// Remote executes commands on remote server, via ssh. Not thread-safe.
+// pidMarker is a prefix of the first output line of each remote command, reporting the pid of the remote shell
+const pidMarker = "spot-pid:"
+
+// remoteKillGrace is a time given to the canceled remote command to exit after TERM, before KILL sent
+var remoteKillGrace = 5 * time.Second
+
+// killCtxKey marks the context of the command killing a canceled one
+type killCtxKey struct{}
+
+// Remote executes commands on remote server, via ssh.
 type Remote struct {
 	client   *ssh.Client
 	hostAddr string
 	hostName string
 	secrets  []string // secrets to be masked in logs
+
+	sftpMu sync.Mutex
+	sftp   *sftp.Client // shared sftp client, made on the first use and reset when its connection is broken
+
+	idsMu sync.Mutex
+	ids   map[string]int // cached remote uid and gid of user and group names
+
+	agentOnce sync.Once
+	agentConn net.Conn // connection to local ssh agent, forwarded to commands requesting it
+	agentErr  error
 }
 
 // Close connection to remote server.
 func (ex *Remote) Close() error {
+	ex.sftpMu.Lock()
+	if ex.sftp != nil {
+		if err := ex.sftp.Close(); err != nil {
+			log.Printf("[WARN] failed to close sftp client for %s: %v", ex.hostAddr, err)
+		}
+		ex.sftp = nil
+	}
+	ex.sftpMu.Unlock()
+	if ex.agentConn != nil {
+		_ = ex.agentConn.Close()
+	}
 	if ex.client != nil {
 		return ex.client.Close()
 	}
 	return nil
 }
 
+// sftpClient returns sftp client shared by all operations of the connection. It is made on the first call.
+// sftp.Client is safe for concurrent use, so it can be used for parallel uploads as well.
+// Failed creation is not cached, and the client is dropped once its connection is broken, so the next call
+// makes a new one instead of failing all later transfers to the host.
+func (ex *Remote) sftpClient() (*sftp.Client, error) {
+	if ex.client == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+	ex.sftpMu.Lock()
+	defer ex.sftpMu.Unlock()
+	if ex.sftp != nil {
+		return ex.sftp, nil
+	}
+	client, err := sftp.NewClient(ex.client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sftp client: %v", err)
+	}
+	ex.sftp = client
+	go func() {
+		err := client.Wait()
+		ex.sftpMu.Lock()
+		defer ex.sftpMu.Unlock()
+		if ex.sftp == client {
+			log.Printf("[DEBUG] sftp client for %s closed: %v", ex.hostAddr, err)
+			ex.sftp = nil
+		}
+	}()
+	return client, nil
+}
+
 // SetSecrets sets the secrets for the remote executor.
 func (ex *Remote) SetSecrets(secrets []string) {
 	ex.secrets = secrets
 }
 
 // Run command on remote server.
-func (ex *Remote) Run(ctx context.Context, cmd string, opts *RunOpts) (out []string, err error) {
+func (ex *Remote) Run(ctx context.Context, cmd string, opts *RunOpts) (res RunResult, err error) {
 	if ex.client == nil {
-		return nil, fmt.Errorf("client is not connected")
+		return res, fmt.Errorf("client is not connected")
 	}
 	log.Printf("[DEBUG] run %s", cmd)
 
-	return ex.sshRun(ctx, ex.client, cmd, opts != nil && opts.Verbose)
+	return ex.sshRun(ctx, ex.client, cmd, opts)
 }
 
 // Upload file to remote server with scp
@@ -91,14 +158,17 @@ func (ex *Remote) Upload(ctx context.Context, local, remote string, opts *UpDown
 			remoteFile = filepath.Join(remote, filepath.Base(match))
 		}
 		req := sftpReq{
-			client:     ex.client,
 			localFile:  match,
 			remoteFile: remoteFile,
 			mkdir:      opts != nil && opts.Mkdir,
 			force:      opts != nil && opts.Force,
+			checksum:   opts != nil && opts.Checksum,
 			remoteHost: host,
 			remotePort: port,
 		}
+		if opts != nil {
+			req.attrs, req.atomic, req.backup = opts.Attrs, opts.Atomic, opts.Backup
+		}
 		if err := ex.sftpUpload(ctx, req); err != nil {
 			return err
 		}
@@ -141,7 +211,6 @@ func (ex *Remote) Download(ctx context.Context, remote, local string, opts *UpDo
 		}
 
 		req := sftpReq{
-			client:     ex.client,
 			localFile:  localFile,
 			remoteFile: remoteFile,
 			mkdir:      mkdir,
@@ -158,44 +227,237 @@ func (ex *Remote) Download(ctx context.Context, remote, local string, opts *UpDo
 }
 
 // Sync compares local and remote files and uploads unmatched files, recursively.
+// With pull option, remote files are compared with local ones and unmatched files are downloaded instead.
+// With files option, only the given files are uploaded, remote directory is not compared.
 func (ex *Remote) Sync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
+	if opts != nil && opts.Pull {
+		return ex.syncPull(ctx, localDir, remoteDir, opts)
+	}
+	var unmatchedFiles, deletedFiles []string
+	var remoteFiles map[string]fileProperties
+	if opts != nil && opts.Files != nil {
+		// files to sync are given by the caller, remote directory is not compared and nothing is deleted
+		unmatchedFiles = opts.Files
+	} else {
+		var err error
+		if unmatchedFiles, deletedFiles, remoteFiles, err = ex.syncDiff(ctx, localDir, remoteDir, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var attrs FileAttrs
+	if opts != nil {
+		attrs = opts.Attrs
+	}
+	if opts != nil && opts.Tar {
+		// upload all changed files in a single tar stream
+		if err := ex.tarUpload(ctx, localDir, remoteDir, unmatchedFiles, opts.Compress, attrs); err != nil {
+			return nil, fmt.Errorf("failed to upload %s to %s with tar: %w", localDir, remoteDir, err)
+		}
+	} else {
+		concurrency := 1
+		if opts != nil && opts.Concurrency > 1 {
+			concurrency = opts.Concurrency
+		}
+		// with checksum or given files the decision to upload is already made, force upload to skip size and mod time check
+		upOpts := UpDownOpts{Force: opts != nil && (opts.Checksum || opts.Files != nil), Attrs: attrs}
+		if opts != nil {
+			upOpts.Atomic, upOpts.Backup = opts.Atomic, opts.Backup
+		}
+		if err := ex.uploadFiles(ctx, localDir, remoteDir, unmatchedFiles, concurrency, upOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts != nil && opts.Delete && opts.Files == nil {
+		// delete remote files which are not in local.
+		// if the missing file is a directory, delete it recursively.
+		// note: this may cause attempts to remove files from already deleted directories, but it's ok, Delete is idempotent.
+		for _, file := range deletedFiles {
+			if opts.Backup > 0 && isBackupFile(file) {
+				continue // keep backups of synced files
+			}
+			deleteOpts := &DeleteOpts{Recursive: remoteFiles[file].IsDir}
+			if err := ex.Delete(ctx, filepath.Join(remoteDir, file), deleteOpts); err != nil {
+				return nil, fmt.Errorf("failed to delete %s: %w", file, err)
+			}
+		}
+	}
+
+	return unmatchedFiles, nil
+}
+
+// syncDiff compares local and remote directories, returns local files to upload, remote files missing locally
+// and properties of remote files.
+func (ex *Remote) syncDiff(ctx context.Context, localDir, remoteDir string,
+	opts *SyncOpts) (updated, deleted []string, remoteFiles map[string]fileProperties, err error) {
 	localFiles, err := ex.getLocalFilesProperties(localDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
+		return nil, nil, nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
 	}
 
 	excl := []string{}
 	if opts != nil {
 		excl = opts.Exclude
 	}
-	remoteFiles, err := ex.getRemoteFilesProperties(ctx, remoteDir, excl)
+	if remoteFiles, err = ex.getRemoteFilesProperties(ctx, remoteDir, excl); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get remote files properties for %s: %w", remoteDir, err)
+	}
+
+	updated, deleted = ex.findUnmatchedFiles(localFiles, remoteFiles, excl)
+	if opts != nil && opts.Checksum {
+		if updated, err = ex.findUnmatchedFilesByChecksum(ctx, localDir, remoteDir, localFiles, remoteFiles, excl); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to compare checksums for %s: %w", localDir, err)
+		}
+	}
+	if opts != nil {
+		updated = withModeChanged(updated, localFiles, remoteFiles, excl, opts.Attrs)
+	}
+	return updated, deleted, remoteFiles, nil
+}
+
+// syncPull mirrors remoteDir to localDir. It downloads remote files missing or changed locally and, with delete option,
+// removes local files missing on remote. Excluded files are neither downloaded nor removed.
+func (ex *Remote) syncPull(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
+	if ex.client == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+	if err := os.MkdirAll(localDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create local directory %s: %w", localDir, err)
+	}
+	host, port, err := net.SplitHostPort(ex.hostAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split hostAddr and port: %w", err)
+	}
+
+	remoteFiles, err := ex.getRemoteFilesProperties(ctx, remoteDir, opts.Exclude)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get remote files properties for %s: %w", remoteDir, err)
 	}
+	localFiles, err := ex.getLocalFilesProperties(localDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
+	}
 
-	unmatchedFiles, deletedFiles := ex.findUnmatchedFiles(localFiles, remoteFiles, excl)
-	for _, file := range unmatchedFiles {
-		localPath := filepath.Join(localDir, file)
-		remotePath := filepath.Join(remoteDir, file)
-		if err = ex.Upload(ctx, localPath, remotePath, &UpDownOpts{Mkdir: true}); err != nil {
-			return nil, fmt.Errorf("failed to upload %s to %s: %w", localPath, remotePath, err)
+	// remote files are the source here, so the properties are passed in the reverse order
+	updatedFiles, deletedFiles := ex.findUnmatchedFiles(remoteFiles, localFiles, opts.Exclude)
+	if opts.Checksum {
+		updatedFiles, err = ex.findUnmatchedFilesByChecksum(ctx, localDir, remoteDir, remoteFiles, localFiles, opts.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare checksums for %s: %w", remoteDir, err)
 		}
-		log.Printf("[INFO] synced %s to %s", localPath, remotePath)
 	}
 
-	if opts != nil && opts.Delete {
-		// delete remote files which are not in local.
-		// if the missing file is a directory, delete it recursively.
-		// note: this may cause attempts to remove files from already deleted directories, but it's ok, Delete is idempotent.
-		for _, file := range deletedFiles {
-			deleteOpts := &DeleteOpts{Recursive: remoteFiles[file].IsDir}
-			if err = ex.Delete(ctx, filepath.Join(remoteDir, file), deleteOpts); err != nil {
-				return nil, fmt.Errorf("failed to delete %s: %w", file, err)
+	for _, file := range updatedFiles {
+		// the decision to download is already made, force download to skip size and mod time check
+		req := sftpReq{localFile: filepath.Join(localDir, file), remoteFile: filepath.Join(remoteDir, file),
+			remoteHost: host, remotePort: port, mkdir: true, force: true}
+		if err = ex.sftpDownload(ctx, req); err != nil {
+			return nil, fmt.Errorf("failed to download remote file %s: %w", req.remoteFile, err)
+		}
+	}
+
+	if opts.Delete {
+		if err = removeUnmatchedLocal(localDir, deletedFiles, localFiles, remoteFiles, opts.Exclude); err != nil {
+			return nil, err
+		}
+	}
+	return updatedFiles, nil
+}
+
+// removeUnmatchedLocal removes local files missing on remote, except excluded ones. Directories are removed
+// only if they are empty after that, so directories with excluded files are kept.
+func removeUnmatchedLocal(localDir string, deletedFiles []string, local, remote map[string]fileProperties, excl []string) error {
+	dirs := []string{}
+	for _, file := range deletedFiles {
+		if isExcluded(file, excl) {
+			continue
+		}
+		if local[file].IsDir {
+			if file != "." {
+				dirs = append(dirs, file)
 			}
+			continue
 		}
+		if err := os.Remove(filepath.Join(localDir, file)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %w", file, err)
+		}
+		log.Printf("[INFO] deleted local %s", filepath.Join(localDir, file))
 	}
 
-	return unmatchedFiles, nil
+	// remove the deepest directories first, non-empty directories are kept
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if hasFilesUnder(dir, remote) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(localDir, dir)); err == nil {
+			log.Printf("[INFO] deleted local directory %s", filepath.Join(localDir, dir))
+		}
+	}
+	return nil
+}
+
+// hasFilesUnder checks if any of the files is located under the directory
+func hasFilesUnder(dir string, files map[string]fileProperties) bool {
+	prefix := dir + string(filepath.Separator)
+	for f := range files {
+		if strings.HasPrefix(f, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Transfer copies srcFile from this host to dstFile on dst host. The file is streamed through the local machine
+// and never stored locally. It is written to a temporary file next to dstFile and renamed to it, so an interrupted
+// transfer never leaves a partial destination. The destination directory is created if missing.
+// Returns false if the destination file has the same size and mod time and force is not set.
+func (ex *Remote) Transfer(ctx context.Context, srcFile string, dst *Remote, dstFile string, force bool) (bool, error) {
+	srcClient, err := ex.sftpClient()
+	if err != nil {
+		return false, err
+	}
+	dstClient, err := dst.sftpClient()
+	if err != nil {
+		return false, err
+	}
+
+	srcFh, err := srcClient.Open(srcFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s on %s: %w", srcFile, ex.hostAddr, err)
+	}
+	defer srcFh.Close() // nolint ro file
+	srcFi, err := srcFh.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s on %s: %w", srcFile, ex.hostAddr, err)
+	}
+	if srcFi.IsDir() {
+		return false, fmt.Errorf("%s on %s is a directory, only files can be transferred", srcFile, ex.hostAddr)
+	}
+
+	if !force {
+		if dstFi, e := dstClient.Stat(dstFile); e == nil && dstFi.Size() == srcFi.Size() &&
+			isWithinOneSecond(dstFi.ModTime(), srcFi.ModTime()) {
+			log.Printf("[INFO] transfer of %s to %s:%s skipped, the same file exists", srcFile, dst.hostAddr, dstFile)
+			return false, nil
+		}
+	}
+
+	if err = dstClient.MkdirAll(filepath.Dir(dstFile)); err != nil {
+		return false, fmt.Errorf("failed to create directory for %s on %s: %w", dstFile, dst.hostAddr, err)
+	}
+	log.Printf("[INFO] transfer %s:%s to %s:%s", ex.hostAddr, srcFile, dst.hostAddr, dstFile)
+	tmpFile := atomicTmpName(dstFile)
+	if err = dst.sftpWrite(ctx, dstClient, srcFh, srcFi, tmpFile, FileAttrs{}); err != nil {
+		_ = dstClient.Remove(tmpFile)
+		return false, err
+	}
+	if err = dstClient.PosixRename(tmpFile, dstFile); err != nil {
+		_ = dstClient.Remove(tmpFile)
+		return false, fmt.Errorf("failed to rename %s to %s on %s: %w", tmpFile, dstFile, dst.hostAddr, err)
+	}
+	return true, nil
 }
 
 // Delete file on remote server. Recursively if recursive is true.
@@ -205,11 +467,10 @@ func (ex *Remote) Delete(ctx context.Context, remoteFile string, opts *DeleteOpt
 		return fmt.Errorf("client is not connected")
 	}
 
-	sftpClient, err := sftp.NewClient(ex.client)
+	sftpClient, err := ex.sftpClient()
 	if err != nil {
-		return fmt.Errorf("failed to create sftp client: %v", err)
+		return err
 	}
-	defer sftpClient.Close()
 
 	fileInfo, err := sftpClient.Stat(remoteFile)
 	if err != nil {
@@ -310,45 +571,501 @@ func (ex *Remote) Delete(ctx context.Context, remoteFile string, opts *DeleteOpt
 	return nil
 }
 
-// sshRun executes command on remote server. context close sends interrupt signal to the remote process.
-func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string, verbose bool) (out []string, err error) {
+// forwardAgent connects to local ssh agent and serves agent channels opened by the remote host with it.
+// It is done once for the connection, sessions request the forwarding with agent.RequestAgentForwarding.
+func (ex *Remote) forwardAgent() error {
+	ex.agentOnce.Do(func() {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			ex.agentErr = fmt.Errorf("SSH_AUTH_SOCK is not set")
+			return
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			ex.agentErr = fmt.Errorf("can't connect to ssh agent: %w", err)
+			return
+		}
+		if err := agent.ForwardToAgent(ex.client, agent.NewClient(conn)); err != nil {
+			_ = conn.Close()
+			ex.agentErr = fmt.Errorf("can't serve agent channels: %w", err)
+			return
+		}
+		ex.agentConn = conn
+		log.Printf("[DEBUG] ssh agent %s forwarded to %s", sock, ex.hostAddr)
+	})
+	return ex.agentErr
+}
+
+// sshRun executes command on remote server. Context close terminates the whole remote process group of the command,
+// with TERM first and KILL after remoteKillGrace, as sshd servers commonly ignore session signals.
+// Stdin of options, if set, is passed to the remote process over the ssh session, without touching the remote disk.
+func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string, opts *RunOpts) (res RunResult, err error) {
 	log.Printf("[DEBUG] run ssh command %q on %s", command, client.RemoteAddr().String())
+	if opts != nil && opts.Stdin != nil && (opts.TTY || opts.Become != nil && opts.Become.NeedsTTY()) {
+		// terminal line discipline truncates long lines and interprets control characters of the input
+		return res, fmt.Errorf("input is not supported with tty")
+	}
+
 	session, err := client.NewSession()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+		return res, fmt.Errorf("failed to create session: %w", err)
 	}
 	defer session.Close()
 
-	outLog, errLog := MakeOutAndErrWriters(ex.hostAddr, ex.hostName, verbose, ex.secrets)
+	if opts != nil && opts.ForwardAgent {
+		if err = ex.forwardAgent(); err != nil {
+			return res, fmt.Errorf("can't forward ssh agent: %w", err)
+		}
+		if err = agent.RequestAgentForwarding(session); err != nil {
+			return res, fmt.Errorf("failed to request ssh agent forwarding: %w", err)
+		}
+	}
+
+	outLog, errLog := MakeOutAndErrWriters(ex.hostAddr, ex.hostName, opts != nil && opts.Verbose, ex.secrets)
 	outLog.Write([]byte(command)) // nolint
 
-	var stdoutBuf bytes.Buffer
-	mwr := io.MultiWriter(outLog, &stdoutBuf)
-	session.Stdout, session.Stderr = mwr, errLog
+	collector, stderrTail := newOutputCollector(opts, false), newStderrTail()
+	pidWr := &pidWriter{wr: io.MultiWriter(outLog, collector)}
+	var stdout, stderr io.Writer = pidWr, io.MultiWriter(errLog, stderrTail)
+	var stdin io.Reader
+	if opts != nil {
+		stdin = opts.Stdin
+	}
+
+	if opts != nil && (opts.TTY || opts.Become != nil && opts.Become.NeedsTTY()) {
+		if err = ex.requestPty(session); err != nil {
+			return res, err
+		}
+		// terminal merges stderr into stdout, the tail of combined output is reported on errors.
+		// the tail is written by pidWriter, so the pid marker is not a part of it
+		pidWr.wr = io.MultiWriter(outLog, collector, stderrTail)
+	}
 
-	done := make(chan error)
+	if opts != nil && opts.Become != nil && opts.Become.Password != "" {
+		// the password is sent over stdin on the prompt, the input is read by own goroutine, as it may block
+		// till the end of the command, and session.Run waits for its stdin reader otherwise
+		bs := newBecomeSession(opts.Become, stdin)
+		defer bs.Close()
+		stdout, stderr = bs.Writer(stdout), bs.Writer(stderr)
+		stdinPipe, e := session.StdinPipe()
+		if e != nil {
+			return res, fmt.Errorf("failed to make stdin pipe: %w", e)
+		}
+		go func() {
+			if _, e := io.Copy(stdinPipe, bs); e != nil {
+				log.Printf("[DEBUG] can't pass input to remote command on %s: %v", ex.hostAddr, e)
+			}
+			_ = stdinPipe.Close()
+		}()
+		stdin = nil
+	}
+
+	if opts != nil && (opts.TTY || opts.Become != nil && opts.Become.NeedsTTY()) {
+		stdout = &crStripper{wr: stdout}
+	}
+	session.Stdout, session.Stderr, session.Stdin = stdout, stderr, stdin
+
+	done := make(chan error, 1)
 	go func() {
-		done <- session.Run(command)
+		// the session shell started by sshd is a session and process group leader, so its pid reported
+		// by the marker line is the id of the process group of everything the command starts. The pid is
+		// printed by sh as parent pid, as the login shell may be not POSIX, i.e. fish has no $$
+		done <- session.Run(fmt.Sprintf("sh -c 'printf \"%s%%s\\n\" \"$PPID\"'; %s", pidMarker, command))
 	}()
 
 	select {
 	case err = <-done:
+	case <-ctx.Done():
+		// most servers ignore session signals, the signal is sent for the ones supporting it
+		if e := session.Signal(ssh.SIGINT); e != nil {
+			log.Printf("[DEBUG] failed to send interrupt signal to remote process on %s: %v", ex.hostAddr, e)
+		}
+		if pid := pidWr.Pid(); pid > 0 && ctx.Value(killCtxKey{}) == nil {
+			var become *Become
+			if opts != nil {
+				become = opts.Become
+			}
+			ex.killProcessGroup(client, pid, become, done, errLog)
+		}
+		return RunResult{ExitCode: -1}, fmt.Errorf("canceled: %w", ctx.Err())
+	}
+
+	res = RunResult{Stdout: collector.Lines(), Stderr: stderrTail.Lines(ex.secrets), ExitCode: -1}
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		res.ExitCode = 0
+	case errors.As(err, &exitErr):
+		res.ExitCode, res.Signal = exitErr.ExitStatus(), exitErr.Signal()
+		if res.Signal != "" {
+			res.ExitCode = -1
+		}
+	}
+	if err = exitResult(&res, opts, err); err != nil {
+		return res, fmt.Errorf("failed to run command on remote server: %w", err)
+	}
+	return res, nil
+}
+
+// requestPty requests a pseudo-terminal for the session, with echo and CR translation of the output disabled.
+func (ex *Remote) requestPty(session *ssh.Session) error {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,     // don't echo the input, i.e. secrets, back to the output
+		ssh.ONLCR:         0,     // don't translate NL to CR-NL in the output
+		ssh.TTY_OP_ISPEED: 14400, // input speed, 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed, 14.4kbaud
+	}
+	if err := session.RequestPty("xterm", 24, 80, modes); err != nil {
+		return fmt.Errorf("failed to request pty on %s: %w", ex.hostAddr, err)
+	}
+	return nil
+}
+
+// killProcessGroup terminates the remote process group of canceled command. It sends TERM to the group first
+// and KILL after the grace period if the command is still running. Killed processes reported to errLog.
+// Signals are sent with the become of the command, as processes started under sudo or su can't be killed
+// by the login user.
+func (ex *Remote) killProcessGroup(client *ssh.Client, pgid int, become *Become, done <-chan error, errLog io.Writer) {
+	procs := ex.groupProcesses(client, pgid)
+
+	signal := func(sig string) {
+		cmd := fmt.Sprintf("kill -s %s -- -%d 2>/dev/null || kill -s %s %d 2>/dev/null", sig, pgid, sig, pgid)
+		var err error
+		if become != nil {
+			// the kill itself is not killed on timeout, the become may hang the same way as the command did
+			ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), killCtxKey{}, true), remoteKillGrace)
+			_, err = ex.sshRun(ctx, client, become.Wrap("sh -c "+ShellQuote(cmd)), &RunOpts{Become: become})
+			cancel()
+		} else {
+			_, err = ex.sshOutput(client, cmd)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to run command on remote server: %w", err)
+			log.Printf("[DEBUG] failed to send %s to remote process group %d on %s: %v", sig, pgid, ex.hostAddr, err)
+		}
+	}
+
+	report := func(sig string) {
+		msg := fmt.Sprintf("killed remote process group %d with %s", pgid, sig)
+		log.Printf("[WARN] %s on %s, processes: %v", msg, ex.hostAddr, procs)
+		errLog.Write([]byte(msg)) // nolint
+		for _, p := range procs {
+			errLog.Write([]byte("  " + p)) // nolint
+		}
+	}
+
+	signal("TERM")
+	select {
+	case <-done:
+		report("TERM")
+		return
+	case <-time.After(remoteKillGrace):
+	}
+
+	if left := ex.groupProcesses(client, pgid); len(left) > 0 {
+		procs = left
+	}
+	signal("KILL")
+	report("KILL")
+	select {
+	case <-done:
+	case <-time.After(remoteKillGrace):
+		log.Printf("[WARN] remote process group %d on %s is still running after KILL", pgid, ex.hostAddr)
+	}
+}
+
+// groupProcesses returns pid and command line of processes in the given remote process group.
+// Empty list returned if processes can't be listed, i.e. ps is not available.
+func (ex *Remote) groupProcesses(client *ssh.Client, pgid int) []string {
+	cmd := fmt.Sprintf("ps -eo pid=,pgid=,args= 2>/dev/null | awk '$2 == %d {$2=\"\"; print}'", pgid)
+	out, err := ex.sshOutput(client, cmd)
+	if err != nil {
+		log.Printf("[DEBUG] can't list remote process group %d on %s: %v", pgid, ex.hostAddr, err)
+		return nil
+	}
+	res := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// sshOutput runs a service command in a separate session and returns its stdout. It doesn't depend
+// on the context of the caller, as used to clean up after cancellation, limited by remoteKillGrace instead.
+func (ex *Remote) sshOutput(client *ssh.Client, command string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	type result struct {
+		out []byte
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		out, e := session.Output(command)
+		resCh <- result{out: out, err: e}
+	}()
+
+	select {
+	case res := <-resCh:
+		return string(res.out), res.err
+	case <-time.After(remoteKillGrace):
+		return "", fmt.Errorf("timeout running %q", command)
+	}
+}
+
+// pidWriter passes the output of the command through, except the leading marker line with the pid
+// of the remote shell. The marker is printed by the command wrapper before the command itself.
+type pidWriter struct {
+	wr   io.Writer
+	mu   sync.Mutex
+	buf  []byte
+	pid  int
+	done bool // marker line processed, the rest passed as is
+}
+
+// Write implements io.Writer.
+func (w *pidWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return w.wr.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	marker := []byte(pidMarker)
+	idx := bytes.IndexByte(w.buf, '\n')
+	if idx < 0 && (bytes.HasPrefix(w.buf, marker) || bytes.HasPrefix(marker, w.buf)) {
+		return len(p), nil // incomplete marker line, wait for more
+	}
+
+	rest := w.buf
+	if idx >= 0 && bytes.HasPrefix(w.buf, marker) {
+		if pid, err := strconv.Atoi(string(bytes.TrimSpace(w.buf[len(marker):idx]))); err == nil {
+			w.pid = pid
+		}
+		rest = w.buf[idx+1:]
+	}
+	w.done, w.buf = true, nil
+	if len(rest) > 0 {
+		if _, err := w.wr.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Pid returns the pid reported by the marker line, 0 if not reported yet.
+func (w *pidWriter) Pid() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pid
+}
+
+// uploadFiles uploads files, relative to localDir, to remoteDir. With concurrency > 1 files are uploaded in parallel
+// over the shared sftp client, remote directories are created upfront, sequentially and parent first.
+// Each upload streams the file, so memory usage is bounded by the concurrency.
+func (ex *Remote) uploadFiles(ctx context.Context, localDir, remoteDir string, files []string, concurrency int, opts UpDownOpts) error {
+	upload := func(file string, mkdir bool) error {
+		localPath, remotePath := filepath.Join(localDir, file), filepath.Join(remoteDir, file)
+		fileOpts := opts
+		fileOpts.Mkdir = mkdir
+		if err := ex.Upload(ctx, localPath, remotePath, &fileOpts); err != nil {
+			return fmt.Errorf("failed to upload %s to %s: %w", localPath, remotePath, err)
+		}
+		log.Printf("[INFO] synced %s to %s", localPath, remotePath)
+		return nil
+	}
+
+	if concurrency <= 1 || len(files) <= 1 {
+		for _, file := range files {
+			if err := upload(file, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sftpClient, err := ex.sftpClient()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{}
+	for _, file := range files {
+		dirs[filepath.Dir(filepath.Join(remoteDir, file))] = true
+	}
+	sortedDirs := make([]string, 0, len(dirs))
+	for d := range dirs {
+		sortedDirs = append(sortedDirs, d)
+	}
+	sort.Strings(sortedDirs) // parent directories go before children
+	for _, d := range sortedDirs {
+		if err = sftpClient.MkdirAll(d); err != nil {
+			return fmt.Errorf("failed to create remote directory %s: %w", d, err)
+		}
+	}
+
+	wg := syncs.NewErrSizedGroup(concurrency, syncs.Context(ctx), syncs.Preemptive)
+	for _, file := range files {
+		file := file
+		wg.Go(func() error { return upload(file, false) })
+	}
+	return wg.Wait()
+}
+
+// tarUpload uploads files, relative to localDir, as a single compressed tar stream. The stream is piped over one ssh
+// session into tar extraction at remoteDir, so file modes and modification times are kept.
+func (ex *Remote) tarUpload(ctx context.Context, localDir, remoteDir string, files []string, compress string, attrs FileAttrs) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if ex.client == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	st := time.Now()
+
+	extractCmd := fmt.Sprintf("mkdir -p %[1]s && tar -xzf - -C %[1]s", ShellQuote(remoteDir))
+	if compress == "zstd" {
+		extractCmd = fmt.Sprintf("mkdir -p %[1]s && zstd -d -c | tar -xf - -C %[1]s", ShellQuote(remoteDir))
+	}
+	log.Printf("[DEBUG] upload %d files from %s to %s with %q", len(files), localDir, remoteDir, extractCmd)
+
+	session, err := ex.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	pr, pw := io.Pipe()
+	session.Stdin, session.Stderr = pr, &stderr
+
+	tarErr := make(chan error, 1)
+	go func() {
+		e := writeTar(pw, localDir, files, compress, attrs)
+		pw.CloseWithError(e) // nolint
+		tarErr <- e
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(extractCmd) }()
+
+	select {
+	case err = <-done:
+		pr.Close() // nolint unblock tar writer if remote side exited early
+		e := <-tarErr
+		// remote failure goes first, as it breaks the tar writer with closed pipe error as well
+		if err != nil {
+			return fmt.Errorf("failed to extract tar stream: %w %s", err, strings.TrimSpace(stderr.String()))
+		}
+		if e != nil {
+			return fmt.Errorf("failed to make tar stream: %w", e)
 		}
 	case <-ctx.Done():
+		pr.CloseWithError(ctx.Err()) // nolint
 		if err = session.Signal(ssh.SIGINT); err != nil {
-			return nil, fmt.Errorf("failed to send interrupt signal to remote process: %w", err)
+			log.Printf("[WARN] failed to send interrupt signal to remote process: %v", err)
 		}
-		return nil, fmt.Errorf("canceled: %w", ctx.Err())
+		return fmt.Errorf("canceled: %w", ctx.Err())
 	}
 
-	for _, line := range strings.Split(stdoutBuf.String(), "\n") {
-		if line != "" {
-			out = append(out, line)
+	log.Printf("[INFO] uploaded %d files from %s to %s:%s with tar in %s", len(files), localDir, ex.hostAddr, remoteDir, time.Since(st))
+	return nil
+}
+
+// writeTar writes files, relative to dir, to w as tar stream compressed with gzip (default) or zstd.
+// Owner of files is set from attrs only, otherwise extracted files are owned by the remote user.
+// Ownership from the stream is applied by tar extracting as root only.
+func writeTar(w io.Writer, dir string, files []string, compress string, attrs FileAttrs) error {
+	var cw io.WriteCloser
+	switch compress {
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return fmt.Errorf("failed to make zstd writer: %w", err)
+		}
+		cw = zw
+	default:
+		cw = gzip.NewWriter(w)
+	}
+
+	tw := tar.NewWriter(cw)
+	addFile := func(file string) error {
+		path := filepath.Join(dir, file)
+		fi, err := os.Stat(path)
+		if attrs.PreserveLinks {
+			fi, err = os.Lstat(path)
+		}
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(file)
+		setTarAttrs(hdr, fi, attrs)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if link != "" {
+			return nil
+		}
+		fh, err := os.Open(path) // nolint
+		if err != nil {
+			return err
+		}
+		defer fh.Close() // nolint ro file
+		_, err = io.Copy(tw, fh)
+		return err
+	}
+
+	for _, file := range files {
+		if err := addFile(file); err != nil {
+			return fmt.Errorf("failed to add %s to tar: %w", file, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	return cw.Close()
+}
+
+// setTarAttrs sets mode and ownership of tar header from attrs. Names of owner and group are resolved by tar on extraction.
+func setTarAttrs(hdr *tar.Header, fi os.FileInfo, attrs FileAttrs) {
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if attrs.Mode != 0 && hdr.Typeflag != tar.TypeSymlink {
+		hdr.Mode = hdr.Mode&^0o7777 | int64(unixMode(attrs.Mode))
+	}
+	if attrs.PreserveOwner {
+		if uid, gid, ok := FileOwner(fi); ok {
+			hdr.Uid, hdr.Gid = uid, gid
+		}
+	}
+	if attrs.Owner != "" {
+		if uid, err := strconv.Atoi(attrs.Owner); err == nil {
+			hdr.Uid = uid
+		} else {
+			hdr.Uname = attrs.Owner
+		}
+	}
+	if attrs.Group != "" {
+		if gid, err := strconv.Atoi(attrs.Group); err == nil {
+			hdr.Gid = gid
+		} else {
+			hdr.Gname = attrs.Group
 		}
 	}
-	return out, nil
 }
 
 type sftpReq struct {
@@ -358,7 +1075,10 @@ type sftpReq struct {
 	remoteFile string
 	mkdir      bool
 	force      bool
-	client     *ssh.Client
+	checksum   bool
+	atomic     bool
+	backup     int
+	attrs      FileAttrs
 }
 
 func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
@@ -367,11 +1087,20 @@ func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
 		log.Printf("[INFO] uploaded %s to %s:%s in %s", req.localFile, req.remoteHost, req.remoteFile, time.Since(st))
 	}(time.Now())
 
-	sftpClient, err := sftp.NewClient(req.client, sftp.UseConcurrentWrites(true))
+	sftpClient, err := ex.sftpClient()
 	if err != nil {
-		return fmt.Errorf("failed to create sftp client: %v", err)
+		return err
+	}
+
+	if req.attrs.PreserveLinks {
+		fi, e := os.Lstat(req.localFile)
+		if e != nil {
+			return fmt.Errorf("failed to stat local file %s: %v", req.localFile, e)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return ex.sftpLink(sftpClient, req)
+		}
 	}
-	defer sftpClient.Close()
 
 	inpFh, err := os.Open(req.localFile)
 	if err != nil {
@@ -386,10 +1115,19 @@ func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
 	log.Printf("[DEBUG] file mode for %s: %s", req.localFile, fmt.Sprintf("%04o", inpFi.Mode().Perm()))
 
 	remoteFi, err := sftpClient.Stat(req.remoteFile)
-	if err == nil {
+	exists := err == nil
+	if exists {
 		// if remote file exists, and has the same size, mod time and mode, skip upload. Force flag overrides this.
-		isSame := !req.force && remoteFi.Size() == inpFi.Size() &&
-			isWithinOneSecond(remoteFi.ModTime(), inpFi.ModTime()) && remoteFi.Mode() == inpFi.Mode()
+		// with checksum option, the content checksum is compared instead of mod time.
+		isSame := !req.force && remoteFi.Size() == inpFi.Size() && remoteFi.Mode() == req.attrs.fileMode(inpFi.Mode())
+		if isSame && !req.checksum {
+			isSame = isWithinOneSecond(remoteFi.ModTime(), inpFi.ModTime())
+		}
+		if isSame && req.checksum {
+			if isSame, err = ex.sameChecksum(ctx, req.localFile, req.remoteFile); err != nil {
+				return fmt.Errorf("failed to compare checksums of %s and %s: %w", req.localFile, req.remoteFile, err)
+			}
+		}
 		if isSame {
 			log.Printf("[INFO] remote file %s identical to local file %s, skipping upload", req.remoteFile, req.localFile)
 			return nil
@@ -402,7 +1140,59 @@ func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
 		}
 	}
 
-	remoteFh, err := sftpClient.Create(req.remoteFile)
+	backup := ""
+	if req.backup > 0 && exists {
+		backup = BackupName(req.remoteFile, time.Now())
+		if !req.atomic {
+			// the original file is moved to backup, the new one is written in place
+			if err = sftpClient.Rename(req.remoteFile, backup); err != nil {
+				return fmt.Errorf("failed to backup remote file %s: %v", req.remoteFile, err)
+			}
+		}
+	}
+
+	// with atomic option, the file is written to a temporary file next to the destination and renamed after that
+	target := req.remoteFile
+	if req.atomic {
+		target = atomicTmpName(req.remoteFile)
+	}
+	if err = ex.sftpWrite(ctx, sftpClient, inpFh, inpFi, target, req.attrs); err != nil {
+		if req.atomic {
+			if e := sftpClient.Remove(target); e != nil && !errors.Is(e, os.ErrNotExist) {
+				log.Printf("[WARN] failed to remove temporary remote file %s: %v", target, e)
+			}
+		}
+		if backup != "" && !req.atomic {
+			// the original file is moved back in place of the partially written one
+			if e := sftpClient.PosixRename(backup, req.remoteFile); e != nil {
+				log.Printf("[WARN] failed to restore remote file %s from backup %s: %v", req.remoteFile, backup, e)
+			}
+		}
+		return err
+	}
+
+	if req.atomic {
+		if backup != "" {
+			// hard link keeps the original file in place until it is replaced
+			if err = sftpClient.Link(req.remoteFile, backup); err != nil {
+				return fmt.Errorf("failed to backup remote file %s: %v", req.remoteFile, err)
+			}
+		}
+		if err = sftpClient.PosixRename(target, req.remoteFile); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %v", target, req.remoteFile, err)
+		}
+	}
+
+	if backup != "" {
+		return ex.sftpPruneBackups(sftpClient, req.remoteFile, req.backup)
+	}
+	return nil
+}
+
+// sftpWrite writes local file to the remote target and sets its attributes
+func (ex *Remote) sftpWrite(ctx context.Context, sftpClient *sftp.Client, inpFh io.Reader, inpFi os.FileInfo,
+	target string, attrs FileAttrs) error {
+	remoteFh, err := sftpClient.Create(target)
 	if err != nil {
 		return fmt.Errorf("failed to create remote file: %v", err)
 	}
@@ -423,26 +1213,147 @@ func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
 		}
 	}
 
-	if err = remoteFh.Chmod(inpFi.Mode().Perm()); err != nil {
+	if attrs.hasOwner() {
+		// ownership is changed before permissions, as chown may reset setuid and setgid bits
+		if err = ex.sftpChown(ctx, sftpClient, target, inpFi, attrs); err != nil {
+			return err
+		}
+	}
+
+	// the same mode is compared with the remote one to skip unchanged files, setuid bits included
+	if err = remoteFh.Chmod(attrs.fileMode(inpFi.Mode())); err != nil {
 		return fmt.Errorf("failed to set permissions on remote file: %v", err)
 	}
 
-	if err = sftpClient.Chtimes(req.remoteFile, inpFi.ModTime(), inpFi.ModTime()); err != nil {
-		return fmt.Errorf("failed to set modification time of remote file %s: %v", req.remoteFile, err)
+	if err = sftpClient.Chtimes(target, inpFi.ModTime(), inpFi.ModTime()); err != nil {
+		return fmt.Errorf("failed to set modification time of remote file %s: %v", target, err)
+	}
+	return remoteFh.Close()
+}
+
+// sftpPruneBackups removes old backups of the remote file, keeping the newest keep ones
+func (ex *Remote) sftpPruneBackups(sftpClient *sftp.Client, remoteFile string, keep int) error {
+	entries, err := sftpClient.ReadDir(filepath.Dir(remoteFile))
+	if err != nil {
+		return fmt.Errorf("failed to read remote directory %s: %v", filepath.Dir(remoteFile), err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
 	}
+	for _, name := range expiredBackups(remoteFile, names, keep) {
+		path := filepath.Join(filepath.Dir(remoteFile), name)
+		if err = sftpClient.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove old backup %s: %v", path, err)
+		}
+		log.Printf("[DEBUG] removed old backup %s", path)
+	}
+	return nil
+}
 
+// sftpLink recreates local symlink on remote host, the existing remote file is replaced.
+// Ownership of the link is not changed, sftp has no way to change it without following the link.
+func (ex *Remote) sftpLink(sftpClient *sftp.Client, req sftpReq) error {
+	target, err := os.Readlink(req.localFile)
+	if err != nil {
+		return fmt.Errorf("failed to read local link %s: %v", req.localFile, err)
+	}
+	if cur, e := sftpClient.ReadLink(req.remoteFile); e == nil && cur == target && !req.force {
+		log.Printf("[INFO] remote link %s identical to local link %s, skipping upload", req.remoteFile, req.localFile)
+		return nil
+	}
+	if req.mkdir {
+		if e := sftpClient.MkdirAll(filepath.Dir(req.remoteFile)); e != nil {
+			return fmt.Errorf("failed to create remote directory: %v", e)
+		}
+	}
+	if e := sftpClient.Remove(req.remoteFile); e != nil && !errors.Is(e, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove remote file %s: %v", req.remoteFile, e)
+	}
+	if err = sftpClient.Symlink(target, req.remoteFile); err != nil {
+		return fmt.Errorf("failed to create remote link %s: %v", req.remoteFile, err)
+	}
 	return nil
 }
 
+// sftpChown changes ownership of the uploaded remote file. Explicit owner and group take precedence
+// over the preserved ownership of the local file, unset parts keep the current remote ownership.
+func (ex *Remote) sftpChown(ctx context.Context, sftpClient *sftp.Client, remoteFile string, localFi os.FileInfo, attrs FileAttrs) error {
+	fi, err := sftpClient.Stat(remoteFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat remote file %s: %v", remoteFile, err)
+	}
+	st, ok := fi.Sys().(*sftp.FileStat)
+	if !ok {
+		return fmt.Errorf("can't get ownership of remote file %s", remoteFile)
+	}
+	uid, gid := int(st.UID), int(st.GID)
+	if attrs.PreserveOwner {
+		if u, g, ok := FileOwner(localFi); ok {
+			uid, gid = u, g
+		}
+	}
+	if attrs.Owner != "" {
+		if uid, err = ex.remoteID(ctx, "id -u", attrs.Owner); err != nil {
+			return fmt.Errorf("can't get uid of %q: %w", attrs.Owner, err)
+		}
+	}
+	if attrs.Group != "" {
+		if gid, err = ex.remoteID(ctx, "getent group", attrs.Group); err != nil {
+			return fmt.Errorf("can't get gid of %q: %w", attrs.Group, err)
+		}
+	}
+	if err = sftpClient.Chown(remoteFile, uid, gid); err != nil {
+		return fmt.Errorf("failed to change owner of remote file %s to %d:%d: %v", remoteFile, uid, gid, err)
+	}
+	return nil
+}
+
+// remoteID returns numeric id of remote user or group name with lookup command, "id -u" or "getent group".
+// Numeric names are returned as is, resolved names are cached for the connection.
+func (ex *Remote) remoteID(ctx context.Context, lookup, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	key := lookup + " " + name
+	ex.idsMu.Lock()
+	defer ex.idsMu.Unlock()
+	if id, ok := ex.ids[key]; ok {
+		return id, nil
+	}
+	runRes, err := ex.sshRun(ctx, ex.client, key+" "+ShellQuote(name), nil)
+	if err != nil {
+		return 0, err
+	}
+	out := runRes.Stdout
+	if len(out) == 0 {
+		return 0, fmt.Errorf("%q not found", name)
+	}
+	res := strings.TrimSpace(out[0])
+	if lookup == "getent group" { // group entry is name:password:gid:members
+		if parts := strings.Split(res, ":"); len(parts) > 2 {
+			res = parts[2]
+		}
+	}
+	id, err := strconv.Atoi(res)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected %s output %q: %w", lookup, res, err)
+	}
+	if ex.ids == nil {
+		ex.ids = map[string]int{}
+	}
+	ex.ids[key] = id
+	return id, nil
+}
+
 func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 	log.Printf("[INFO] download %s from %s:%s", req.localFile, req.remoteHost, req.remoteFile)
 	defer func(st time.Time) { log.Printf("[DEBUG] download done for %q in %s", req.localFile, time.Since(st)) }(time.Now())
 
-	sftpClient, err := sftp.NewClient(req.client)
+	sftpClient, err := ex.sftpClient()
 	if err != nil {
-		return fmt.Errorf("failed to create sftp client: %v", err)
+		return err
 	}
-	defer sftpClient.Close()
 
 	remoteFh, err := sftpClient.Open(req.remoteFile)
 	if err != nil {
@@ -455,6 +1366,12 @@ func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 		return fmt.Errorf("failed to stat remote file: %v", err)
 	}
 
+	if req.mkdir {
+		if err = os.MkdirAll(filepath.Dir(req.localFile), 0o750); err != nil {
+			return fmt.Errorf("failed to create local directory: %v", err)
+		}
+	}
+
 	// Check if local file exists, if not create it.
 	if _, stErr := os.Stat(req.localFile); stErr != nil {
 		if !os.IsNotExist(stErr) {
@@ -484,6 +1401,11 @@ func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 		return nil
 	}
 
+	// the existing local file can be longer than the remote one
+	if err = localFh.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate local file: %v", err)
+	}
+
 	errCh := make(chan error, 1)
 	go func() {
 		_, e := io.Copy(localFh, remoteFh)
@@ -499,7 +1421,14 @@ func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 		}
 	}
 
-	return localFh.Sync() // nolint
+	if err = localFh.Sync(); err != nil {
+		return fmt.Errorf("failed to sync local file: %v", err)
+	}
+	// keep the remote mod time, so the next download or sync can skip the unchanged file
+	if err = os.Chtimes(req.localFile, remoteFi.ModTime(), remoteFi.ModTime()); err != nil {
+		return fmt.Errorf("failed to set local file mod time: %v", err)
+	}
+	return nil
 }
 
 type fileProperties struct {
@@ -507,6 +1436,7 @@ type fileProperties struct {
 	Time     time.Time
 	FileName string
 	IsDir    bool
+	Mode     os.FileMode
 }
 
 // getLocalFilesProperties returns map of file properties for all files in the local directory.
@@ -525,7 +1455,8 @@ func (ex *Remote) getLocalFilesProperties(dir string) (map[string]fileProperties
 		if err != nil {
 			return fmt.Errorf("failed to get relative path: %w", err)
 		}
-		fileProps[relPath] = fileProperties{Size: info.Size(), Time: info.ModTime(), FileName: info.Name(), IsDir: info.IsDir()}
+		fileProps[relPath] = fileProperties{Size: info.Size(), Time: info.ModTime(), FileName: info.Name(), IsDir: info.IsDir(),
+			Mode: info.Mode()}
 		return nil
 	})
 
@@ -541,11 +1472,10 @@ func (ex *Remote) getLocalFilesProperties(dir string) (map[string]fileProperties
 // doesn't support excluding files/directories, and we can speed up the process by excluding files/directories that
 // are not needed.
 func (ex *Remote) getRemoteFilesProperties(ctx context.Context, dir string, excl []string) (map[string]fileProperties, error) {
-	sftpClient, e := sftp.NewClient(ex.client)
+	sftpClient, e := ex.sftpClient()
 	if e != nil {
-		return nil, fmt.Errorf("failed to create sftp client: %v", e)
+		return nil, e
 	}
-	defer sftpClient.Close()
 
 	fileProps := make(map[string]fileProperties)
 
@@ -588,7 +1518,8 @@ func (ex *Remote) getRemoteFilesProperties(ctx context.Context, dir string, excl
 				continue
 			}
 
-			fileProps[relPath] = fileProperties{Size: entry.Size(), Time: entry.ModTime(), FileName: fullPath, IsDir: entry.IsDir()}
+			fileProps[relPath] = fileProperties{Size: entry.Size(), Time: entry.ModTime(), FileName: fullPath, IsDir: entry.IsDir(),
+				Mode: entry.Mode()}
 		}
 		return nil
 	}
@@ -630,12 +1561,75 @@ func (ex *Remote) findUnmatchedFiles(local, remote map[string]fileProperties, ex
 	return updatedFiles, deletedFiles
 }
 
+// findUnmatchedFilesByChecksum returns local files to be uploaded, comparing the content checksums of local and remote
+// files of the same size. Files missing on remote or with a different size are unmatched without checksum calculation.
+func (ex *Remote) findUnmatchedFilesByChecksum(ctx context.Context, localDir, remoteDir string,
+	local, remote map[string]fileProperties, excl []string) ([]string, error) {
+	sums := func(files []string) (map[string]string, error) { return ex.remoteChecksums(ctx, files) }
+	return unmatchedByChecksum(localDir, remoteDir, local, remote, excl, sums)
+}
+
+// sameChecksum checks if local and remote files have the same content checksum
+func (ex *Remote) sameChecksum(ctx context.Context, localFile, remoteFile string) (bool, error) {
+	localSum, err := fileChecksum(localFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to calculate checksum of %s: %w", localFile, err)
+	}
+	remoteSums, err := ex.remoteChecksums(ctx, []string{remoteFile})
+	if err != nil {
+		return false, err
+	}
+	return remoteSums[remoteFile] == localSum, nil
+}
+
+// remoteChecksums returns sha256 checksums of remote files, by file path. It runs sha256sum for batches of files
+// and falls back to reading files with sftp if sha256sum fails, i.e. not installed.
+func (ex *Remote) remoteChecksums(ctx context.Context, files []string) (map[string]string, error) {
+	run := func(cmd string) (RunResult, error) { return ex.sshRun(ctx, ex.client, cmd, nil) }
+	res, err := runChecksums(run, files)
+	if err == nil {
+		return res, nil
+	}
+	log.Printf("[DEBUG] can't run sha256sum on %s, fallback to sftp: %v", ex.hostAddr, err)
+	return ex.sftpChecksums(ctx, files)
+}
+
+// sftpChecksums returns sha256 checksums of remote files, by file path, reading files with sftp.
+// Missing files are skipped.
+func (ex *Remote) sftpChecksums(ctx context.Context, files []string) (map[string]string, error) {
+	sftpClient, err := ex.sftpClient()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(files))
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		sum, err := func() (string, error) {
+			fh, err := sftpClient.Open(f)
+			if err != nil {
+				return "", err
+			}
+			defer fh.Close() // nolint ro file
+			return readerChecksum(fh)
+		}()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to calculate checksum of remote file %s: %w", f, err)
+		}
+		res[f] = sum
+	}
+	return res, nil
+}
+
 func (ex *Remote) findMatchedFiles(remote string, excl []string) ([]string, error) {
-	sftpClient, err := sftp.NewClient(ex.client)
+	sftpClient, err := ex.sftpClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create sftp client: %v", err)
+		return nil, err
 	}
-	defer sftpClient.Close()
 
 	matches, err := sftpClient.Glob(remote)
 	if err != nil {
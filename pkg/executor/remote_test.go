@@ -1,22 +1,33 @@
 package executor
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-pkgz/fileutils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func TestExecuter_UploadAndDownload(t *testing.T) {
@@ -27,7 +38,7 @@ func TestExecuter_UploadAndDownload(t *testing.T) {
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
 
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -55,7 +66,7 @@ func TestExecuter_UploadGlobAndDownload(t *testing.T) {
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
 
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -113,7 +124,7 @@ func TestExecuter_Upload_FailedSourceNotFound(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -129,7 +140,7 @@ func TestExecuter_Upload_FailedNoRemoteDir(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -145,7 +156,7 @@ func TestExecuter_Upload_CantMakeRemoteDir(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -161,7 +172,7 @@ func TestExecuter_Upload_Canceled(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -178,7 +189,7 @@ func TestExecuter_UploadCanceledWithoutMkdir(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -188,6 +199,35 @@ func TestExecuter_UploadCanceledWithoutMkdir(t *testing.T) {
 	require.EqualError(t, err, "failed to copy file: context canceled")
 }
 
+func TestExecuter_UploadAtomicWithBackup(t *testing.T) {
+	ctx := context.Background()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	src := filepath.Join(t.TempDir(), "app.conf")
+	for _, atomic := range []bool{true, false} {
+		dst := fmt.Sprintf("/tmp/atomic-%v/app.conf", atomic)
+		for _, content := range []string{"v1", "v22", "v333"} {
+			require.NoError(t, os.WriteFile(src, []byte(content), 0o644))
+			err = sess.Upload(ctx, src, dst, &UpDownOpts{Mkdir: true, Atomic: atomic, Backup: 1})
+			require.NoError(t, err)
+			time.Sleep(5 * time.Millisecond)
+		}
+		runRes, err := sess.Run(ctx, fmt.Sprintf("cd %s && ls -a | sort && cat app.conf app.conf.spot-*", filepath.Dir(dst)), nil)
+		require.NoError(t, err)
+		require.Len(t, runRes.Stdout, 5, "atomic %v: %v", atomic, runRes.Stdout)
+		assert.Equal(t, []string{".", "..", "app.conf"}, runRes.Stdout[:3])
+		assert.True(t, isBackupFile(runRes.Stdout[3]))
+		assert.Equal(t, "v333v22", runRes.Stdout[4])
+	}
+}
+
 func TestUpload_UploadOverwriteWithAndWithoutForce(t *testing.T) {
 	ctx := context.Background()
 	hostAndPort, teardown := startTestContainer(t)
@@ -196,7 +236,7 @@ func TestUpload_UploadOverwriteWithAndWithoutForce(t *testing.T) {
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
 
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -229,7 +269,7 @@ func TestExecuter_ConnectCanceled(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	_, err = c.Connect(ctx, hostAndPort, "h1", "test")
+	_, err = c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	assert.ErrorContains(t, err, "failed to dial: dial tcp: lookup localhost: i/o timeout")
 }
 
@@ -241,14 +281,14 @@ func TestExecuter_Run(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
 	t.Run("single line out", func(t *testing.T) {
-		out, e := sess.Run(ctx, "sh -c 'echo hello world'", nil)
+		runRes, e := sess.Run(ctx, "sh -c 'echo hello world'", nil)
 		require.NoError(t, e)
-		assert.Equal(t, []string{"hello world"}, out)
+		assert.Equal(t, []string{"hello world"}, runRes.Stdout)
 	})
 
 	t.Run("multi line out", func(t *testing.T) {
@@ -257,20 +297,20 @@ func TestExecuter_Run(t *testing.T) {
 		err = sess.Upload(ctx, "testdata/data2.txt", "/tmp/st/data2.txt", &UpDownOpts{Mkdir: true})
 		assert.NoError(t, err)
 
-		out, err := sess.Run(ctx, "ls -1 /tmp/st", nil)
+		runRes, err := sess.Run(ctx, "ls -1 /tmp/st", nil)
 		require.NoError(t, err)
-		t.Logf("out: %v", out)
-		assert.Equal(t, 2, len(out))
-		assert.Equal(t, "data1.txt", out[0])
-		assert.Equal(t, "data2.txt", out[1])
+		t.Logf("out: %v", runRes.Stdout)
+		assert.Equal(t, 2, len(runRes.Stdout))
+		assert.Equal(t, "data1.txt", runRes.Stdout[0])
+		assert.Equal(t, "data2.txt", runRes.Stdout[1])
 	})
 
 	t.Run("find out", func(t *testing.T) {
 		cmd := fmt.Sprintf("find %s -type f -exec stat -c '%%n:%%s' {} \\;", "/tmp/")
-		out, e := sess.Run(ctx, cmd, &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, cmd, &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
-		assert.Equal(t, []string{"/tmp/st/data1.txt:13", "/tmp/st/data2.txt:13"}, out)
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
+		assert.Equal(t, []string{"/tmp/st/data1.txt:13", "/tmp/st/data2.txt:13"}, runRes.Stdout)
 	})
 
 	t.Run("with secrets", func(t *testing.T) {
@@ -281,7 +321,7 @@ func TestExecuter_Run(t *testing.T) {
 		sess.SetSecrets([]string{"data2"})
 		defer sess.SetSecrets(nil)
 		cmd := fmt.Sprintf("find %s -type f -exec stat -c '%%n:%%s' {} \\;", "/tmp/")
-		out, e := sess.Run(ctx, cmd, &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, cmd, &RunOpts{Verbose: true})
 		writer.Close()
 		os.Stdout = originalStdout
 
@@ -289,8 +329,8 @@ func TestExecuter_Run(t *testing.T) {
 		require.NoError(t, err)
 
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
-		assert.Equal(t, []string{"/tmp/st/data1.txt:13", "/tmp/st/data2.txt:13"}, out)
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
+		assert.Equal(t, []string{"/tmp/st/data1.txt:13", "/tmp/st/data2.txt:13"}, runRes.Stdout)
 		t.Logf("capturedStdout: %s", capturedStdout)
 		assert.NotContains(t, string(capturedStdout), "data2", "captured stdout should not contain secrets")
 		assert.Contains(t, string(capturedStdout), "****", "captured stdout should contain masked secrets")
@@ -301,6 +341,33 @@ func TestExecuter_Run(t *testing.T) {
 		assert.ErrorContains(t, err, "failed to run command on remote server")
 	})
 
+	t.Run("with tty", func(t *testing.T) {
+		res, err := sess.Run(ctx, "test -t 1 && echo has tty; echo err1 >&2", &RunOpts{TTY: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"has tty", "err1"}, res.Stdout, "stderr merged, no CR")
+
+		_, err = sess.Run(ctx, ". /dev/stdin; echo $SEC", &RunOpts{TTY: true, Stdin: strings.NewReader("export SEC='secret value'\n")})
+		require.EqualError(t, err, "input is not supported with tty")
+
+		res, err = sess.Run(ctx, "test -t 1 || echo no tty", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"no tty"}, res.Stdout)
+	})
+
+	t.Run("exit code and stderr", func(t *testing.T) {
+		res, err := sess.Run(ctx, "echo out1; echo err1 >&2; exit 3", nil)
+		var exitErr *ExitError
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, 3, exitErr.ExitCode)
+		assert.EqualError(t, err, "failed to run command on remote server: Process exited with status 3, stderr:\n  err1")
+		assert.Equal(t, RunResult{Stdout: []string{"out1"}, Stderr: []string{"err1"}, ExitCode: 3}, res)
+
+		res, err = sess.Run(ctx, "echo out1; exit 3", &RunOpts{OkExitCodes: []int{0, 3}})
+		require.NoError(t, err)
+		assert.Equal(t, 3, res.ExitCode)
+		assert.Equal(t, []string{"out1"}, res.Stdout)
+	})
+
 	t.Run("ctx canceled", func(t *testing.T) {
 		ctxCancel, cancel := context.WithCancel(ctx)
 		cancel()
@@ -308,6 +375,47 @@ func TestExecuter_Run(t *testing.T) {
 		assert.ErrorContains(t, err, "context canceled")
 	})
 
+	t.Run("ctx canceled kills process group", func(t *testing.T) {
+		defer func(grace time.Duration) { remoteKillGrace = grace }(remoteKillGrace)
+		remoteKillGrace = time.Second
+		ctxCancel, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		_, err := sess.Run(ctxCancel, "sleep 31 & sleep 32 & sh -c 'trap \"\" TERM; sleep 33'", nil)
+		assert.ErrorContains(t, err, "context deadline exceeded")
+
+		runRes, err := sess.Run(ctx, "ps -o args | grep 'sleep 3[123]' || true", nil)
+		require.NoError(t, err)
+		assert.Empty(t, runRes.Stdout, "all processes of the command killed")
+	})
+}
+
+func TestPidWriter(t *testing.T) {
+	tbl := []struct {
+		name   string
+		writes []string
+		out    string
+		pid    int
+	}{
+		{name: "marker and output", writes: []string{"spot-pid:123\nline1\nline2\n"}, out: "line1\nline2\n", pid: 123},
+		{name: "split marker", writes: []string{"spot-", "pid:45", "6\nline1", "\nline2\n"}, out: "line1\nline2\n", pid: 456},
+		{name: "marker only", writes: []string{"spot-pid:7\n"}, out: "", pid: 7},
+		{name: "no marker", writes: []string{"line1\n", "spot-pid:1\n"}, out: "line1\nspot-pid:1\n", pid: 0},
+		{name: "no marker without newline", writes: []string{"line1", "line2\n"}, out: "line1line2\n", pid: 0},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			wr := &pidWriter{wr: &buf}
+			for _, w := range tt.writes {
+				n, err := wr.Write([]byte(w))
+				require.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			assert.Equal(t, tt.out, buf.String())
+			assert.Equal(t, tt.pid, wr.Pid())
+		})
+	}
 }
 
 func TestExecuter_Sync(t *testing.T) {
@@ -317,7 +425,7 @@ func TestExecuter_Sync(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -326,10 +434,10 @@ func TestExecuter_Sync(t *testing.T) {
 		require.NoError(t, e)
 		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
 		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
-		out, e := sess.Run(ctx, "find /tmp/sync.dest -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, "find /tmp/sync.dest -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
-		assert.Equal(t, []string{"17 /tmp/sync.dest/d1/file11.txt", "185 /tmp/sync.dest/file1.txt", "61 /tmp/sync.dest/file2.txt"}, out)
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
+		assert.Equal(t, []string{"17 /tmp/sync.dest/d1/file11.txt", "185 /tmp/sync.dest/file1.txt", "61 /tmp/sync.dest/file2.txt"}, runRes.Stdout)
 
 		res, e = sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest", &SyncOpts{Delete: true})
 		require.NoError(t, e)
@@ -349,10 +457,10 @@ func TestExecuter_Sync(t *testing.T) {
 		require.NoError(t, e)
 		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
 		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
-		out, e := sess.Run(ctx, "find /tmp/sync.dest2 -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, "find /tmp/sync.dest2 -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
-		assert.Equal(t, []string{"17 /tmp/sync.dest2/d1/file11.txt", "185 /tmp/sync.dest2/file1.txt", "61 /tmp/sync.dest2/file2.txt"}, out)
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
+		assert.Equal(t, []string{"17 /tmp/sync.dest2/d1/file11.txt", "185 /tmp/sync.dest2/file1.txt", "61 /tmp/sync.dest2/file2.txt"}, runRes.Stdout)
 	})
 
 	t.Run("sync with non-empty dir on remote to delete", func(t *testing.T) {
@@ -364,10 +472,10 @@ func TestExecuter_Sync(t *testing.T) {
 		require.NoError(t, e)
 		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
 		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
-		out, e := sess.Run(ctx, "find /tmp/sync.dest3 -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, "find /tmp/sync.dest3 -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
-		assert.Equal(t, []string{"17 /tmp/sync.dest3/d1/file11.txt", "185 /tmp/sync.dest3/file1.txt", "61 /tmp/sync.dest3/file2.txt"}, out)
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
+		assert.Equal(t, []string{"17 /tmp/sync.dest3/d1/file11.txt", "185 /tmp/sync.dest3/file1.txt", "61 /tmp/sync.dest3/file2.txt"}, runRes.Stdout)
 	})
 
 	t.Run("sync  with non-empty dir on remote to keep", func(t *testing.T) {
@@ -379,11 +487,112 @@ func TestExecuter_Sync(t *testing.T) {
 		require.NoError(t, e)
 		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
 		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
-		out, e := sess.Run(ctx, "find /tmp/sync.dest4 -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, "find /tmp/sync.dest4 -type f -exec stat -c '%s %n' {} \\;", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+		sort.Slice(runRes.Stdout, func(i, j int) bool { return runRes.Stdout[i] < runRes.Stdout[j] })
 		assert.Equal(t, []string{"0 /tmp/sync.dest4/empty/afile1.txt", "17 /tmp/sync.dest4/d1/file11.txt",
-			"185 /tmp/sync.dest4/file1.txt", "61 /tmp/sync.dest4/file2.txt"}, out)
+			"185 /tmp/sync.dest4/file1.txt", "61 /tmp/sync.dest4/file2.txt"}, runRes.Stdout)
+	})
+
+	t.Run("sync with concurrency", func(t *testing.T) {
+		res, e := sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest7/sub", &SyncOpts{Concurrency: 4})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
+		runRes, e := sess.Run(ctx, "find /tmp/sync.dest7 -type f -exec stat -c '%s %n' {} \\;", nil)
+		require.NoError(t, e)
+		sort.Strings(runRes.Stdout)
+		assert.Equal(t, []string{"17 /tmp/sync.dest7/sub/d1/file11.txt", "185 /tmp/sync.dest7/sub/file1.txt",
+			"61 /tmp/sync.dest7/sub/file2.txt"}, runRes.Stdout)
+
+		res, e = sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest7/sub", &SyncOpts{Concurrency: 4})
+		require.NoError(t, e)
+		assert.Empty(t, res)
+	})
+
+	t.Run("sync with attributes", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("content"), 0o644))
+		require.NoError(t, os.Symlink("file.txt", filepath.Join(dir, "link.txt")))
+		attrs := FileAttrs{Mode: 0o600, Owner: "test", Group: "test", PreserveLinks: true}
+		res, e := sess.Sync(ctx, dir, "/tmp/sync.dest8", &SyncOpts{Attrs: attrs})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"file.txt", "link.txt"}, res)
+		runRes, e := sess.Run(ctx, "stat -c '%a %U %n' /tmp/sync.dest8/file.txt && readlink /tmp/sync.dest8/link.txt", nil)
+		require.NoError(t, e)
+		assert.Equal(t, []string{"600 test /tmp/sync.dest8/file.txt", "file.txt"}, runRes.Stdout)
+
+		_, e = sess.Sync(ctx, dir, "/tmp/sync.dest9", &SyncOpts{Attrs: FileAttrs{Owner: "no-such-user-spot"}})
+		require.ErrorContains(t, e, `can't get uid of "no-such-user-spot"`)
+	})
+
+	t.Run("sync with tar", func(t *testing.T) {
+		_, e := sess.Run(ctx, "mkdir -p /tmp/sync.dest6 && touch /tmp/sync.dest6/extra.txt", nil)
+		require.NoError(t, e)
+		res, e := sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest6", &SyncOpts{Tar: true, Delete: true})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
+		runRes, e := sess.Run(ctx, "find /tmp/sync.dest6 -type f -exec stat -c '%s %n' {} \\;", nil)
+		require.NoError(t, e)
+		sort.Strings(runRes.Stdout)
+		assert.Equal(t, []string{"17 /tmp/sync.dest6/d1/file11.txt", "185 /tmp/sync.dest6/file1.txt", "61 /tmp/sync.dest6/file2.txt"}, runRes.Stdout)
+
+		res, e = sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest6", &SyncOpts{Tar: true, Delete: true})
+		require.NoError(t, e)
+		assert.Empty(t, res, "mod times kept by tar, nothing to sync")
+	})
+
+	t.Run("sync with checksum", func(t *testing.T) {
+		res, e := sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest5", &SyncOpts{Checksum: true})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
+
+		// reset mod times on remote, same content shouldn't be uploaded with checksum
+		_, e = sess.Run(ctx, "touch -d '2000-01-01' /tmp/sync.dest5/file1.txt /tmp/sync.dest5/file2.txt", nil)
+		require.NoError(t, e)
+		res, e = sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest5", &SyncOpts{Checksum: true})
+		require.NoError(t, e)
+		assert.Empty(t, res)
+
+		// same size edit with the same mod time should be detected by checksum
+		_, e = sess.Run(ctx, "sed -i 's/./X/' /tmp/sync.dest5/file2.txt", nil)
+		require.NoError(t, e)
+		res, e = sess.Sync(ctx, "testdata/sync", "/tmp/sync.dest5", &SyncOpts{Checksum: true})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"file2.txt"}, res)
+	})
+
+	t.Run("sync pull", func(t *testing.T) {
+		_, e := sess.Sync(ctx, "testdata/sync", "/tmp/sync.pull", &SyncOpts{})
+		require.NoError(t, e)
+		_, e = sess.Run(ctx, "echo log > /tmp/sync.pull/app.log", &RunOpts{Verbose: true})
+		require.NoError(t, e)
+
+		localDir := filepath.Join(t.TempDir(), "pulled")
+		require.NoError(t, os.MkdirAll(filepath.Join(localDir, "old"), 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(localDir, "old", "extra.txt"), []byte("extra"), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(localDir, "keep.log"), []byte("keep"), 0o600))
+
+		opts := &SyncOpts{Pull: true, Delete: true, Exclude: []string{"*.log"}}
+		res, e := sess.Sync(ctx, localDir, "/tmp/sync.pull", opts)
+		require.NoError(t, e)
+		assert.Equal(t, []string{"d1/file11.txt", "file1.txt", "file2.txt"}, res)
+		data, e := os.ReadFile(filepath.Join(localDir, "d1", "file11.txt"))
+		require.NoError(t, e)
+		expected, e := os.ReadFile("testdata/sync/d1/file11.txt")
+		require.NoError(t, e)
+		assert.Equal(t, string(expected), string(data))
+		assert.NoDirExists(t, filepath.Join(localDir, "old"), "deleted on pull")
+		assert.FileExists(t, filepath.Join(localDir, "keep.log"), "excluded file kept")
+		assert.NoFileExists(t, filepath.Join(localDir, "app.log"), "excluded file not pulled")
+
+		res, e = sess.Sync(ctx, localDir, "/tmp/sync.pull", opts)
+		require.NoError(t, e)
+		assert.Empty(t, res, "no files should be pulled")
+
+		opts.Checksum = true
+		res, e = sess.Sync(ctx, localDir, "/tmp/sync.pull", opts)
+		require.NoError(t, e)
+		assert.Empty(t, res, "no files should be pulled with checksum")
 	})
 }
 
@@ -394,7 +603,7 @@ func TestExecuter_Delete(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -406,9 +615,9 @@ func TestExecuter_Delete(t *testing.T) {
 	t.Run("delete file", func(t *testing.T) {
 		err = sess.Delete(ctx, "/tmp/sync.dest/file1.txt", nil)
 		assert.NoError(t, err)
-		out, e := sess.Run(ctx, "ls -1 /tmp/sync.dest", nil)
+		runRes, e := sess.Run(ctx, "ls -1 /tmp/sync.dest", nil)
 		require.NoError(t, e)
-		assert.Equal(t, []string{"d1", "file2.txt"}, out)
+		assert.Equal(t, []string{"d1", "file2.txt"}, runRes.Stdout)
 	})
 
 	t.Run("delete dir non-recursive", func(t *testing.T) {
@@ -419,22 +628,22 @@ func TestExecuter_Delete(t *testing.T) {
 	t.Run("delete dir", func(t *testing.T) {
 		err = sess.Delete(ctx, "/tmp/sync.dest", &DeleteOpts{Recursive: true})
 		assert.NoError(t, err)
-		out, e := sess.Run(ctx, "ls -1 /tmp/", &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, "ls -1 /tmp/", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.NotContains(t, out, "file2.txt", out)
+		assert.NotContains(t, runRes.Stdout, "file2.txt", runRes.Stdout)
 	})
 
 	t.Run("delete empty dir", func(t *testing.T) {
 		_, err = sess.Run(ctx, "mkdir -p /tmp/sync.dest/empty", &RunOpts{Verbose: true})
 		require.NoError(t, err)
-		out, e := sess.Run(ctx, "ls -1 /tmp/sync.dest", &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, "ls -1 /tmp/sync.dest", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.Contains(t, out, "empty", out)
+		assert.Contains(t, runRes.Stdout, "empty", runRes.Stdout)
 		err = sess.Delete(ctx, "/tmp/sync.dest/empty", nil)
 		assert.NoError(t, err)
-		out, e = sess.Run(ctx, "ls -1 /tmp/sync.dest", &RunOpts{Verbose: true})
+		runRes, e = sess.Run(ctx, "ls -1 /tmp/sync.dest", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.NotContains(t, out, "empty", out)
+		assert.NotContains(t, runRes.Stdout, "empty", runRes.Stdout)
 	})
 
 	t.Run("delete no-such-file", func(t *testing.T) {
@@ -455,7 +664,7 @@ func TestExecuter_DeleteWithExclude(t *testing.T) {
 
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -467,25 +676,25 @@ func TestExecuter_DeleteWithExclude(t *testing.T) {
 	t.Run("delete dir with excluded files", func(t *testing.T) {
 		err = sess.Delete(ctx, "/tmp/delete.dest", &DeleteOpts{Recursive: true, Exclude: []string{"file2.*", "d1/*", "d2/file21.txt"}})
 		assert.NoError(t, err)
-		out, e := sess.Run(ctx, "ls -1 /tmp/", &RunOpts{Verbose: true})
+		runRes, e := sess.Run(ctx, "ls -1 /tmp/", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.Contains(t, out, "delete.dest", out)
+		assert.Contains(t, runRes.Stdout, "delete.dest", runRes.Stdout)
 
-		out, e = sess.Run(ctx, "ls -1 /tmp/delete.dest", &RunOpts{Verbose: true})
+		runRes, e = sess.Run(ctx, "ls -1 /tmp/delete.dest", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.Contains(t, out, "d1", out)
-		assert.Contains(t, out, "d2", out)
-		assert.Contains(t, out, "file2.txt", out)
-		assert.NotContains(t, out, "file3.txt", out)
+		assert.Contains(t, runRes.Stdout, "d1", runRes.Stdout)
+		assert.Contains(t, runRes.Stdout, "d2", runRes.Stdout)
+		assert.Contains(t, runRes.Stdout, "file2.txt", runRes.Stdout)
+		assert.NotContains(t, runRes.Stdout, "file3.txt", runRes.Stdout)
 
-		out, e = sess.Run(ctx, "ls -1 /tmp/delete.dest/d1", &RunOpts{Verbose: true})
+		runRes, e = sess.Run(ctx, "ls -1 /tmp/delete.dest/d1", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.Contains(t, out, "file12.txt", out)
+		assert.Contains(t, runRes.Stdout, "file12.txt", runRes.Stdout)
 
-		out, e = sess.Run(ctx, "ls -1 /tmp/delete.dest/d2", &RunOpts{Verbose: true})
+		runRes, e = sess.Run(ctx, "ls -1 /tmp/delete.dest/d2", &RunOpts{Verbose: true})
 		require.NoError(t, e)
-		assert.Contains(t, out, "file21.txt", out)
-		assert.NotContains(t, out, "file22.txt", out)
+		assert.Contains(t, runRes.Stdout, "file21.txt", runRes.Stdout)
+		assert.NotContains(t, runRes.Stdout, "file22.txt", runRes.Stdout)
 	})
 }
 
@@ -606,7 +815,7 @@ func Test_getRemoteFilesProperties(t *testing.T) {
 	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, err)
 
-	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test", nil)
 	require.NoError(t, err)
 	defer sess.Close()
 
@@ -679,3 +888,493 @@ func startTestContainer(t *testing.T) (hostAndPort string, teardown func()) {
 	require.NoError(t, err)
 	return fmt.Sprintf("%s:%s", host, port.Port()), func() { container.Terminate(ctx) }
 }
+
+func Test_removeUnmatchedLocal(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.txt", "d1/b.txt", "d2/c.txt", "d3/d.log"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), []byte(f), 0o600))
+	}
+	local := map[string]fileProperties{
+		".": {IsDir: true}, "a.txt": {}, "d1": {IsDir: true}, "d1/b.txt": {},
+		"d2": {IsDir: true}, "d2/c.txt": {}, "d3": {IsDir: true}, "d3/d.log": {},
+	}
+	remote := map[string]fileProperties{"a.txt": {}, "d1/b.txt": {}}
+	deleted := []string{".", "d1", "d2", "d2/c.txt", "d3", "d3/d.log"}
+
+	err := removeUnmatchedLocal(dir, deleted, local, remote, []string{"*.log", "d3/*.log"})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "a.txt"))
+	assert.FileExists(t, filepath.Join(dir, "d1", "b.txt"))
+	assert.NoDirExists(t, filepath.Join(dir, "d2"))
+	assert.FileExists(t, filepath.Join(dir, "d3", "d.log"), "excluded file kept with its directory")
+}
+
+func Test_writeTar(t *testing.T) {
+	for _, compress := range []string{"gzip", "zstd"} {
+		t.Run(compress, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			err := writeTar(&buf, "testdata/sync", []string{"d1/file11.txt", "file1.txt"}, compress, FileAttrs{})
+			require.NoError(t, err)
+
+			var rdr io.Reader
+			if compress == "zstd" {
+				zr, e := zstd.NewReader(&buf)
+				require.NoError(t, e)
+				defer zr.Close()
+				rdr = zr
+			} else {
+				gr, e := gzip.NewReader(&buf)
+				require.NoError(t, e)
+				rdr = gr
+			}
+
+			tr := tar.NewReader(rdr)
+			res := map[string]string{}
+			for {
+				hdr, e := tr.Next()
+				if e == io.EOF {
+					break
+				}
+				require.NoError(t, e)
+				data, e := io.ReadAll(tr)
+				require.NoError(t, e)
+				res[hdr.Name] = string(data)
+				fi, e := os.Stat(filepath.Join("testdata/sync", hdr.Name))
+				require.NoError(t, e)
+				assert.Equal(t, fi.ModTime().Unix(), hdr.ModTime.Unix())
+				assert.Equal(t, 0, hdr.Uid)
+			}
+			require.Len(t, res, 2)
+			expected, err := os.ReadFile("testdata/sync/d1/file11.txt")
+			require.NoError(t, err)
+			assert.Equal(t, string(expected), res["d1/file11.txt"])
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		err := writeTar(io.Discard, "testdata/sync", []string{"no-such-file.txt"}, "", FileAttrs{})
+		require.ErrorContains(t, err, "failed to add no-such-file.txt to tar")
+	})
+
+	t.Run("with attributes and links", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("content"), 0o644))
+		require.NoError(t, os.Symlink("file.txt", filepath.Join(dir, "link.txt")))
+
+		buf := bytes.Buffer{}
+		attrs := FileAttrs{Mode: 0o600, Owner: "app", Group: "123", PreserveLinks: true}
+		require.NoError(t, writeTar(&buf, dir, []string{"file.txt", "link.txt"}, "gzip", attrs))
+
+		gr, err := gzip.NewReader(&buf)
+		require.NoError(t, err)
+		tr := tar.NewReader(gr)
+		hdrs := map[string]*tar.Header{}
+		for {
+			hdr, e := tr.Next()
+			if e == io.EOF {
+				break
+			}
+			require.NoError(t, e)
+			hdrs[hdr.Name] = hdr
+		}
+		require.Len(t, hdrs, 2)
+		assert.Equal(t, int64(0o600), hdrs["file.txt"].Mode&0o7777)
+		assert.Equal(t, "app", hdrs["file.txt"].Uname)
+		assert.Equal(t, 0, hdrs["file.txt"].Uid)
+		assert.Equal(t, 123, hdrs["file.txt"].Gid)
+		assert.Equal(t, byte(tar.TypeSymlink), hdrs["link.txt"].Typeflag)
+		assert.Equal(t, "file.txt", hdrs["link.txt"].Linkname)
+	})
+}
+
+func TestRemote_ForwardAgent(t *testing.T) {
+	ctx := context.Background()
+
+	// local agent with a single key, forwarded to the test server
+	keyring := agent.NewKeyring()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "forwarded-key"}))
+	sockDir, err := os.MkdirTemp("", "spot-agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(sockDir)
+	lst, err := net.Listen("unix", filepath.Join(sockDir, "agent.sock"))
+	require.NoError(t, err)
+	defer lst.Close()
+	go func() {
+		for {
+			conn, e := lst.Accept()
+			if e != nil {
+				return
+			}
+			go func() { _ = agent.ServeAgent(keyring, conn) }()
+		}
+	}()
+
+	// server session lists keys of the forwarded agent as the command output
+	handle := func(sconn *ssh.ServerConn, nch ssh.NewChannel) {
+		ch, reqs, e := nch.Accept()
+		if e != nil {
+			return
+		}
+		defer ch.Close()
+		forwarded := false
+		for req := range reqs {
+			switch req.Type {
+			case "auth-agent-req@openssh.com":
+				forwarded = true
+				_ = req.Reply(true, nil)
+			case "exec":
+				_ = req.Reply(true, nil)
+				status := uint32(0)
+				if keys, e := listForwardedKeys(sconn, forwarded); e != nil {
+					fmt.Fprintln(ch.Stderr(), e)
+					status = 1
+				} else {
+					for _, k := range keys {
+						fmt.Fprintln(ch, k.Comment)
+					}
+				}
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+	srvConf := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	addr := startTestSSHServer(t, srvConf, handle)
+
+	t.Setenv("SSH_AUTH_SOCK", lst.Addr().String())
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(ctx, addr, "h1", "test", nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	t.Run("forwarded", func(t *testing.T) {
+		for i := 0; i < 2; i++ { // agent channels are served for every session of the connection
+			res, err := sess.Run(ctx, "ssh-add -l", &RunOpts{ForwardAgent: true})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"forwarded-key"}, res.Stdout)
+		}
+	})
+
+	t.Run("not forwarded", func(t *testing.T) {
+		res, err := sess.Run(ctx, "ssh-add -l", nil)
+		require.Error(t, err)
+		assert.Equal(t, []string{"agent forwarding not requested"}, res.Stderr)
+	})
+
+	t.Run("no agent", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", "")
+		s, err := c.Connect(ctx, addr, "h1", "test", nil)
+		require.NoError(t, err)
+		defer s.Close()
+		_, err = s.Run(ctx, "ssh-add -l", &RunOpts{ForwardAgent: true})
+		require.EqualError(t, err, "can't forward ssh agent: SSH_AUTH_SOCK is not set")
+	})
+}
+
+// listForwardedKeys lists keys of the agent forwarded by the client, the way ssh-add does on the remote host
+func listForwardedKeys(sconn *ssh.ServerConn, forwarded bool) ([]*agent.Key, error) {
+	if !forwarded {
+		return nil, fmt.Errorf("agent forwarding not requested")
+	}
+	ch, reqs, err := sconn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	return agent.NewClient(ch).List()
+}
+
+func TestRemote_tarUploadRemoteFailed(t *testing.T) {
+	// server session fails the extraction right away, without reading the tar stream
+	handle := func(_ *ssh.ServerConn, nch ssh.NewChannel) {
+		ch, reqs, e := nch.Accept()
+		if e != nil {
+			return
+		}
+		defer ch.Close()
+		for req := range reqs {
+			if req.Type != "exec" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			fmt.Fprintln(ch.Stderr(), "sh: 1: zstd: not found")
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{127}))
+			return
+		}
+	}
+	srvConf := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	addr := startTestSSHServer(t, srvConf, handle)
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(context.Background(), addr, "h1", "test", nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big.bin"), bytes.Repeat([]byte("data"), 1024*1024), 0o600))
+	err = sess.tarUpload(context.Background(), dir, "/tmp/dst", []string{"big.bin"}, "zstd", FileAttrs{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to extract tar stream")
+	assert.Contains(t, err.Error(), "zstd: not found", "remote stderr reported")
+}
+
+func TestRemote_killProcessGroupWithBecome(t *testing.T) {
+	defer func(grace time.Duration) { remoteKillGrace = grace }(remoteKillGrace)
+	remoteKillGrace = time.Second
+
+	var mu sync.Mutex
+	var kills []string
+	killed := make(chan struct{})
+	var killOnce sync.Once
+	handle := func(_ *ssh.ServerConn, nch ssh.NewChannel) {
+		ch, reqs, e := nch.Accept()
+		if e != nil {
+			return
+		}
+		defer ch.Close()
+		for req := range reqs {
+			if req.Type != "exec" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			var payload struct{ Command string }
+			_ = ssh.Unmarshal(req.Payload, &payload)
+			if strings.Contains(payload.Command, "kill -s") {
+				mu.Lock()
+				kills = append(kills, payload.Command)
+				mu.Unlock()
+				killOnce.Do(func() { close(killed) })
+			}
+			if strings.Contains(payload.Command, "sleep 30") {
+				fmt.Fprintln(ch, "spot-pid:4242")
+				<-killed // the command runs till the group is signaled
+			}
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		}
+	}
+	srvConf := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	addr := startTestSSHServer(t, srvConf, handle)
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(context.Background(), addr, "h1", "test", nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	become := NewBecome("sudo", "", "")
+	_, err = sess.Run(ctx, become.Wrap("sleep 30"), &RunOpts{Become: become})
+	require.ErrorContains(t, err, "context deadline exceeded")
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, kills, 1, "group exited after TERM")
+	assert.Contains(t, kills[0], "sudo sh -c 'kill -s TERM -- -4242", "kill runs with become of the command")
+}
+
+func TestRemote_sftpClientReset(t *testing.T) {
+	var mu sync.Mutex
+	sessions := 0
+	channels := make(chan ssh.Channel, 10)
+	handle := func(_ *ssh.ServerConn, nch ssh.NewChannel) {
+		ch, reqs, e := nch.Accept()
+		if e != nil {
+			return
+		}
+		defer ch.Close()
+		for req := range reqs {
+			if req.Type != "subsystem" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			mu.Lock()
+			sessions++
+			first := sessions == 1
+			mu.Unlock()
+			if first { // the first sftp request fails, i.e. transient server error
+				_ = req.Reply(false, nil)
+				return
+			}
+			_ = req.Reply(true, nil)
+			channels <- ch
+			srv, e := sftp.NewServer(ch)
+			if e != nil {
+				return
+			}
+			_ = srv.Serve()
+			return
+		}
+	}
+	srvConf := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	addr := startTestSSHServer(t, srvConf, handle)
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(context.Background(), addr, "h1", "test", nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	_, err = sess.sftpClient()
+	require.Error(t, err, "first sftp session rejected")
+
+	client1, err := sess.sftpClient()
+	require.NoError(t, err, "failed creation not cached")
+	client2, err := sess.sftpClient()
+	require.NoError(t, err)
+	assert.Same(t, client1, client2, "client shared")
+
+	_ = (<-channels).Close() // sftp connection broken
+	require.Eventually(t, func() bool {
+		client3, e := sess.sftpClient()
+		return e == nil && client3 != client1
+	}, time.Second, 10*time.Millisecond, "broken client replaced")
+	_, err = (<-channels).Write(nil)
+	require.NoError(t, err, "new sftp session opened")
+}
+
+func TestRemote_uploadBackupRestoredOnFailure(t *testing.T) {
+	sess := connectSftpOnly(t)
+	defer sess.Close()
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.conf"), filepath.Join(dir, "app.conf")
+	require.NoError(t, os.WriteFile(src, []byte("new"), 0o600))
+	require.NoError(t, os.WriteFile(dst, []byte("original"), 0o600))
+
+	err := sess.Upload(context.Background(), src, dst, &UpDownOpts{Backup: 2, Attrs: FileAttrs{Owner: "someone"}})
+	require.Error(t, err, "owner can't be set after the file is written")
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "backup moved back")
+}
+
+func TestRemote_syncModeRerun(t *testing.T) {
+	sess := connectSftpOnly(t)
+	defer sess.Close()
+	ctx := context.Background()
+
+	src, dst := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "app"), []byte("app"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "app.conf"), []byte("conf"), 0o600))
+	opts := &SyncOpts{Attrs: FileAttrs{Mode: 0o750}}
+
+	res, err := sess.Sync(ctx, src, dst, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app", "app.conf"}, res)
+	fi, err := os.Stat(filepath.Join(dst, "app"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), fi.Mode())
+
+	res, err = sess.Sync(ctx, src, dst, opts)
+	require.NoError(t, err)
+	assert.Empty(t, res, "nothing uploaded on rerun")
+	res, err = NewDry(sess.hostAddr, "h1").WithRemote(sess).Sync(ctx, src, dst, opts)
+	require.NoError(t, err)
+	assert.Empty(t, res, "nothing to upload in dry run")
+
+	require.NoError(t, os.Chmod(filepath.Join(dst, "app.conf"), 0o644))
+	res, err = NewDry(sess.hostAddr, "h1").WithRemote(sess).Sync(ctx, src, dst, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app.conf"}, res, "mode changed on remote")
+	res, err = sess.Sync(ctx, src, dst, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app.conf"}, res)
+	fi, err = os.Stat(filepath.Join(dst, "app.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), fi.Mode())
+}
+
+// connectSftpOnly connects to a test server serving sftp with the local file system and rejecting commands
+func connectSftpOnly(t *testing.T) *Remote {
+	handle := func(_ *ssh.ServerConn, nch ssh.NewChannel) {
+		ch, reqs, e := nch.Accept()
+		if e != nil {
+			return
+		}
+		defer ch.Close()
+		for req := range reqs {
+			if req.Type != "subsystem" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			if srv, e := sftp.NewServer(ch); e == nil {
+				_ = srv.Serve()
+			}
+			return
+		}
+	}
+	srvConf := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	addr := startTestSSHServer(t, srvConf, handle)
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(context.Background(), addr, "h1", "test", nil)
+	require.NoError(t, err)
+	return sess
+}
+
+func TestRemote_ttyErrorWithoutPidMarker(t *testing.T) {
+	// server accepts the pty and prints the pid marker and the error to the merged output, as a terminal does
+	handle := func(_ *ssh.ServerConn, nch ssh.NewChannel) {
+		ch, reqs, e := nch.Accept()
+		if e != nil {
+			return
+		}
+		defer ch.Close()
+		for req := range reqs {
+			switch req.Type {
+			case "pty-req":
+				_ = req.Reply(true, nil)
+			case "exec":
+				_ = req.Reply(true, nil)
+				fmt.Fprint(ch, "spot-pid:4242\nout1\nerr1\n")
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{2}))
+				return
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+	srvConf := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	addr := startTestSSHServer(t, srvConf, handle)
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	sess, err := c.Connect(context.Background(), addr, "h1", "test", nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	res, err := sess.Run(context.Background(), "echo out1; echo err1 >&2; exit 2", &RunOpts{TTY: true})
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), pidMarker)
+	assert.Equal(t, []string{"out1", "err1"}, res.Stderr, "tail of merged output without pid marker")
+	assert.Equal(t, []string{"out1", "err1"}, res.Stdout)
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,12 +20,22 @@ import (
 // execCmd is a single command execution on a target host. It prepares the command, executes it and returns details.
 // All commands directly correspond to the config.Cmd commands.
 type execCmd struct {
-	cmd      config.Cmd
-	hostAddr string
-	hostName string
-	tsk      *config.Task
-	exec     executor.Interface
-	verbose  bool
+	cmd         config.Cmd
+	hostAddr    string
+	hostName    string
+	user        string
+	tmpDir      string // temporary directory on the host of the executor, removed after the task
+	localTmpDir string // temporary directory on the local host, used by local commands
+	tsk         *config.Task
+	exec        executor.Interface
+	verbose     bool
+	maxOutput   int              // max size of command output retained in memory, unlimited if 0
+	now         func() time.Time // clock for names of releases, time.Now if not set
+	hostAgent   bool             // forward ssh agent to the host, set by forward_agent of playbook, target or host
+	cmdPath     string           // index path of the command in the task, like "2/block/0", unique for nested commands
+	sshKey      string           // ssh key of the host, own or inherited from the target, used by transfer peers
+	sshCert     string           // ssh certificate of the host key, used by transfer peers
+	selected    bool             // command or its group is in the only list, nested commands are not filtered by it
 }
 
 type execCmdResp struct {
@@ -32,11 +44,43 @@ type execCmdResp struct {
 	vars    map[string]string
 }
 
-const tmpRemoteDir = "/tmp/.spot" // this is a directory on remote host to store temporary files
+// become returns privilege escalation of the command, set by sudo or become options, with the password
+// from the secret set by become_secret. Each call makes a new one, the same instance should be used
+// for wrapping the command and for running it.
+func (ec *execCmd) become() *executor.Become {
+	return executor.NewBecome(ec.cmd.Options.Become, ec.cmd.Options.BecomeUser, ec.cmd.BecomePassword())
+}
+
+// forwardAgent returns true if ssh agent should be forwarded to the command, set by forward_agent
+// of the command or of the host.
+func (ec *execCmd) forwardAgent() bool {
+	return ec.hostAgent || ec.cmd.Options.ForwardAgent
+}
+
+// becomeDetails returns privilege escalation part of the command details, ", sudo: true" for plain sudo.
+// Returns empty string for not privileged command.
+func (ec *execCmd) becomeDetails() string {
+	opts := ec.cmd.Options
+	if !opts.Privileged() {
+		return ""
+	}
+	if opts.Become == "" && opts.BecomeUser == "" {
+		return ", sudo: true"
+	}
+	method := opts.Become
+	if method == "" {
+		method = "sudo"
+	}
+	if opts.BecomeUser != "" {
+		return fmt.Sprintf(", become: %s as %s", method, opts.BecomeUser)
+	}
+	return ", become: " + method
+}
 
 // Script executes a script command on a target host. It can be a single line or multiline script,
 // this part is translated by the prepScript function.
-// If sudo option is set, it will execute the script with sudo. If output contains variables as "setvar foo=bar",
+// If sudo or become option is set, it will execute the script with privilege escalation.
+// If output contains variables as "setvar foo=bar",
 // it will return the variables as map.
 func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 	cond, err := ec.checkCondition(ctx)
@@ -64,23 +108,28 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 			}
 		}
 	}()
-	resp.details = fmt.Sprintf(" {script: %s}", c)
-	if ec.cmd.Options.Sudo {
-		resp.details = fmt.Sprintf(" {script: %s, sudo: true}", c)
-		c = fmt.Sprintf("sudo sh -c %q", c)
+	resp.details = fmt.Sprintf(" {script: %s%s}", c, ec.becomeDetails())
+	var become *executor.Become
+	if ec.cmd.Options.Privileged() {
+		become = ec.become()
+		c = become.Wrap("sh -c " + executor.ShellQuote(c))
 	}
 	resp.verbose = scr
 
-	out, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose})
+	out, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose, Stdin: ec.cmd.SecretsInput(), MaxOutput: ec.maxOutput,
+		OkExitCodes: ec.cmd.OkExitCodes, TTY: ec.cmd.Options.TTY, Become: become, ForwardAgent: ec.forwardAgent()})
 	if err != nil {
 		return resp, fmt.Errorf("can't run script on %s: %w", ec.hostAddr, err)
 	}
+	if out.ExitCode > 0 {
+		resp.details = strings.TrimSuffix(resp.details, "}") + fmt.Sprintf(", exit code: %d}", out.ExitCode)
+	}
 
 	// collect setvar output to vars and latter it will be set to the environment. This is needed for the next commands.
 	// setenv output is in the format of "setenv foo=bar" and it is appended to the output by the script itself.
 	// this part done inside cmd.scriptFile function.
 	resp.vars = make(map[string]string)
-	for _, line := range out {
+	for _, line := range out.Stdout {
 		if !strings.HasPrefix(line, "setvar ") {
 			continue
 		}
@@ -95,50 +144,76 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 }
 
 // Copy uploads a single file or multiple files (if wildcard is used) to a target host.
-// if sudo option is set, it will make a temporary directory and upload the files there,
-// then move it to the final destination with sudo script execution.
+// if sudo or become option is set, it will make a temporary directory and upload the files there,
+// then move it to the final destination with privilege escalation.
 func (ec *execCmd) Copy(ctx context.Context) (resp execCmdResp, err error) {
 	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
 
 	src := tmpl.apply(ec.cmd.Copy.Source)
 	dst := tmpl.apply(ec.cmd.Copy.Dest)
-
-	if !ec.cmd.Options.Sudo {
-		// if sudo is not set, we can use the original destination and upload the file directly
-		resp.details = fmt.Sprintf(" {copy: %s -> %s}", src, dst)
-		opts := &executor.UpDownOpts{Mkdir: ec.cmd.Copy.Mkdir, Force: ec.cmd.Copy.Force, Exclude: ec.cmd.Copy.Exclude}
+	attrs := fileAttrs(ec.cmd.Copy.Mode, ec.cmd.Copy.Owner, ec.cmd.Copy.Group, ec.cmd.Copy.Preserve)
+
+	if _, isDry := ec.exec.(*executor.Dry); !ec.cmd.Options.Privileged() || isDry {
+		// if sudo is not set, we can use the original destination and upload the file directly. dry run just
+		// shows the changes of the original destination, nothing is staged
+		resp.details = fmt.Sprintf(" {copy: %s -> %s%s}", src, dst, ec.becomeDetails())
+		opts := &executor.UpDownOpts{Mkdir: ec.cmd.Copy.Mkdir, Force: ec.cmd.Copy.Force, Exclude: ec.cmd.Copy.Exclude,
+			Checksum: ec.cmd.Copy.Checksum, Atomic: ec.cmd.Copy.Atomic, Backup: ec.cmd.Copy.Backup, Attrs: attrs}
 		if err := ec.exec.Upload(ctx, src, dst, opts); err != nil {
 			return resp, fmt.Errorf("can't copy file to %s: %w", ec.hostAddr, err)
 		}
 		return resp, nil
 	}
 
-	if ec.cmd.Options.Sudo {
+	if ec.cmd.Options.Privileged() {
 		// if sudo is set, we need to upload the file to a temporary directory and move it to the final destination
-		resp.details = fmt.Sprintf(" {copy: %s -> %s, sudo: true}", src, dst)
-		tmpDest := filepath.Join(tmpRemoteDir, filepath.Base(dst))
-		if err := ec.exec.Upload(ctx, src, tmpDest, &executor.UpDownOpts{Mkdir: true, Force: true, Exclude: ec.cmd.Copy.Exclude}); err != nil {
+		resp.details = fmt.Sprintf(" {copy: %s -> %s%s}", src, dst, ec.becomeDetails())
+		become := ec.become()
+		tmpDest := filepath.Join(ec.tmpDir, filepath.Base(dst))
+		// ownership can't be changed by the remote user, it is changed with sudo in the temporary directory
+		tmpAttrs := executor.FileAttrs{Mode: attrs.Mode, PreserveLinks: attrs.PreserveLinks, PreserveTimes: attrs.PreserveTimes}
+		tmpOpts := &executor.UpDownOpts{Mkdir: true, Force: true, Exclude: ec.cmd.Copy.Exclude, Attrs: tmpAttrs}
+		if err := ec.exec.Upload(ctx, src, tmpDest, tmpOpts); err != nil {
 			// upload to a temporary directory with mkdir
 			return resp, fmt.Errorf("can't copy file to %s: %w", ec.hostAddr, err)
 		}
 
+		multi := strings.Contains(src, "*") && !strings.HasSuffix(tmpDest, "/")
+		if chownCmd := sudoChownCmd(become, src, tmpDest, multi, attrs); chownCmd != "" {
+			if _, err := ec.exec.Run(ctx, chownCmd, &executor.RunOpts{Verbose: ec.verbose, Become: become}); err != nil {
+				return resp, fmt.Errorf("can't change owner of files on %s: %w", ec.hostAddr, err)
+			}
+		}
+
 		mvCmd := fmt.Sprintf("mv -f %s %s", tmpDest, dst) // move a single file
-		if strings.Contains(src, "*") && !strings.HasSuffix(tmpDest, "/") {
+		if multi {
 			mvCmd = fmt.Sprintf("mv -f %s/* %s", tmpDest, dst) // move multiple files, if wildcard is used
 			defer func() {
-				// remove temporary directory we created under /tmp/.spot for multiple files
+				// remove temporary directory we created under the host's temporary directory for multiple files
 				if _, err := ec.exec.Run(ctx, fmt.Sprintf("rm -rf %s", tmpDest), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
 					log.Printf("[WARN] can't remove temporary directory on %s: %v", ec.hostAddr, err)
 				}
 			}()
 		}
-		c, _, _, err := ec.prepScript(ctx, mvCmd, nil)
+		var script io.Reader
+		if ec.cmd.Copy.Atomic || ec.cmd.Copy.Backup > 0 {
+			// atomic replacement and backups are made per file, so moving goes through a script
+			mvCmd, script = "", strings.NewReader(sudoMoveScript(src, tmpDest, dst, multi, ec.cmd.Copy.Atomic, ec.cmd.Copy.Backup))
+		}
+		c, _, teardown, err := ec.prepScript(ctx, mvCmd, script)
 		if err != nil {
 			return resp, fmt.Errorf("can't prepare sudo moving command on %s: %w", ec.hostAddr, err)
 		}
+		if teardown != nil {
+			defer func() {
+				if err := teardown(); err != nil {
+					log.Printf("[WARN] can't teardown sudo moving script on %s: %v", ec.hostAddr, err)
+				}
+			}()
+		}
 
-		sudoMove := fmt.Sprintf("sudo %s", c)
-		if _, err := ec.exec.Run(ctx, sudoMove, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		sudoMove := become.Wrap(c)
+		if _, err := ec.exec.Run(ctx, sudoMove, &executor.RunOpts{Verbose: ec.verbose, Become: become}); err != nil {
 			return resp, fmt.Errorf("can't move file to %s: %w", ec.hostAddr, err)
 		}
 	}
@@ -155,7 +230,9 @@ func (ec *execCmd) Mcopy(ctx context.Context) (resp execCmdResp, err error) {
 		dst := tmpl.apply(c.Dest)
 		msgs = append(msgs, fmt.Sprintf("%s -> %s", src, dst))
 		ecSingle := ec
-		ecSingle.cmd.Copy = config.CopyInternal{Source: src, Dest: dst, Mkdir: c.Mkdir, Force: c.Force}
+		ecSingle.cmd.Copy = config.CopyInternal{Source: src, Dest: dst, Mkdir: c.Mkdir, Force: c.Force, Exclude: c.Exclude,
+			Checksum: c.Checksum, Mode: c.Mode, Owner: c.Owner, Group: c.Group, Preserve: c.Preserve,
+			Atomic: c.Atomic, Backup: c.Backup}
 		if _, err := ecSingle.Copy(ctx); err != nil {
 			return resp, fmt.Errorf("can't copy file to %s: %w", ec.hostAddr, err)
 		}
@@ -165,18 +242,133 @@ func (ec *execCmd) Mcopy(ctx context.Context) (resp execCmdResp, err error) {
 }
 
 // Sync synchronizes files from a source to a destination on a target host.
+// If sudo or become option is set, files are synced to a temporary staging directory and moved to the destination
+// with privilege escalation.
 func (ec *execCmd) Sync(ctx context.Context) (resp execCmdResp, err error) {
 	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
 	src := tmpl.apply(ec.cmd.Sync.Source)
 	dst := tmpl.apply(ec.cmd.Sync.Dest)
 	resp.details = fmt.Sprintf(" {sync: %s -> %s}", src, dst)
-	opts := &executor.SyncOpts{Delete: ec.cmd.Sync.Delete, Exclude: ec.cmd.Sync.Exclude, Force: ec.cmd.Sync.Force}
-	if _, err := ec.exec.Sync(ctx, src, dst, opts); err != nil {
+	opts := &executor.SyncOpts{Delete: ec.cmd.Sync.Delete, Exclude: ec.cmd.Sync.Exclude, Force: ec.cmd.Sync.Force,
+		Checksum: ec.cmd.Sync.Checksum, Tar: ec.cmd.Sync.Mode == "tar", Compress: ec.cmd.Sync.Compress,
+		Concurrency: ec.cmd.Sync.Concurrency, Atomic: ec.cmd.Sync.Atomic, Backup: ec.cmd.Sync.Backup,
+		Attrs: fileAttrs(ec.cmd.Sync.Perm(), ec.cmd.Sync.Owner, ec.cmd.Sync.Group, ec.cmd.Sync.Preserve)}
+
+	if ec.cmd.Sync.Direction == "pull" {
+		// each host is pulled to its own subdirectory of the local destination, so hosts don't overwrite each other
+		localDst := filepath.Join(dst, hostDirName(ec.hostAddr, ec.hostName))
+		resp.details = fmt.Sprintf(" {sync pull: %s -> %s}", src, localDst)
+		opts.Pull = true
+		if _, err := ec.exec.Sync(ctx, localDst, src, opts); err != nil {
+			return resp, fmt.Errorf("can't pull files from %s: %w", ec.hostAddr, err)
+		}
+		return resp, nil
+	}
+
+	if _, isDry := ec.exec.(*executor.Dry); !ec.cmd.Options.Privileged() || isDry {
+		// without sudo we can sync to the original destination directly. dry run just shows the changes
+		// of the original destination, nothing is staged
+		if _, err := ec.exec.Sync(ctx, src, dst, opts); err != nil {
+			return resp, fmt.Errorf("can't sync files on %s: %w", ec.hostAddr, err)
+		}
+		resp.details = fmt.Sprintf(" {sync: %s -> %s%s}", src, dst, ec.becomeDetails())
+		return resp, nil
+	}
+
+	resp.details = fmt.Sprintf(" {sync: %s -> %s%s}", src, dst, ec.becomeDetails())
+	if err := ec.sudoSync(ctx, src, dst, opts); err != nil {
 		return resp, fmt.Errorf("can't sync files on %s: %w", ec.hostAddr, err)
 	}
 	return resp, nil
 }
 
+// hostDirName returns the name of the local directory for files pulled from the host, host name if set or host address
+// without port otherwise.
+func hostDirName(hostAddr, hostName string) string {
+	if hostName != "" {
+		return hostName
+	}
+	if host, _, err := net.SplitHostPort(hostAddr); err == nil {
+		return host
+	}
+	return hostAddr
+}
+
+// sudoSync syncs src to dst owned by another user. Destination is compared with src read-only, listed with privilege
+// escalation, and only changed files are uploaded to a temporary staging directory. After that the changed files are
+// moved to dst and deleted files are removed from dst with privilege escalation. Nothing is copied out of dst,
+// files which are not changed are not touched, and the staging directory is removed in any case.
+func (ec *execCmd) sudoSync(ctx context.Context, src, dst string, opts *executor.SyncOpts) error {
+	become := ec.become()
+	updated, deleted, deletedDirs, err := executor.SyncDiff(ctx, ec.exec, src, dst, opts, become)
+	if err != nil {
+		return fmt.Errorf("can't compare %s with %s: %w", src, dst, err)
+	}
+	if !opts.Delete {
+		deleted, deletedDirs = nil, nil
+	}
+	if len(updated) == 0 && len(deleted) == 0 && len(deletedDirs) == 0 {
+		return nil
+	}
+
+	script := []string{"set -e", "mkdir -p " + executor.ShellQuote(dst)}
+	for _, f := range deleted {
+		script = append(script, "rm -f -- "+executor.ShellQuote(filepath.Join(dst, f)))
+	}
+	// directories are removed deepest first and only if empty, so directories with excluded files or kept backups stay
+	for _, d := range deletedDirs {
+		script = append(script, "rmdir -- "+executor.ShellQuote(filepath.Join(dst, d))+" 2>/dev/null || true")
+	}
+
+	if len(updated) > 0 {
+		stage := filepath.Join(ec.tmpDir, fmt.Sprintf("sync-%d", time.Now().UnixNano()))
+		defer func() {
+			// staged files can be owned by another user after chown, so the directory is removed with privileges
+			rmCmd := become.Wrap("rm -rf " + executor.ShellQuote(stage))
+			if _, err := ec.exec.Run(ctx, rmCmd, &executor.RunOpts{Verbose: ec.verbose, Become: become}); err != nil {
+				log.Printf("[WARN] can't remove staging directory %s on %s: %v", stage, ec.hostAddr, err)
+			}
+		}()
+		if _, err := ec.exec.Run(ctx, "mkdir -p "+executor.ShellQuote(stage), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			return fmt.Errorf("can't make staging directory %s: %w", stage, err)
+		}
+
+		// ownership can't be changed by the remote user, it is changed with sudo before moving.
+		// atomic replacement is made on moving, only the changed files are uploaded to staging
+		stageOpts := executor.SyncOpts{Files: updated, Tar: opts.Tar, Compress: opts.Compress, Concurrency: opts.Concurrency,
+			Attrs: executor.FileAttrs{Mode: opts.Attrs.Mode, PreserveLinks: opts.Attrs.PreserveLinks,
+				PreserveTimes: opts.Attrs.PreserveTimes}}
+		if _, err := ec.exec.Sync(ctx, src, stage, &stageOpts); err != nil {
+			return fmt.Errorf("can't upload changed files to staging directory %s: %w", stage, err)
+		}
+
+		for _, f := range updated {
+			stageFile, dstFile := filepath.Join(stage, f), filepath.Join(dst, f)
+			if dir := filepath.Dir(f); dir != "." {
+				script = append(script, "mkdir -p "+executor.ShellQuote(filepath.Join(dst, dir)))
+			}
+			if spec := ownerSpec(filepath.Join(src, f), opts.Attrs); spec != "" {
+				script = append(script, fmt.Sprintf("chown -h %s %s", spec, executor.ShellQuote(stageFile)))
+			}
+			script = append(script, sudoReplaceCmd(stageFile, dstFile, opts.Atomic, opts.Backup))
+		}
+	}
+
+	c, _, teardown, err := ec.prepScript(ctx, "", strings.NewReader(strings.Join(script, "\n")))
+	if err != nil {
+		return fmt.Errorf("can't prepare sudo sync script: %w", err)
+	}
+	defer func() {
+		if err := teardown(); err != nil {
+			log.Printf("[WARN] can't teardown sudo sync script on %s: %v", ec.hostAddr, err)
+		}
+	}()
+	if _, err := ec.exec.Run(ctx, become.Wrap(c), &executor.RunOpts{Verbose: ec.verbose, Become: become}); err != nil {
+		return fmt.Errorf("can't move synced files to %s: %w", dst, err)
+	}
+	return nil
+}
+
 // Msync synchronizes multiple locations from a source to a destination on a target host.
 func (ec *execCmd) Msync(ctx context.Context) (resp execCmdResp, err error) {
 	msgs := []string{}
@@ -186,7 +378,10 @@ func (ec *execCmd) Msync(ctx context.Context) (resp execCmdResp, err error) {
 		dst := tmpl.apply(c.Dest)
 		msgs = append(msgs, fmt.Sprintf("%s -> %s", src, dst))
 		ecSingle := ec
-		ecSingle.cmd.Sync = config.SyncInternal{Source: src, Dest: dst, Exclude: c.Exclude, Delete: c.Delete, Force: c.Force}
+		ecSingle.cmd.Sync = config.SyncInternal{Source: src, Dest: dst, Exclude: c.Exclude, Delete: c.Delete, Force: c.Force,
+			Checksum: c.Checksum, Mode: c.Mode, Compress: c.Compress, Concurrency: c.Concurrency,
+			Owner: c.Owner, Group: c.Group, Preserve: c.Preserve, Atomic: c.Atomic, Backup: c.Backup,
+			Direction: c.Direction}
 		if _, err := ecSingle.Sync(ctx); err != nil {
 			return resp, fmt.Errorf("can't sync %s to %s %s: %w", src, ec.hostAddr, dst, err)
 		}
@@ -195,12 +390,13 @@ func (ec *execCmd) Msync(ctx context.Context) (resp execCmdResp, err error) {
 	return resp, nil
 }
 
-// Delete deletes files on a target host. If sudo option is set, it will execute a sudo rm commands.
+// Delete deletes files on a target host. If sudo or become option is set, it will execute rm command
+// with privilege escalation.
 func (ec *execCmd) Delete(ctx context.Context) (resp execCmdResp, err error) {
 	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
 	loc := tmpl.apply(ec.cmd.Delete.Location)
 
-	if !ec.cmd.Options.Sudo {
+	if !ec.cmd.Options.Privileged() {
 		// if sudo is not set, we can delete the file directly
 		if err := ec.exec.Delete(ctx, loc, &executor.DeleteOpts{Recursive: ec.cmd.Delete.Recursive}); err != nil {
 			return resp, fmt.Errorf("can't delete files on %s: %w", ec.hostAddr, err)
@@ -208,16 +404,17 @@ func (ec *execCmd) Delete(ctx context.Context) (resp execCmdResp, err error) {
 		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v}", loc, ec.cmd.Delete.Recursive)
 	}
 
-	if ec.cmd.Options.Sudo {
+	if ec.cmd.Options.Privileged() {
 		// if sudo is set, we need to delete the file using sudo by ssh-ing into the host and running the command
-		cmd := fmt.Sprintf("sudo rm -f %s", loc)
+		cmd := fmt.Sprintf("rm -f %s", loc)
 		if ec.cmd.Delete.Recursive {
-			cmd = fmt.Sprintf("sudo rm -rf %s", loc)
+			cmd = fmt.Sprintf("rm -rf %s", loc)
 		}
-		if _, err := ec.exec.Run(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		become := ec.become()
+		if _, err := ec.exec.Run(ctx, become.Wrap(cmd), &executor.RunOpts{Verbose: ec.verbose, Become: become}); err != nil {
 			return resp, fmt.Errorf("can't delete file(s) on %s: %w", ec.hostAddr, err)
 		}
-		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v, sudo: true}", loc, ec.cmd.Delete.Recursive)
+		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v%s}", loc, ec.cmd.Delete.Recursive, ec.becomeDetails())
 	}
 
 	return resp, nil
@@ -240,6 +437,141 @@ func (ec *execCmd) MDelete(ctx context.Context) (resp execCmdResp, err error) {
 	return resp, nil
 }
 
+// Restore restores a file on a target host from the backup made by copy or sync with backup option.
+// The backup is moved back to the file, so each restore of the latest backup rolls the file one version back.
+// If sudo or become option is set, it will execute the restore command with privilege escalation.
+func (ec *execCmd) Restore(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	loc := tmpl.apply(ec.cmd.Restore.Location)
+	resp.details = fmt.Sprintf(" {restore: %s}", loc)
+
+	q := executor.ShellQuote
+	// the glob of backups is left unquoted after the quoted location
+	cmd := fmt.Sprintf("b=$(ls -1d %[1]s.spot-[0-9]* 2>/dev/null | sort | tail -n 1); "+
+		"test -n \"$b\" || { echo no backups of %[1]s >&2; exit 1; }; mv -f \"$b\" %[1]s", q(loc))
+	if v := tmpl.apply(ec.cmd.Restore.Version); v != "" {
+		resp.details = fmt.Sprintf(" {restore: %s, version: %s}", loc, v)
+		cmd = fmt.Sprintf("mv -f %s %s", q(loc+".spot-"+v), q(loc))
+	}
+	var become *executor.Become
+	if ec.cmd.Options.Privileged() {
+		resp.details = strings.TrimSuffix(resp.details, "}") + ec.becomeDetails() + "}"
+		become = ec.become()
+		cmd = become.Wrap("sh -c " + q(cmd))
+	}
+
+	if _, err := ec.exec.Run(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose, Become: become}); err != nil {
+		return resp, fmt.Errorf("can't restore %s on %s: %w", loc, ec.hostAddr, err)
+	}
+	return resp, nil
+}
+
+// Release deploys src to a new timestamped directory under base_dir/releases and switches base_dir/current link to it.
+// The new release is seeded with the content of the current one, so only changed files are uploaded. Old releases
+// are removed, keeping the last keep ones. With rollback option, current link is switched back to the previous release.
+// The directory of the active release is exposed to the following commands as SPOT_RELEASE_DIR.
+// If sudo or become option is set, all the remote commands are executed with privilege escalation.
+func (ec *execCmd) Release(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	base := strings.TrimSuffix(tmpl.apply(ec.cmd.Release.BaseDir), "/")
+	run := func(cmd string) ([]string, error) {
+		var become *executor.Become
+		if ec.cmd.Options.Privileged() {
+			become = ec.become()
+			cmd = become.Wrap("sh -c " + executor.ShellQuote(cmd))
+		}
+		res, err := ec.exec.Run(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose, Become: become})
+		return res.Stdout, err
+	}
+	sudoDetails := func() {
+		if ec.cmd.Options.Privileged() {
+			resp.details = strings.TrimSuffix(resp.details, "}") + ec.becomeDetails() + "}"
+		}
+	}
+
+	if ec.cmd.Release.Rollback {
+		resp.details = fmt.Sprintf(" {release: %s, rollback: true}", base)
+		sudoDetails()
+		q := executor.ShellQuote
+		cmd := fmt.Sprintf("cur=$(basename \"$(readlink %[1]s)\"); prev=\"\"; found=\"\"; "+
+			"for r in $(ls -1 %[2]s | sort); do if [ \"$r\" = \"$cur\" ]; then found=1; break; fi; prev=$r; done; "+
+			"test -n \"$found\" -a -n \"$prev\" || { echo no previous release in %[3]s >&2; exit 1; }; %[4]s && echo \"$prev\"",
+			q(base+"/current"), q(base+"/releases"), q(base), releaseSwitchCmd(base, "$prev"))
+		out, err := run(cmd)
+		if err != nil {
+			return resp, fmt.Errorf("can't rollback release in %s on %s: %w", base, ec.hostAddr, err)
+		}
+		if _, isDry := ec.exec.(*executor.Dry); isDry {
+			// dry run reports the command instead of the previous release, the release dir is unknown
+			return resp, nil
+		}
+		if len(out) == 0 {
+			return resp, fmt.Errorf("can't rollback release in %s on %s: no previous release reported", base, ec.hostAddr)
+		}
+		relDir := base + "/releases/" + strings.TrimSpace(out[len(out)-1])
+		resp.details = fmt.Sprintf(" {release: %s, rollback: true, dir: %s}", base, relDir)
+		sudoDetails()
+		resp.vars = map[string]string{"SPOT_RELEASE_DIR": relDir}
+		return resp, nil
+	}
+
+	src := tmpl.apply(ec.cmd.Release.Source)
+	now := time.Now
+	if ec.now != nil {
+		now = ec.now
+	}
+	// nanoseconds keep names of releases made in the same second unique, and the names still sort by time
+	name := now().UTC().Format("20060102150405.000000000")
+	relDir := base + "/releases/" + name
+	resp.details = fmt.Sprintf(" {release: %s -> %s}", src, relDir)
+	sudoDetails()
+
+	keep := ec.cmd.Release.Keep
+	if keep == 0 {
+		keep = 5
+	}
+
+	// seed the new release with the current one to upload the changed files only.
+	// the release directory is made without -p, so an existing one fails the release instead of being overwritten
+	q := executor.ShellQuote
+	if _, err := run(fmt.Sprintf("mkdir -p %[1]s && mkdir %[2]s && { test ! -d %[3]s || cp -a %[3]s/. %[2]s/; }",
+		q(base+"/releases"), q(relDir), q(base+"/current"))); err != nil {
+		return resp, fmt.Errorf("can't prepare release %s on %s: %w", relDir, ec.hostAddr, err)
+	}
+
+	opts := &executor.SyncOpts{Delete: true, Exclude: ec.cmd.Release.Exclude}
+	if _, isDry := ec.exec.(*executor.Dry); ec.cmd.Options.Privileged() && !isDry {
+		err = ec.sudoSync(ctx, src, relDir, opts)
+	} else {
+		_, err = ec.exec.Sync(ctx, src, relDir, opts)
+	}
+	if err != nil {
+		return resp, fmt.Errorf("can't sync release %s on %s: %w", relDir, ec.hostAddr, err)
+	}
+
+	if _, err := run(releaseSwitchCmd(base, name)); err != nil {
+		return resp, fmt.Errorf("can't switch current release to %s on %s: %w", relDir, ec.hostAddr, err)
+	}
+
+	// the new release is the latest one, so it is never removed here
+	if _, err := run(fmt.Sprintf("cd %s && ls -1 | sort -r | tail -n +%d | xargs -r rm -rf", q(base+"/releases"), keep+1)); err != nil {
+		return resp, fmt.Errorf("can't remove old releases in %s on %s: %w", base, ec.hostAddr, err)
+	}
+
+	resp.vars = map[string]string{"SPOT_RELEASE_DIR": relDir}
+	return resp, nil
+}
+
+// releaseSwitchCmd returns a command switching base/current link to the release atomically. The new link is made
+// next to the current one and renamed over it. mv -T is not available everywhere, in this case the link is replaced
+// in place.
+// The release is put in double quotes, so it can be a shell variable.
+func releaseSwitchCmd(base, release string) string {
+	q := executor.ShellQuote
+	return fmt.Sprintf("ln -sfn \"releases/%[2]s\" %[3]s && { mv -Tf %[3]s %[1]s 2>/dev/null || "+
+		"{ rm -f %[3]s && ln -sfn \"releases/%[2]s\" %[1]s; }; }", q(base+"/current"), release, q(base+"/.current.spot-tmp"))
+}
+
 // Wait waits for a command to complete on a target hostAddr. It runs the command in a loop with a check duration
 // until the command succeeds or the timeout is exceeded.
 func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
@@ -269,10 +601,12 @@ func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
 		c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
 
 	waitCmd := fmt.Sprintf("sh -c %q", c) // run wait command in a shell
-	if ec.cmd.Options.Sudo {
-		resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v, sudo: true}",
-			c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
-		waitCmd = fmt.Sprintf("sudo sh -c %q", c) // add sudo if needed
+	var become *executor.Become
+	if ec.cmd.Options.Privileged() {
+		resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v%s}",
+			c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond), ec.becomeDetails())
+		become = ec.become()
+		waitCmd = become.Wrap("sh -c " + executor.ShellQuote(c)) // add sudo if needed
 	}
 	resp.verbose = script
 
@@ -288,7 +622,10 @@ func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
 		case <-timeoutTk.C:
 			return resp, fmt.Errorf("timeout exceeded")
 		case <-checkTk.C:
-			if _, err := ec.exec.Run(ctx, waitCmd, nil); err == nil {
+			// secrets input is consumed by each run, so it is made for every check
+			runOpts := &executor.RunOpts{Stdin: ec.cmd.SecretsInput(), MaxOutput: ec.maxOutput, TTY: ec.cmd.Options.TTY,
+				Become: become, ForwardAgent: ec.forwardAgent()}
+			if _, err := ec.exec.Run(ctx, waitCmd, runOpts); err == nil {
 				return resp, nil // command succeeded
 			}
 		}
@@ -303,14 +640,16 @@ func (ec *execCmd) Echo(ctx context.Context) (resp execCmdResp, err error) {
 	if !strings.HasPrefix(echoCmd, "echo ") {
 		echoCmd = fmt.Sprintf("echo %s", echoCmd)
 	}
-	if ec.cmd.Options.Sudo {
-		echoCmd = fmt.Sprintf("sudo %s", echoCmd)
+	var become *executor.Become
+	if ec.cmd.Options.Privileged() {
+		become = ec.become()
+		echoCmd = become.Wrap(echoCmd)
 	}
-	out, err := ec.exec.Run(ctx, echoCmd, nil)
+	out, err := ec.exec.Run(ctx, echoCmd, &executor.RunOpts{MaxOutput: ec.maxOutput, Become: become})
 	if err != nil {
 		return resp, fmt.Errorf("can't run echo command on %s: %w", ec.hostAddr, err)
 	}
-	resp.details = fmt.Sprintf(" {echo: %s}", strings.Join(out, "; "))
+	resp.details = fmt.Sprintf(" {echo: %s}", strings.Join(out.Stdout, "; "))
 	return resp, nil
 }
 
@@ -333,12 +672,16 @@ func (ec *execCmd) checkCondition(ctx context.Context) (bool, error) {
 		}
 	}()
 
-	if ec.cmd.Options.Sudo { // command's sudo also applies to condition script
-		c = fmt.Sprintf("sudo sh -c %q", c)
+	var become *executor.Become
+	if ec.cmd.Options.Privileged() { // command's sudo also applies to condition script
+		become = ec.become()
+		c = become.Wrap("sh -c " + executor.ShellQuote(c))
 	}
 
 	// run the condition command
-	if _, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+	runOpts := &executor.RunOpts{Verbose: ec.verbose, Stdin: ec.cmd.SecretsInput(), MaxOutput: ec.maxOutput, TTY: ec.cmd.Options.TTY,
+		Become: become, ForwardAgent: ec.forwardAgent()}
+	if _, err := ec.exec.Run(ctx, c, runOpts); err != nil {
 		log.Printf("[DEBUG] condition not passed on %s: %v", ec.hostAddr, err)
 		if inverted {
 			return true, nil // inverted condition failed, so we return true
@@ -359,6 +702,8 @@ func (ec *execCmd) checkCondition(ctx context.Context) (bool, error) {
 // it also  returns a teardown function to remove the temporary file after the command execution.
 func (ec *execCmd) prepScript(ctx context.Context, s string, r io.Reader) (cmd, scr string, teardown func() error, err error) {
 	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name}
+	// rescue and rollback commands get SPOT_ERROR in the environment, leave it to the shell instead of blanking
+	_, tmpl.envErr = ec.cmd.Environment["SPOT_ERROR"]
 
 	if s != "" { // single command, nothing to do just apply templates
 		return tmpl.apply(s), "", nil, nil
@@ -399,7 +744,7 @@ func (ec *execCmd) prepScript(ctx context.Context, s string, r io.Reader) (cmd,
 	}
 
 	// get temp file name for remote hostAddr
-	dst := filepath.Join(tmpRemoteDir, filepath.Base(tmp.Name())) // nolint
+	dst := filepath.Join(ec.tmpDir, filepath.Base(tmp.Name())) // nolint
 	scr = fmt.Sprintf("script: %s\n", dst) + scr
 
 	// upload the script to the remote hostAddr
@@ -419,6 +764,135 @@ func (ec *execCmd) prepScript(ctx context.Context, s string, r io.Reader) (cmd,
 	return cmd, scr, teardown, nil
 }
 
+// fileAttrs makes executor file attributes from mode, owner, group and preserve options of copy and sync.
+// Options are validated on config load, so invalid mode is just logged and ignored.
+func fileAttrs(mode, owner, group string, preserve []string) executor.FileAttrs {
+	res := executor.FileAttrs{Owner: owner, Group: group}
+	if mode != "" {
+		m, err := config.ParseFileMode(mode)
+		if err != nil {
+			log.Printf("[WARN] ignore %v", err)
+		}
+		res.Mode = m
+	}
+	for _, p := range preserve {
+		switch p {
+		case "owner":
+			res.PreserveOwner = true
+		case "links":
+			res.PreserveLinks = true
+		case "times":
+			res.PreserveTimes = true
+		}
+	}
+	return res
+}
+
+// sudoChownCmd makes a command changing ownership of files uploaded to tmpDest before they are moved, wrapped with
+// privilege escalation. Returns empty string if ownership is not requested. For multiple files tmpDest is a directory
+// with uploaded files.
+func sudoChownCmd(become *executor.Become, src, tmpDest string, multi bool, attrs executor.FileAttrs) string {
+	if !attrs.PreserveOwner {
+		if attrs.Owner == "" && attrs.Group == "" {
+			return ""
+		}
+		return become.Wrap(fmt.Sprintf("chown -R -h %s %s", ownerSpec("", attrs), tmpDest))
+	}
+
+	matches, err := filepath.Glob(src)
+	if err != nil {
+		log.Printf("[WARN] can't expand %s to preserve owner: %v", src, err)
+		return ""
+	}
+	cmds := []string{}
+	for _, m := range matches {
+		spec := ownerSpec(m, attrs)
+		if spec == "" {
+			continue
+		}
+		dst := tmpDest
+		if multi {
+			dst = filepath.Join(tmpDest, filepath.Base(m))
+		}
+		// excluded files are not uploaded, so the missing ones are skipped
+		cmds = append(cmds, fmt.Sprintf("{ test ! -e %[1]s -a ! -h %[1]s || chown -h %[2]s %[1]s; }", dst, spec))
+	}
+	if len(cmds) == 0 {
+		return ""
+	}
+	return become.Wrap("sh -c " + executor.ShellQuote(strings.Join(cmds, " && ")))
+}
+
+// sudoMoveScript makes a script moving files uploaded to tmpDest to dst with sudo, replacing each file
+// with sudoReplaceCmd. For multiple files tmpDest and dst are directories, excluded files are skipped as missing.
+func sudoMoveScript(src, tmpDest, dst string, multi, atomic bool, backup int) string {
+	if !multi {
+		return "set -e\n" + sudoReplaceCmd(tmpDest, dst, atomic, backup)
+	}
+	matches, err := filepath.Glob(src)
+	if err != nil {
+		log.Printf("[WARN] can't expand %s: %v", src, err)
+	}
+	lines := []string{"set -e"}
+	for _, m := range matches {
+		staged := filepath.Join(tmpDest, filepath.Base(m))
+		lines = append(lines, fmt.Sprintf("if [ -e %s ]; then %s; fi", executor.ShellQuote(staged),
+			sudoReplaceCmd(staged, filepath.Join(dst, filepath.Base(m)), atomic, backup)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sudoReplaceCmd makes a command replacing dst with the staged file, to be run with sudo. With atomic, the staged file
+// is moved next to dst first and renamed to dst, so it never crosses file systems. With backup, replaced dst
+// is hard linked to its backup name and backups beyond the limit are removed, the oldest first.
+func sudoReplaceCmd(staged, dst string, atomic bool, backup int) string {
+	cmds := []string{}
+	q := executor.ShellQuote
+	if backup > 0 {
+		cmds = append(cmds, fmt.Sprintf("{ test ! -f %[1]s || ln -f %[1]s %[2]s; }", q(dst), q(executor.BackupName(dst, time.Now()))))
+	}
+	if atomic {
+		tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".spot-tmp")
+		cmds = append(cmds, fmt.Sprintf("mv -f %s %s", q(staged), q(tmp)), fmt.Sprintf("mv -f %s %s", q(tmp), q(dst)))
+	} else {
+		cmds = append(cmds, fmt.Sprintf("mv -f %s %s", q(staged), q(dst)))
+	}
+	if backup > 0 {
+		// the glob is kept out of quotes to be expanded by the shell
+		cmds = append(cmds, fmt.Sprintf("{ ls -1d %s.spot-[0-9]* 2>/dev/null | sort -r | tail -n +%d | xargs -r rm -f; }",
+			q(dst), backup+1))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// ownerSpec returns owner[:group] argument of chown for the local file. Explicit owner and group take precedence
+// over the preserved ownership of the local file. Returns empty string if ownership is not requested.
+func ownerSpec(localFile string, attrs executor.FileAttrs) string {
+	uid, gid := attrs.Owner, attrs.Group
+	if attrs.PreserveOwner && (uid == "" || gid == "") {
+		fi, err := os.Lstat(localFile)
+		if err != nil {
+			log.Printf("[WARN] can't stat %s to preserve owner: %v", localFile, err)
+			return ""
+		}
+		u, g, ok := executor.FileOwner(fi)
+		if !ok {
+			log.Printf("[WARN] can't preserve owner of %s, not supported on this platform", localFile)
+			return ""
+		}
+		if uid == "" {
+			uid = strconv.Itoa(u)
+		}
+		if gid == "" {
+			gid = strconv.Itoa(g)
+		}
+	}
+	if gid == "" {
+		return uid
+	}
+	return uid + ":" + gid
+}
+
 // templater is a helper struct to apply templates to a command
 type templater struct {
 	hostAddr string
@@ -427,6 +901,7 @@ type templater struct {
 	env      map[string]string
 	task     *config.Task
 	err      error
+	envErr   bool // SPOT_ERROR is set in the command environment and expanded by the shell
 }
 
 // apply applies templates to a string to replace predefined vars placeholders with actual values
@@ -446,9 +921,11 @@ func (tm *templater) apply(inp string) string {
 	res = apply(res, "SPOT_COMMAND", tm.command)
 	res = apply(res, "SPOT_REMOTE_USER", tm.task.User)
 	res = apply(res, "SPOT_TASK", tm.task.Name)
-	if tm.err != nil {
+	switch {
+	case tm.err != nil:
 		res = apply(res, "SPOT_ERROR", tm.err.Error())
-	} else {
+	case tm.envErr:
+	default:
 		res = apply(res, "SPOT_ERROR", "")
 	}
 
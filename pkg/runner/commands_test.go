@@ -7,6 +7,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -130,6 +132,9 @@ func Test_templaterApply(t *testing.T) {
 	}
 }
 
+// testTmpDir is a temporary directory on the test host, made by runTaskOnHost in real runs
+const testTmpDir = "/tmp/.spot-test"
+
 func Test_execCmd(t *testing.T) {
 	testingHostAndPort, teardown := startTestContainer(t)
 	defer teardown()
@@ -137,11 +142,11 @@ func Test_execCmd(t *testing.T) {
 	ctx := context.Background()
 	connector, connErr := executor.NewConnector("testdata/test_ssh_key", time.Second*10)
 	require.NoError(t, connErr)
-	sess, errSess := connector.Connect(ctx, testingHostAndPort, "my-hostAddr", "test")
+	sess, errSess := connector.Connect(ctx, testingHostAndPort, "my-hostAddr", "test", nil)
 	require.NoError(t, errSess)
 
 	t.Run("copy a single file", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
 			Copy: config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory.txt"}}}
 		resp, err := ec.Copy(ctx)
 		require.NoError(t, err)
@@ -152,7 +157,7 @@ func Test_execCmd(t *testing.T) {
 		time.AfterFunc(time.Second, func() {
 			_, _ = sess.Run(ctx, "touch /tmp/wait.done", nil)
 		})
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
 			Command: "cat /tmp/wait.done", Timeout: 2 * time.Second, CheckDuration: time.Millisecond * 100}}}
 		resp, err := ec.Wait(ctx)
 		require.NoError(t, err)
@@ -163,7 +168,7 @@ func Test_execCmd(t *testing.T) {
 		time.AfterFunc(time.Second, func() {
 			_, _ = sess.Run(ctx, "touch /tmp/wait.done", nil)
 		})
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
 			Command: "echo this is wait\ncat /tmp/wait.done", Timeout: 2 * time.Second, CheckDuration: time.Millisecond * 100}}}
 		resp, err := ec.Wait(ctx)
 		require.NoError(t, err)
@@ -174,7 +179,7 @@ func Test_execCmd(t *testing.T) {
 		time.AfterFunc(time.Second, func() {
 			_, _ = sess.Run(ctx, "sudo touch /srv/wait.done", nil)
 		})
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
 			Command: "cat /srv/wait.done", Timeout: 2 * time.Second, CheckDuration: time.Millisecond * 100},
 			Options: config.CmdOptions{Sudo: true}}}
 		resp, err := ec.Wait(ctx)
@@ -183,14 +188,14 @@ func Test_execCmd(t *testing.T) {
 	})
 
 	t.Run("wait failed", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
 			Command: "cat /tmp/wait.never-done", Timeout: 1 * time.Second, CheckDuration: time.Millisecond * 100}}}
 		_, err := ec.Wait(ctx)
 		require.EqualError(t, err, "timeout exceeded")
 	})
 
 	t.Run("wait failed with sudo", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Wait: config.WaitInternal{
 			Command: "cat /srv/wait.never-done", Timeout: 1 * time.Second, CheckDuration: time.Millisecond * 100},
 			Options: config.CmdOptions{Sudo: true}}}
 		_, err := ec.Wait(ctx)
@@ -200,7 +205,7 @@ func Test_execCmd(t *testing.T) {
 	t.Run("delete a single file", func(t *testing.T) {
 		_, err := sess.Run(ctx, "touch /tmp/delete.me", &executor.RunOpts{Verbose: true})
 		require.NoError(t, err)
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
 			Location: "/tmp/delete.me"}}}
 		_, err = ec.Delete(ctx)
 		require.NoError(t, err)
@@ -211,7 +216,7 @@ func Test_execCmd(t *testing.T) {
 		require.NoError(t, err)
 		_, err = sess.Run(ctx, "ls /tmp/delete1.me", &executor.RunOpts{Verbose: true})
 		require.NoError(t, err)
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{MDelete: []config.DeleteInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{MDelete: []config.DeleteInternal{
 			{Location: "/tmp/delete1.me"}, {Location: "/tmp/delete2.me"}}}}
 		_, err = ec.MDelete(ctx)
 		require.NoError(t, err)
@@ -230,7 +235,7 @@ func Test_execCmd(t *testing.T) {
 		_, err = sess.Run(ctx, "touch /tmp/delete-recursive/delete2.me", &executor.RunOpts{Verbose: true})
 		require.NoError(t, err)
 
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
 			Location: "/tmp/delete-recursive", Recursive: true}}}
 
 		_, err = ec.Delete(ctx)
@@ -243,13 +248,13 @@ func Test_execCmd(t *testing.T) {
 	t.Run("delete file with sudo", func(t *testing.T) {
 		_, err := sess.Run(ctx, "sudo touch /srv/delete.me", &executor.RunOpts{Verbose: true})
 		require.NoError(t, err)
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
 			Location: "/srv/delete.me"}, Options: config.CmdOptions{Sudo: false}}}
 
 		_, err = ec.Delete(ctx)
 		require.Error(t, err, "should fail because of missing sudo")
 
-		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
+		ec = execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
 			Location: "/srv/delete.me"}, Options: config.CmdOptions{Sudo: true}}}
 
 		_, err = ec.Delete(ctx)
@@ -265,7 +270,7 @@ func Test_execCmd(t *testing.T) {
 		_, err = sess.Run(ctx, "sudo touch /srv/delete-recursive/delete2.me", &executor.RunOpts{Verbose: true})
 		require.NoError(t, err)
 
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
 			Location: "/srv/delete-recursive", Recursive: true}, Options: config.CmdOptions{Sudo: true}}}
 
 		_, err = ec.Delete(ctx)
@@ -275,8 +280,48 @@ func Test_execCmd(t *testing.T) {
 		require.Error(t, err, "should not exist")
 	})
 
+	t.Run("sync with sudo", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(dir+"/sub", 0o750))
+		require.NoError(t, os.WriteFile(dir+"/a.txt", []byte("a"), 0o644))
+		require.NoError(t, os.WriteFile(dir+"/sub/b.txt", []byte("b"), 0o644))
+		_, err := sess.Run(ctx, "sudo mkdir -p /srv/sync-sudo && sudo touch /srv/sync-sudo/extra.txt /srv/sync-sudo/keep.conf",
+			&executor.RunOpts{Verbose: true})
+		require.NoError(t, err)
+
+		cmd := config.Cmd{Sync: config.SyncInternal{Source: dir, Dest: "/srv/sync-sudo", Delete: true,
+			Exclude: []string{"*.conf"}, Owner: "root"}}
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: cmd}
+		_, err = ec.Sync(ctx)
+		require.Error(t, err, "should fail because of missing sudo")
+
+		cmd.Options.Sudo = true
+		ec = execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: cmd}
+		resp, err := ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {sync: %s -> /srv/sync-sudo, sudo: true}", dir), resp.details)
+
+		runRes, err := sess.Run(ctx, "cd /srv/sync-sudo && find . -type f -exec stat -c '%U %n' {} \\; | sort", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"root ./a.txt", "root ./keep.conf", "root ./sub/b.txt"}, runRes.Stdout)
+
+		runRes, err = sess.Run(ctx, "ls "+testTmpDir+" | grep sync- || true", nil)
+		require.NoError(t, err)
+		assert.Empty(t, runRes.Stdout, "staging directory removed")
+	})
+
+	t.Run("mcopy with exclude", func(t *testing.T) {
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{MCopy: []config.CopyInternal{
+			{Source: "testdata/*.yml", Dest: "/tmp/mcopy-exclude", Mkdir: true, Exclude: []string{"conf*.yml"}}}}}
+		_, err := ec.Mcopy(ctx)
+		require.NoError(t, err)
+		runRes, err := sess.Run(ctx, "ls /tmp/mcopy-exclude", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"inventory.yml"}, runRes.Stdout)
+	})
+
 	t.Run("condition false", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Condition: "ls /srv/test.condition",
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Condition: "ls /srv/test.condition",
 			Script: "echo 'condition false'", Name: "test"}}
 		resp, err := ec.Script(ctx)
 		require.NoError(t, err)
@@ -286,7 +331,7 @@ func Test_execCmd(t *testing.T) {
 	t.Run("condition true", func(t *testing.T) {
 		_, err := sess.Run(ctx, "sudo touch /srv/test.condition", &executor.RunOpts{Verbose: true})
 		require.NoError(t, err)
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Condition: "ls -la /srv/test.condition",
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Condition: "ls -la /srv/test.condition",
 			Script: "echo condition true", Name: "test"}}
 		resp, err := ec.Script(ctx)
 		require.NoError(t, err)
@@ -296,7 +341,7 @@ func Test_execCmd(t *testing.T) {
 	t.Run("condition true inverted", func(t *testing.T) {
 		_, err := sess.Run(ctx, "sudo touch /srv/test.condition", &executor.RunOpts{Verbose: true})
 		require.NoError(t, err)
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Condition: "! ls -la /srv/test.condition",
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Condition: "! ls -la /srv/test.condition",
 			Script: "echo condition true", Name: "test"}}
 		resp, err := ec.Script(ctx)
 		require.NoError(t, err)
@@ -304,30 +349,30 @@ func Test_execCmd(t *testing.T) {
 	})
 
 	t.Run("echo command", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "welcome back", Name: "test"}}
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "welcome back", Name: "test"}}
 		resp, err := ec.Echo(ctx)
 		require.NoError(t, err)
 		assert.Equal(t, " {echo: welcome back}", resp.details)
 
-		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "echo welcome back", Name: "test"}}
+		ec = execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "echo welcome back", Name: "test"}}
 		resp, err = ec.Echo(ctx)
 		require.NoError(t, err)
 		assert.Equal(t, " {echo: welcome back}", resp.details)
 
-		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$var1 welcome back", Name: "test", Environment: map[string]string{"var1": "foo"}}}
+		ec = execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$var1 welcome back", Name: "test", Environment: map[string]string{"var1": "foo"}}}
 		resp, err = ec.Echo(ctx)
 		require.NoError(t, err)
 		assert.Equal(t, " {echo: foo welcome back}", resp.details)
 	})
 
 	t.Run("sync command", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Sync: config.SyncInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Sync: config.SyncInternal{
 			Source: "testdata", Dest: "/tmp/sync.testdata", Exclude: []string{"conf2.yml"}}, Name: "test"}}
 		resp, err := ec.Sync(ctx)
 		require.NoError(t, err)
 		assert.Equal(t, " {sync: testdata -> /tmp/sync.testdata}", resp.details)
 
-		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$(ls -la /tmp/sync.testdata)", Name: "test"}}
+		ec = execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$(ls -la /tmp/sync.testdata)", Name: "test"}}
 		resp, err = ec.Echo(ctx)
 		require.NoError(t, err)
 		assert.Contains(t, resp.details, "conf.yml")
@@ -335,7 +380,7 @@ func Test_execCmd(t *testing.T) {
 	})
 
 	t.Run("msync command", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{MSync: []config.SyncInternal{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{MSync: []config.SyncInternal{
 			{Source: "testdata", Dest: "/tmp/sync.testdata_m1", Exclude: []string{"conf2.yml"}},
 			{Source: "testdata", Dest: "/tmp/sync.testdata_m2"},
 		}, Name: "test"}}
@@ -343,14 +388,14 @@ func Test_execCmd(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, " {sync: testdata -> /tmp/sync.testdata_m1, testdata -> /tmp/sync.testdata_m2}", resp.details)
 
-		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$(ls -la /tmp/sync.testdata_m1)",
+		ec = execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$(ls -la /tmp/sync.testdata_m1)",
 			Name: "test"}}
 		resp, err = ec.Echo(ctx)
 		require.NoError(t, err)
 		assert.Contains(t, resp.details, "conf.yml")
 		assert.NotContains(t, resp.details, "conf2.yml")
 
-		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$(ls -la /tmp/sync.testdata_m2)",
+		ec = execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Echo: "$(ls -la /tmp/sync.testdata_m2)",
 			Name: "test"}}
 		resp, err = ec.Echo(ctx)
 		require.NoError(t, err)
@@ -359,7 +404,7 @@ func Test_execCmd(t *testing.T) {
 	})
 
 	t.Run("dbl-copy non-forced", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
 			Copy: config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory.txt"}}}
 		resp, err := ec.Copy(ctx)
 		require.NoError(t, err)
@@ -375,7 +420,7 @@ func Test_execCmd(t *testing.T) {
 	})
 
 	t.Run("dbl-copy forced", func(t *testing.T) {
-		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+		ec := execCmd{exec: sess, tmpDir: testTmpDir, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
 			Copy: config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory.txt", Force: true}}}
 		resp, err := ec.Copy(ctx)
 		require.NoError(t, err)
@@ -391,3 +436,204 @@ func Test_execCmd(t *testing.T) {
 	})
 
 }
+
+func Test_fileAttrs(t *testing.T) {
+	res := fileAttrs("0640", "app", "", []string{"mode", "owner", "links", "times"})
+	assert.Equal(t, executor.FileAttrs{Mode: 0o640, Owner: "app", PreserveOwner: true, PreserveLinks: true,
+		PreserveTimes: true}, res)
+	assert.Equal(t, executor.FileAttrs{}, fileAttrs("", "", "", nil))
+}
+
+func Test_sudoChownCmd(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/f1.txt", []byte("1"), 0o600))
+	require.NoError(t, os.WriteFile(dir+"/f2.txt", []byte("2"), 0o600))
+	uid, gid := os.Getuid(), os.Getgid()
+
+	tbl := []struct {
+		name  string
+		src   string
+		multi bool
+		attrs executor.FileAttrs
+		res   string
+	}{
+		{"no owner", dir + "/f1.txt", false, executor.FileAttrs{Mode: 0o600}, ""},
+		{"owner and group", dir + "/*.txt", true, executor.FileAttrs{Owner: "app", Group: "web"},
+			"sudo chown -R -h app:web /tmp/.spot/f1"},
+		{"group only", dir + "/f1.txt", false, executor.FileAttrs{Group: "web"}, "sudo chown -R -h :web /tmp/.spot/f1"},
+		{"preserve owner", dir + "/f1.txt", false, executor.FileAttrs{PreserveOwner: true},
+			"sudo sh -c " + executor.ShellQuote(
+				fmt.Sprintf("{ test ! -e /tmp/.spot/f1 -a ! -h /tmp/.spot/f1 || chown -h %d:%d /tmp/.spot/f1; }", uid, gid))},
+		{"preserve owner with group, multiple files", dir + "/*.txt", true,
+			executor.FileAttrs{PreserveOwner: true, Group: "web"},
+			"sudo sh -c " + executor.ShellQuote(
+				fmt.Sprintf("{ test ! -e /tmp/.spot/f1/f1.txt -a ! -h /tmp/.spot/f1/f1.txt || chown -h %[1]d:web /tmp/.spot/f1/f1.txt; } && "+
+					"{ test ! -e /tmp/.spot/f1/f2.txt -a ! -h /tmp/.spot/f1/f2.txt || chown -h %[1]d:web /tmp/.spot/f1/f2.txt; }", uid))},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.res, sudoChownCmd(executor.NewBecome("", "", ""), tt.src, "/tmp/.spot/f1", tt.multi, tt.attrs))
+		})
+	}
+
+	t.Run("doas as user", func(t *testing.T) {
+		res := sudoChownCmd(executor.NewBecome("doas", "app", ""), dir+"/f1.txt", "/tmp/.spot/f1", false,
+			executor.FileAttrs{Owner: "app"})
+		assert.Equal(t, "doas -u app chown -R -h app /tmp/.spot/f1", res)
+	})
+}
+
+func Test_sudoReplaceCmd(t *testing.T) {
+	assert.Equal(t, "mv -f '/tmp/.spot/a' '/etc/a'", sudoReplaceCmd("/tmp/.spot/a", "/etc/a", false, 0))
+	assert.Equal(t, "mv -f '/tmp/.spot/a' '/etc/.a.spot-tmp' && mv -f '/etc/.a.spot-tmp' '/etc/a'",
+		sudoReplaceCmd("/tmp/.spot/a", "/etc/a", true, 0))
+	assert.Regexp(t, `^\{ test ! -f '/etc/a' \|\| ln -f '/etc/a' '/etc/a\.spot-\d{8}T\d{6}\.\d{3}'; \} && `+
+		`mv -f '/tmp/.spot/a' '/etc/a' && \{ ls -1d '/etc/a'\.spot-\[0-9\]\* 2>/dev/null \| sort -r \| tail -n \+4 \| xargs -r rm -f; \}$`,
+		sudoReplaceCmd("/tmp/.spot/a", "/etc/a", false, 3))
+	assert.Equal(t, `mv -f '/tmp/.spot/it'\''s a' '/etc/it'\''s a'`, sudoReplaceCmd("/tmp/.spot/it's a", "/etc/it's a", false, 0))
+}
+
+func Test_sudoSync(t *testing.T) {
+	src, dst, tmpDir := t.TempDir(), t.TempDir(), t.TempDir()
+	ts := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(dir, name, content string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o750))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		require.NoError(t, os.Chtimes(path, ts, ts))
+	}
+	write(src, "same.conf", "same")
+	write(src, "app's dir/app.conf", "new content")
+	write(dst, "same.conf", "same")
+	write(dst, "app's dir/app.conf", "old")
+	write(dst, "secret.key", "private")
+	write(dst, "old.conf", "old")
+	write(dst, "old dir/sub/old.conf", "old")
+
+	// fake sudo records the commands it runs
+	binDir := t.TempDir()
+	sudoLog := filepath.Join(binDir, "sudo.log")
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "sudo"),
+		[]byte("#!/bin/sh\nprintf '%s\\n' \"$*\" >> "+sudoLog+"\nexec \"$@\"\n"), 0o700)) //nolint:gosec // test script
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	ec := execCmd{exec: &executor.Local{}, tsk: &config.Task{Name: "test"}, tmpDir: tmpDir, hostAddr: "localhost",
+		cmd: config.Cmd{Name: "sync", Sync: config.SyncInternal{Source: src, Dest: dst, Delete: true},
+			Options: config.CmdOptions{Sudo: true}}}
+	resp, err := ec.Sync(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(" {sync: %s -> %s, sudo: true}", src, dst), resp.details)
+
+	data, err := os.ReadFile(filepath.Join(dst, "app's dir", "app.conf")) //nolint:gosec // test file
+	require.NoError(t, err)
+	assert.Equal(t, "new content", string(data))
+	assert.NoFileExists(t, filepath.Join(dst, "secret.key"))
+	assert.NoFileExists(t, filepath.Join(dst, "old.conf"))
+	assert.NoDirExists(t, filepath.Join(dst, "old dir"), "removed directory deleted")
+	assert.FileExists(t, filepath.Join(dst, "same.conf"))
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "staging directory removed")
+	sudoCmds, err := os.ReadFile(sudoLog) //nolint:gosec // test file
+	require.NoError(t, err)
+	assert.NotContains(t, string(sudoCmds), "cp ", "destination is not copied")
+	assert.NotContains(t, string(sudoCmds), "same.conf", "unchanged file is not touched")
+
+	t.Run("nothing changed", func(t *testing.T) {
+		// local copies don't keep modification time, so the content is compared
+		require.NoError(t, os.Remove(sudoLog))
+		ec.cmd.Sync.Checksum = true
+		_, err := ec.Sync(context.Background())
+		require.NoError(t, err)
+		sudoCmds, err := os.ReadFile(sudoLog) //nolint:gosec // test file
+		require.NoError(t, err)
+		assert.Equal(t, 2, strings.Count(string(sudoCmds), "\n"), "only listing and checksums, got %s", sudoCmds)
+	})
+}
+
+func Test_restoreSudo(t *testing.T) {
+	binDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "sudo"), []byte("#!/bin/sh\nexec \"$@\"\n"), 0o700)) //nolint:gosec // test script
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	dir := filepath.Join(t.TempDir(), "it's $HOME `id` dir")
+	require.NoError(t, os.MkdirAll(dir, 0o750))
+	loc := filepath.Join(dir, "app.conf")
+	for name, content := range map[string]string{"": "current", ".spot-20230101120000": "v1", ".spot-20230102120000": "v2"} {
+		require.NoError(t, os.WriteFile(loc+name, []byte(content), 0o600))
+	}
+	restore := func(version string) {
+		ec := execCmd{exec: &executor.Local{}, tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "restore", Restore: config.RestoreInternal{Location: loc, Version: version},
+				Options: config.CmdOptions{Sudo: true}}}
+		_, err := ec.Restore(context.Background())
+		require.NoError(t, err)
+	}
+
+	restore("")
+	data, err := os.ReadFile(loc) //nolint:gosec // test file
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(data), "latest backup restored")
+
+	restore("20230101120000")
+	data, err = os.ReadFile(loc) //nolint:gosec // test file
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data), "backup of the version restored")
+}
+
+func Test_copyDryPrivileged(t *testing.T) {
+	ctx := context.Background()
+	addr := startLocalExecSSHServer(t)
+	connector, err := executor.NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	remote, err := connector.Connect(ctx, addr, "h1", "test", nil)
+	require.NoError(t, err)
+	defer remote.Close()
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.conf"), filepath.Join(dir, "dst", "app.conf")
+	require.NoError(t, os.MkdirAll(filepath.Dir(dst), 0o750))
+	require.NoError(t, os.WriteFile(src, []byte("v1"), 0o644)) //nolint:gosec // test file
+	require.NoError(t, os.WriteFile(dst, []byte("v1"), 0o600))
+	mtime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(src, mtime, mtime))
+	require.NoError(t, os.Chtimes(dst, mtime, mtime))
+
+	dryCopy := func(mode string) string {
+		ec := execCmd{exec: executor.NewDry(addr, "h1").WithRemote(remote), tsk: &config.Task{Name: "test"}, hostAddr: addr,
+			hostName: "h1", tmpDir: filepath.Join(dir, "staging"), cmd: config.Cmd{Name: "copy", Options: config.CmdOptions{Sudo: true},
+				Copy: config.CopyInternal{Source: src, Dest: dst, Mode: mode}}}
+		stdout := os.Stdout
+		rd, wr, err := os.Pipe()
+		require.NoError(t, err)
+		os.Stdout = wr
+		resp, err := ec.Copy(ctx)
+		os.Stdout = stdout
+		require.NoError(t, wr.Close())
+		require.NoError(t, err)
+		assert.Equal(t, " {copy: "+src+" -> "+dst+", sudo: true}", resp.details)
+		out, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	assert.Contains(t, dryCopy("0600"), dst+" (unchanged)", "compared with destination and its mode set by mode option")
+	assert.Contains(t, dryCopy(""), dst+" (update)", "mode of destination differs from source")
+	assert.NoDirExists(t, filepath.Join(dir, "staging"), "nothing staged")
+}
+
+func Test_releaseDryRollback(t *testing.T) {
+	ec := execCmd{exec: executor.NewDry("h1:22", "h1"), tsk: &config.Task{Name: "test"}, hostAddr: "h1:22", hostName: "h1",
+		cmd: config.Cmd{Name: "rollback", Release: config.ReleaseInternal{BaseDir: "/srv/app", Rollback: true}}}
+	resp, err := ec.Release(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, " {release: /srv/app, rollback: true}", resp.details)
+	assert.Empty(t, resp.vars, "release dir is not known in dry mode")
+}
+
+func Test_hostDirName(t *testing.T) {
+	assert.Equal(t, "h1", hostDirName("10.0.0.1:22", "h1"))
+	assert.Equal(t, "10.0.0.1", hostDirName("10.0.0.1:22", ""))
+	assert.Equal(t, "localhost", hostDirName("localhost", ""))
+}
@@ -0,0 +1,251 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/go-pkgz/stringutils"
+
+	"github.com/umputun/spot/pkg/config"
+)
+
+// TaskPlan is an execution plan of a task for a target. It lists all resolved hosts and commands
+// in the order they would be executed, without executing anything.
+type TaskPlan struct {
+	Task   string     `json:"task"`
+	Target string     `json:"target"`
+	Hosts  []HostPlan `json:"hosts"`
+}
+
+// HostPlan is an execution plan of a task for a single host
+type HostPlan struct {
+	Name     string    `json:"name,omitempty"`
+	Host     string    `json:"host"`
+	Port     int       `json:"port"`
+	User     string    `json:"user"`
+	Canary   bool      `json:"canary,omitempty"`
+	Commands []CmdPlan `json:"commands"`
+}
+
+// CmdPlan is a planned command with all templates applied for the host. Skip is set to the reason
+// if the command would be skipped on the host. Nested commands of parallel and block types are listed in Commands.
+type CmdPlan struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Section   string            `json:"section,omitempty"` // block, rescue or always for commands nested in block
+	Details   string            `json:"details,omitempty"`
+	Local     bool              `json:"local,omitempty"`
+	Sudo      bool              `json:"sudo,omitempty"`
+	Become    string            `json:"become,omitempty"` // become method and user, if set
+	Condition string            `json:"cond,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Secrets   []string          `json:"secrets,omitempty"`
+	Skip      string            `json:"skip,omitempty"`
+	Commands  []CmdPlan         `json:"commands,omitempty"`
+}
+
+// Plan makes an execution plan of a task for a target. It resolves target hosts, users and ports and applies
+// templates to commands for each host. Nothing is executed, neither locally nor remotely, and no connections are made.
+func (p *Process) Plan(task, target string) (TaskPlan, error) {
+	tsk, err := p.Playbook.Task(task)
+	if err != nil {
+		return TaskPlan{}, fmt.Errorf("can't get task %s: %w", task, err)
+	}
+
+	targetHosts, err := p.Playbook.TargetHosts(target)
+	if err != nil {
+		return TaskPlan{}, fmt.Errorf("can't get target %s: %w", target, err)
+	}
+	log.Printf("[DEBUG] plan task %q for target hosts (%d) %+v", task, len(targetHosts), targetHosts)
+
+	res := TaskPlan{Task: tsk.Name, Target: target, Hosts: make([]HostPlan, 0, len(targetHosts))}
+	for i, host := range targetHosts {
+		user := host.User
+		if user == "" {
+			user = tsk.User
+		}
+		hp := HostPlan{Name: host.Name, Host: host.Host, Port: host.Port, User: user,
+			Canary: i < tsk.Canary, Commands: make([]CmdPlan, 0, len(tsk.Commands))}
+		hostAddr := fmt.Sprintf("%s:%d", host.Host, host.Port)
+		for _, cmd := range tsk.Commands {
+			cp := p.planCmd(tsk, cmd, hostAddr, host.Name, "", stringutils.Contains(cmd.Name, p.Only))
+			cp.Skip = p.skipReason(cmd, host.Name, hostAddr, false)
+			hp.Commands = append(hp.Commands, cp)
+		}
+		res.Hosts = append(res.Hosts, hp)
+	}
+	return res, nil
+}
+
+// planCmd makes a plan for a single command on a host, including nested commands. Selected is set if the command
+// or its group is in the only list, the same way as for execution.
+func (p *Process) planCmd(tsk *config.Task, cmd config.Cmd, hostAddr, hostName, section string, selected bool) CmdPlan {
+	if cmd.Options.Local && !isGroup(cmd) {
+		hostAddr, hostName = "localhost", ""
+	}
+	tmpl := templater{hostAddr: hostAddr, hostName: hostName, task: tsk, command: cmd.Name, env: cmd.Environment}
+
+	res := CmdPlan{Name: cmd.Name, Section: section, Local: cmd.Options.Local, Sudo: cmd.Options.Sudo,
+		Condition: tmpl.apply(cmd.Condition), Secrets: cmd.Options.Secrets}
+	if cmd.Options.Become != "" || cmd.Options.BecomeUser != "" {
+		res.Become = cmd.Options.Become
+		if res.Become == "" {
+			res.Become = "sudo"
+		}
+		if cmd.Options.BecomeUser != "" {
+			res.Become += " as " + cmd.Options.BecomeUser
+		}
+	}
+	if len(cmd.Environment) > 0 {
+		res.Env = make(map[string]string, len(cmd.Environment))
+		for k, v := range cmd.Environment {
+			res.Env[k] = tmpl.apply(v)
+		}
+	}
+
+	pair := func(src, dst string) string { return fmt.Sprintf("%s -> %s", tmpl.apply(src), tmpl.apply(dst)) }
+	nested := func(cmds []config.Cmd, section string) {
+		for _, c := range cmds {
+			cp := p.planCmd(tsk, inheritEnv(c, cmd.Environment), hostAddr, hostName, section,
+				selected || stringutils.Contains(c.Name, p.Only))
+			cp.Skip = p.skipReason(c, hostName, hostAddr, selected)
+			res.Commands = append(res.Commands, cp)
+		}
+	}
+
+	switch {
+	case cmd.Script != "":
+		res.Type, res.Details = "script", tmpl.apply(cmd.Script)
+	case cmd.Copy.Source != "" && cmd.Copy.Dest != "":
+		res.Type, res.Details = "copy", pair(cmd.Copy.Source, cmd.Copy.Dest)
+	case len(cmd.MCopy) > 0:
+		msgs := make([]string, 0, len(cmd.MCopy))
+		for _, c := range cmd.MCopy {
+			msgs = append(msgs, pair(c.Source, c.Dest))
+		}
+		res.Type, res.Details = "mcopy", strings.Join(msgs, ", ")
+	case cmd.Sync.Source != "" && cmd.Sync.Dest != "":
+		res.Type, res.Details = "sync", pair(cmd.Sync.Source, cmd.Sync.Dest)
+		if cmd.Sync.Direction == "pull" {
+			res.Details += ", pull"
+		}
+	case len(cmd.MSync) > 0:
+		msgs := make([]string, 0, len(cmd.MSync))
+		for _, c := range cmd.MSync {
+			msgs = append(msgs, pair(c.Source, c.Dest))
+		}
+		res.Type, res.Details = "msync", strings.Join(msgs, ", ")
+	case cmd.Delete.Location != "":
+		res.Type, res.Details = "delete", tmpl.apply(cmd.Delete.Location)
+	case len(cmd.MDelete) > 0:
+		locs := make([]string, 0, len(cmd.MDelete))
+		for _, c := range cmd.MDelete {
+			locs = append(locs, tmpl.apply(c.Location))
+		}
+		res.Type, res.Details = "mdelete", strings.Join(locs, ", ")
+	case cmd.Restore.Location != "":
+		res.Type, res.Details = "restore", tmpl.apply(cmd.Restore.Location)
+	case cmd.Transfer.SrcHost != "":
+		res.Type = "transfer"
+		res.Details = pair(cmd.Transfer.SrcHost+":"+cmd.Transfer.Source, cmd.Transfer.Dest)
+	case cmd.Release.BaseDir != "":
+		res.Type, res.Details = "release", pair(cmd.Release.Source, cmd.Release.BaseDir)
+		if cmd.Release.Rollback {
+			res.Details = tmpl.apply(cmd.Release.BaseDir) + ", rollback"
+		}
+	case cmd.Wait.Command != "":
+		res.Type, res.Details = "wait", tmpl.apply(cmd.Wait.Command)
+	case cmd.Echo != "":
+		res.Type, res.Details = "echo", tmpl.apply(cmd.Echo)
+	case len(cmd.Parallel.Commands) > 0:
+		res.Type = "parallel"
+		nested(cmd.Parallel.Commands, "")
+	case len(cmd.Block) > 0:
+		res.Type = "block"
+		nested(cmd.Block, "block")
+		nested(cmd.Rescue, "rescue")
+		nested(cmd.Always, "always")
+	default:
+		res.Type = "unknown"
+	}
+	return res
+}
+
+// WritePlan writes execution plans to the writer, as a json array if asJSON set or as a human-readable text otherwise.
+func WritePlan(w io.Writer, plans []TaskPlan, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	}
+
+	var writeCmds func(cmds []CmdPlan, indent string)
+	writeCmds = func(cmds []CmdPlan, indent string) {
+		for i, c := range cmds {
+			fmt.Fprintf(w, "%s%d. %s [%s]", indent, i+1, c.Name, c.Type) // nolint
+			if c.Section != "" {
+				fmt.Fprintf(w, " (%s)", c.Section) // nolint
+			}
+			var opts []string
+			if c.Local {
+				opts = append(opts, "local")
+			}
+			if c.Sudo {
+				opts = append(opts, "sudo")
+			}
+			if c.Become != "" {
+				opts = append(opts, "become: "+c.Become)
+			}
+			if len(opts) > 0 {
+				fmt.Fprintf(w, " {%s}", strings.Join(opts, ", ")) // nolint
+			}
+			if c.Skip != "" {
+				fmt.Fprintf(w, " - skip: %s", c.Skip) // nolint
+			}
+			fmt.Fprintln(w) // nolint
+			if c.Details != "" {
+				for _, l := range strings.Split(strings.TrimSpace(c.Details), "\n") {
+					fmt.Fprintf(w, "%s   > %s\n", indent, l) // nolint
+				}
+			}
+			if c.Condition != "" {
+				fmt.Fprintf(w, "%s   cond: %s\n", indent, c.Condition) // nolint
+			}
+			keys := make([]string, 0, len(c.Env))
+			for k := range c.Env {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(w, "%s   env: %s=%s\n", indent, k, c.Env[k]) // nolint
+			}
+			if len(c.Secrets) > 0 {
+				fmt.Fprintf(w, "%s   secrets: %s\n", indent, strings.Join(c.Secrets, ", ")) // nolint
+			}
+			writeCmds(c.Commands, indent+"   ")
+		}
+	}
+
+	for _, tp := range plans {
+		if _, err := fmt.Fprintf(w, "task %q, target %q, hosts: %d\n", tp.Task, tp.Target, len(tp.Hosts)); err != nil {
+			return fmt.Errorf("can't write plan: %w", err)
+		}
+		for _, h := range tp.Hosts {
+			fmt.Fprintf(w, " host %s:%d", h.Host, h.Port) // nolint
+			if h.Name != "" {
+				fmt.Fprintf(w, " (%s)", h.Name) // nolint
+			}
+			fmt.Fprintf(w, ", user: %s", h.User) // nolint
+			if h.Canary {
+				fmt.Fprint(w, ", canary") // nolint
+			}
+			fmt.Fprintln(w) // nolint
+			writeCmds(h.Commands, "  ")
+		}
+	}
+	return nil
+}
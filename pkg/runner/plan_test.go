@@ -0,0 +1,138 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+	"github.com/umputun/spot/pkg/runner/mocks"
+)
+
+func TestProcess_Plan(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker")
+	tsk := config.Task{Name: "deploy", User: "deployer", Canary: 1, Commands: []config.Cmd{
+		{Name: "local cmd", Script: "touch " + marker, Options: config.CmdOptions{Local: true}},
+		{Name: "copy", Copy: config.CopyInternal{Source: "/src/{SPOT_REMOTE_NAME}.conf", Dest: "/etc/$FOO/app.conf"},
+			Environment: map[string]string{"FOO": "foo"}},
+		{Name: "only h2", Script: "echo h2", Options: config.CmdOptions{OnlyOn: []string{"h2"}, Sudo: true}},
+		{Name: "skipped", Script: "echo skipped"},
+		{Name: "manual", Script: "echo manual", Options: config.CmdOptions{NoAuto: true}},
+		{Name: "par", Parallel: config.ParallelInternal{Commands: []config.Cmd{
+			{Name: "p1", Echo: "p1 {SPOT_REMOTE_HOST}"},
+			{Name: "p2", Delete: config.DeleteInternal{Location: "/tmp/p2"}, Options: config.CmdOptions{OnlyOn: []string{"!h1", "h2"}}},
+		}}},
+		{Name: "blk", Block: []config.Cmd{{Name: "b1", Script: "echo b1"}, {Name: "b2", Script: "echo b2",
+			Options: config.CmdOptions{NoAuto: true}}}, Rescue: []config.Cmd{{Name: "r1", Script: "echo r1"}}},
+	}}
+
+	p := &Process{
+		Dry: false, // plan should not execute anything even without dry mode
+		Playbook: &mocks.PlaybookMock{
+			TaskFunc: func(name string) (*config.Task, error) { return &tsk, nil },
+			TargetHostsFunc: func(name string) ([]config.Destination, error) {
+				return []config.Destination{{Host: "10.0.0.1", Port: 22, Name: "h1", User: "admin"}, {Host: "10.0.0.2", Port: 2222, Name: "h2"}}, nil
+			},
+		},
+		Skip:        []string{"skipped"},
+		ColorWriter: executor.NewColorizedWriter(os.Stdout, "", "", "", nil),
+	}
+
+	plan, err := p.Plan("deploy", "prod")
+	require.NoError(t, err)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "local command should not be executed")
+
+	assert.Equal(t, "deploy", plan.Task)
+	assert.Equal(t, "prod", plan.Target)
+	require.Len(t, plan.Hosts, 2)
+
+	h1, h2 := plan.Hosts[0], plan.Hosts[1]
+	assert.Equal(t, "admin", h1.User)
+	assert.True(t, h1.Canary)
+	assert.Equal(t, "deployer", h2.User)
+	assert.Equal(t, 2222, h2.Port)
+	assert.False(t, h2.Canary)
+
+	require.Len(t, h1.Commands, 7)
+	assert.Equal(t, CmdPlan{Name: "local cmd", Type: "script", Details: "touch " + marker, Local: true}, h1.Commands[0])
+	assert.Equal(t, CmdPlan{Name: "copy", Type: "copy", Details: "/src/h1.conf -> /etc/foo/app.conf",
+		Env: map[string]string{"FOO": "foo"}}, h1.Commands[1])
+	assert.Equal(t, "not in only_on list", h1.Commands[2].Skip)
+	assert.Equal(t, "", h2.Commands[2].Skip)
+	assert.True(t, h2.Commands[2].Sudo)
+	assert.Equal(t, "in skip list", h1.Commands[3].Skip)
+	assert.Equal(t, "has noauto option", h1.Commands[4].Skip)
+
+	par := h1.Commands[5]
+	assert.Equal(t, "parallel", par.Type)
+	require.Len(t, par.Commands, 2)
+	assert.Equal(t, "p1 10.0.0.1:22", par.Commands[0].Details)
+	assert.Equal(t, `excluded host "h1"`, par.Commands[1].Skip)
+	assert.Equal(t, "", h2.Commands[5].Commands[1].Skip)
+
+	blk := h1.Commands[6]
+	assert.Equal(t, "block", blk.Type)
+	require.Len(t, blk.Commands, 3)
+	assert.Equal(t, "block", blk.Commands[0].Section)
+	assert.Equal(t, "has noauto option", blk.Commands[1].Skip)
+	assert.Equal(t, "rescue", blk.Commands[2].Section)
+
+	t.Run("write text", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		require.NoError(t, WritePlan(&buf, []TaskPlan{plan}, false))
+		out := buf.String()
+		assert.Contains(t, out, `task "deploy", target "prod", hosts: 2`)
+		assert.Contains(t, out, " host 10.0.0.1:22 (h1), user: admin, canary\n")
+		assert.Contains(t, out, "  2. copy [copy]\n     > /src/h1.conf -> /etc/foo/app.conf\n     env: FOO=foo\n")
+		assert.Contains(t, out, "  3. only h2 [script] {sudo} - skip: not in only_on list\n")
+		assert.Contains(t, out, "     2. p2 [delete] - skip: excluded host \"h1\"\n")
+		assert.Contains(t, out, "     3. r1 [script] (rescue)\n")
+	})
+
+	t.Run("write json", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		require.NoError(t, WritePlan(&buf, []TaskPlan{plan}, true))
+		var res []TaskPlan
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+		assert.Equal(t, []TaskPlan{plan}, res)
+	})
+
+	t.Run("only nested command", func(t *testing.T) {
+		defer func() { p.Only = nil }()
+		p.Only = []string{"b2"}
+		plan, err := p.Plan("deploy", "prod")
+		require.NoError(t, err)
+		cmds := plan.Hosts[0].Commands
+		assert.Equal(t, "not in only list", cmds[1].Skip)
+		assert.Equal(t, "not in only list", cmds[5].Skip, "no commands of the group in only list")
+		assert.Equal(t, "", cmds[6].Skip, "group of the command in only list")
+		assert.Equal(t, "not in only list", cmds[6].Commands[0].Skip)
+		assert.Equal(t, "", cmds[6].Commands[1].Skip, "noauto command in only list")
+		assert.Equal(t, "not in only list", cmds[6].Commands[2].Skip)
+	})
+
+	t.Run("only group", func(t *testing.T) {
+		defer func() { p.Only, p.Skip = nil, []string{"skipped"} }()
+		p.Only, p.Skip = []string{"blk"}, []string{"r1"}
+		plan, err := p.Plan("deploy", "prod")
+		require.NoError(t, err)
+		blk := plan.Hosts[0].Commands[6]
+		assert.Equal(t, "", blk.Skip)
+		assert.Equal(t, "", blk.Commands[0].Skip, "nested commands of the group not filtered by only list")
+		assert.Equal(t, "has noauto option", blk.Commands[1].Skip)
+		assert.Equal(t, "in skip list", blk.Commands[2].Skip)
+	})
+
+	t.Run("unknown task", func(t *testing.T) {
+		p.Playbook = &mocks.PlaybookMock{TaskFunc: func(name string) (*config.Task, error) { return nil, assert.AnError }}
+		_, err := p.Plan("bad", "prod")
+		require.ErrorContains(t, err, "can't get task bad")
+	})
+}
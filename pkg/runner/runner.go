@@ -1,14 +1,20 @@
 package runner
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,16 +41,22 @@ type Process struct {
 	ColorWriter *executor.ColorizedWriter
 	Verbose     bool
 	Dry         bool
+	TmpDir      string // base directory for temporary directories on hosts, /tmp if not set
+	MaxOutput   int    // max size of output retained in memory per command, in bytes, unlimited if 0
 
 	Skip []string
 	Only []string
 
 	secrets []string
+	now     func() time.Time // clock for names of releases, time.Now if not set
+
+	transfersMu sync.Mutex
+	transfers   map[string]*transferSeeds // hosts with transferred files, by task and command, for transfer fanout
 }
 
 // Connector is an interface for connecting to a host, and returning remote executer.
 type Connector interface {
-	Connect(ctx context.Context, hostAddr, hostName, user string) (*executor.Remote, error)
+	Connect(ctx context.Context, hostAddr, hostName, user string, opts *executor.ConnectOpts) (*executor.Remote, error)
 }
 
 // Playbook is an interface for getting task and target information from playbook.
@@ -83,39 +95,302 @@ func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err
 	log.Printf("[DEBUG] target hosts (%d) %+v", len(targetHosts), targetHosts)
 
 	p.secrets = p.Playbook.AllSecretValues()
+	p.transfersMu.Lock()
+	p.transfers = nil // hosts of the previous runs can't be used as transfer seeds
+	p.transfersMu.Unlock()
 	var commands int32
 	lock := sync.Mutex{}
+	hostErrs := make(map[int]error, len(targetHosts)) // errors by host index, nil error means host completed
+
+	// runOnHosts runs the task on the given hosts, offset is the index of the first host in targetHosts
+	runOnHosts := func(hosts []config.Destination, offset int) error {
+		wg := syncs.NewErrSizedGroup(p.Concurrency, syncs.Context(ctx), syncs.Preemptive)
+		for i, host := range hosts {
+			i, host := i+offset, host
+			wg.Go(func() error {
+				count, vv, e := p.runTaskOnHost(ctx, tsk, host)
+				if i == 0 {
+					atomic.AddInt32(&commands, int32(count))
+				}
+
+				lock.Lock()
+				if e != nil {
+					_, errLog := executor.MakeOutAndErrWriters(fmt.Sprintf("%s:%d", host.Host, host.Port), host.Name, p.Verbose, p.secrets)
+					errLog.Write([]byte(e.Error())) // nolint
+				}
+				hostErrs[i] = e
+				for k, v := range vv {
+					allVars[k] = v
+				}
+				lock.Unlock()
+
+				return e
+			})
+		}
+		return wg.Wait()
+	}
+
+	canaryHosts, restHosts := []config.Destination{}, targetHosts
+	if tsk.Canary > 0 {
+		// canary larger than the number of hosts makes all hosts canary, the check still gates the task
+		canary := tsk.Canary
+		if canary > len(targetHosts) {
+			canary = len(targetHosts)
+		}
+		canaryHosts, restHosts = targetHosts[:canary], targetHosts[canary:]
+	}
+
+	if len(canaryHosts) > 0 {
+		log.Printf("[INFO] run task %q on %d canary hosts first", tsk.Name, len(canaryHosts))
+		err = runOnHosts(canaryHosts, 0)
+		if err == nil {
+			var checkErrs map[int]error
+			checkErrs, err = p.canaryCheck(ctx, tsk, canaryHosts)
+			for i, e := range checkErrs {
+				hostErrs[i] = e // canary hosts failed the check considered as failed, i.e. for rollback
+			}
+		}
+		if err == nil {
+			err = p.canaryPause(ctx, tsk, len(restHosts))
+		}
+		if err != nil {
+			err = fmt.Errorf("canary failed, skipped %d hosts: %w", len(restHosts), err)
+		}
+	}
+	if err == nil {
+		err = runOnHosts(restHosts, len(canaryHosts))
+	}
 
+	// execute on-error command if any error occurred during task execution and on-error command is defined
+	if err != nil && tsk.OnError != "" && !p.Dry {
+		p.onError(ctx, tsk)
+	}
+
+	// execute rollback task if any error occurred during task execution and rollback task is defined
+	if err != nil && tsk.Rollback != "" {
+		err = p.rollback(ctx, tsk, targetHosts, hostErrs, err)
+	}
+
+	return ProcResp{Hosts: len(targetHosts), Commands: int(atomic.LoadInt32(&commands)), Vars: allVars}, err
+}
+
+// canaryCheck runs the canary check of the task on all canary hosts. Script check runs as a command on each canary
+// host, or locally (once per canary host) if local is set. URL check probes the url with http GET, expecting 2xx status.
+// Returns check errors by host index and all errors combined.
+func (p *Process) canaryCheck(ctx context.Context, tsk *config.Task, hosts []config.Destination) (map[int]error, error) {
+	check := tsk.CanaryCheck
+	if check.Script == "" && check.URL == "" {
+		return nil, nil
+	}
+
+	res := make(map[int]error)
+	lock := sync.Mutex{}
 	wg := syncs.NewErrSizedGroup(p.Concurrency, syncs.Context(ctx), syncs.Preemptive)
-	for i, host := range targetHosts {
+	for i, host := range hosts {
 		i, host := i, host
 		wg.Go(func() error {
-			count, vv, e := p.runTaskOnHost(ctx, tsk, fmt.Sprintf("%s:%d", host.Host, host.Port), host.Name, host.User)
-			if i == 0 {
-				atomic.AddInt32(&commands, int32(count))
+			hostAddr := fmt.Sprintf("%s:%d", host.Host, host.Port)
+			if e := p.canaryCheckHost(ctx, tsk, host); e != nil {
+				e = fmt.Errorf("canary check failed on %s: %w", hostAddr, e)
+				lock.Lock()
+				res[i] = e
+				lock.Unlock()
+				return e
 			}
+			fmt.Fprintf(p.ColorWriter.WithHost(hostAddr, host.Name), "canary check passed for task %q\n", tsk.Name)
+			return nil
+		})
+	}
+	return res, wg.Wait()
+}
 
-			lock.Lock()
-			if e != nil {
-				_, errLog := executor.MakeOutAndErrWriters(fmt.Sprintf("%s:%d", host.Host, host.Port), host.Name, p.Verbose, p.secrets)
-				errLog.Write([]byte(e.Error())) // nolint
+// canaryCheckHost runs the canary check script and url probe for a single canary host.
+func (p *Process) canaryCheckHost(ctx context.Context, tsk *config.Task, host config.Destination) error {
+	check := tsk.CanaryCheck
+	hostAddr := fmt.Sprintf("%s:%d", host.Host, host.Port)
+
+	if check.Script != "" {
+		cmd := config.Cmd{Name: "canary check", Script: check.Script, Options: config.CmdOptions{Local: check.Local}}
+		ec := execCmd{cmd: cmd, hostAddr: hostAddr, hostName: host.Name, user: host.User, tsk: tsk, verbose: p.Verbose,
+			maxOutput: p.MaxOutput, hostAgent: host.ForwardAgent}
+		if !p.Dry {
+			var exec executor.Interface = &executor.Local{}
+			if !check.Local {
+				remote, err := p.Connector.Connect(ctx, hostAddr, host.Name, host.User, connectOpts(host))
+				if err != nil {
+					return fmt.Errorf("can't connect to %s: %w", hostAddr, err)
+				}
+				defer remote.Close()
+				remote.SetSecrets(p.secrets)
+				ec.exec, exec = remote, remote
 			}
-			for k, v := range vv {
-				allVars[k] = v
+			tmpDir, cleanup, err := p.makeTmpDir(ctx, exec, hostAddr, host.Name, host.User)
+			if err != nil {
+				return err
 			}
-			lock.Unlock()
+			defer cleanup()
+			ec.tmpDir, ec.localTmpDir = tmpDir, tmpDir
+		}
+		ec = p.pickCmdExecutor(cmd, ec, hostAddr, host.Name)
+		if _, err := p.execCommand(ctx, ec); err != nil {
+			return err
+		}
+	}
 
-			return e
-		})
+	if check.URL != "" {
+		// url check is using host address without ssh port, as the probe is not related to ssh
+		tmpl := templater{hostAddr: host.Host, hostName: host.Name, task: tsk, command: "canary check"}
+		url := tmpl.apply(check.URL)
+		if p.Dry {
+			log.Printf("[DEBUG] dry run, skip canary probe %s", url)
+			return nil
+		}
+		timeout := check.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+		if err != nil {
+			return fmt.Errorf("can't make canary probe request for %s: %w", url, err)
+		}
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("canary probe %s failed: %w", url, err)
+		}
+		defer resp.Body.Close() // nolint
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("canary probe %s failed, status: %s", url, resp.Status)
+		}
 	}
-	err = wg.Wait()
+	return nil
+}
 
-	// execute on-error command if any error occurred during task execution and on-error command is defined
-	if err != nil && tsk.OnError != "" {
-		p.onError(ctx, tsk)
+// canaryPause waits for the soak duration and for manual confirmation, if set, before processing the rest of the hosts.
+// Both are skipped in dry mode.
+func (p *Process) canaryPause(ctx context.Context, tsk *config.Task, rest int) error {
+	check := tsk.CanaryCheck
+	if p.Dry || rest == 0 {
+		return nil
 	}
 
-	return ProcResp{Hosts: len(targetHosts), Commands: int(atomic.LoadInt32(&commands)), Vars: allVars}, err
+	if check.Pause > 0 {
+		log.Printf("[INFO] canary pause %v before the rest of %d hosts", check.Pause, rest)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(check.Pause):
+		}
+	}
+
+	if check.Confirm {
+		msg := fmt.Sprintf("canary hosts of task %q completed, continue with the rest of %d hosts? [y/N] ", tsk.Name, rest)
+		ok, err := confirm(ctx, msg)
+		if err != nil {
+			return fmt.Errorf("can't get confirmation: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("rollout not confirmed")
+		}
+	}
+	return nil
+}
+
+// confirmIn and confirmOut used to ask for manual confirmation. They are vars so they can be mocked in tests
+var (
+	confirmIn  io.Reader = os.Stdin
+	confirmOut io.Writer = os.Stdout
+)
+
+// confirm asks for confirmation on the terminal, returns true if user answered "y" or "yes".
+// On context cancellation the pending read is interrupted with a read deadline. If stdin doesn't support
+// deadlines, the reader goroutine stays blocked until the next line or EOF, which is harmless as
+// cancellation ends the run anyway.
+func confirm(ctx context.Context, msg string) (bool, error) {
+	f, isFile := confirmIn.(*os.File)
+	if isFile {
+		fi, err := f.Stat()
+		if err != nil {
+			return false, fmt.Errorf("can't stat stdin: %w", err)
+		}
+		if fi.Mode()&os.ModeCharDevice == 0 {
+			return false, fmt.Errorf("stdin is not a terminal")
+		}
+		_ = f.SetReadDeadline(time.Time{}) // reset deadline possibly left by the previous canceled confirmation
+	}
+
+	fmt.Fprint(confirmOut, msg)
+	answerCh := make(chan string, 1)
+	go func() {
+		answer, _ := bufio.NewReader(confirmIn).ReadString('\n')
+		answerCh <- answer
+	}()
+
+	select {
+	case <-ctx.Done():
+		if isFile {
+			_ = f.SetReadDeadline(time.Now()) // unblock the pending read
+		}
+		return false, ctx.Err()
+	case answer := <-answerCh:
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
+// rollback executes the rollback task of the failed task on all failed hosts, and on all completed hosts as well
+// if rollback_all is set. The rollback task gets the failure details in SPOT_FAILED_TASK, SPOT_FAILED_HOSTS
+// and SPOT_ERROR (host's own error, empty for completed hosts) environment variables.
+// Returns the original task error, annotated with the rollback outcome.
+func (p *Process) rollback(ctx context.Context, tsk *config.Task, hosts []config.Destination, hostErrs map[int]error,
+	taskErr error) error {
+	rbTask, err := p.Playbook.Task(tsk.Rollback)
+	if err != nil {
+		return fmt.Errorf("can't get rollback task %s: %v, task error: %w", tsk.Rollback, err, taskErr)
+	}
+
+	failedHosts, rbHosts := []string{}, []int{}
+	for i, h := range hosts {
+		hostErr, processed := hostErrs[i]
+		if !processed {
+			continue // host was not processed at all, i.e. canceled
+		}
+		if hostErr != nil {
+			failedHosts = append(failedHosts, fmt.Sprintf("%s:%d", h.Host, h.Port))
+		}
+		if hostErr != nil || tsk.RollbackAll {
+			rbHosts = append(rbHosts, i)
+		}
+	}
+	log.Printf("[INFO] rollback task %q with %q on %d hosts", tsk.Name, rbTask.Name, len(rbHosts))
+
+	wg := syncs.NewErrSizedGroup(p.Concurrency, syncs.Context(ctx), syncs.Preemptive)
+	for _, idx := range rbHosts {
+		host, hostErr := hosts[idx], hostErrs[idx]
+		wg.Go(func() error {
+			hostAddr := fmt.Sprintf("%s:%d", host.Host, host.Port)
+			env := map[string]string{"SPOT_FAILED_TASK": tsk.Name, "SPOT_FAILED_HOSTS": strings.Join(failedHosts, ",")}
+			env["SPOT_ERROR"] = ""
+			if hostErr != nil {
+				env["SPOT_ERROR"] = hostErr.Error()
+			}
+			hostTask := deepcopy.Copy(*rbTask).(config.Task)
+			for i := range hostTask.Commands {
+				hostTask.Commands[i] = inheritEnv(hostTask.Commands[i], env)
+			}
+			if _, _, e := p.runTaskOnHost(ctx, &hostTask, host); e != nil {
+				_, errLog := executor.MakeOutAndErrWriters(hostAddr, host.Name, p.Verbose, p.secrets)
+				errLog.Write([]byte(e.Error())) // nolint
+				return e
+			}
+			return nil
+		})
+	}
+	if rbErr := wg.Wait(); rbErr != nil {
+		return fmt.Errorf("rollback with task %q failed: %v, task error: %w", rbTask.Name, rbErr, taskErr)
+	}
+	log.Printf("[INFO] rollback with task %q completed on %d host(s)", rbTask.Name, len(rbHosts))
+	return fmt.Errorf("rolled back with task %q on %d host(s): %w", rbTask.Name, len(rbHosts), taskErr)
 }
 
 // Gen generates the list target hosts for a given target, applying templates.
@@ -152,9 +427,10 @@ func (p *Process) Gen(targets []string, tmplRdr io.Reader, respWr io.Writer) err
 	return nil
 }
 
-// runTaskOnHost executes all commands of a task on a target host. hostAddr can be a remote host or localhost with port.
+// runTaskOnHost executes all commands of a task on a target host. The host can be a remote host or localhost with port.
 // returns number of executed commands, vars from all commands and error if any.
-func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr, hostName, user string) (int, vars, error) {
+func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, host config.Destination) (int, vars, error) {
+	hostAddr, hostName, user := fmt.Sprintf("%s:%d", host.Host, host.Port), host.Name, host.User
 	report := func(hostAddr, hostName, f string, vals ...any) {
 		fmt.Fprintf(p.ColorWriter.WithHost(hostAddr, hostName), f, vals...)
 	}
@@ -163,10 +439,11 @@ func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr,
 	stTask := time.Now()
 
 	var remote executor.Interface
-	if p.anyRemoteCommand(tsk) {
+	var tmpDir, localTmpDir string
+	if anyRemoteCommand(tsk.Commands) {
 		// make remote executor only if there is a remote command in the taks
 		var err error
-		remote, err = p.Connector.Connect(ctx, hostAddr, hostName, user)
+		remote, err = p.Connector.Connect(ctx, hostAddr, hostName, user, connectOpts(host))
 		if err != nil {
 			if hostName != "" {
 				return 0, nil, fmt.Errorf("can't connect to %s: %w", hostName, err)
@@ -176,9 +453,23 @@ func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr,
 		defer remote.Close()
 		remote.SetSecrets(p.secrets)
 		report(hostAddr, hostName, "run task %q, commands: %d\n", tsk.Name, len(tsk.Commands))
+
+		var cleanup func()
+		if tmpDir, cleanup, err = p.makeTmpDir(ctx, remote, hostAddr, hostName, user); err != nil {
+			return 0, nil, err
+		}
+		defer cleanup()
 	} else {
 		report("localhost", "", "run task %q, commands: %d (local)\n", tsk.Name, len(tsk.Commands))
 	}
+	if anyLocalCommand(tsk.Commands) {
+		var cleanup func()
+		var err error
+		if localTmpDir, cleanup, err = p.makeTmpDir(ctx, &executor.Local{}, "localhost", "", ""); err != nil {
+			return 0, nil, err
+		}
+		defer cleanup()
+	}
 
 	count := 0
 	tskVars := vars{}
@@ -186,14 +477,17 @@ func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr,
 	// copy task to prevent one task on hostA modifying task on hostB as it does updateVars
 	activeTask := deepcopy.Copy(*tsk).(config.Task)
 
-	for _, cmd := range activeTask.Commands {
+	for i, cmd := range activeTask.Commands {
 		if !p.shouldRunCmd(cmd, hostName, hostAddr) {
 			continue
 		}
 
 		log.Printf("[INFO] %s", p.infoMessage(cmd, hostAddr, hostName))
 		stCmd := time.Now()
-		ec := execCmd{cmd: cmd, hostAddr: hostAddr, hostName: hostName, tsk: &activeTask, exec: remote, verbose: p.Verbose}
+		ec := execCmd{cmd: cmd, hostAddr: hostAddr, hostName: hostName, user: user, tsk: &activeTask, exec: remote,
+			verbose: p.Verbose, tmpDir: tmpDir, localTmpDir: localTmpDir, maxOutput: p.MaxOutput, hostAgent: host.ForwardAgent,
+			now: p.now, cmdPath: strconv.Itoa(i), sshKey: host.SSHKey, sshCert: host.SSHCert,
+			selected: stringutils.Contains(cmd.Name, p.Only)}
 		ec = p.pickCmdExecutor(cmd, ec, hostAddr, hostName) // pick executor on dry run or local command
 
 		exResp, err := p.execCommand(ctx, ec)
@@ -216,7 +510,7 @@ func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr,
 		}
 	}
 
-	if p.anyRemoteCommand(&activeTask) {
+	if anyRemoteCommand(activeTask.Commands) {
 		report(hostAddr, hostName, "completed task %q, commands: %d (%v)\n", activeTask.Name, count, since(stTask))
 	} else {
 		report("localhost", "", "completed task %q, commands: %d (%v)\n", activeTask.Name, count, since(stTask))
@@ -250,40 +544,297 @@ func (p *Process) execCommand(ctx context.Context, ec execCmd) (resp execCmdResp
 	case len(ec.cmd.MDelete) > 0:
 		log.Printf("[DEBUG] delete multiple files on %s", ec.hostAddr)
 		return ec.MDelete(ctx)
+	case ec.cmd.Restore.Location != "":
+		log.Printf("[DEBUG] restore file on %s", ec.hostAddr)
+		return ec.Restore(ctx)
+	case ec.cmd.Release.BaseDir != "":
+		log.Printf("[DEBUG] release to %s", ec.hostAddr)
+		return ec.Release(ctx)
+	case ec.cmd.Transfer.SrcHost != "":
+		log.Printf("[DEBUG] transfer file to %s", ec.hostAddr)
+		return p.execTransfer(ctx, ec)
 	case ec.cmd.Wait.Command != "":
 		log.Printf("[DEBUG] wait for command on %s", ec.hostAddr)
 		return ec.Wait(ctx)
 	case ec.cmd.Echo != "":
 		log.Printf("[DEBUG] echo on %s", ec.hostAddr)
 		return ec.Echo(ctx)
+	case len(ec.cmd.Parallel.Commands) > 0:
+		log.Printf("[DEBUG] run %d parallel commands on %s", len(ec.cmd.Parallel.Commands), ec.hostAddr)
+		return p.execParallel(ctx, ec)
+	case len(ec.cmd.Block) > 0:
+		log.Printf("[DEBUG] run block of %d commands on %s", len(ec.cmd.Block), ec.hostAddr)
+		return p.execBlock(ctx, ec)
 	default:
 		return execCmdResp{}, fmt.Errorf("unknown command %q", ec.cmd.Name)
 	}
 }
 
+// execParallel executes a group of commands concurrently on the same host. All commands share the executor
+// (and the ssh connection) of the group, unless a command picks its own executor, i.e. local.
+// Concurrency is limited by the group's concurrency setting, all commands started at once if not set.
+// Errors of all failed commands are collected and returned together. Vars set by the commands are merged
+// only after all of them are completed, in the order of the commands in the group.
+func (p *Process) execParallel(ctx context.Context, ec execCmd) (resp execCmdResp, err error) {
+	cmds := make([]config.Cmd, 0, len(ec.cmd.Parallel.Commands))
+	paths := make([]string, 0, len(ec.cmd.Parallel.Commands))
+	for i, c := range ec.cmd.Parallel.Commands {
+		if !p.shouldRunNested(c, ec) {
+			continue
+		}
+		cmds = append(cmds, inheritEnv(c, ec.cmd.Environment))
+		paths = append(paths, fmt.Sprintf("%s/parallel/%d", ec.cmdPath, i))
+	}
+
+	concurrency := ec.cmd.Parallel.Concurrency
+	if concurrency <= 0 || concurrency > len(cmds) {
+		concurrency = len(cmds)
+	}
+
+	results := make([]execCmdResp, len(cmds))
+	wg := syncs.NewErrSizedGroup(concurrency, syncs.Context(ctx), syncs.Preemptive)
+	for i, c := range cmds {
+		i, c := i, c
+		wg.Go(func() (e error) {
+			results[i], e = p.execNested(ctx, ec, c, paths[i])
+			return e
+		})
+	}
+	err = wg.Wait()
+
+	names := make([]string, 0, len(cmds))
+	for i, c := range cmds {
+		names = append(names, c.Name)
+		for k, v := range results[i].vars {
+			if resp.vars == nil {
+				resp.vars = make(map[string]string)
+			}
+			resp.vars[k] = v
+		}
+	}
+	resp.details = fmt.Sprintf(" {parallel: %s}", strings.Join(names, ", "))
+	return resp, err
+}
+
+// execBlock executes commands of the block sequentially, the same way as commands of a task. If a command fails,
+// the rest of the block is skipped and rescue commands are executed on the same host, with SPOT_ERROR,
+// SPOT_FAILED_COMMAND and SPOT_REMOTE_HOST set in the environment. Always commands are executed after block
+// and rescue regardless of the result. The block fails only if it failed without rescue or if rescue failed,
+// failures of always commands are logged.
+func (p *Process) execBlock(ctx context.Context, ec execCmd) (resp execCmdResp, err error) {
+	resp.vars = make(map[string]string)
+	env := make(map[string]string, len(ec.cmd.Environment))
+	for k, v := range ec.cmd.Environment {
+		env[k] = v
+	}
+
+	details := []string{fmt.Sprintf("block: %d", len(ec.cmd.Block))}
+	failedCmd, err := p.execNestedSeq(ctx, ec, "block", ec.cmd.Block, env, resp.vars)
+	if err != nil && len(ec.cmd.Rescue) > 0 {
+		log.Printf("[INFO] block %q failed on %s, run rescue: %v", ec.cmd.Name, ec.hostAddr, err)
+		rescueEnv := make(map[string]string, len(env)+3)
+		for k, v := range env {
+			rescueEnv[k] = v
+		}
+		rescueEnv["SPOT_ERROR"] = err.Error()
+		rescueEnv["SPOT_FAILED_COMMAND"] = failedCmd
+		rescueEnv["SPOT_REMOTE_HOST"] = ec.hostAddr
+		if _, rErr := p.execNestedSeq(ctx, ec, "rescue", ec.cmd.Rescue, rescueEnv, resp.vars); rErr != nil {
+			err = fmt.Errorf("rescue failed: %w, block error: %v", rErr, err)
+		} else {
+			err = nil // block rescued
+			details = append(details, fmt.Sprintf("rescued: %s", failedCmd))
+		}
+	}
+
+	if len(ec.cmd.Always) > 0 {
+		// always is a cleanup, its failure is reported but doesn't fail the block
+		if failed, aErr := p.execNestedSeq(ctx, ec, "always", ec.cmd.Always, env, resp.vars); aErr != nil {
+			log.Printf("[WARN] always of block %q failed on %s: %v", ec.cmd.Name, ec.hostAddr, aErr)
+			details = append(details, fmt.Sprintf("always failed: %s", failed))
+		}
+		details = append(details, fmt.Sprintf("always: %d", len(ec.cmd.Always)))
+	}
+
+	resp.details = fmt.Sprintf(" {%s}", strings.Join(details, ", "))
+	return resp, err
+}
+
+// execNestedSeq executes nested commands of the section (block, rescue or always) sequentially and stops on the first
+// failed command, returning its name. Vars set by each command are collected to vars and passed to the following
+// commands via env.
+func (p *Process) execNestedSeq(ctx context.Context, ec execCmd, section string, cmds []config.Cmd,
+	env, vars map[string]string) (string, error) {
+	for i, c := range cmds {
+		if !p.shouldRunNested(c, ec) {
+			continue
+		}
+		resp, err := p.execNested(ctx, ec, inheritEnv(c, env), fmt.Sprintf("%s/%s/%d", ec.cmdPath, section, i))
+		if err != nil {
+			return c.Name, err
+		}
+		for k, v := range resp.vars {
+			vars[k] = v
+			if _, ok := env[k]; !ok { // don't allow override variables, same as updateVars
+				env[k] = v
+			}
+		}
+	}
+	return "", nil
+}
+
+// execNested executes a single nested command of a group (parallel or block) and reports the result.
+// Errors of commands with ignore_errors option are reported but not returned.
+func (p *Process) execNested(ctx context.Context, ec execCmd, c config.Cmd, path string) (execCmdResp, error) {
+	st := time.Now()
+	cec := ec
+	cec.cmd, cec.cmdPath, cec.selected = c, path, ec.selected || stringutils.Contains(c.Name, p.Only)
+	cec = p.pickCmdExecutor(c, cec, ec.hostAddr, ec.hostName)
+	log.Printf("[INFO] %s", p.infoMessage(c, cec.hostAddr, cec.hostName))
+
+	resp, err := p.execCommand(ctx, cec)
+	wr := p.ColorWriter.WithHost(cec.hostAddr, cec.hostName)
+	if err != nil {
+		if !c.Options.IgnoreErrors {
+			return resp, fmt.Errorf("failed command %q: %w", c.Name, err)
+		}
+		fmt.Fprintf(wr, "failed command %q%s (%v)", c.Name, resp.details, time.Since(st).Truncate(time.Millisecond))
+		return execCmdResp{}, nil
+	}
+	fmt.Fprintf(wr, "completed command %q%s (%v)", c.Name, resp.details, time.Since(st).Truncate(time.Millisecond))
+	return resp, nil
+}
+
+// inheritEnv returns a copy of the command with environment of the group added, command's own env takes precedence
+func inheritEnv(c config.Cmd, env map[string]string) config.Cmd {
+	res := make(map[string]string, len(env)+len(c.Environment))
+	for k, v := range env {
+		res[k] = v
+	}
+	for k, v := range c.Environment {
+		res[k] = v
+	}
+	c.Environment = res
+	return c
+}
+
 // pickCmdExecutor returns executor for dry run or local command, otherwise returns the default executor.
+// Groups (parallel and block) keep the default executor, each nested command picks its own by its options.
 func (p *Process) pickCmdExecutor(cmd config.Cmd, ec execCmd, hostAddr, hostName string) execCmd {
 	switch {
-	case cmd.Options.Local:
-		log.Printf("[DEBUG] run local command %q", cmd.Name)
-		ec.exec = &executor.Local{}
-		ec.exec.SetSecrets(p.secrets)
-		ec.hostAddr = "localhost"
-		ec.hostName = ""
+	case isGroup(cmd):
 		return ec
 	case p.Dry:
+		// dry run checked first, local commands should not be executed in dry mode either
 		log.Printf("[DEBUG] run dry command %q", cmd.Name)
-		ec.exec = executor.NewDry(hostAddr, hostName)
-		ec.exec.SetSecrets(p.secrets)
+		dry := executor.NewDry(hostAddr, hostName)
+		if remote, ok := ec.exec.(*executor.Remote); ok && remote != nil {
+			dry = dry.WithRemote(remote) // real connection used read-only, to show what would be changed
+		}
+		ec.exec = dry
 		if cmd.Options.Local {
+			ec.exec = executor.NewDry("localhost", "")
 			ec.hostAddr = "localhost"
 			ec.hostName = ""
+			ec.tmpDir = ec.localTmpDir
 		}
+		ec.exec.SetSecrets(p.secrets)
+		return ec
+	case cmd.Options.Local:
+		log.Printf("[DEBUG] run local command %q", cmd.Name)
+		ec.exec = &executor.Local{}
+		ec.exec.SetSecrets(p.secrets)
+		ec.hostAddr = "localhost"
+		ec.hostName = ""
+		ec.tmpDir = ec.localTmpDir
 		return ec
 	}
 	return ec
 }
 
+// makeTmpDir makes a temporary directory for a task run on the host, with 0700 mode. The directory is unique
+// per run and per user, so concurrent runs don't collide, and it is created once per host connection.
+// In dry mode, the directory is not created. Returns the directory and the cleanup function removing it,
+// cleanup runs even if ctx is canceled, i.e. on SIGINT, and failures of cleanup are reported.
+func (p *Process) makeTmpDir(ctx context.Context, exec executor.Interface, hostAddr, hostName, user string) (string, func(), error) {
+	base := p.TmpDir
+	if base == "" {
+		base = "/tmp"
+	}
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", nil, fmt.Errorf("can't make temporary directory name: %w", err)
+	}
+	name := ".spot-" + hex.EncodeToString(rnd)
+	if user != "" {
+		name = fmt.Sprintf(".spot-%s-%s", user, hex.EncodeToString(rnd))
+	}
+	dir := filepath.Join(base, name)
+	if p.Dry {
+		return dir, func() {}, nil
+	}
+
+	// the base directory is created if missing, the temporary directory itself should not exist
+	mkdirCmd := fmt.Sprintf("mkdir -p %s && mkdir -m 700 %s", executor.ShellQuote(base), executor.ShellQuote(dir))
+	if _, err := exec.Run(ctx, mkdirCmd, nil); err != nil {
+		return "", nil, fmt.Errorf("can't make temporary directory %s on %s: %w", dir, hostAddr, err)
+	}
+	log.Printf("[DEBUG] temporary directory %s made on %s", dir, hostAddr)
+
+	cleanup := func() {
+		// the task context can be canceled already, cleanup should be done anyway
+		cctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := exec.Run(cctx, "rm -rf "+executor.ShellQuote(dir), nil); err != nil {
+			log.Printf("[WARN] can't remove temporary directory %s on %s: %v", dir, hostAddr, err)
+			fmt.Fprintf(p.ColorWriter.WithHost(hostAddr, hostName), "can't remove temporary directory %s: %v\n", dir, err)
+			return
+		}
+		log.Printf("[DEBUG] temporary directory %s removed on %s", dir, hostAddr)
+	}
+	return dir, cleanup, nil
+}
+
+// anyLocalCommand checks if any of the commands, including nested ones, is a local command
+func anyLocalCommand(cmds []config.Cmd) bool {
+	for _, c := range cmds {
+		if c.Options.Local {
+			return true
+		}
+		if anyLocalCommand(nestedCmds(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyRemoteCommand checks if any of the commands, including nested ones, runs on the remote host.
+// Groups run nothing themselves, so only their nested commands are checked.
+func anyRemoteCommand(cmds []config.Cmd) bool {
+	for _, c := range cmds {
+		if !isGroup(c) && !c.Options.Local {
+			return true
+		}
+		if anyRemoteCommand(nestedCmds(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nestedCmds returns all nested commands of parallel or block command, nil for other commands
+func nestedCmds(c config.Cmd) []config.Cmd {
+	if !isGroup(c) {
+		return nil
+	}
+	return append(append(append(append([]config.Cmd{}, c.Parallel.Commands...), c.Block...), c.Rescue...), c.Always...)
+}
+
+// isGroup checks if the command is a group of nested commands, parallel or block
+func isGroup(c config.Cmd) bool {
+	return len(c.Parallel.Commands) > 0 || len(c.Block) > 0
+}
+
 // onError executes on-error command if any error occurred during task execution and on-error command is defined
 func (p *Process) onError(ctx context.Context, tsk *config.Task) {
 	onErrCmd := exec.CommandContext(ctx, "sh", "-c", tsk.OnError) // nolint we want to run shell here
@@ -301,15 +852,6 @@ func (p *Process) onError(ctx context.Context, tsk *config.Task) {
 	}
 }
 
-func (p *Process) anyRemoteCommand(tsk *config.Task) bool {
-	for _, cmd := range tsk.Commands {
-		if !cmd.Options.Local {
-			return true
-		}
-	}
-	return false
-}
-
 func (p *Process) infoMessage(cmd config.Cmd, hostAddr, hostName string) string {
 	infoMsg := fmt.Sprintf("run command %q on host %q (%s)", cmd.Name, hostAddr, hostName)
 	if hostName == "" {
@@ -351,37 +893,77 @@ func (p *Process) updateVars(vars map[string]string, cmd config.Cmd, tsk *config
 // of hosts. If the onlyOn field is empty, the command will be executed on all hosts.
 // It also checks if the command is in the 'only' or 'skip' list, and considers the 'NoAuto' option.
 func (p *Process) shouldRunCmd(cmd config.Cmd, hostName, hostAddr string) bool {
+	if reason := p.skipReason(cmd, hostName, hostAddr, false); reason != "" {
+		log.Printf("[DEBUG] skip command %q, %s", cmd.Name, reason)
+		return false
+	}
+	return true
+}
 
-	if len(p.Only) > 0 && !stringutils.Contains(cmd.Name, p.Only) {
-		log.Printf("[DEBUG] skip command %q, not in only list", cmd.Name)
+// shouldRunNested checks if the nested command of the group executed by ec should be executed, the same way
+// as shouldRunCmd does for commands of the task.
+func (p *Process) shouldRunNested(cmd config.Cmd, ec execCmd) bool {
+	if reason := p.skipReason(cmd, ec.hostName, ec.hostAddr, ec.selected); reason != "" {
+		log.Printf("[DEBUG] skip nested command %q of %q, %s", cmd.Name, ec.cmd.Name, reason)
 		return false
 	}
+	return true
+}
+
+// skipReason returns the reason why the command should be skipped on the host, empty string if it should run.
+// A group is in the only list if any of its nested commands is. Selected is set for nested commands of a group
+// named in the only list, such commands are not filtered by the list.
+func (p *Process) skipReason(cmd config.Cmd, hostName, hostAddr string, selected bool) string {
+	if len(p.Only) > 0 && !selected && !p.inOnly(cmd) {
+		return "not in only list"
+	}
 	if len(p.Skip) > 0 && stringutils.Contains(cmd.Name, p.Skip) {
-		log.Printf("[DEBUG] skip command %q, in skip list", cmd.Name)
-		return false
+		return "in skip list"
 	}
 	if cmd.Options.NoAuto && (len(p.Only) == 0 || !stringutils.Contains(cmd.Name, p.Only)) {
-		log.Printf("[DEBUG] skip command %q, has noauto option", cmd.Name)
-		return false
+		return "has noauto option"
+	}
+	return onlyOnReason(cmd, hostName, hostAddr)
+}
+
+// inOnly checks if the command or any of its nested commands is in the only list
+func (p *Process) inOnly(cmd config.Cmd) bool {
+	if stringutils.Contains(cmd.Name, p.Only) {
+		return true
 	}
+	for _, c := range nestedCmds(cmd) {
+		if p.inOnly(c) {
+			return true
+		}
+	}
+	return false
+}
 
+// onlyOnReason returns the reason why the command is not allowed on the host by the only_on restrictions,
+// empty string if allowed.
+func onlyOnReason(cmd config.Cmd, hostName, hostAddr string) string {
 	if len(cmd.Options.OnlyOn) == 0 {
-		return true
+		return ""
 	}
 
 	for _, host := range cmd.Options.OnlyOn {
 		if strings.HasPrefix(host, "!") { // exclude host
 			if hostName == host[1:] || hostAddr == host[1:] {
-				log.Printf("[DEBUG] skip command %q, excluded host %q", cmd.Name, host[1:])
-				return false
+				return fmt.Sprintf("excluded host %q", host[1:])
 			}
 			continue
 		}
 		if hostName == host || hostAddr == host { // include host
-			return true
+			return ""
 		}
 	}
+	return "not in only_on list"
+}
 
-	log.Printf("[DEBUG] skip command %q, not in only_on list", cmd.Name)
-	return false
+// connectOpts returns connection options with ssh key and certificate of the host, nil if the host has no own key
+func connectOpts(host config.Destination) *executor.ConnectOpts {
+	if host.SSHKey == "" && host.SSHCert == "" {
+		return nil
+	}
+	return &executor.ConnectOpts{SSHKey: host.SSHKey, SSHCert: host.SSHCert}
 }
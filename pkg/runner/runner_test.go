@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -241,7 +245,7 @@ func TestProcess_Run(t *testing.T) {
 		res, err := p.Run(ctx, "task1", testingHostAndPort)
 		require.NoError(t, err)
 		assert.Equal(t, 1, res.Commands)
-		assert.Contains(t, outWriter.String(), `uploaded testdata/conf.yml to localhost:/tmp/.spot/conf.yml`)
+		assert.Regexp(t, `uploaded testdata/conf.yml to localhost:/tmp/\.spot-[^/]+/conf.yml`, outWriter.String())
 	})
 
 	t.Run("echo with variables", func(t *testing.T) {
@@ -372,7 +376,7 @@ func TestProcess_RunWithSudo(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, 1, res.Commands)
 		assert.Equal(t, 1, res.Hosts)
-		assert.Contains(t, outWriter.String(), "> sudo mv -f /tmp/.spot/conf.yml /srv/conf.yml")
+		assert.Regexp(t, `> sudo mv -f /tmp/\.spot-[^/]+/conf.yml /srv/conf.yml`, outWriter.String())
 
 		p.Only = []string{"root only stat /srv/conf.yml"}
 		_, err = p.Run(ctx, "task1", testingHostAndPort)
@@ -396,8 +400,8 @@ func TestProcess_RunWithSudo(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, 1, res.Commands)
 		assert.Equal(t, 1, res.Hosts)
-		assert.Contains(t, outWriter.String(), " > sudo mv -f /tmp/.spot/srv/* /srv", "files were copied to /srv")
-		assert.Contains(t, outWriter.String(), " > rm -rf /tmp/.spot/srv", "tmp dir was removed")
+		assert.Regexp(t, ` > sudo mv -f /tmp/\.spot-[^/]+/srv/\* /srv`, outWriter.String(), "files were copied to /srv")
+		assert.Regexp(t, ` > rm -rf /tmp/\.spot-[^/]+/srv`, outWriter.String(), "tmp dir was removed")
 
 		p.Only = []string{"root only ls /srv"}
 		_, err = p.Run(ctx, "task1", testingHostAndPort)
@@ -678,6 +682,570 @@ func TestProcess_RunTaskWithWait(t *testing.T) {
 	assert.Contains(t, buf.String(), "wait done")
 }
 
+func TestProcess_RunParallel(t *testing.T) {
+	ctx := context.Background()
+	local := config.CmdOptions{Local: true}
+	makeProc := func(cmds ...config.Cmd) *Process {
+		return newTestProcess([]config.Destination{{Host: "localhost", Port: 22}}, &config.Task{Name: "parallel",
+			Commands: []config.Cmd{{Name: "group", Options: local, Environment: map[string]string{"FOO": "foo"},
+				Parallel: config.ParallelInternal{Commands: cmds}}}})
+	}
+
+	t.Run("all commands completed", func(t *testing.T) {
+		p := makeProc(
+			config.Cmd{Name: "p1", Script: "sleep 0.5\nexport v1=${FOO}1", Options: local},
+			config.Cmd{Name: "p2", Script: "sleep 0.5\nexport v2=2", Options: local},
+			config.Cmd{Name: "p3", Script: "sleep 0.5\nexport v3=3", Environment: map[string]string{"FOO": "bar"}, Options: local},
+		)
+		st := time.Now()
+		res, err := p.Run(ctx, "parallel", "default")
+		require.NoError(t, err)
+		assert.Less(t, time.Since(st), 1400*time.Millisecond, "commands should run concurrently")
+		assert.Equal(t, 1, res.Commands)
+		assert.Equal(t, map[string]string{"v1": "foo1", "v2": "2", "v3": "3"}, res.Vars)
+	})
+
+	t.Run("failed commands", func(t *testing.T) {
+		p := makeProc(
+			config.Cmd{Name: "p1", Script: "exit 1", Options: local},
+			config.Cmd{Name: "p2", Script: "echo good", Options: local},
+			config.Cmd{Name: "p3", Script: "exit 2", Options: local},
+		)
+		_, err := p.Run(ctx, "parallel", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "2 error(s) occurred")
+		assert.Contains(t, err.Error(), `failed command "p1"`)
+		assert.Contains(t, err.Error(), `failed command "p3"`)
+	})
+
+	t.Run("failed command ignored", func(t *testing.T) {
+		p := makeProc(
+			config.Cmd{Name: "p1", Script: "exit 1", Options: config.CmdOptions{Local: true, IgnoreErrors: true}},
+			config.Cmd{Name: "p2", Script: "export v2=2", Options: local},
+		)
+		res, err := p.Run(ctx, "parallel", "default")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"v2": "2"}, res.Vars)
+	})
+}
+
+func TestProcess_RunBlock(t *testing.T) {
+	ctx := context.Background()
+	local := config.CmdOptions{Local: true}
+	makeProc := func(blockCmd config.Cmd) *Process {
+		blockCmd.Name, blockCmd.Options = "block", local
+		return newTestProcess([]config.Destination{{Host: "localhost", Port: 22}},
+			&config.Task{Name: "task", Commands: []config.Cmd{blockCmd}})
+	}
+
+	t.Run("block completed, rescue skipped", func(t *testing.T) {
+		dir := t.TempDir()
+		p := makeProc(config.Cmd{
+			Block:  []config.Cmd{{Name: "b1", Script: "export v1=1", Options: local}, {Name: "b2", Script: "echo $v1 > " + dir + "/b2", Options: local}},
+			Rescue: []config.Cmd{{Name: "r1", Script: "touch " + dir + "/r1", Options: local}},
+			Always: []config.Cmd{{Name: "a1", Script: "touch " + dir + "/a1", Options: local}},
+		})
+		res, err := p.Run(ctx, "task", "default")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"v1": "1"}, res.Vars)
+		b2, err := os.ReadFile(dir + "/b2")
+		require.NoError(t, err)
+		assert.Equal(t, "1\n", string(b2), "vars passed to the next command of the block")
+		assert.NoFileExists(t, dir+"/r1")
+		assert.FileExists(t, dir+"/a1")
+	})
+
+	t.Run("block failed and rescued", func(t *testing.T) {
+		dir := t.TempDir()
+		p := makeProc(config.Cmd{
+			Block: []config.Cmd{{Name: "b1", Script: "exit 1", Options: local}, {Name: "b2", Script: "touch " + dir + "/b2", Options: local}},
+			Rescue: []config.Cmd{{Name: "r1", Options: local,
+				Script: "echo $SPOT_FAILED_COMMAND $SPOT_REMOTE_HOST > " + dir + "/r1\necho \"$SPOT_ERROR\" > " + dir + "/err"}},
+			Always: []config.Cmd{{Name: "a1", Script: "touch " + dir + "/a1", Options: local}},
+		})
+		_, err := p.Run(ctx, "task", "default")
+		require.NoError(t, err)
+		assert.NoFileExists(t, dir+"/b2", "rest of the block skipped")
+		r1, err := os.ReadFile(dir + "/r1")
+		require.NoError(t, err)
+		assert.Equal(t, "b1 localhost\n", string(r1))
+		spotErr, err := os.ReadFile(dir + "/err")
+		require.NoError(t, err)
+		assert.Contains(t, string(spotErr), "exit status 1", "SPOT_ERROR set")
+		assert.FileExists(t, dir+"/a1")
+	})
+
+	t.Run("rescue gets error with shell metacharacters", func(t *testing.T) {
+		dir := t.TempDir()
+		p := makeProc(config.Cmd{
+			Block:  []config.Cmd{{Name: "b1", Script: "echo '$(id -un) `id -un`' \"it's\" >&2\nexit 1", Options: local}},
+			Rescue: []config.Cmd{{Name: "r1", Script: "echo \"$SPOT_ERROR\" > " + dir + "/err", Options: local}},
+		})
+		_, err := p.Run(ctx, "task", "default")
+		require.NoError(t, err)
+		spotErr, err := os.ReadFile(dir + "/err")
+		require.NoError(t, err)
+		assert.Contains(t, string(spotErr), "$(id -un) `id -un` it's", "SPOT_ERROR passed as is, not expanded")
+	})
+
+	t.Run("rescue failed", func(t *testing.T) {
+		dir := t.TempDir()
+		p := makeProc(config.Cmd{
+			Block:  []config.Cmd{{Name: "b1", Script: "exit 1", Options: local}},
+			Rescue: []config.Cmd{{Name: "r1", Script: "exit 2", Options: local}},
+			Always: []config.Cmd{{Name: "a1", Script: "touch " + dir + "/a1", Options: local}},
+		})
+		_, err := p.Run(ctx, "task", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `rescue failed: failed command "r1"`)
+		assert.Contains(t, err.Error(), `block error: failed command "b1"`)
+		assert.FileExists(t, dir+"/a1")
+	})
+
+	t.Run("block failed without rescue", func(t *testing.T) {
+		dir := t.TempDir()
+		p := makeProc(config.Cmd{
+			Block:  []config.Cmd{{Name: "b1", Script: "exit 1", Options: local}},
+			Always: []config.Cmd{{Name: "a1", Script: "touch " + dir + "/a1", Options: local}},
+		})
+		_, err := p.Run(ctx, "task", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `failed command "b1"`)
+		assert.FileExists(t, dir+"/a1")
+	})
+
+	t.Run("nested commands with only, skip and no_auto", func(t *testing.T) {
+		dir := t.TempDir()
+		p := makeProc(config.Cmd{
+			Block: []config.Cmd{{Name: "b1", Script: "touch " + dir + "/b1", Options: local},
+				{Name: "b2", Script: "touch " + dir + "/b2", Options: config.CmdOptions{Local: true, NoAuto: true}},
+				{Name: "b3", Script: "touch " + dir + "/b3", Options: local}},
+		})
+		p.Skip = []string{"b3"}
+		_, err := p.Run(ctx, "task", "default")
+		require.NoError(t, err)
+		assert.FileExists(t, dir+"/b1")
+		assert.NoFileExists(t, dir+"/b2", "no_auto command skipped")
+		assert.NoFileExists(t, dir+"/b3", "command in skip list skipped")
+
+		require.NoError(t, os.Remove(dir+"/b1"))
+		p.Only, p.Skip = []string{"b2"}, nil
+		_, err = p.Run(ctx, "task", "default")
+		require.NoError(t, err)
+		assert.FileExists(t, dir+"/b2", "command in only list runs with its group")
+		assert.NoFileExists(t, dir+"/b1")
+		assert.NoFileExists(t, dir+"/b3")
+	})
+
+	t.Run("always failed, block not failed", func(t *testing.T) {
+		dir := t.TempDir()
+		p := makeProc(config.Cmd{
+			Block:  []config.Cmd{{Name: "b1", Script: "echo good", Options: local}},
+			Always: []config.Cmd{{Name: "a1", Script: "exit 1", Options: local}, {Name: "a2", Script: "touch " + dir + "/a2", Options: local}},
+		})
+		res, err := p.Run(ctx, "task", "default")
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Commands)
+		assert.NoFileExists(t, dir+"/a2", "rest of always skipped")
+	})
+}
+
+func TestProcess_RunRollback(t *testing.T) {
+	ctx := context.Background()
+	local := config.CmdOptions{Local: true}
+	makeProc := func(rbFile string, rollbackAll bool) *Process {
+		deploy := &config.Task{Name: "deploy", Rollback: "undo", RollbackAll: rollbackAll, Commands: []config.Cmd{
+			{Name: "good", Script: "echo good", Options: local},
+			{Name: "bad", Script: "echo '$(id -un) `id -un`' \"it's\" >&2\nexit 1", Options: config.CmdOptions{Local: true, OnlyOn: []string{"h2"}}},
+		}}
+		undo := &config.Task{Name: "undo", Commands: []config.Cmd{
+			{Name: "undo", Script: "echo $SPOT_FAILED_TASK $SPOT_FAILED_HOSTS >> " + rbFile, Options: local},
+			{Name: "error", Script: "echo \"$SPOT_ERROR\" >> " + rbFile + ".err", Options: local},
+		}}
+		p := newTestProcess([]config.Destination{{Host: "h1", Port: 22, Name: "h1"}, {Host: "h2", Port: 22, Name: "h2"}}, deploy, undo)
+		p.Concurrency = 2
+		return p
+	}
+
+	t.Run("rollback failed hosts", func(t *testing.T) {
+		rbFile := filepath.Join(t.TempDir(), "rb")
+		p := makeProc(rbFile, false)
+		_, err := p.Run(ctx, "deploy", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `rolled back with task "undo" on 1 host(s)`)
+		assert.Contains(t, err.Error(), `failed command "bad"`)
+		data, err := os.ReadFile(rbFile)
+		require.NoError(t, err)
+		assert.Equal(t, "deploy h2:22\n", string(data))
+		data, err = os.ReadFile(rbFile + ".err")
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "can't run script", "SPOT_ERROR with quote passed to rollback")
+		assert.Contains(t, string(data), "$(id -un) `id -un` it's", "SPOT_ERROR passed as is, not expanded")
+	})
+
+	t.Run("rollback all hosts", func(t *testing.T) {
+		rbFile := filepath.Join(t.TempDir(), "rb")
+		p := makeProc(rbFile, true)
+		_, err := p.Run(ctx, "deploy", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `rolled back with task "undo" on 2 host(s)`)
+		data, err := os.ReadFile(rbFile)
+		require.NoError(t, err)
+		assert.Equal(t, "deploy h2:22\ndeploy h2:22\n", string(data))
+	})
+
+	t.Run("rollback failed", func(t *testing.T) {
+		p := makeProc("/dev/null/not-writable", false)
+		_, err := p.Run(ctx, "deploy", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `rollback with task "undo" failed`)
+		assert.Contains(t, err.Error(), `task error: 1 error(s) occurred`)
+	})
+}
+
+func TestProcess_RunCanary(t *testing.T) {
+	ctx := context.Background()
+	local := config.CmdOptions{Local: true}
+	makeProc := func(outFile string, canary int, check config.CanaryCheck) *Process {
+		tsk := &config.Task{Name: "deploy", Canary: canary, CanaryCheck: check, Commands: []config.Cmd{
+			{Name: "mark", Script: "echo done >> " + outFile, Options: local},
+		}}
+		p := newTestProcess([]config.Destination{{Host: "127.0.0.1", Port: 22, Name: "h1"},
+			{Host: "127.0.0.1", Port: 22, Name: "h2"}, {Host: "127.0.0.1", Port: 22, Name: "h3"}}, tsk)
+		p.Concurrency = 2
+		return p
+	}
+	countRuns := func(t *testing.T, outFile string) int {
+		data, err := os.ReadFile(outFile)
+		require.NoError(t, err)
+		return strings.Count(string(data), "done\n")
+	}
+
+	t.Run("canary check passed", func(t *testing.T) {
+		outFile := filepath.Join(t.TempDir(), "out")
+		p := makeProc(outFile, 1, config.CanaryCheck{Script: "grep done " + outFile, Local: true})
+		res, err := p.Run(ctx, "deploy", "default")
+		require.NoError(t, err)
+		assert.Equal(t, 3, res.Hosts)
+		assert.Equal(t, 3, countRuns(t, outFile), "all hosts processed")
+	})
+
+	t.Run("canary check failed", func(t *testing.T) {
+		outFile := filepath.Join(t.TempDir(), "out")
+		p := makeProc(outFile, 1, config.CanaryCheck{Script: "exit 1", Local: true})
+		_, err := p.Run(ctx, "deploy", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "canary failed, skipped 2 hosts")
+		assert.Contains(t, err.Error(), "canary check failed on 127.0.0.1:22")
+		assert.Equal(t, 1, countRuns(t, outFile), "canary host only")
+	})
+
+	t.Run("canary larger than hosts, check still runs", func(t *testing.T) {
+		outFile := filepath.Join(t.TempDir(), "out")
+		p := makeProc(outFile, 5, config.CanaryCheck{Script: "exit 1", Local: true})
+		_, err := p.Run(ctx, "deploy", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "canary failed, skipped 0 hosts")
+		assert.Equal(t, 3, countRuns(t, outFile), "all hosts are canary")
+	})
+
+	t.Run("canary url probe", func(t *testing.T) {
+		status := http.StatusOK
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/health/h1", r.URL.Path)
+			w.WriteHeader(status)
+		}))
+		defer ts.Close()
+
+		outFile := filepath.Join(t.TempDir(), "out")
+		p := makeProc(outFile, 1, config.CanaryCheck{URL: ts.URL + "/health/{SPOT_REMOTE_NAME}", Timeout: time.Second})
+		_, err := p.Run(ctx, "deploy", "default")
+		require.NoError(t, err)
+		assert.Equal(t, 3, countRuns(t, outFile), "all hosts processed")
+
+		status = http.StatusServiceUnavailable
+		outFile = filepath.Join(t.TempDir(), "out")
+		p = makeProc(outFile, 1, config.CanaryCheck{URL: ts.URL + "/health/{SPOT_REMOTE_NAME}"})
+		_, err = p.Run(ctx, "deploy", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "503 Service Unavailable")
+		assert.Equal(t, 1, countRuns(t, outFile), "canary host only")
+	})
+
+	t.Run("canary confirm", func(t *testing.T) {
+		defer func(in io.Reader, out io.Writer) { confirmIn, confirmOut = in, out }(confirmIn, confirmOut)
+		confirmOut = io.Discard
+
+		confirmIn = strings.NewReader("y\n")
+		outFile := filepath.Join(t.TempDir(), "out")
+		p := makeProc(outFile, 1, config.CanaryCheck{Confirm: true, Pause: 10 * time.Millisecond})
+		_, err := p.Run(ctx, "deploy", "default")
+		require.NoError(t, err)
+		assert.Equal(t, 3, countRuns(t, outFile), "all hosts processed")
+
+		confirmIn = strings.NewReader("n\n")
+		outFile = filepath.Join(t.TempDir(), "out")
+		p = makeProc(outFile, 1, config.CanaryCheck{Confirm: true})
+		_, err = p.Run(ctx, "deploy", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "rollout not confirmed")
+		assert.Equal(t, 1, countRuns(t, outFile), "canary host only")
+	})
+
+	t.Run("canary confirm canceled", func(t *testing.T) {
+		defer func(in io.Reader, out io.Writer) { confirmIn, confirmOut = in, out }(confirmIn, confirmOut)
+		confirmOut = io.Discard
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		confirmIn = pr
+
+		cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		ok, err := confirm(cctx, "continue? ")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.False(t, ok)
+	})
+}
+
+func TestProcess_RunDryLocal(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker")
+	tsk := config.Task{Name: "task1", Commands: []config.Cmd{
+		{Name: "local", Script: "touch " + marker, Options: config.CmdOptions{Local: true}},
+	}}
+	p := newTestProcess(testHosts, &tsk)
+	p.Dry = true
+	res, err := p.Run(context.Background(), "task1", "default")
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Commands)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "local command should not be executed in dry mode")
+}
+
+func TestProcess_RunBackupAndRestore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "it's $HOME dir") // restore command quotes the path
+	require.NoError(t, os.MkdirAll(dir, 0o750))
+	src, dst := filepath.Join(dir, "src.conf"), filepath.Join(dir, "app.conf")
+	tsk := config.Task{Name: "task1"}
+	p := newTestProcess(testHosts, &tsk)
+	local := config.CmdOptions{Local: true}
+
+	tsk.Commands = []config.Cmd{{Name: "copy", Options: local,
+		Copy: config.CopyInternal{Source: src, Dest: dst, Atomic: true, Backup: 2}}}
+	for _, content := range []string{"v1", "v22", "v333"} {
+		require.NoError(t, os.WriteFile(src, []byte(content), 0o644))
+		_, err := p.Run(context.Background(), "task1", "default")
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	tsk.Commands = []config.Cmd{{Name: "restore", Options: local, Restore: config.RestoreInternal{Location: dst}}}
+	for _, expected := range []string{"v22", "v1"} {
+		_, err := p.Run(context.Background(), "task1", "default")
+		require.NoError(t, err)
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	_, err := p.Run(context.Background(), "task1", "default")
+	require.ErrorContains(t, err, "can't restore "+dst)
+}
+
+func TestProcess_RunReleaseAndRollback(t *testing.T) {
+	dir := t.TempDir()
+	src, base := filepath.Join(dir, "src"), filepath.Join(dir, "app")
+	require.NoError(t, os.MkdirAll(src, 0o755))
+	relFile := filepath.Join(dir, "release.txt")
+	tsk := config.Task{Name: "task1"}
+	p := newTestProcess(testHosts, &tsk)
+	clock := time.Date(2023, 6, 15, 14, 30, 0, 0, time.UTC)
+	p.now = func() time.Time { return clock }
+	local := config.CmdOptions{Local: true}
+	current := func() (dir, content string) {
+		link, err := os.Readlink(filepath.Join(base, "current"))
+		require.NoError(t, err)
+		data, err := os.ReadFile(filepath.Join(base, "current", "app.txt"))
+		require.NoError(t, err)
+		rel, err := os.ReadFile(relFile)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(base, link), strings.TrimSpace(string(rel)), "SPOT_RELEASE_DIR set")
+		return link, string(data)
+	}
+
+	tsk.Commands = []config.Cmd{
+		{Name: "release", Options: local, Release: config.ReleaseInternal{Source: src, BaseDir: base, Keep: 2}},
+		{Name: "show", Options: local, Script: "echo $SPOT_RELEASE_DIR > " + relFile},
+	}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		clock = clock.Add(time.Millisecond) // releases in the same second get different names
+		require.NoError(t, os.WriteFile(filepath.Join(src, "app.txt"), []byte(content), 0o644))
+		_, err := p.Run(context.Background(), "task1", "default")
+		require.NoError(t, err)
+		_, data := current()
+		assert.Equal(t, content, data)
+	}
+	releases, err := os.ReadDir(filepath.Join(base, "releases"))
+	require.NoError(t, err)
+	assert.Len(t, releases, 2, "old releases removed")
+
+	tsk.Commands[0] = config.Cmd{Name: "rollback", Options: local,
+		Release: config.ReleaseInternal{BaseDir: base, Rollback: true}}
+	_, err = p.Run(context.Background(), "task1", "default")
+	require.NoError(t, err)
+	link, data := current()
+	assert.Equal(t, "v2", data)
+	assert.Equal(t, "releases/"+releases[0].Name(), link)
+
+	_, err = p.Run(context.Background(), "task1", "default")
+	require.ErrorContains(t, err, "can't rollback release in "+base)
+
+	t.Run("existing release dir is not overwritten", func(t *testing.T) {
+		tsk.Commands[0] = config.Cmd{Name: "release", Options: local,
+			Release: config.ReleaseInternal{Source: src, BaseDir: base, Keep: 2}}
+		require.NoError(t, os.WriteFile(filepath.Join(src, "app.txt"), []byte("v4"), 0o644))
+		_, err := p.Run(context.Background(), "task1", "default") // the clock is not changed, v3 has the same name
+		require.ErrorContains(t, err, "can't prepare release")
+		data, err := os.ReadFile(filepath.Join(base, "releases", releases[1].Name(), "app.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "v3", string(data), "existing release kept")
+	})
+}
+
+func TestProcess_RunWithSecretsInput(t *testing.T) {
+	dir := t.TempDir()
+	tsk := config.Task{Name: "task1"}
+	p := newTestProcess(testHosts, &tsk)
+	secrets := map[string]string{"SEC1": "it's secret", "SEC2": "$HOME"}
+	opts := config.CmdOptions{Local: true, Secrets: []string{"SEC1", "SEC2"}}
+	out := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		return strings.TrimSpace(string(data))
+	}
+
+	tsk.Commands = []config.Cmd{
+		{Name: "single", Options: opts, Secrets: secrets, Script: "echo \"$SEC1 $SEC2\" > " + filepath.Join(dir, "single.txt")},
+		{Name: "multi", Options: opts, Secrets: secrets,
+			Script: "echo \"$SEC1\" > " + filepath.Join(dir, "multi.txt") + "\necho \"$SEC2\" >> " + filepath.Join(dir, "multi.txt")},
+		{Name: "cond", Options: opts, Secrets: secrets, Condition: "test -n \"$SEC1\"",
+			Script: "echo passed > " + filepath.Join(dir, "cond.txt")},
+	}
+	_, err := p.Run(context.Background(), "task1", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "it's secret $HOME", out("single.txt"))
+	assert.Equal(t, "it's secret\n$HOME", out("multi.txt"))
+	assert.Equal(t, "passed", out("cond.txt"))
+}
+
+func TestProcess_RunWithMaxOutput(t *testing.T) {
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "task1", Commands: []config.Cmd{
+		{Name: "chatty", Script: "seq 1 100000\nexport v1=value1", Options: local},
+		{Name: "check", Script: "test \"$v1\" = value1", Options: local},
+	}}
+	p := newTestProcess(testHosts, &tsk)
+	p.MaxOutput = 100
+	res, err := p.Run(context.Background(), "task1", "default")
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Commands)
+	assert.Equal(t, map[string]string{"v1": "value1"}, res.Vars)
+}
+
+func TestProcess_RunWithExitCodes(t *testing.T) {
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "task1"}
+	p := newTestProcess(testHosts, &tsk)
+	p.Playbook.(*mocks.PlaybookMock).AllSecretValuesFunc = func() []string { return []string{"secret1"} }
+
+	t.Run("ok exit code", func(t *testing.T) {
+		tsk.Commands = []config.Cmd{
+			{Name: "diff", Script: "echo out1; exit 3", OkExitCodes: []int{0, 3}, Options: local},
+			{Name: "next", Script: "echo out2", Options: local},
+		}
+		res, err := p.Run(context.Background(), "task1", "default")
+		require.NoError(t, err)
+		assert.Equal(t, 2, res.Commands)
+	})
+
+	t.Run("ok exit code with vars", func(t *testing.T) {
+		tsk.Commands = []config.Cmd{
+			{Name: "diff", Script: "export CHANGED=yes\nfalse\necho never", OkExitCodes: []int{0, 1}, Options: local},
+		}
+		res, err := p.Run(context.Background(), "task1", "default")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"CHANGED": "yes"}, res.Vars, "vars set on exit by set -e")
+	})
+
+	t.Run("failed with stderr", func(t *testing.T) {
+		tsk.Commands = []config.Cmd{
+			{Name: "fail", Script: "echo err1 secret1 >&2; echo err2 >&2; exit 4", OkExitCodes: []int{0, 3}, Options: local},
+		}
+		_, err := p.Run(context.Background(), "task1", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "exit status 4, stderr:\n  err1 ****\n  err2")
+		assert.NotContains(t, err.Error(), "secret1")
+	})
+}
+
+func TestProcess_makeTmpDir(t *testing.T) {
+	ctx := context.Background()
+	base := filepath.Join(t.TempDir(), "base")
+	p := &Process{TmpDir: base, ColorWriter: executor.NewColorizedWriter(os.Stdout, "", "", "", nil)}
+
+	dir, cleanup, err := p.makeTmpDir(ctx, &executor.Local{}, "localhost", "", "user1")
+	require.NoError(t, err)
+	assert.Regexp(t, `/base/\.spot-user1-[0-9a-f]{16}$`, dir)
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o700), fi.Mode().Perm())
+
+	dir2, cleanup2, err := p.makeTmpDir(ctx, &executor.Local{}, "localhost", "", "user1")
+	require.NoError(t, err)
+	assert.NotEqual(t, dir, dir2, "each run gets its own directory")
+
+	cleanup()
+	assert.NoDirExists(t, dir)
+	cleanup2()
+	assert.NoDirExists(t, dir2)
+
+	p.Dry = true
+	dir, cleanup, err = p.makeTmpDir(ctx, &executor.Local{}, "localhost", "", "")
+	require.NoError(t, err)
+	cleanup()
+	assert.Regexp(t, `/base/\.spot-[0-9a-f]{16}$`, dir)
+	assert.NoDirExists(t, dir, "not created in dry mode")
+
+	t.Run("base with special characters", func(t *testing.T) {
+		root := t.TempDir()
+		p := &Process{TmpDir: filepath.Join(root, "my tmp's $HOME;x"), ColorWriter: p.ColorWriter}
+		dir, cleanup, err := p.makeTmpDir(ctx, &executor.Local{}, "localhost", "", "")
+		require.NoError(t, err)
+		assert.Equal(t, p.TmpDir, filepath.Dir(dir))
+		assert.DirExists(t, dir)
+		cleanup()
+		assert.NoDirExists(t, dir)
+		entries, err := os.ReadDir(root)
+		require.NoError(t, err)
+		require.Len(t, entries, 1, "nothing made outside of the base")
+		assert.Equal(t, "my tmp's $HOME;x", entries[0].Name())
+	})
+}
+
+func TestProcess_RunTmpDirRemoved(t *testing.T) {
+	base := t.TempDir()
+	tsk := config.Task{Name: "task1", Commands: []config.Cmd{
+		{Name: "multiline", Options: config.CmdOptions{Local: true}, Script: "echo 1\necho 2"},
+		{Name: "fail", Options: config.CmdOptions{Local: true}, Script: "echo 1\nexit 1"},
+	}}
+	p := newTestProcess(testHosts, &tsk)
+	p.TmpDir = base
+	_, err := p.Run(context.Background(), "task1", "default")
+	require.Error(t, err)
+	entries, err := os.ReadDir(base)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "temporary directory removed on failure")
+}
+
 func Test_shouldRunCmd(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -883,6 +1451,75 @@ func TestGen(t *testing.T) {
 	}
 }
 
+// testHosts is a single target host of tests running local commands
+var testHosts = []config.Destination{{Host: "h1", Port: 22, Name: "h1"}}
+
+// newTestProcess makes Process with playbook of the given tasks, looked up by name on each run,
+// so tests can change commands of a task between runs. All tasks target the given hosts.
+func TestProcess_RunRemoteNestedInLocalGroup(t *testing.T) {
+	addr := startLocalExecSSHServer(t)
+	host, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	connector, err := executor.NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+
+	out := filepath.Join(t.TempDir(), "out")
+	p := newTestProcess([]config.Destination{{Host: host, Port: port, User: "test"}}, &config.Task{Name: "task",
+		Commands: []config.Cmd{{Name: "group", Options: config.CmdOptions{Local: true},
+			Block: []config.Cmd{{Name: "remote", Script: "echo {SPOT_REMOTE_HOST} > " + out}}}}})
+	p.Connector = connector
+	res, err := p.Run(context.Background(), "task", "default")
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Commands)
+	data, err := os.ReadFile(out) //nolint:gosec // test file
+	require.NoError(t, err)
+	assert.Equal(t, addr+"\n", string(data), "nested command runs on the remote host")
+}
+
+func Test_anyRemoteCommand(t *testing.T) {
+	local := config.CmdOptions{Local: true}
+	tbl := []struct {
+		name string
+		cmds []config.Cmd
+		want bool
+	}{
+		{"remote", []config.Cmd{{Name: "c1", Script: "echo", Options: local}, {Name: "c2", Script: "echo"}}, true},
+		{"local", []config.Cmd{{Name: "c1", Script: "echo", Options: local}}, false},
+		{"remote nested in local group", []config.Cmd{{Name: "g", Options: local,
+			Parallel: config.ParallelInternal{Commands: []config.Cmd{{Name: "c1", Script: "echo"}}}}}, true},
+		{"remote in rescue", []config.Cmd{{Name: "g", Options: local, Block: []config.Cmd{{Name: "c1", Script: "echo", Options: local}},
+			Rescue: []config.Cmd{{Name: "c2", Script: "echo"}}}}, true},
+		{"local group of local commands", []config.Cmd{{Name: "g",
+			Block: []config.Cmd{{Name: "c1", Script: "echo", Options: local}}}}, false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, anyRemoteCommand(tt.cmds))
+		})
+	}
+}
+
+func newTestProcess(hosts []config.Destination, tasks ...*config.Task) *Process {
+	return &Process{
+		Concurrency: 1,
+		Playbook: &mocks.PlaybookMock{
+			TaskFunc: func(name string) (*config.Task, error) {
+				for _, tsk := range tasks {
+					if tsk.Name == name {
+						return tsk, nil
+					}
+				}
+				return nil, fmt.Errorf("task %q not found", name)
+			},
+			TargetHostsFunc:     func(name string) ([]config.Destination, error) { return hosts, nil },
+			AllSecretValuesFunc: func() []string { return nil },
+		},
+		ColorWriter: executor.NewColorizedWriter(os.Stdout, "", "", "", nil),
+	}
+}
+
 func startTestContainer(t *testing.T) (hostAndPort string, teardown func()) {
 	ctx := context.Background()
 	pubKey, err := os.ReadFile("testdata/test_ssh_key.pub")
@@ -916,3 +1553,38 @@ func startTestContainer(t *testing.T) (hostAndPort string, teardown func()) {
 
 	return fmt.Sprintf("%s:%s", host, port.Port()), func() { container.Terminate(ctx) }
 }
+
+func TestProcess_RunWithHostKey(t *testing.T) {
+	ctx := context.Background()
+	connector := &mocks.ConnectorMock{
+		ConnectFunc: func(ctx context.Context, hostAddr, hostName, user string, opts *executor.ConnectOpts) (*executor.Remote, error) {
+			return nil, fmt.Errorf("connect failed")
+		},
+	}
+	p := Process{
+		Concurrency: 2,
+		Connector:   connector,
+		Playbook: &mocks.PlaybookMock{
+			TaskFunc: func(name string) (*config.Task, error) {
+				return &config.Task{Name: name, Commands: []config.Cmd{{Name: "c1", Script: "echo 1"}}}, nil
+			},
+			TargetHostsFunc: func(name string) ([]config.Destination, error) {
+				return []config.Destination{{Host: "h1", Port: 22, User: "u1", SSHKey: "keys/h1", SSHCert: "keys/h1-cert.pub"},
+					{Host: "h2", Port: 22, User: "u1"}}, nil
+			},
+			AllSecretValuesFunc: func() []string { return nil },
+		},
+		ColorWriter: executor.NewColorizedWriter(os.Stdout, "", "", "", nil),
+	}
+	_, err := p.Run(ctx, "task1", "default")
+	require.ErrorContains(t, err, "connect failed")
+
+	calls := connector.ConnectCalls()
+	require.Len(t, calls, 2)
+	opts := map[string]*executor.ConnectOpts{}
+	for _, c := range calls {
+		opts[c.HostAddr] = c.Opts
+	}
+	assert.Equal(t, &executor.ConnectOpts{SSHKey: "keys/h1", SSHCert: "keys/h1-cert.pub"}, opts["h1:22"])
+	assert.Nil(t, opts["h2:22"], "host without own key uses the key of connector")
+}
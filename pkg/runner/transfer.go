@@ -0,0 +1,220 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+)
+
+// transferPeer is a host with the file of a transfer command
+type transferPeer struct {
+	host config.Destination
+	file string
+}
+
+// transferSeeds tracks hosts which got the file of a transfer command with fanout. The first fanout hosts get the file
+// from the source host, the rest wait for any of the hosts done and get the file from it, round-robin.
+// If no hosts are done and none are getting the file from the source, i.e. all of them failed,
+// the next host gets the file from the source.
+type transferSeeds struct {
+	mu      sync.Mutex
+	fanout  int
+	started int            // hosts started to get the file from the source
+	running int            // hosts getting the file from the source right now
+	ready   []transferPeer // hosts with the file
+	next    int            // index of the next ready host to use
+	changed chan struct{}  // closed and replaced on every change of ready and running
+}
+
+func newTransferSeeds(fanout int) *transferSeeds {
+	return &transferSeeds{fanout: fanout, changed: make(chan struct{})}
+}
+
+// acquire returns the peer host to get the file from, or nil if the file should be taken from the source host.
+// It blocks until a peer host is available or the host can get the file from the source.
+func (s *transferSeeds) acquire(ctx context.Context) (*transferPeer, error) {
+	for {
+		s.mu.Lock()
+		if len(s.ready) > 0 {
+			peer := s.ready[s.next%len(s.ready)]
+			s.next++
+			s.mu.Unlock()
+			return &peer, nil
+		}
+		if s.started < s.fanout || s.running == 0 {
+			s.started++
+			s.running++
+			s.mu.Unlock()
+			return nil, nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// release reports the result of the transfer to the host. fromSource should be set if acquire returned nil.
+// The host becomes a peer for the rest of the hosts if the transfer succeeded.
+func (s *transferSeeds) release(host transferPeer, fromSource, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fromSource {
+		s.running--
+	}
+	if ok {
+		s.ready = append(s.ready, host)
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// transferSeeds returns seeds of the transfer command, shared by all hosts of the task
+func (p *Process) transferSeeds(key string, fanout int) *transferSeeds {
+	p.transfersMu.Lock()
+	defer p.transfersMu.Unlock()
+	if p.transfers == nil {
+		p.transfers = make(map[string]*transferSeeds)
+	}
+	if _, ok := p.transfers[key]; !ok {
+		p.transfers[key] = newTransferSeeds(fanout)
+	}
+	return p.transfers[key]
+}
+
+// execTransfer copies a file from the source host to the target host. By default, the file is streamed through spot
+// over both ssh connections. With direct option, the source host copies the file to the target host with scp,
+// so it should be able to reach the target with its own ssh credentials. With fanout, the file is taken from the hosts
+// which already got it, except for the first fanout hosts.
+func (p *Process) execTransfer(ctx context.Context, ec execCmd) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	srcHost, src, dst := tmpl.apply(ec.cmd.Transfer.SrcHost), tmpl.apply(ec.cmd.Transfer.Source), tmpl.apply(ec.cmd.Transfer.Dest)
+	resp.details = fmt.Sprintf(" {transfer: %s:%s -> %s}", srcHost, src, dst)
+	if _, isDry := ec.exec.(*executor.Dry); isDry {
+		return resp, nil // nothing to show without connecting to the source host
+	}
+	target, ok := ec.exec.(*executor.Remote)
+	if !ok || target == nil {
+		return resp, fmt.Errorf("transfer to %s is supported for remote hosts only", ec.hostAddr)
+	}
+
+	srcHosts, err := p.Playbook.TargetHosts(srcHost)
+	if err != nil {
+		return resp, fmt.Errorf("can't get transfer source host %s: %w", srcHost, err)
+	}
+	if len(srcHosts) == 0 {
+		return resp, fmt.Errorf("no transfer source host %s", srcHost)
+	}
+	from := transferPeer{host: srcHosts[0], file: src}
+
+	if ec.cmd.Transfer.Fanout > 0 {
+		self, e := transferDest(ec, dst)
+		if e != nil {
+			return resp, e
+		}
+		seeds := p.transferSeeds(ec.tsk.Name+"/"+ec.cmdPath, ec.cmd.Transfer.Fanout)
+		peer, e := seeds.acquire(ctx)
+		if e != nil {
+			return resp, fmt.Errorf("can't wait for transfer peer hosts: %w", e)
+		}
+		if peer != nil {
+			from = *peer
+		}
+		// the host becomes a peer for the rest of hosts if the transfer succeeded, err is the returned error
+		defer func() { seeds.release(self, peer == nil, err == nil) }()
+	}
+
+	fromAddr := fmt.Sprintf("%s:%d", from.host.Host, from.host.Port)
+	resp.details = fmt.Sprintf(" {transfer: %s:%s -> %s}", fromAddr, from.file, dst)
+	if from.host.Name != "" {
+		resp.details = fmt.Sprintf(" {transfer: %s:%s -> %s}", from.host.Name, from.file, dst)
+	}
+
+	source, err := p.Connector.Connect(ctx, fromAddr, from.host.Name, from.host.User, connectOpts(from.host))
+	if err != nil {
+		return resp, fmt.Errorf("can't connect to transfer source %s: %w", fromAddr, err)
+	}
+	defer source.Close()
+	source.SetSecrets(p.secrets)
+
+	if ec.cmd.Transfer.Direct {
+		resp.details = resp.details[:len(resp.details)-1] + ", direct: true}"
+		if err = p.transferDirect(ctx, ec, target, source, from.file, dst); err != nil {
+			return resp, fmt.Errorf("can't transfer %s from %s to %s: %w", from.file, fromAddr, ec.hostAddr, err)
+		}
+		return resp, nil
+	}
+
+	if _, err = source.Transfer(ctx, from.file, target, dst, ec.cmd.Transfer.Force); err != nil {
+		return resp, fmt.Errorf("can't transfer %s from %s to %s: %w", from.file, fromAddr, ec.hostAddr, err)
+	}
+	return resp, nil
+}
+
+// transferDirect runs scp on the source host to copy the file to a temporary file on the target host, and renames it
+// to the destination on the target host. The target is addressed the same way as spot does, with the same user and port.
+// The host key of the target is verified with known_hosts of the source host, unknown target is not accepted.
+// The temporary file is removed if the copy or rename failed.
+func (p *Process) transferDirect(ctx context.Context, ec execCmd, target, source *executor.Remote, src, dst string) (err error) {
+	self, err := transferDest(ec, dst)
+	if err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.spot-tmp-%d", filepath.Base(dst), time.Now().UnixNano()))
+	mkdirCmd := fmt.Sprintf("mkdir -p %s", executor.ShellQuote(filepath.Dir(dst)))
+	if _, err = target.Run(ctx, mkdirCmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return fmt.Errorf("can't create directory for %s: %w", dst, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// partially copied file is left by failed scp, and the file is not renamed if mv failed
+		if _, e := target.Run(ctx, fmt.Sprintf("rm -f %s", executor.ShellQuote(tmpFile)), nil); e != nil {
+			log.Printf("[WARN] can't remove temporary file %s on %s: %v", tmpFile, ec.hostAddr, e)
+		}
+	}()
+
+	userHost := self.host.Host
+	if self.host.User != "" {
+		userHost = self.host.User + "@" + self.host.Host
+	}
+	scp := fmt.Sprintf("scp -q -p -o BatchMode=yes -P %d %s %s", self.host.Port, executor.ShellQuote(src),
+		executor.ShellQuote(userHost+":"+tmpFile))
+	if _, err = source.Run(ctx, scp, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return fmt.Errorf("can't copy with scp: %w", err)
+	}
+	mvCmd := fmt.Sprintf("mv -f %s %s", executor.ShellQuote(tmpFile), executor.ShellQuote(dst))
+	if _, err = target.Run(ctx, mvCmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return fmt.Errorf("can't rename %s to %s: %w", tmpFile, dst, err)
+	}
+	log.Printf("[INFO] transferred %s to %s:%s directly", src, ec.hostAddr, dst)
+	return nil
+}
+
+// transferDest returns the current host with the transferred file. The host keeps its ssh key and certificate,
+// as other hosts connect to it as to the transfer peer.
+func transferDest(ec execCmd, dst string) (transferPeer, error) {
+	host, port, err := net.SplitHostPort(ec.hostAddr)
+	if err != nil {
+		return transferPeer{}, fmt.Errorf("can't parse host address %s: %w", ec.hostAddr, err)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return transferPeer{}, fmt.Errorf("can't parse port of %s: %w", ec.hostAddr, err)
+	}
+	dest := config.Destination{Host: host, Port: portNum, Name: ec.hostName, User: ec.user, SSHKey: ec.sshKey, SSHCert: ec.sshCert}
+	return transferPeer{host: dest, file: dst}, nil
+}
@@ -0,0 +1,301 @@
+package runner
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+	"github.com/umputun/spot/pkg/runner/mocks"
+)
+
+func TestTransferSeeds(t *testing.T) {
+	ctx := context.Background()
+	peer := func(name string) transferPeer {
+		return transferPeer{host: config.Destination{Host: name, Port: 22, Name: name}, file: "/srv/app.tgz"}
+	}
+
+	t.Run("seeds first, then peers round-robin", func(t *testing.T) {
+		s := newTransferSeeds(2)
+		for i := 0; i < 2; i++ {
+			p, err := s.acquire(ctx)
+			require.NoError(t, err)
+			assert.Nil(t, p, "seed gets the file from the source")
+		}
+
+		got := make(chan *transferPeer, 1)
+		go func() {
+			p, err := s.acquire(ctx)
+			assert.NoError(t, err)
+			got <- p
+		}()
+		select {
+		case <-got:
+			t.Fatal("should wait for seeds")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		s.release(peer("h1"), true, true)
+		p := <-got
+		require.NotNil(t, p)
+		assert.Equal(t, "h1", p.host.Name)
+
+		s.release(peer("h3"), false, true)
+		p, err := s.acquire(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "h3", p.host.Name)
+		p, err = s.acquire(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "h1", p.host.Name)
+	})
+
+	t.Run("failed seeds fall back to the source", func(t *testing.T) {
+		s := newTransferSeeds(1)
+		p, err := s.acquire(ctx)
+		require.NoError(t, err)
+		assert.Nil(t, p)
+		s.release(peer("h1"), true, false)
+
+		p, err = s.acquire(ctx)
+		require.NoError(t, err)
+		assert.Nil(t, p, "no peers, get the file from the source")
+	})
+
+	t.Run("canceled wait", func(t *testing.T) {
+		s := newTransferSeeds(1)
+		_, err := s.acquire(ctx)
+		require.NoError(t, err)
+		cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = s.acquire(cctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func Test_transferDest(t *testing.T) {
+	ec := execCmd{hostAddr: "h1.example.com:2222", hostName: "h1", user: "deploy", sshKey: "keys/h1", sshCert: "keys/h1-cert.pub"}
+	peer, err := transferDest(ec, "/srv/app.tar")
+	require.NoError(t, err)
+	assert.Equal(t, transferPeer{host: config.Destination{Host: "h1.example.com", Port: 2222, Name: "h1", User: "deploy",
+		SSHKey: "keys/h1", SSHCert: "keys/h1-cert.pub"}, file: "/srv/app.tar"}, peer, "peer connected with own key and cert")
+
+	_, err = transferDest(execCmd{hostAddr: "h1"}, "/srv/app.tar")
+	require.Error(t, err)
+}
+
+func TestProcess_RunTransfer(t *testing.T) {
+	ctx := context.Background()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	connector, err := executor.NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	host, portStr, err := net.SplitHostPort(hostAndPort)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	tsk := config.Task{Name: "task1", Commands: []config.Cmd{
+		{Name: "copy", Copy: config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/transfer/src.yml"}},
+		{Name: "transfer", Transfer: config.TransferInternal{SrcHost: "build", Source: "/tmp/transfer/src.yml",
+			Dest: "/tmp/transfer/dst/inventory.yml", Fanout: 1}},
+		{Name: "check", Script: "diff /tmp/transfer/src.yml /tmp/transfer/dst/inventory.yml"},
+	}}
+	p := &Process{
+		Concurrency: 1,
+		Connector:   connector,
+		Playbook: &mocks.PlaybookMock{
+			TaskFunc: func(name string) (*config.Task, error) { return &tsk, nil },
+			TargetHostsFunc: func(name string) ([]config.Destination, error) {
+				return []config.Destination{{Host: host, Port: port, Name: name, User: "test"}}, nil
+			},
+			AllSecretValuesFunc: func() []string { return nil },
+		},
+		ColorWriter: executor.NewColorizedWriter(os.Stdout, "", "", "", nil),
+	}
+
+	res, err := p.Run(ctx, "task1", "default")
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Commands)
+}
+
+func TestProcess_RunTransferDirect(t *testing.T) {
+	ctx := context.Background()
+	addr := startLocalExecSSHServer(t)
+	host, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	// fake scp on the source host copies the file locally and logs its arguments, fails for "fail" source
+	binDir := t.TempDir()
+	scpLog := filepath.Join(binDir, "scp.log")
+	scp := "#!/bin/sh\necho \"$*\" >> " + scpLog + "\n" +
+		"for a; do src=$dst; dst=$a; done\n" +
+		"dst=${dst#*:}\n" +
+		"echo partial > \"$dst\"\n" +
+		"case \"$src\" in *fail*) exit 1;; esac\n" +
+		"cp \"$src\" \"$dst\"\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "scp"), []byte(scp), 0o700)) //nolint
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	connector, err := executor.NewConnector("testdata/test_ssh_key", time.Second*10)
+	require.NoError(t, err)
+	makeProc := func(tsk config.Task) *Process {
+		return &Process{
+			Concurrency: 1,
+			Connector:   connector,
+			Playbook: &mocks.PlaybookMock{
+				TaskFunc: func(name string) (*config.Task, error) { return &tsk, nil },
+				TargetHostsFunc: func(name string) ([]config.Destination, error) {
+					return []config.Destination{{Host: host, Port: port, Name: name, User: "test"}}, nil
+				},
+				AllSecretValuesFunc: func() []string { return nil },
+			},
+			ColorWriter: executor.NewColorizedWriter(os.Stdout, "", "", "", nil),
+		}
+	}
+
+	t.Run("direct with fanout", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "src.txt"), []byte("content"), 0o600))
+		tr := config.TransferInternal{SrcHost: "build", Source: filepath.Join(dir, "src.txt"), Direct: true, Fanout: 1}
+		tr1, tr2 := tr, tr
+		tr1.Dest, tr2.Dest = filepath.Join(dir, "dst1", "f.txt"), filepath.Join(dir, "dst2", "f.txt")
+		tsk := config.Task{Name: "task1", Commands: []config.Cmd{
+			{Name: "transfer", Transfer: tr1},
+			{Name: "group", Block: []config.Cmd{{Name: "transfer", Transfer: tr2}}},
+		}}
+		p := makeProc(tsk)
+		res, err := p.Run(ctx, "task1", "default")
+		require.NoError(t, err)
+		assert.Equal(t, 2, res.Commands)
+		for _, f := range []string{tr1.Dest, tr2.Dest} {
+			data, e := os.ReadFile(f)
+			require.NoError(t, e)
+			assert.Equal(t, "content", string(data))
+		}
+		tmpFiles, err := filepath.Glob(filepath.Join(dir, "dst*", ".*spot-tmp*"))
+		require.NoError(t, err)
+		assert.Empty(t, tmpFiles)
+
+		keys := []string{}
+		for k := range p.transfers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		assert.Equal(t, []string{"task1/0", "task1/1/block/0"}, keys, "same-named commands don't share seeds")
+
+		args, err := os.ReadFile(scpLog)
+		require.NoError(t, err)
+		assert.Contains(t, string(args), "-q -p -o BatchMode=yes -P "+portStr)
+		assert.NotContains(t, string(args), "StrictHostKeyChecking", "default host key checking")
+	})
+
+	t.Run("failed scp removes temp file", func(t *testing.T) {
+		dir := t.TempDir()
+		dst := filepath.Join(dir, "dst", "f.txt")
+		tsk := config.Task{Name: "task1", Commands: []config.Cmd{
+			{Name: "transfer", Transfer: config.TransferInternal{SrcHost: "build", Source: filepath.Join(dir, "fail.txt"),
+				Dest: dst, Direct: true}},
+		}}
+		_, err := makeProc(tsk).Run(ctx, "task1", "default")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't copy with scp")
+		assert.NoFileExists(t, dst)
+		tmpFiles, err := filepath.Glob(filepath.Join(dir, "dst", ".*spot-tmp*"))
+		require.NoError(t, err)
+		assert.Empty(t, tmpFiles, "temp file removed")
+	})
+}
+
+// startLocalExecSSHServer starts ssh server accepting any key, it runs exec requests with sh on the local host
+// and serves sftp subsystem with the local file system
+func startLocalExecSSHServer(t *testing.T) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	conf := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	conf.AddHostKey(hostKey)
+
+	handle := func(nch ssh.NewChannel) {
+		ch, reqs, e := nch.Accept()
+		if e != nil {
+			return
+		}
+		defer ch.Close()
+		for req := range reqs {
+			var subsystem struct{ Name string }
+			if req.Type == "subsystem" && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp" {
+				_ = req.Reply(true, nil)
+				if srv, e := sftp.NewServer(ch); e == nil {
+					_ = srv.Serve()
+				}
+				return
+			}
+			if req.Type != "exec" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			var payload struct{ Command string }
+			if e = ssh.Unmarshal(req.Payload, &payload); e != nil {
+				_ = req.Reply(false, nil)
+				return
+			}
+			_ = req.Reply(true, nil)
+			cmd := exec.Command("sh", "-c", payload.Command) //nolint
+			cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+			status := uint32(0)
+			if e = cmd.Run(); e != nil {
+				status = 1
+			}
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		}
+	}
+
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lst.Close() })
+	go func() {
+		for {
+			conn, e := lst.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sconn, chans, reqs, e := ssh.NewServerConn(conn, conf)
+				if e != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nch := range chans {
+					if nch.ChannelType() != "session" {
+						_ = nch.Reject(ssh.UnknownChannelType, "sessions only")
+						continue
+					}
+					go handle(nch)
+				}
+				_ = sconn.Close()
+			}()
+		}
+	}()
+	return lst.Addr().String()
+}